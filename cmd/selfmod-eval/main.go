@@ -0,0 +1,150 @@
+// Command selfmod-eval runs the selfmod benchmark tasks against LLM
+// providers and reports pass rate, token usage, latency and cost for each.
+//
+//	go run ./cmd/selfmod-eval -providers fake,anthropic,openai:gpt-4.1
+//
+// API keys are read from the same environment variables as the server.
+// The fake provider replays each task's fake.json, so runs against it are
+// deterministic and need no network.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/yuki/flyagi/internal/config"
+	"github.com/yuki/flyagi/internal/provider"
+	"github.com/yuki/flyagi/internal/provider/llm"
+	"github.com/yuki/flyagi/internal/sandbox"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, "selfmod-eval:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("selfmod-eval", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	tasksDir := fs.String("tasks", "cmd/selfmod-eval/tasks", "directory of task fixtures")
+	only := fs.String("only", "", "comma-separated task names to run (default all)")
+	providers := fs.String("providers", "fake", "comma-separated providers to evaluate, as name or name:model")
+	timeout := fs.Duration("timeout", 3*time.Minute, "generation timeout per task")
+	asJSON := fs.Bool("json", false, "write results as JSON")
+	failUnder := fs.Float64("fail-under", 0, "exit with an error if a provider's pass rate is below this (0-1)")
+	verbose := fs.Bool("v", false, "log engine activity")
+	prices := DefaultPrices()
+	fs.Var(prices, "price", "model price in USD per million tokens, as model=input:output (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelInfo
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: level})))
+
+	var names []string
+	if *only != "" {
+		names = strings.Split(*only, ",")
+	}
+	tasks, err := loadTasks(*tasksDir, names)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := config.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var targets []Target
+	for _, spec := range strings.Split(*providers, ",") {
+		t, err := newTarget(ctx, cfg, strings.TrimSpace(spec))
+		if err != nil {
+			return err
+		}
+		targets = append(targets, t)
+	}
+
+	runner := &Runner{
+		Verifier: sandbox.New(sandbox.Options{Limits: sandbox.DefaultLimits(), GoModCache: sandbox.GoModCache()}),
+		Prices:   prices,
+		Timeout:  *timeout,
+	}
+	results := runner.Run(ctx, tasks, targets)
+	summaries := summarize(results)
+
+	if *asJSON {
+		err = writeJSON(stdout, results, summaries)
+	} else {
+		err = writeText(stdout, results, summaries)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, s := range summaries {
+		if s.PassRate < *failUnder {
+			return fmt.Errorf("%s passed %.0f%% of tasks, below %.0f%%", s.Target, s.PassRate*100, *failUnder*100)
+		}
+	}
+	return nil
+}
+
+// newTarget creates the target for a "name" or "name:model" spec.
+func newTarget(ctx context.Context, cfg *config.Config, spec string) (Target, error) {
+	name, model, _ := strings.Cut(spec, ":")
+	if name == "fake" {
+		return fakeTarget(), nil
+	}
+
+	var p provider.LLMProvider
+	switch name {
+	case "anthropic":
+		if cfg.AnthropicAPIKey == "" {
+			return Target{}, fmt.Errorf("anthropic: ANTHROPIC_API_KEY is not set")
+		}
+		p = llm.NewAnthropicProvider(cfg.AnthropicAPIKey)
+	case "openai":
+		if cfg.OpenAIAPIKey == "" {
+			return Target{}, fmt.Errorf("openai: OPENAI_API_KEY is not set")
+		}
+		p = llm.NewOpenAIProvider(cfg.OpenAIAPIKey)
+	case "gemini":
+		if cfg.GeminiAPIKey == "" {
+			return Target{}, fmt.Errorf("gemini: GEMINI_API_KEY is not set")
+		}
+		g, err := llm.NewGeminiProvider(ctx, cfg.GeminiAPIKey)
+		if err != nil {
+			return Target{}, err
+		}
+		p = g
+	default:
+		return Target{}, fmt.Errorf("unknown provider %q", name)
+	}
+
+	ms := p.(provider.ModelSwitcher)
+	if model != "" {
+		p = ms.WithModel(model)
+	} else {
+		model = ms.Model()
+	}
+	return Target{
+		Name:  spec,
+		Model: model,
+		llm:   func(*Task) (provider.LLMProvider, error) { return p, nil },
+	}, nil
+}
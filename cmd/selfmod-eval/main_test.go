@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type report struct {
+	Results   []Result  `json:"results"`
+	Summaries []Summary `json:"summaries"`
+}
+
+func runJSON(t *testing.T, args ...string) (report, error) {
+	t.Helper()
+	var out bytes.Buffer
+	err := run(append([]string{"-json"}, args...), &out, io.Discard)
+	var r report
+	if out.Len() > 0 {
+		if err := json.Unmarshal(out.Bytes(), &r); err != nil {
+			t.Fatalf("invalid JSON output: %v\n%s", err, out.String())
+		}
+	}
+	return r, err
+}
+
+func TestRun_Fake(t *testing.T) {
+	first, err := runJSON(t, "-tasks", "tasks", "-fail-under", "1")
+	if err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	for _, r := range first.Results {
+		if !r.Passed {
+			t.Errorf("%s failed: %v", r.Task, r.Failures)
+		}
+	}
+	if len(first.Summaries) != 1 || first.Summaries[0].PassRate != 1 || first.Summaries[0].OutputTokens == 0 {
+		t.Errorf("unexpected summaries: %+v", first.Summaries)
+	}
+
+	// Everything but the latency is the same on every run.
+	second, err := runJSON(t, "-tasks", "tasks")
+	if err != nil {
+		t.Fatalf("second run failed: %v", err)
+	}
+	for i := range first.Results {
+		a, b := first.Results[i], second.Results[i]
+		a.Latency, b.Latency = 0, 0
+		if a.Task != b.Task || a.Passed != b.Passed || a.Usage != b.Usage || a.Cost != b.Cost {
+			t.Errorf("runs differ: %+v and %+v", a, b)
+		}
+	}
+}
+
+func TestRun_Failures(t *testing.T) {
+	// A reply that leaves the bug in place fails both the assertions and
+	// the task's test.
+	dir := t.TempDir()
+	task := filepath.Join(dir, "fix-failing-test")
+	if err := os.CopyFS(task, os.DirFS("tasks/fix-failing-test")); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := os.ReadFile(filepath.Join(task, "repo", "stats.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, _ := json.Marshal(map[string]any{
+		"description": "Document Sum",
+		"changes": []map[string]string{
+			{"path": "stats.go", "action": "modify", "new_content": "// Package stats adds numbers.\n" + string(stats)},
+		},
+	})
+	if err := os.WriteFile(filepath.Join(task, "fake.json"), reply, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := runJSON(t, "-tasks", dir, "-fail-under", "1")
+	if err == nil {
+		t.Error("expected an error below the pass rate")
+	}
+	if len(r.Results) != 1 || r.Results[0].Passed {
+		t.Fatalf("expected a failed result, got %+v", r.Results)
+	}
+	failures := strings.Join(r.Results[0].Failures, "\n")
+	if !strings.Contains(failures, `contains "i := 1"`) || !strings.Contains(failures, `check "go test ./..." failed`) {
+		t.Errorf("unexpected failures:\n%s", failures)
+	}
+}
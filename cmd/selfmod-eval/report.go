@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/yuki/flyagi/internal/provider"
+)
+
+// Price is the cost of a model in US dollars per million tokens.
+type Price struct {
+	Input  float64
+	Output float64
+}
+
+// Prices maps models to their prices.
+type Prices map[string]Price
+
+// DefaultPrices covers the providers' default models. Use -price for others.
+func DefaultPrices() Prices {
+	return Prices{
+		"claude-sonnet-4-20250514": {Input: 3, Output: 15},
+		"gpt-4o":                   {Input: 2.5, Output: 10},
+		"gemini-2.0-flash":         {Input: 0.1, Output: 0.4},
+		"fake":                     {},
+	}
+}
+
+// Cost returns what u costs on model, or 0 for unknown models.
+func (p Prices) Cost(model string, u provider.Usage) float64 {
+	price := p[model]
+	return (float64(u.InputTokens)*price.Input + float64(u.OutputTokens)*price.Output) / 1e6
+}
+
+// Set parses "model=input:output", so Prices can be a flag.Value.
+func (p Prices) Set(s string) error {
+	model, rates, ok := strings.Cut(s, "=")
+	in, out, ok2 := strings.Cut(rates, ":")
+	if !ok || !ok2 || model == "" {
+		return fmt.Errorf("want model=input:output, got %q", s)
+	}
+	input, err := strconv.ParseFloat(in, 64)
+	if err != nil {
+		return fmt.Errorf("invalid input price: %w", err)
+	}
+	output, err := strconv.ParseFloat(out, 64)
+	if err != nil {
+		return fmt.Errorf("invalid output price: %w", err)
+	}
+	p[model] = Price{Input: input, Output: output}
+	return nil
+}
+
+func (p Prices) String() string { return "" }
+
+// Summary aggregates the results of one target.
+type Summary struct {
+	Target       string        `json:"target"`
+	Tasks        int           `json:"tasks"`
+	Passed       int           `json:"passed"`
+	PassRate     float64       `json:"pass_rate"`
+	InputTokens  int           `json:"input_tokens"`
+	OutputTokens int           `json:"output_tokens"`
+	MeanLatency  time.Duration `json:"mean_latency_ns"`
+	Cost         float64       `json:"cost_usd"`
+}
+
+// summarize aggregates results per target, in the order targets first
+// appear.
+func summarize(results []Result) []Summary {
+	var summaries []Summary
+	index := make(map[string]int)
+	var latency []time.Duration
+	for _, r := range results {
+		i, ok := index[r.Target]
+		if !ok {
+			i = len(summaries)
+			index[r.Target] = i
+			summaries = append(summaries, Summary{Target: r.Target})
+			latency = append(latency, 0)
+		}
+		s := &summaries[i]
+		s.Tasks++
+		if r.Passed {
+			s.Passed++
+		}
+		s.InputTokens += r.Usage.InputTokens
+		s.OutputTokens += r.Usage.OutputTokens
+		s.Cost += r.Cost
+		latency[i] += r.Latency
+	}
+	for i := range summaries {
+		s := &summaries[i]
+		s.PassRate = float64(s.Passed) / float64(s.Tasks)
+		s.MeanLatency = latency[i] / time.Duration(s.Tasks)
+	}
+	return summaries
+}
+
+// writeText writes the results and summaries as tables.
+func writeText(w io.Writer, results []Result, summaries []Summary) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tTASK\tRESULT\tLATENCY\tTOKENS IN/OUT\tDETAILS")
+	for _, r := range results {
+		outcome := "PASS"
+		if !r.Passed {
+			outcome = "FAIL"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d/%d\t%s\n", r.Target, r.Task, outcome,
+			r.Latency.Round(time.Millisecond), r.Usage.InputTokens, r.Usage.OutputTokens, strings.Join(r.Failures, "; "))
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "TARGET\tPASSED\tPASS RATE\tMEAN LATENCY\tTOKENS IN/OUT\tCOST")
+	for _, s := range summaries {
+		fmt.Fprintf(tw, "%s\t%d/%d\t%.0f%%\t%s\t%d/%d\t$%.4f\n", s.Target, s.Passed, s.Tasks, s.PassRate*100,
+			s.MeanLatency.Round(time.Millisecond), s.InputTokens, s.OutputTokens, s.Cost)
+	}
+	return tw.Flush()
+}
+
+// writeJSON writes the results and summaries as one JSON document.
+func writeJSON(w io.Writer, results []Result, summaries []Summary) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(map[string]any{
+		"results":   results,
+		"summaries": summaries,
+	})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/yuki/flyagi/internal/provider"
+	"github.com/yuki/flyagi/internal/provider/llm"
+	"github.com/yuki/flyagi/internal/selfmod"
+)
+
+// Target is a provider, and optionally a model, to evaluate.
+type Target struct {
+	Name  string // as reported, e.g. "anthropic" or "openai:gpt-4.1"
+	Model string
+	// llm returns the provider to run a task with. The fake provider is
+	// set up per task with the task's canned reply.
+	llm func(t *Task) (provider.LLMProvider, error)
+}
+
+// fakeTarget replays each task's fake.json.
+func fakeTarget() Target {
+	return Target{
+		Name:  "fake",
+		Model: "fake",
+		llm: func(t *Task) (provider.LLMProvider, error) {
+			if t.fakeResponse == "" {
+				return nil, errors.New("task has no fake.json")
+			}
+			p := llm.NewFakeProvider()
+			p.Reply("", t.fakeResponse)
+			return p, nil
+		},
+	}
+}
+
+// Result is the outcome of one task on one target.
+type Result struct {
+	Task     string         `json:"task"`
+	Target   string         `json:"target"`
+	Passed   bool           `json:"passed"`
+	Failures []string       `json:"failures,omitempty"`
+	Latency  time.Duration  `json:"latency_ns"`
+	Usage    provider.Usage `json:"usage"`
+	Cost     float64        `json:"cost_usd"`
+}
+
+// Runner runs the suite.
+type Runner struct {
+	Verifier selfmod.Runner
+	Prices   Prices
+	// Timeout bounds the generation of each task.
+	Timeout time.Duration
+}
+
+// Run runs every task on every target, one at a time so latencies are
+// comparable.
+func (r *Runner) Run(ctx context.Context, tasks []*Task, targets []Target) []Result {
+	var results []Result
+	for _, target := range targets {
+		for _, task := range tasks {
+			res := r.runTask(ctx, task, target)
+			res.Cost = r.Prices.Cost(target.Model, res.Usage)
+			results = append(results, res)
+		}
+	}
+	return results
+}
+
+func (r *Runner) runTask(ctx context.Context, task *Task, target Target) Result {
+	res := Result{Task: task.Name, Target: target.Name}
+	fail := func(format string, args ...any) Result {
+		res.Failures = append(res.Failures, fmt.Sprintf(format, args...))
+		return res
+	}
+
+	base, err := target.llm(task)
+	if err != nil {
+		return fail("no provider: %v", err)
+	}
+	m := &meter{llm: base}
+
+	dir, err := os.MkdirTemp("", "selfmod-eval-")
+	if err != nil {
+		return fail("failed to create work directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.CopyFS(dir, os.DirFS(task.repo)); err != nil {
+		return fail("failed to copy repository: %v", err)
+	}
+
+	engine := selfmod.NewEngine(dir)
+	checks := selfmod.ParseChecks(task.Checks)
+	if len(checks) > 0 && r.Verifier != nil {
+		engine.SetVerifier(r.Verifier, checks)
+	}
+
+	genCtx := ctx
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		genCtx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	cr, err := engine.GenerateChanges(genCtx, m, task.Request)
+	res.Latency = time.Since(start)
+	res.Usage = m.usage
+	if err != nil {
+		return fail("generation failed: %v", err)
+	}
+
+	if err := engine.ApproveAndApply(cr.ID); err != nil {
+		return fail("apply failed: %v", err)
+	}
+
+	changed := make([]string, len(cr.Changes))
+	for i, c := range cr.Changes {
+		changed[i] = c.Path
+	}
+	res.Failures = task.check(dir, changed)
+
+	if len(checks) > 0 && r.Verifier != nil {
+		verified, err := engine.Verify(ctx, cr.ID)
+		if err != nil {
+			return fail("verification failed to run: %v", err)
+		}
+		for _, v := range verified {
+			if !v.Passed {
+				res.Failures = append(res.Failures, fmt.Sprintf("check %q failed: %s", v.Name, lastLine(v.Output)))
+			}
+		}
+	}
+
+	res.Passed = len(res.Failures) == 0
+	return res
+}
+
+func lastLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		s = s[i+1:]
+	}
+	return s
+}
+
+// meter adds up the token usage reported by an LLM provider. It offers
+// structured output to the engine either way, falling back to plain chat
+// for providers without it.
+type meter struct {
+	llm   provider.LLMProvider
+	usage provider.Usage
+}
+
+func (m *meter) Name() string { return m.llm.Name() }
+
+func (m *meter) ChatStream(ctx context.Context, messages []provider.Message, onChunk func(provider.StreamChunk) error) error {
+	return m.llm.ChatStream(ctx, messages, m.count(onChunk))
+}
+
+func (m *meter) ChatStructured(ctx context.Context, messages []provider.Message, schema provider.Schema, onChunk func(provider.StreamChunk) error) error {
+	if s, ok := m.llm.(provider.StructuredLLM); ok {
+		return s.ChatStructured(ctx, messages, schema, m.count(onChunk))
+	}
+	return m.llm.ChatStream(ctx, messages, m.count(onChunk))
+}
+
+func (m *meter) count(onChunk func(provider.StreamChunk) error) func(provider.StreamChunk) error {
+	return func(chunk provider.StreamChunk) error {
+		if u := chunk.Usage; u != nil {
+			m.usage.InputTokens += u.InputTokens
+			m.usage.OutputTokens += u.OutputTokens
+		}
+		return onChunk(chunk)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Task is a benchmark fixture: a repository snapshot, a change request for
+// it and the assertions a good change passes. It is stored as a directory
+// holding task.json, the snapshot in repo/ and, for the fake provider, the
+// reply to give in fake.json.
+type Task struct {
+	Name        string `json:"-"`
+	Description string `json:"description"`
+	Request     string `json:"request"`
+	// Checks are commands such as "go test ./..." run in the changed
+	// repository. All must pass.
+	Checks []string `json:"checks"`
+	Expect Expect   `json:"expect"`
+
+	repo         string
+	fakeResponse string
+}
+
+// Expect are assertions on the changed repository.
+type Expect struct {
+	// Changed lists every file the change may create, modify or delete.
+	// Empty allows any.
+	Changed []string `json:"changed"`
+	// Contains maps files to text they must contain afterwards.
+	Contains map[string][]string `json:"contains"`
+	// NotContains maps files to text they must not contain afterwards.
+	NotContains map[string][]string `json:"not_contains"`
+	// Absent lists files that must not exist afterwards.
+	Absent []string `json:"absent"`
+}
+
+// loadTasks loads the tasks in the subdirectories of dir, sorted by name.
+// Only tasks named in only are loaded when it is not empty.
+func loadTasks(dir string, only []string) ([]*Task, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tasks: %w", err)
+	}
+
+	var tasks []*Task
+	for _, e := range entries {
+		if !e.IsDir() || len(only) > 0 && !slices.Contains(only, e.Name()) {
+			continue
+		}
+		t, err := loadTask(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("task %s: %w", e.Name(), err)
+		}
+		tasks = append(tasks, t)
+	}
+	if len(tasks) == 0 {
+		return nil, fmt.Errorf("no tasks found in %s", dir)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Name < tasks[j].Name })
+	return tasks, nil
+}
+
+func loadTask(dir string) (*Task, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "task.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read task.json: %w", err)
+	}
+	t := &Task{Name: filepath.Base(dir), repo: filepath.Join(dir, "repo")}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("failed to parse task.json: %w", err)
+	}
+	if strings.TrimSpace(t.Request) == "" {
+		return nil, fmt.Errorf("task.json has no request")
+	}
+	if info, err := os.Stat(t.repo); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("missing repo directory")
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, "fake.json")); err == nil {
+		t.fakeResponse = string(data)
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read fake.json: %w", err)
+	}
+	return t, nil
+}
+
+// check returns the assertions of t that the repository in dir, changed by
+// changed, fails.
+func (t *Task) check(dir string, changed []string) []string {
+	var failures []string
+	if len(t.Expect.Changed) > 0 {
+		for _, path := range changed {
+			if !slices.Contains(t.Expect.Changed, path) {
+				failures = append(failures, "unexpected change to "+path)
+			}
+		}
+	}
+
+	for _, path := range sortedKeys(t.Expect.Contains) {
+		data, err := os.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			failures = append(failures, "missing "+path)
+			continue
+		}
+		for _, want := range t.Expect.Contains[path] {
+			if !strings.Contains(string(data), want) {
+				failures = append(failures, fmt.Sprintf("%s does not contain %q", path, want))
+			}
+		}
+	}
+	for _, path := range sortedKeys(t.Expect.NotContains) {
+		data, err := os.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			continue
+		}
+		for _, unwanted := range t.Expect.NotContains[path] {
+			if strings.Contains(string(data), unwanted) {
+				failures = append(failures, fmt.Sprintf("%s contains %q", path, unwanted))
+			}
+		}
+	}
+	for _, path := range t.Expect.Absent {
+		if _, err := os.Stat(filepath.Join(dir, path)); err == nil {
+			failures = append(failures, path+" still exists")
+		}
+	}
+	return failures
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,8 @@
+package greet
+
+import "fmt"
+
+// Hello returns a greeting for name.
+func Hello(name string) string {
+	return fmt.Sprintf("Hello, %s!", name)
+}
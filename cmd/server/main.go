@@ -2,22 +2,31 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/yuki/flyagi/internal/api"
+	"github.com/yuki/flyagi/internal/automerge"
+	"github.com/yuki/flyagi/internal/codeindex"
 	"github.com/yuki/flyagi/internal/config"
+	"github.com/yuki/flyagi/internal/forge"
 	"github.com/yuki/flyagi/internal/git"
 	"github.com/yuki/flyagi/internal/github"
+	"github.com/yuki/flyagi/internal/liveupdate"
 	"github.com/yuki/flyagi/internal/provider"
+	"github.com/yuki/flyagi/internal/provider/embedding"
 	"github.com/yuki/flyagi/internal/provider/llm"
 	"github.com/yuki/flyagi/internal/provider/stt"
 	"github.com/yuki/flyagi/internal/provider/tts"
+	"github.com/yuki/flyagi/internal/sandbox"
 	"github.com/yuki/flyagi/internal/selfmod"
 	"github.com/yuki/flyagi/internal/ws"
 )
@@ -34,6 +43,19 @@ func main() {
 		os.Exit(1)
 	}
 
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	// A build started by a live update only to be health-checked serves
+	// requests but leaves background work to the running server.
+	preflight := liveupdate.Preflight()
+
+	ln, inherited, err := liveupdate.Listen(":" + cfg.Port)
+	if err != nil {
+		slog.Error("failed to listen", "port", cfg.Port, "error", err)
+		os.Exit(1)
+	}
+
 	// Build provider registry
 	registry := provider.NewRegistry()
 	registerProviders(cfg, registry)
@@ -41,34 +63,170 @@ func main() {
 	// Initialize self-modification services
 	var engine *selfmod.Engine
 	var gitSvc *git.Service
+	var fg forge.Forge
 	var ghClient *github.Client
 
 	if cfg.RepoPath != "" {
 		engine = selfmod.NewEngine(cfg.RepoPath)
+		engine.SetDiffContext(cfg.DiffContextLines)
+		engine.SetScanner(selfmod.NewScanner(cfg.ScanAllowedHosts))
+		engine.SetRetention(selfmod.Retention{
+			PendingTTL: cfg.PendingRequestTTL,
+			MaxHistory: cfg.HistoryMaxRequests,
+			MaxAge:     cfg.HistoryMaxAge,
+		})
+		if checks := selfmod.ParseChecks(cfg.VerifyCommands); len(checks) > 0 {
+			engine.SetVerifier(newSandbox(cfg), checks)
+		}
 		slog.Info("selfmod engine initialized", "repo_path", cfg.RepoPath)
 	}
 
-	if cfg.GitHubToken != "" && cfg.GitHubOwner != "" && cfg.GitHubRepo != "" {
-		gitSvc = git.NewService(cfg.RepoPath, cfg.GitHubToken)
-		ghClient = github.NewClient(cfg.GitHubToken, cfg.GitHubOwner, cfg.GitHubRepo)
+	if (cfg.ForgeToken != "" || cfg.GitHubAppConfigured()) && cfg.ForgeOwner != "" && cfg.ForgeRepo != "" {
+		ts, err := tokenSource(cfg)
+		if err != nil {
+			slog.Error("failed to configure GitHub App", "error", err)
+			os.Exit(1)
+		}
+
+		f, err := forge.New(forge.Config{
+			Type:        cfg.ForgeType,
+			BaseURL:     cfg.ForgeURL,
+			Token:       cfg.ForgeToken,
+			Owner:       cfg.ForgeOwner,
+			Repo:        cfg.ForgeRepo,
+			TokenSource: ts,
+		})
+		if err != nil {
+			slog.Error("failed to configure forge", "error", err)
+			os.Exit(1)
+		}
+
+		gitAuth, cloneURL, err := gitTransport(cfg, f, ts)
+		if err != nil {
+			slog.Error("failed to configure git auth", "error", err)
+			os.Exit(1)
+		}
+		gitSvc = git.NewService(cfg.RepoPath, gitAuth)
+		gitSvc.SetIdentity(git.Identity{Name: cfg.GitAuthorName, Email: cfg.GitAuthorEmail})
+		gitSvc.SetBaseBranch(cfg.PRBaseBranch)
+		if cfg.GitSigningFormat != "" {
+			signer, err := git.NewSigner(cfg.GitSigningFormat, cfg.GitSigningKey, cfg.GitSigningKeyPassphrase)
+			if err != nil {
+				slog.Error("failed to load commit signing key", "error", err)
+				os.Exit(1)
+			}
+			gitSvc.SetSigner(signer)
+		}
 
 		// Clone or open the repo
-		cloneURL := fmt.Sprintf("https://github.com/%s/%s.git", cfg.GitHubOwner, cfg.GitHubRepo)
 		if err := gitSvc.CloneOrOpen(cloneURL); err != nil {
 			slog.Error("failed to clone/open repo", "error", err)
 			// Non-fatal: continue without git
 			gitSvc = nil
-			ghClient = nil
 		} else {
-			slog.Info("git service initialized", "owner", cfg.GitHubOwner, "repo", cfg.GitHubRepo)
+			fg = f
+			if g, ok := f.(*forge.GitHub); ok {
+				ghClient = g.Client()
+			}
+			slog.Info("git service initialized", "forge", f.Name(), "owner", cfg.ForgeOwner, "repo", cfg.ForgeRepo, "auth", cfg.GitAuth)
+		}
+	}
+
+	// Without a forge the local repository is still opened read-only for
+	// the git introspection API and selfmod context.
+	if gitSvc == nil && cfg.RepoPath != "" {
+		local := git.NewService(cfg.RepoPath, nil)
+		if err := local.Open(); err != nil {
+			slog.Warn("git repository not available", "path", cfg.RepoPath, "error", err)
+		} else {
+			gitSvc = local
+		}
+	}
+	if engine != nil && gitSvc != nil {
+		engine.SetGit(gitSvc)
+		if fg != nil {
+			// Approvals check out selfmod branches; generations read the base.
+			engine.SetBase("origin/" + cfg.PRBaseBranch)
+		}
+	}
+
+	// Semantic code index, refreshed at startup and whenever the base
+	// branch changes
+	var index *codeindex.Index
+	if emb, err := registry.GetEmbedding(cfg.DefaultEmbeddingProvider); err == nil && cfg.RepoPath != "" {
+		index, err = codeindex.New(cfg.RepoPath, cfg.IndexPath, emb, selfmod.IsProtected)
+		if err != nil {
+			slog.Error("failed to open code index", "error", err)
+		} else {
+			if engine != nil {
+				engine.SetRetriever(index)
+			}
+			slog.Info("code index enabled", "provider", emb.Name(), "model", emb.Model(), "path", cfg.IndexPath)
 		}
 	}
 
 	// Build WebSocket hub
-	chatHandler := ws.NewChatHandler(registry, engine, gitSvc, ghClient)
+	chatHandler := ws.NewChatHandler(registry, engine, gitSvc, fg)
+	prDefaults, err := loadPRDefaults(cfg)
+	if err != nil {
+		slog.Error("failed to load PR settings", "error", err)
+		os.Exit(1)
+	}
+	chatHandler.SetPRDefaults(prDefaults)
+	chatHandler.SetCodebase(cfg.RepoPath, index)
+	if index != nil && !preflight {
+		go updateIndex(ctx, chatHandler)
+	}
+	chatHandler.SetGenerationQueue(ws.NewGenerationQueue(cfg.GenerationWorkers, cfg.GenerationMaxPerClient))
+	chatHandler.SetProgressText(cfg.GenerationProgressText)
+	switch cfg.IntentClassifier {
+	case "rules":
+		chatHandler.SetIntentRouter(ws.NewIntentRouter(ws.RulesClassifier{}, cfg.IntentThreshold))
+	case "llm":
+		classifier := &ws.LLMClassifier{}
+		if cfg.IntentProvider != "" {
+			if classifier.LLM, err = registry.GetLLM(cfg.IntentProvider); err != nil {
+				slog.Error("intent provider not found", "provider", cfg.IntentProvider, "error", err)
+				os.Exit(1)
+			}
+		}
+		chatHandler.SetIntentRouter(ws.NewIntentRouter(classifier, cfg.IntentThreshold))
+	}
 	hub := ws.NewHub(chatHandler, cfg.AllowedOrigin)
+	hub.SetAdminToken(cfg.AdminToken)
+	chatHandler.SetHub(hub)
 
-	router := api.NewRouter(cfg, registry, hub)
+	router := api.NewRouter(cfg, registry, hub, chatHandler, gitSvc, index)
+
+	if ghClient != nil && cfg.GitHubIssuePollInterval > 0 && !preflight {
+		go ghClient.WatchLabeledIssues(ctx, cfg.GitHubIssueLabel, cfg.GitHubIssuePollInterval, func(issue github.Issue) {
+			chatHandler.HandleIssue(cfg.DefaultLLMProvider, issue)
+		})
+		slog.Info("polling labeled issues", "label", cfg.GitHubIssueLabel, "interval", cfg.GitHubIssuePollInterval)
+	}
+
+	if ghClient != nil && engine != nil && cfg.AutoMergeMode != "" && !preflight {
+		policy := automerge.Policy{
+			Mode:              cfg.AutoMergeMode,
+			AllowedPaths:      cfg.AutoMergeAllowedPaths,
+			MaxLines:          cfg.AutoMergeMaxLines,
+			RequiredChecks:    cfg.AutoMergeRequiredChecks,
+			RequiredApprovals: cfg.AutoMergeRequiredApprovals,
+			MergeMethod:       cfg.AutoMergeMethod,
+		}
+		go automerge.NewWatcher(policy, ghClient, engine, cfg.AutoMergeInterval).Run(ctx)
+		slog.Info("auto-merge enabled", "mode", cfg.AutoMergeMode, "allowed_paths", cfg.AutoMergeAllowedPaths)
+	}
+
+	// Without a GitHub webhook reporting merges, pull requests are polled.
+	if fg != nil && engine != nil && (fg.Name() != "github" || cfg.GitHubWebhookSecret == "") && cfg.PRPollInterval > 0 && !preflight {
+		go engine.WatchPRs(ctx, fg, cfg.PRPollInterval)
+		slog.Info("polling pull requests", "forge", fg.Name(), "interval", cfg.PRPollInterval)
+	}
+
+	if engine != nil && cfg.SweepInterval > 0 && !preflight {
+		go sweep(ctx, chatHandler, newSandbox(cfg), cfg.SweepInterval)
+	}
 
 	srv := &http.Server{
 		Addr:         ":" + cfg.Port,
@@ -78,29 +236,177 @@ func main() {
 		IdleTimeout:  60 * time.Second,
 	}
 
+	var updater *liveupdate.Updater
+	if cfg.LiveUpdate && engine != nil && !preflight {
+		updater = liveupdate.New(liveupdate.Config{
+			RepoPath:      cfg.RepoPath,
+			BinDir:        cfg.LiveUpdateBinDir,
+			Test:          cfg.LiveUpdateTest,
+			HealthTimeout: cfg.LiveUpdateHealthTimeout,
+		}, newSandbox(cfg), ln)
+		srv.ConnState = updater.ConnState
+		updater.OnEvent(func(ev liveupdate.Event) {
+			payload, _ := json.Marshal(ev)
+			hub.Broadcast(ws.Envelope{Type: "server.update", Payload: payload})
+		})
+		if fg != nil {
+			// Merged changes land on the forge; bring the clone up to date.
+			updater.SetSync(chatHandler.SyncMain)
+		} else {
+			// Approvals write to the working tree; build between them.
+			updater.SetSync(chatHandler.HoldRepo)
+		}
+		// Pending requests and generations only live in memory.
+		updater.SetBusy(chatHandler.Busy)
+		slog.Info("live update enabled", "bin_dir", cfg.LiveUpdateBinDir, "test", cfg.LiveUpdateTest)
+	}
+	if engine != nil && !preflight {
+		engine.OnStatusChange(func(cr *selfmod.ChangeRequest, status string) {
+			switch {
+			case updater != nil && (status == "merged" || (status == "applied" && fg == nil)):
+				go func() {
+					if err := updater.Update(ctx, cr.ID); err != nil {
+						slog.Error("live update failed", "request_id", cr.ID, "error", err)
+					}
+				}()
+			case status == "merged" && fg != nil:
+				// Pull the merge anyway, so the code index follows the
+				// base branch.
+				go func() {
+					if err := chatHandler.SyncMain(nil); err != nil {
+						slog.Warn("failed to pull merged change", "request_id", cr.ID, "error", err)
+					}
+				}()
+			}
+		})
+	}
+
 	go func() {
-		slog.Info("server starting", "port", cfg.Port)
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Info("server starting", "port", cfg.Port, "inherited_listener", inherited, "preflight", preflight)
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
 			slog.Error("server failed", "error", err)
 			os.Exit(1)
 		}
 	}()
+	if updater != nil {
+		go updater.Confirm(ctx)
+	}
 
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 
 	slog.Info("shutting down server")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	stop()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	if err := srv.Shutdown(ctx); err != nil {
+	if err := srv.Shutdown(shutdownCtx); err != nil {
 		slog.Error("server forced to shutdown", "error", err)
 	}
 
 	slog.Info("server stopped")
 }
 
+func updateIndex(ctx context.Context, h *ws.ChatHandler) {
+	stats, err := h.Reindex(ctx)
+	if err != nil {
+		slog.Error("code index update failed", "error", err)
+		return
+	}
+	slog.Info("code index updated", "files", stats.Files, "changed", stats.Changed, "removed", stats.Removed, "chunks", stats.Chunks)
+}
+
+// sweep expires and prunes change requests and removes what failed
+// approvals and interrupted sandbox runs left behind, every interval.
+func sweep(ctx context.Context, h *ws.ChatHandler, sb *sandbox.Sandbox, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		h.Sweep(time.Now())
+		if n := sb.Sweep(); n > 0 {
+			slog.Info("removed stale sandbox directories", "count", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tokenSource returns the GitHub App installation token source, or nil when
+// the static forge token should be used.
+func tokenSource(cfg *config.Config) (git.TokenSource, error) {
+	if !cfg.GitHubAppConfigured() {
+		if cfg.ForgeToken == "" {
+			return nil, nil
+		}
+		return github.StaticToken(cfg.ForgeToken), nil
+	}
+	if cfg.ForgeType != "github" {
+		return nil, fmt.Errorf("GitHub App auth requires FORGE_TYPE=github")
+	}
+
+	key, err := os.ReadFile(cfg.GitHubAppPrivateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read app private key: %w", err)
+	}
+
+	apiURL := ""
+	if cfg.ForgeURL != "" {
+		apiURL = strings.TrimSuffix(cfg.ForgeURL, "/") + "/api/v3"
+	}
+	return github.NewAppTokenSource(int64(cfg.GitHubAppID), int64(cfg.GitHubAppInstallationID), key, apiURL)
+}
+
+// gitTransport picks the credentials and clone URL for git operations.
+func gitTransport(cfg *config.Config, f forge.Forge, ts git.TokenSource) (git.Auth, string, error) {
+	cloneURL := cfg.GitCloneURL
+
+	if cfg.GitAuth == "ssh" {
+		auth, err := git.NewSSHAuth(cfg.GitSSHUser, cfg.GitSSHKeyPath, cfg.GitSSHKeyPassphrase, cfg.GitSSHKnownHosts)
+		if err != nil {
+			return nil, "", err
+		}
+		if cloneURL == "" {
+			if cloneURL, err = forge.SSHCloneURL(f.CloneURL(), cfg.GitSSHUser); err != nil {
+				return nil, "", err
+			}
+		}
+		return auth, cloneURL, nil
+	}
+
+	if cloneURL == "" {
+		cloneURL = f.CloneURL()
+	}
+	if ts == nil {
+		return nil, cloneURL, nil
+	}
+	return &git.TokenAuth{Source: ts}, cloneURL, nil
+}
+
+func loadPRDefaults(cfg *config.Config) (ws.PRDefaults, error) {
+	d := ws.PRDefaults{
+		TitlePrefix: cfg.PRTitlePrefix,
+		Base:        cfg.PRBaseBranch,
+		Draft:       cfg.PRDraft,
+		Labels:      cfg.PRLabels,
+		Assignees:   cfg.PRAssignees,
+		Reviewers:   cfg.PRReviewers,
+	}
+	if cfg.PRTemplatePath == "" {
+		return d, nil
+	}
+
+	text, err := os.ReadFile(cfg.PRTemplatePath)
+	if err != nil {
+		return d, fmt.Errorf("failed to read PR template: %w", err)
+	}
+	d.Template, err = selfmod.ParsePRTemplate(string(text))
+	return d, err
+}
+
 func registerProviders(cfg *config.Config, registry *provider.Registry) {
 	// LLM providers
 	if cfg.AnthropicAPIKey != "" {
@@ -121,6 +427,29 @@ func registerProviders(cfg *config.Config, registry *provider.Registry) {
 		}
 	}
 
+	// Embedding providers
+	if cfg.OpenAIAPIKey != "" {
+		registry.RegisterEmbedding(embedding.NewOpenAIProvider(cfg.OpenAIAPIKey, cfg.EmbeddingModel))
+		slog.Info("registered embedding provider", "name", "openai")
+	}
+	if cfg.GeminiAPIKey != "" {
+		p, err := embedding.NewGeminiProvider(context.Background(), cfg.GeminiAPIKey, cfg.EmbeddingModel)
+		if err != nil {
+			slog.Error("failed to create Gemini embedding provider", "error", err)
+		} else {
+			registry.RegisterEmbedding(p)
+			slog.Info("registered embedding provider", "name", "gemini")
+		}
+	}
+	if cfg.EmbeddingBaseURL != "" {
+		registry.RegisterEmbedding(embedding.NewCompatibleProvider("compatible", cfg.EmbeddingBaseURL, cfg.EmbeddingAPIKey, cfg.EmbeddingModel))
+		slog.Info("registered embedding provider", "name", "compatible", "base_url", cfg.EmbeddingBaseURL)
+	}
+	if cfg.DefaultEmbeddingProvider == "fake" {
+		registry.RegisterEmbedding(embedding.NewFakeProvider(0))
+		slog.Info("registered embedding provider", "name", "fake")
+	}
+
 	// TTS providers
 	if cfg.OpenAIAPIKey != "" {
 		registry.RegisterTTS(tts.NewOpenAITTSProvider(cfg.OpenAIAPIKey))
@@ -141,3 +470,25 @@ func registerProviders(cfg *config.Config, registry *provider.Registry) {
 		slog.Info("registered STT provider", "name", "google")
 	}
 }
+
+// newSandbox creates the sandbox that runs verification commands.
+func newSandbox(cfg *config.Config) *sandbox.Sandbox {
+	limits := sandbox.DefaultLimits()
+	limits.Timeout = cfg.SandboxTimeout
+	limits.CPUTime = cfg.SandboxCPUTime
+	limits.Memory = int64(cfg.SandboxMemoryMB) << 20
+	limits.Processes = cfg.SandboxMaxProcesses
+	limits.Output = cfg.SandboxOutputKB << 10
+
+	var passEnv []string
+	if len(cfg.SandboxPassEnv) > 0 {
+		passEnv = append(slices.Clone(sandbox.DefaultPassEnv), cfg.SandboxPassEnv...)
+	}
+	return sandbox.New(sandbox.Options{
+		Limits:       limits,
+		Network:      cfg.SandboxNetwork,
+		PassEnv:      passEnv,
+		GoModCache:   sandbox.GoModCache(),
+		CgroupParent: cfg.SandboxCgroup,
+	})
+}
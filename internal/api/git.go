@@ -0,0 +1,161 @@
+package api
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/yuki/flyagi/internal/git"
+	"github.com/yuki/flyagi/internal/selfmod"
+)
+
+// requireGit writes an error and returns false when no repository is open.
+func (s *Server) requireGit(w http.ResponseWriter) bool {
+	if s.git == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "git repository not available"})
+		return false
+	}
+	return true
+}
+
+// protectedPath reports whether a file is protected from selfmod and so not
+// served, resolving the path the way the git service does.
+func protectedPath(p string) bool {
+	p = path.Clean("/" + strings.ReplaceAll(p, "\\", "/"))
+	return selfmod.IsProtected(strings.TrimPrefix(p, "/"))
+}
+
+// writeGitError maps git errors to HTTP responses.
+func writeGitError(w http.ResponseWriter, op string, err error) {
+	if errors.Is(err, git.ErrNotFound) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	slog.Error("git "+op+" failed", "error", err)
+	writeJSON(w, http.StatusInternalServerError, map[string]string{"error": op + " failed"})
+}
+
+func (s *Server) handleGitStatus(w http.ResponseWriter, r *http.Request) {
+	if !s.requireGit(w) {
+		return
+	}
+
+	status, err := s.git.Status()
+	if err != nil {
+		writeGitError(w, "status", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleGitLog lists commits. Query: rev, path, page (1-based), per_page.
+func (s *Server) handleGitLog(w http.ResponseWriter, r *http.Request) {
+	if !s.requireGit(w) {
+		return
+	}
+
+	q := r.URL.Query()
+	if p := q.Get("path"); p != "" && protectedPath(p) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "path is protected"})
+		return
+	}
+	page, err := queryInt(q.Get("page"), 1)
+	if err != nil || page < 1 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid page"})
+		return
+	}
+	perPage, err := queryInt(q.Get("per_page"), git.DefaultLogLimit)
+	if err != nil || perPage < 1 || perPage > git.MaxLogLimit {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid per_page"})
+		return
+	}
+
+	commits, err := s.git.Log(git.LogOptions{
+		Rev:   q.Get("rev"),
+		Path:  q.Get("path"),
+		Skip:  (page - 1) * perPage,
+		Limit: perPage,
+	})
+	if err != nil {
+		writeGitError(w, "log", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"commits":  commits,
+		"page":     page,
+		"per_page": perPage,
+		"has_more": len(commits) == perPage,
+	})
+}
+
+// handleGitBlame blames a file. Query: path (required), rev.
+func (s *Server) handleGitBlame(w http.ResponseWriter, r *http.Request) {
+	if !s.requireGit(w) {
+		return
+	}
+
+	filePath := r.URL.Query().Get("path")
+	if filePath == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "path parameter is required"})
+		return
+	}
+	if protectedPath(filePath) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "path is protected"})
+		return
+	}
+
+	lines, err := s.git.Blame(filePath, r.URL.Query().Get("rev"))
+	if err != nil {
+		writeGitError(w, "blame", err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"path":  filePath,
+		"lines": lines,
+	})
+}
+
+// handleGitFile returns a file at a revision. Query: path (required), rev.
+func (s *Server) handleGitFile(w http.ResponseWriter, r *http.Request) {
+	if !s.requireGit(w) {
+		return
+	}
+
+	filePath := r.URL.Query().Get("path")
+	if filePath == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "path parameter is required"})
+		return
+	}
+	if protectedPath(filePath) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "path is protected"})
+		return
+	}
+	rev := r.URL.Query().Get("rev")
+
+	content, err := s.git.FileAt(filePath, rev)
+	if err != nil {
+		writeGitError(w, "read", err)
+		return
+	}
+
+	if rev == "" {
+		rev = "HEAD"
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"path":    filePath,
+		"rev":     rev,
+		"content": content,
+	})
+}
+
+func queryInt(v string, fallback int) (int, error) {
+	if v == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(v)
+}
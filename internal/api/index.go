@@ -0,0 +1,104 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/yuki/flyagi/internal/codeindex"
+	"github.com/yuki/flyagi/internal/ws"
+)
+
+// requireIndex writes an error and returns false when no index is configured.
+func (s *Server) requireIndex(w http.ResponseWriter) bool {
+	if s.index == nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "code index not configured"})
+		return false
+	}
+	return true
+}
+
+func (s *Server) handleIndexStatus(w http.ResponseWriter, r *http.Request) {
+	if !s.requireIndex(w) {
+		return
+	}
+	writeJSON(w, http.StatusOK, s.index.Status())
+}
+
+// handleIndexSearch returns the chunks most similar to a query. Query: q
+// (required), k. Admins only, since every query is embedded.
+func (s *Server) handleIndexSearch(w http.ResponseWriter, r *http.Request) {
+	if ws.RoleFor(r, s.cfg.AdminToken) != ws.RoleAdmin {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin role required"})
+		return
+	}
+	if !s.requireIndex(w) {
+		return
+	}
+
+	query := r.URL.Query().Get("q")
+	if query == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "q parameter is required"})
+		return
+	}
+	k, err := queryInt(r.URL.Query().Get("k"), codeindex.DefaultK)
+	if err != nil || k < 1 || k > codeindex.MaxK {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid k"})
+		return
+	}
+
+	hits, err := s.index.Search(r.Context(), query, k)
+	if err != nil {
+		slog.Error("index search failed", "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "search failed"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"hits": hits})
+}
+
+// handleIndexUpdate starts an incremental index update in the background.
+// Admins only, since updates spend embedding API calls. Requests made while
+// an update runs are coalesced into one more run after it.
+func (s *Server) handleIndexUpdate(w http.ResponseWriter, r *http.Request) {
+	if ws.RoleFor(r, s.cfg.AdminToken) != ws.RoleAdmin {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin role required"})
+		return
+	}
+	if !s.requireIndex(w) {
+		return
+	}
+
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+	if s.indexRunning {
+		s.indexAgain = true
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "queued"})
+		return
+	}
+	s.indexRunning = true
+	go s.updateIndex()
+
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "updating"})
+}
+
+// updateIndex updates the index until no further update was requested
+// while it ran. The chat handler holds the repository during updates.
+func (s *Server) updateIndex() {
+	for {
+		stats, err := s.chat.Reindex(context.Background())
+		if err != nil {
+			slog.Error("index update failed", "error", err)
+		} else {
+			slog.Info("index updated", "files", stats.Files, "changed", stats.Changed, "removed", stats.Removed)
+		}
+
+		s.indexMu.Lock()
+		again := s.indexAgain
+		s.indexAgain, s.indexRunning = false, again
+		s.indexMu.Unlock()
+		if !again {
+			return
+		}
+	}
+}
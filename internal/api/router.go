@@ -9,12 +9,17 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 
+	"github.com/yuki/flyagi/internal/codeindex"
+	"github.com/yuki/flyagi/internal/codesearch"
 	"github.com/yuki/flyagi/internal/config"
+	"github.com/yuki/flyagi/internal/git"
+	"github.com/yuki/flyagi/internal/github"
 	"github.com/yuki/flyagi/internal/provider"
 	"github.com/yuki/flyagi/internal/ws"
 )
@@ -24,11 +29,20 @@ type Server struct {
 	cfg      *config.Config
 	registry *provider.Registry
 	hub      *ws.Hub
+	chat     *ws.ChatHandler
+	git      *git.Service
+	index    *codeindex.Index
+
+	deliveries *github.Deliveries
+
+	indexMu      sync.Mutex
+	indexRunning bool
+	indexAgain   bool // an update was requested while one ran
 }
 
 // NewRouter creates a fully wired Chi router.
-func NewRouter(cfg *config.Config, registry *provider.Registry, hub *ws.Hub) *chi.Mux {
-	s := &Server{cfg: cfg, registry: registry, hub: hub}
+func NewRouter(cfg *config.Config, registry *provider.Registry, hub *ws.Hub, chat *ws.ChatHandler, gitSvc *git.Service, index *codeindex.Index) *chi.Mux {
+	s := &Server{cfg: cfg, registry: registry, hub: hub, chat: chat, git: gitSvc, index: index, deliveries: github.NewDeliveries(1000)}
 
 	r := chi.NewRouter()
 
@@ -45,10 +59,21 @@ func NewRouter(cfg *config.Config, registry *provider.Registry, hub *ws.Hub) *ch
 	r.Route("/api", func(r chi.Router) {
 		r.Get("/health", s.handleHealth)
 		r.Get("/providers", s.handleProviders)
+		r.Get("/commands", s.handleCommands)
+		r.Post("/selfmod/{id}/cancel", s.handleSelfModCancel)
 		r.Post("/tts", s.handleTTS)
 		r.Post("/stt", s.handleSTT)
 		r.Get("/code/tree", s.handleCodeTree)
 		r.Get("/code/file", s.handleCodeFile)
+		r.Get("/code/search", s.handleCodeSearch)
+		r.Get("/index/status", s.handleIndexStatus)
+		r.Get("/index/search", s.handleIndexSearch)
+		r.Post("/index/update", s.handleIndexUpdate)
+		r.Get("/git/status", s.handleGitStatus)
+		r.Get("/git/log", s.handleGitLog)
+		r.Get("/git/blame", s.handleGitBlame)
+		r.Get("/git/file", s.handleGitFile)
+		r.Post("/webhooks/github", s.handleGitHubWebhook)
 	})
 
 	// WebSocket
@@ -67,12 +92,38 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) handleProviders(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]any{
-		"llm": s.registry.ListLLMs(),
-		"tts": s.registry.ListTTS(),
-		"stt": s.registry.ListSTT(),
+		"llm":       s.registry.ListLLMs(),
+		"tts":       s.registry.ListTTS(),
+		"stt":       s.registry.ListSTT(),
+		"embedding": s.registry.ListEmbeddings(),
+	})
+}
+
+// handleCommands lists the chat slash commands the caller's role may run,
+// for autocompletion.
+func (s *Server) handleCommands(w http.ResponseWriter, r *http.Request) {
+	role := ws.RoleFor(r, s.cfg.AdminToken)
+	writeJSON(w, http.StatusOK, map[string]any{
+		"role":     role,
+		"commands": s.chat.Commands().List(role),
 	})
 }
 
+// handleSelfModCancel cancels the refinement or approval running for a
+// change request. Admins only.
+func (s *Server) handleSelfModCancel(w http.ResponseWriter, r *http.Request) {
+	if ws.RoleFor(r, s.cfg.AdminToken) != ws.RoleAdmin {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin role required"})
+		return
+	}
+	id := chi.URLParam(r, "id")
+	if !s.chat.CancelSelfMod(id) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "nothing to cancel for " + id})
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "cancelling"})
+}
+
 func (s *Server) handleTTS(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Text     string `json:"text"`
@@ -154,19 +205,7 @@ func (s *Server) handleCodeTree(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var files []string
-	err := filepath.Walk(repoPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		// Skip hidden directories and common non-source directories
-		if info.IsDir() {
-			base := filepath.Base(path)
-			if strings.HasPrefix(base, ".") || base == "node_modules" || base == "vendor" {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-		rel, _ := filepath.Rel(repoPath, path)
+	err := codesearch.WalkSkipping(repoPath, codesearch.SkipTreeDir, func(rel string) error {
 		files = append(files, rel)
 		return nil
 	})
@@ -1,16 +1,29 @@
 package api_test
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
 
 	"github.com/yuki/flyagi/internal/api"
+	"github.com/yuki/flyagi/internal/codeindex"
 	"github.com/yuki/flyagi/internal/config"
+	"github.com/yuki/flyagi/internal/git"
 	"github.com/yuki/flyagi/internal/provider"
+	"github.com/yuki/flyagi/internal/provider/embedding"
 	"github.com/yuki/flyagi/internal/ws"
 )
 
@@ -34,7 +47,7 @@ func newTestServer(t *testing.T) (*httptest.Server, *config.Config) {
 	reg := provider.NewRegistry()
 	handler := ws.NewChatHandler(reg, nil, nil, nil)
 	hub := ws.NewHub(handler, "*")
-	router := api.NewRouter(cfg, reg, hub)
+	router := api.NewRouter(cfg, reg, hub, handler, nil, nil)
 
 	return httptest.NewServer(router), cfg
 }
@@ -96,6 +109,68 @@ func TestProvidersEndpoint(t *testing.T) {
 	}
 }
 
+func TestCommandsEndpoint(t *testing.T) {
+	srv, cfg := newTestServer(t)
+	defer srv.Close()
+	cfg.AdminToken = "secret"
+
+	list := func(token string) (string, []string) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/commands", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var body struct {
+			Role     string       `json:"role"`
+			Commands []ws.Command `json:"commands"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		var names []string
+		for _, c := range body.Commands {
+			names = append(names, c.Name)
+		}
+		return body.Role, names
+	}
+
+	if role, names := list(""); role != ws.RoleUser || slices.Contains(names, "selfmod") || !slices.Contains(names, "help") {
+		t.Errorf("anonymous caller: role %s, commands %v", role, names)
+	}
+	if role, names := list("secret"); role != ws.RoleAdmin || !slices.Contains(names, "selfmod") {
+		t.Errorf("admin caller: role %s, commands %v", role, names)
+	}
+}
+
+func TestSelfModCancelEndpoint(t *testing.T) {
+	srv, cfg := newTestServer(t)
+	defer srv.Close()
+	cfg.AdminToken = "secret"
+
+	cancel := func(token string) int {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/selfmod/abc/cancel", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := cancel(""); code != http.StatusForbidden {
+		t.Errorf("anonymous caller: expected 403, got %d", code)
+	}
+	if code := cancel("secret"); code != http.StatusNotFound {
+		t.Errorf("nothing running: expected 404, got %d", code)
+	}
+}
+
 func TestCodeTreeEndpoint(t *testing.T) {
 	srv, _ := newTestServer(t)
 	defer srv.Close()
@@ -121,6 +196,30 @@ func TestCodeTreeEndpoint(t *testing.T) {
 	}
 }
 
+func TestCodeTreeEndpoint_ListsBuildOutput(t *testing.T) {
+	srv, cfg := newTestServer(t)
+	defer srv.Close()
+	os.MkdirAll(filepath.Join(cfg.RepoPath, "web", "dist"), 0755)
+	os.WriteFile(filepath.Join(cfg.RepoPath, "web", "dist", "index.html"), []byte("<html>"), 0644)
+	os.MkdirAll(filepath.Join(cfg.RepoPath, "node_modules", "x"), 0755)
+	os.WriteFile(filepath.Join(cfg.RepoPath, "node_modules", "x", "index.js"), []byte(""), 0644)
+
+	resp, err := http.Get(srv.URL + "/api/code/tree")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Files []string `json:"files"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	// The tree skips dependencies but, unlike search, lists dist.
+	if !slices.Contains(body.Files, "web/dist/index.html") || slices.Contains(body.Files, "node_modules/x/index.js") {
+		t.Errorf("unexpected files: %v", body.Files)
+	}
+}
+
 func TestCodeFileEndpoint(t *testing.T) {
 	srv, _ := newTestServer(t)
 	defer srv.Close()
@@ -156,3 +255,393 @@ func TestCodeFileEndpoint_PathTraversal(t *testing.T) {
 		t.Errorf("expected 403, got %d", resp.StatusCode)
 	}
 }
+
+func postWebhook(t *testing.T, url, event, secret, body string) *http.Response {
+	t.Helper()
+	return postDelivery(t, url, event, secret, body, "")
+}
+
+// postDelivery posts a webhook delivery with an X-GitHub-Delivery ID.
+func postDelivery(t *testing.T, url, event, secret, body, delivery string) *http.Response {
+	t.Helper()
+
+	req, _ := http.NewRequest(http.MethodPost, url+"/api/webhooks/github", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-GitHub-Event", event)
+	if delivery != "" {
+		req.Header.Set("X-GitHub-Delivery", delivery)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	req.Header.Set("X-Hub-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	return resp
+}
+
+func TestGitHubWebhook_NotConfigured(t *testing.T) {
+	srv, _ := newTestServer(t)
+	defer srv.Close()
+
+	resp := postWebhook(t, srv.URL, "ping", "secret", `{"zen":"hi"}`)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestGitHubWebhook_InvalidSignature(t *testing.T) {
+	srv, cfg := newTestServer(t)
+	defer srv.Close()
+	cfg.GitHubWebhookSecret = "secret"
+
+	resp := postWebhook(t, srv.URL, "ping", "wrong", `{"zen":"hi"}`)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", resp.StatusCode)
+	}
+}
+
+func TestGitHubWebhook_Ping(t *testing.T) {
+	srv, cfg := newTestServer(t)
+	defer srv.Close()
+	cfg.GitHubWebhookSecret = "secret"
+
+	resp := postWebhook(t, srv.URL, "ping", "secret", `{"zen":"hi"}`)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestGitHubWebhook_IgnoresPlainIssueComment(t *testing.T) {
+	srv, cfg := newTestServer(t)
+	defer srv.Close()
+	cfg.GitHubWebhookSecret = "secret"
+
+	body := `{"action":"created","issue":{"number":1},"comment":{"body":"please rename this","user":{"login":"alice"}}}`
+	resp := postWebhook(t, srv.URL, "issue_comment", "secret", body)
+	defer resp.Body.Close()
+
+	var got map[string]string
+	json.NewDecoder(resp.Body).Decode(&got)
+	if resp.StatusCode != http.StatusAccepted || got["status"] != "ignored" {
+		t.Errorf("expected 202 ignored, got %d %q", resp.StatusCode, got["status"])
+	}
+}
+
+func TestGitHubWebhook_PullRequestClosed(t *testing.T) {
+	srv, cfg := newTestServer(t)
+	defer srv.Close()
+	cfg.GitHubWebhookSecret = "secret"
+
+	for action, want := range map[string]string{"closed": "recorded", "opened": "ignored"} {
+		body := `{"action":"` + action + `","pull_request":{"number":4,"merged":true}}`
+		resp := postWebhook(t, srv.URL, "pull_request", "secret", body)
+		var got map[string]string
+		json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if got["status"] != want {
+			t.Errorf("%s: expected %q, got %d %q", action, want, resp.StatusCode, got["status"])
+		}
+	}
+}
+
+func TestGitHubWebhook_ReviewCommentAuthors(t *testing.T) {
+	srv, cfg := newTestServer(t)
+	defer srv.Close()
+	cfg.GitHubWebhookSecret = "secret"
+
+	comment := func(association string) string {
+		return `{"action":"created","issue":{"number":1,"pull_request":{"url":"x"}},` +
+			`"comment":{"body":"please rename this","author_association":"` + association + `","user":{"login":"alice"}}}`
+	}
+	for _, tc := range []struct {
+		association, delivery, want string
+	}{
+		{"NONE", "d1", "ignored"},
+		{"CONTRIBUTOR", "d2", "ignored"},
+		{"MEMBER", "d3", "queued"},
+		{"MEMBER", "d3", "duplicate"},
+		{"COLLABORATOR", "d4", "queued"},
+	} {
+		resp := postDelivery(t, srv.URL, "issue_comment", "secret", comment(tc.association), tc.delivery)
+		var got map[string]string
+		json.NewDecoder(resp.Body).Decode(&got)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted || got["status"] != tc.want {
+			t.Errorf("%s (%s): expected 202 %s, got %d %q", tc.association, tc.delivery, tc.want, resp.StatusCode, got["status"])
+		}
+	}
+}
+
+func TestGitHubWebhook_IgnoresUnlabeledIssue(t *testing.T) {
+	srv, cfg := newTestServer(t)
+	defer srv.Close()
+	cfg.GitHubWebhookSecret = "secret"
+	cfg.GitHubIssueLabel = "flyagi"
+
+	body := `{"action":"opened","issue":{"number":7,"title":"Add dark mode","labels":[{"name":"bug"}]}}`
+	resp := postWebhook(t, srv.URL, "issues", "secret", body)
+	defer resp.Body.Close()
+
+	var got map[string]string
+	json.NewDecoder(resp.Body).Decode(&got)
+	if resp.StatusCode != http.StatusAccepted || got["status"] != "ignored" {
+		t.Errorf("expected 202 ignored, got %d %q", resp.StatusCode, got["status"])
+	}
+}
+
+func TestGitEndpoints_NotConfigured(t *testing.T) {
+	srv, _ := newTestServer(t)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/git/status")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503, got %d", resp.StatusCode)
+	}
+}
+
+func TestGitEndpoints(t *testing.T) {
+	tmpDir := t.TempDir()
+	if _, err := gogit.PlainInit(tmpDir, false); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(tmpDir, "main.go"), []byte("package main\n"), 0644)
+	os.WriteFile(filepath.Join(tmpDir, ".env"), []byte("API_KEY=secret\n"), 0644)
+
+	gitSvc := git.NewService(tmpDir, nil)
+	if err := gitSvc.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gitSvc.CommitAll("initial\n"); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{RepoPath: tmpDir, AllowedOrigin: "*"}
+	reg := provider.NewRegistry()
+	handler := ws.NewChatHandler(reg, nil, nil, nil)
+	srv := httptest.NewServer(api.NewRouter(cfg, reg, ws.NewHub(handler, "*"), handler, gitSvc, nil))
+	defer srv.Close()
+
+	tests := []struct {
+		path   string
+		status int
+		want   string
+	}{
+		{"/api/git/status", http.StatusOK, `"clean":true`},
+		{"/api/git/log?path=main.go", http.StatusOK, `"subject":"initial"`},
+		{"/api/git/log?per_page=0", http.StatusBadRequest, "invalid per_page"},
+		{"/api/git/blame?path=main.go", http.StatusOK, `"text":"package main"`},
+		{"/api/git/file?path=main.go&rev=HEAD", http.StatusOK, `"content":"package main\n"`},
+		{"/api/git/file?path=missing.go", http.StatusNotFound, "not found"},
+		{"/api/git/file?path=main.go&rev=nope", http.StatusNotFound, "not found"},
+		{"/api/git/blame", http.StatusBadRequest, "path parameter is required"},
+		{"/api/git/file?path=.env&rev=HEAD", http.StatusForbidden, "path is protected"},
+		{"/api/git/file?path=/./.env", http.StatusForbidden, "path is protected"},
+		{"/api/git/blame?path=.env", http.StatusForbidden, "path is protected"},
+		{"/api/git/log?path=.github/workflows", http.StatusForbidden, "path is protected"},
+	}
+	for _, tt := range tests {
+		resp, err := http.Get(srv.URL + tt.path)
+		if err != nil {
+			t.Fatalf("%s: request failed: %v", tt.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: expected %d, got %d (%s)", tt.path, tt.status, resp.StatusCode, body)
+		}
+		if !strings.Contains(string(body), tt.want) {
+			t.Errorf("%s: body %s does not contain %q", tt.path, body, tt.want)
+		}
+	}
+}
+
+func TestCodeSearchEndpoint(t *testing.T) {
+	srv, cfg := newTestServer(t)
+	defer srv.Close()
+	os.WriteFile(filepath.Join(cfg.RepoPath, ".env"), []byte("package main"), 0644)
+
+	resp, err := http.Get(srv.URL + "/api/code/search?q=package&context=1")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Matches []struct {
+			Path string `json:"path"`
+			Line int    `json:"line"`
+		} `json:"matches"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+
+	if len(body.Matches) != 1 || body.Matches[0].Path != "src/main.go" || body.Matches[0].Line != 1 {
+		t.Errorf("unexpected matches: %+v", body.Matches)
+	}
+}
+
+func TestCodeSearchEndpoint_InvalidRegex(t *testing.T) {
+	srv, _ := newTestServer(t)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/code/search?mode=regex&q=(")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", resp.StatusCode)
+	}
+}
+
+func TestIndexEndpoints(t *testing.T) {
+	tmpDir := t.TempDir()
+	os.WriteFile(filepath.Join(tmpDir, "handler.go"), []byte("package api\n\n// HandleLogin checks passwords.\nfunc HandleLogin() {}\n"), 0644)
+
+	index, err := codeindex.New(tmpDir, t.TempDir(), embedding.NewFakeProvider(0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := index.Update(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{RepoPath: tmpDir, AllowedOrigin: "*"}
+	reg := provider.NewRegistry()
+	handler := ws.NewChatHandler(reg, nil, nil, nil)
+	srv := httptest.NewServer(api.NewRouter(cfg, reg, ws.NewHub(handler, "*"), handler, nil, index))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/index/search?q=login&k=1")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Hits []struct {
+			Path   string `json:"path"`
+			Symbol string `json:"symbol"`
+		} `json:"hits"`
+	}
+	json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusOK || len(body.Hits) != 1 || body.Hits[0].Symbol != "HandleLogin" {
+		t.Errorf("unexpected response %d: %+v", resp.StatusCode, body)
+	}
+
+	// Searches spend embedding calls, so they need the admin token.
+	cfg.AdminToken = "secret"
+	resp3, err := http.Get(srv.URL + "/api/index/search?q=login")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp3.Body.Close()
+	if resp3.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 without the admin token, got %d", resp3.StatusCode)
+	}
+
+	srv2, _ := newTestServer(t)
+	defer srv2.Close()
+	resp2, err := http.Get(srv2.URL + "/api/index/status")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	resp2.Body.Close()
+	if resp2.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 without index, got %d", resp2.StatusCode)
+	}
+}
+
+// gatedEmbedder blocks every Embed call until the gate is closed.
+type gatedEmbedder struct {
+	*embedding.FakeProvider
+	started chan struct{}
+	gate    chan struct{}
+}
+
+func (e *gatedEmbedder) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	select {
+	case e.started <- struct{}{}:
+	default:
+	}
+	<-e.gate
+	return e.FakeProvider.Embed(ctx, texts)
+}
+
+func TestIndexUpdateEndpoint(t *testing.T) {
+	tmpDir := t.TempDir()
+	os.WriteFile(filepath.Join(tmpDir, "a.go"), []byte("package a\n"), 0644)
+
+	embedder := &gatedEmbedder{embedding.NewFakeProvider(0), make(chan struct{}, 1), make(chan struct{})}
+	index, err := codeindex.New(tmpDir, t.TempDir(), embedder, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{RepoPath: tmpDir, AllowedOrigin: "*", AdminToken: "secret"}
+	reg := provider.NewRegistry()
+	handler := ws.NewChatHandler(reg, nil, nil, nil)
+	handler.SetCodebase(tmpDir, index)
+	srv := httptest.NewServer(api.NewRouter(cfg, reg, ws.NewHub(handler, "*"), handler, nil, index))
+	defer srv.Close()
+
+	update := func(token string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/index/update", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var got map[string]string
+		json.NewDecoder(resp.Body).Decode(&got)
+		return resp.StatusCode, got["status"]
+	}
+
+	if code, _ := update(""); code != http.StatusForbidden {
+		t.Errorf("expected 403 without the admin token, got %d", code)
+	}
+	if code, status := update("secret"); code != http.StatusAccepted || status != "updating" {
+		t.Fatalf("expected 202 updating, got %d %q", code, status)
+	}
+	<-embedder.started
+
+	// Requests during the update are coalesced into one more run, which
+	// picks up files added meanwhile.
+	os.WriteFile(filepath.Join(tmpDir, "b.go"), []byte("package b\n"), 0644)
+	for range 2 {
+		if code, status := update("secret"); code != http.StatusAccepted || status != "queued" {
+			t.Errorf("expected 202 queued, got %d %q", code, status)
+		}
+	}
+	close(embedder.gate)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for st := index.Status(); st.Files != 2 || st.Updating; st = index.Status() {
+		if time.Now().After(deadline) {
+			t.Fatalf("queued update did not run: %+v", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
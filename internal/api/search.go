@@ -0,0 +1,68 @@
+package api
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/yuki/flyagi/internal/codesearch"
+	"github.com/yuki/flyagi/internal/selfmod"
+)
+
+// handleCodeSearch searches the repository. Query: q (required), mode
+// (literal, regex or symbol), path (comma-separated globs, repeatable),
+// case (true for case-sensitive), context and limit.
+func (s *Server) handleCodeSearch(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.RepoPath == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "repo path not configured"})
+		return
+	}
+
+	q := r.URL.Query()
+	contextLines, err := queryInt(q.Get("context"), 0)
+	if err != nil || contextLines < 0 || contextLines > codesearch.MaxContext {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid context"})
+		return
+	}
+	limit, err := queryInt(q.Get("limit"), codesearch.DefaultLimit)
+	if err != nil || limit < 1 || limit > codesearch.MaxLimit {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+		return
+	}
+
+	var paths []string
+	for _, v := range q["path"] {
+		for _, p := range strings.Split(v, ",") {
+			if p = strings.TrimSpace(p); p != "" {
+				paths = append(paths, p)
+			}
+		}
+	}
+
+	// Approvals switch branches and write files; search between them.
+	var res *codesearch.Result
+	err = s.chat.ReadRepo(func() (err error) {
+		res, err = codesearch.Search(r.Context(), s.cfg.RepoPath, codesearch.Options{
+			Query:         q.Get("q"),
+			Mode:          q.Get("mode"),
+			Paths:         paths,
+			CaseSensitive: q.Get("case") == "true",
+			Context:       contextLines,
+			Limit:         limit,
+			Exclude:       selfmod.IsProtected,
+		})
+		return err
+	})
+	if errors.Is(err, codesearch.ErrInvalidQuery) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		slog.Error("code search failed", "error", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "search failed"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
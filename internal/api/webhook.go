@@ -0,0 +1,71 @@
+package api
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/yuki/flyagi/internal/github"
+)
+
+// handleGitHubWebhook receives signed GitHub webhook deliveries. Review
+// comments on selfmod pull requests become follow-up change requests,
+// labeled issues become new change requests and closed pull requests mark
+// their requests merged or closed.
+func (s *Server) handleGitHubWebhook(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.GitHubWebhookSecret == "" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "webhook not configured"})
+		return
+	}
+
+	eventType, event, err := github.ParseWebhook(r, []byte(s.cfg.GitHubWebhookSecret))
+	if errors.Is(err, github.ErrInvalidSignature) {
+		slog.Warn("rejected webhook delivery", "error", err)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid signature"})
+		return
+	}
+	if err != nil {
+		slog.Warn("unsupported webhook delivery", "event", eventType, "error", err)
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "ignored"})
+		return
+	}
+
+	// GitHub redelivers events it thinks failed, and deliveries can be
+	// replayed from the settings page.
+	if id := r.Header.Get("X-GitHub-Delivery"); id != "" && s.deliveries.Seen(id) {
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "duplicate"})
+		return
+	}
+
+	switch eventType {
+	case "ping":
+		writeJSON(w, http.StatusOK, map[string]string{"status": "pong"})
+		return
+	case "pull_request_review_comment", "issue_comment":
+		rc, ok := github.ReviewCommentFromEvent(event)
+		if !ok {
+			writeJSON(w, http.StatusAccepted, map[string]string{"status": "ignored"})
+			return
+		}
+		s.chat.HandleReviewComment(s.cfg.DefaultLLMProvider, rc)
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "queued"})
+	case "pull_request":
+		number, merged, ok := github.ClosedPRFromEvent(event)
+		if !ok {
+			writeJSON(w, http.StatusAccepted, map[string]string{"status": "ignored"})
+			return
+		}
+		s.chat.HandlePRClosed(number, merged)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "recorded"})
+	case "issues":
+		issue, ok := github.IssueFromEvent(event, s.cfg.GitHubIssueLabel)
+		if !ok {
+			writeJSON(w, http.StatusAccepted, map[string]string{"status": "ignored"})
+			return
+		}
+		s.chat.HandleIssue(s.cfg.DefaultLLMProvider, issue)
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "queued"})
+	default:
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "ignored"})
+	}
+}
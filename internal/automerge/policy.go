@@ -0,0 +1,107 @@
+package automerge
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/yuki/flyagi/internal/codesearch"
+	"github.com/yuki/flyagi/internal/github"
+	"github.com/yuki/flyagi/internal/selfmod"
+)
+
+// Merge modes.
+const (
+	// ModeMerge merges the pull request through the API once the policy is met.
+	ModeMerge = "merge"
+	// ModeAuto enables GitHub auto-merge once the policy is met, leaving the
+	// final merge to branch protection.
+	ModeAuto = "auto"
+)
+
+// Policy decides which selfmod pull requests may be merged without a human.
+type Policy struct {
+	Mode string
+	// AllowedPaths are globs every changed file must match. A pattern ending
+	// in "/**" matches everything below a directory; a pattern without a
+	// slash is matched against the file name.
+	AllowedPaths      []string
+	MaxLines          int      // 0 means no limit
+	RequiredChecks    []string // all must pass; none means nothing is merged
+	RequiredApprovals int
+	MergeMethod       string // "merge", "squash" or "rebase"
+}
+
+// Evaluate applies the policy to the current state of a pull request.
+func (p Policy) Evaluate(state *github.PRState) selfmod.MergeDecision {
+	switch {
+	case state.Merged:
+		return decision("closed", "pull request already merged")
+	case state.State != "open":
+		return decision("closed", "pull request closed without merge")
+	case state.Draft:
+		return decision("wait", "pull request is a draft")
+	}
+
+	for _, f := range state.Files {
+		if !p.allowed(f.Path) {
+			return decision("ineligible", fmt.Sprintf("%s is outside the allowed paths", f.Path))
+		}
+	}
+	if p.MaxLines > 0 && state.Lines() > p.MaxLines {
+		return decision("ineligible", fmt.Sprintf("%d changed lines exceed the limit of %d", state.Lines(), p.MaxLines))
+	}
+
+	if state.ChangesRequested {
+		return decision("wait", "changes requested by a reviewer")
+	}
+	if state.Approvals < p.RequiredApprovals {
+		return decision("wait", fmt.Sprintf("%d of %d required approvals", state.Approvals, p.RequiredApprovals))
+	}
+
+	if len(p.RequiredChecks) == 0 {
+		return decision("ineligible", "no required checks are configured")
+	}
+	var failed, pending []string
+	for _, name := range p.RequiredChecks {
+		if name == selfmod.StatusContext {
+			// FlyAGI sets this on approval, before any CI has run.
+			failed = append(failed, name+" (set by FlyAGI itself)")
+			continue
+		}
+		switch state.Checks[name] {
+		case github.CheckSuccess:
+		case github.CheckFailure:
+			failed = append(failed, name)
+		default:
+			pending = append(pending, name)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return decision("wait", "required checks failed: "+strings.Join(failed, ", "))
+	}
+	if len(pending) > 0 {
+		sort.Strings(pending)
+		return decision("wait", "waiting for required checks: "+strings.Join(pending, ", "))
+	}
+
+	action := "merge"
+	if p.Mode == ModeAuto {
+		action = "auto_merge"
+	}
+	return decision(action, fmt.Sprintf("policy met: %d files, %d lines, %d approvals", len(state.Files), state.Lines(), state.Approvals))
+}
+
+func (p Policy) allowed(file string) bool {
+	for _, pattern := range p.AllowedPaths {
+		if codesearch.MatchGlob(pattern, file) {
+			return true
+		}
+	}
+	return false
+}
+
+func decision(action, reason string) selfmod.MergeDecision {
+	return selfmod.MergeDecision{Action: action, Reason: reason}
+}
@@ -0,0 +1,144 @@
+package automerge_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/yuki/flyagi/internal/automerge"
+	"github.com/yuki/flyagi/internal/github"
+	"github.com/yuki/flyagi/internal/selfmod"
+)
+
+func openPR(files ...github.PRFile) *github.PRState {
+	return &github.PRState{
+		Number: 1,
+		State:  "open",
+		Files:  files,
+		Checks: map[string]string{"test": github.CheckSuccess},
+	}
+}
+
+func TestPolicy_Evaluate(t *testing.T) {
+	policy := automerge.Policy{
+		Mode:           automerge.ModeMerge,
+		AllowedPaths:   []string{"docs/**", "web/src/**", "*.md"},
+		MaxLines:       50,
+		RequiredChecks: []string{"test"},
+		MergeMethod:    "squash",
+	}
+
+	tests := []struct {
+		name   string
+		state  *github.PRState
+		action string
+		reason string
+	}{
+		{
+			name:   "docs only",
+			state:  openPR(github.PRFile{Path: "docs/setup.md", Additions: 3}, github.PRFile{Path: "README.md", Additions: 1}),
+			action: "merge",
+		},
+		{
+			name:   "outside allowed paths",
+			state:  openPR(github.PRFile{Path: "web/src/App.tsx", Additions: 1}, github.PRFile{Path: "cmd/server/main.go", Additions: 1}),
+			action: "ineligible",
+			reason: "cmd/server/main.go",
+		},
+		{
+			name:   "too many lines",
+			state:  openPR(github.PRFile{Path: "docs/a.md", Additions: 40, Deletions: 20}),
+			action: "ineligible",
+			reason: "60 changed lines",
+		},
+		{
+			name: "check pending",
+			state: func() *github.PRState {
+				s := openPR(github.PRFile{Path: "docs/a.md", Additions: 1})
+				s.Checks = map[string]string{}
+				return s
+			}(),
+			action: "wait",
+			reason: "waiting for required checks: test",
+		},
+		{
+			name: "check failed",
+			state: func() *github.PRState {
+				s := openPR(github.PRFile{Path: "docs/a.md", Additions: 1})
+				s.Checks["test"] = github.CheckFailure
+				return s
+			}(),
+			action: "wait",
+			reason: "required checks failed: test",
+		},
+		{
+			name: "already merged",
+			state: func() *github.PRState {
+				s := openPR()
+				s.State, s.Merged = "closed", true
+				return s
+			}(),
+			action: "closed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := policy.Evaluate(tt.state)
+			if d.Action != tt.action {
+				t.Errorf("expected action %q, got %q (%s)", tt.action, d.Action, d.Reason)
+			}
+			if !strings.Contains(d.Reason, tt.reason) {
+				t.Errorf("expected reason containing %q, got %q", tt.reason, d.Reason)
+			}
+		})
+	}
+}
+
+func TestPolicy_RequiredApprovals(t *testing.T) {
+	policy := automerge.Policy{
+		Mode:              automerge.ModeAuto,
+		AllowedPaths:      []string{"docs/**"},
+		RequiredChecks:    []string{"test"},
+		RequiredApprovals: 1,
+	}
+
+	state := openPR(github.PRFile{Path: "docs/a.md", Additions: 1})
+	if d := policy.Evaluate(state); d.Action != "wait" {
+		t.Errorf("expected wait without approval, got %q", d.Action)
+	}
+
+	state.Approvals = 1
+	if d := policy.Evaluate(state); d.Action != "auto_merge" {
+		t.Errorf("expected auto_merge with approval, got %q", d.Action)
+	}
+
+	state.ChangesRequested = true
+	if d := policy.Evaluate(state); d.Action != "wait" {
+		t.Errorf("expected wait with changes requested, got %q", d.Action)
+	}
+}
+
+func TestPolicy_OwnStatusIsNotACheck(t *testing.T) {
+	policy := automerge.Policy{
+		Mode:           automerge.ModeMerge,
+		AllowedPaths:   []string{"docs/**"},
+		RequiredChecks: []string{"test", selfmod.StatusContext},
+	}
+
+	// The status FlyAGI sets on approval must not stand in for CI.
+	state := openPR(github.PRFile{Path: "docs/a.md", Additions: 1})
+	state.Checks[selfmod.StatusContext] = github.CheckSuccess
+	d := policy.Evaluate(state)
+	if d.Action != "wait" || !strings.Contains(d.Reason, "flyagi/selfmod (set by FlyAGI itself)") {
+		t.Errorf("expected wait on the own status, got %q (%s)", d.Action, d.Reason)
+	}
+}
+
+func TestPolicy_RequiresChecks(t *testing.T) {
+	policy := automerge.Policy{Mode: automerge.ModeMerge, AllowedPaths: []string{"docs/**"}}
+
+	d := policy.Evaluate(openPR(github.PRFile{Path: "docs/a.md", Additions: 1}))
+	if d.Action != "ineligible" {
+		t.Errorf("expected ineligible without required checks, got %q (%s)", d.Action, d.Reason)
+	}
+}
@@ -0,0 +1,95 @@
+package automerge
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/yuki/flyagi/internal/github"
+	"github.com/yuki/flyagi/internal/selfmod"
+)
+
+// Watcher periodically evaluates the merge policy for open selfmod pull
+// requests and merges those that qualify.
+type Watcher struct {
+	policy   Policy
+	gh       *github.Client
+	engine   *selfmod.Engine
+	interval time.Duration
+}
+
+// NewWatcher creates a new auto-merge watcher.
+func NewWatcher(policy Policy, gh *github.Client, engine *selfmod.Engine, interval time.Duration) *Watcher {
+	return &Watcher{
+		policy:   policy,
+		gh:       gh,
+		engine:   engine,
+		interval: interval,
+	}
+}
+
+// Run evaluates tracked pull requests every interval until ctx is cancelled.
+func (w *Watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.poll(ctx)
+		}
+	}
+}
+
+func (w *Watcher) poll(ctx context.Context) {
+	// Follow-up requests share the pull request of the request that opened
+	// it; decisions are recorded on the first one.
+	seen := make(map[int]bool)
+	for _, cr := range w.engine.Requests() {
+		if cr.PRNumber == 0 || cr.Status != "approved" || seen[cr.PRNumber] {
+			continue
+		}
+		seen[cr.PRNumber] = true
+		w.evaluate(ctx, cr)
+	}
+}
+
+func (w *Watcher) evaluate(ctx context.Context, cr selfmod.ChangeRequest) {
+	state, err := w.gh.GetPRState(ctx, cr.PRNumber)
+	if err != nil {
+		slog.Error("failed to fetch PR state", "pr", cr.PRNumber, "error", err)
+		return
+	}
+
+	d := w.policy.Evaluate(state)
+	if cr.Override != nil && (d.Action == "merge" || d.Action == "auto_merge") {
+		d = decision("ineligible", "safety findings were overridden in review")
+	}
+	recorded := w.engine.RecordMergeDecision(cr.ID, d)
+	if recorded {
+		slog.Info("merge decision", "request_id", cr.ID, "pr", cr.PRNumber, "action", d.Action, "reason", d.Reason)
+	}
+
+	switch d.Action {
+	case "closed":
+		w.engine.PRClosed(cr.PRNumber, state.Merged)
+	case "merge":
+		if err := w.gh.MergePR(ctx, cr.PRNumber, w.policy.MergeMethod, state.HeadSHA); err != nil {
+			w.engine.RecordMergeDecision(cr.ID, decision("wait", "merge failed: "+err.Error()))
+			slog.Error("auto-merge failed", "pr", cr.PRNumber, "error", err)
+			return
+		}
+		w.engine.PRClosed(cr.PRNumber, true)
+	case "auto_merge":
+		if !recorded {
+			// Already enabled; GitHub merges the pull request.
+			return
+		}
+		if err := w.gh.EnableAutoMerge(ctx, state.NodeID, w.policy.MergeMethod); err != nil {
+			w.engine.RecordMergeDecision(cr.ID, decision("wait", "enabling auto-merge failed: "+err.Error()))
+			slog.Error("enabling auto-merge failed", "pr", cr.PRNumber, "error", err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+// Package codeindex maintains a semantic vector index of the repository
+// used to retrieve relevant code for chat and selfmod prompts.
+package codeindex
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Chunk is a contiguous range of lines from a file.
+type Chunk struct {
+	Path      string `json:"path"`
+	StartLine int    `json:"start_line"` // 1-based, inclusive
+	EndLine   int    `json:"end_line"`   // inclusive
+	Symbol    string `json:"symbol,omitempty"`
+	Text      string `json:"text"`
+}
+
+// maxChunkLines bounds chunk size; longer sections are split into windows.
+const maxChunkLines = 80
+
+// Supported reports whether files with this path are indexed.
+func Supported(rel string) bool {
+	switch path.Ext(rel) {
+	case ".go", ".ts", ".tsx", ".md":
+		return true
+	}
+	return false
+}
+
+// ChunkFile splits a file into chunks along declarations (Go, TypeScript)
+// or headings (Markdown).
+func ChunkFile(rel, content string) []Chunk {
+	lines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return nil
+	}
+
+	var starts []section
+	switch path.Ext(rel) {
+	case ".go":
+		starts = goSections(rel, content)
+	case ".ts", ".tsx":
+		starts = matchSections(lines, tsDecl)
+	case ".md":
+		starts = matchSections(lines, mdHeading)
+	}
+
+	sections := sectionsWithPreamble(starts)
+	var chunks []Chunk
+	for i, s := range sections {
+		end := len(lines)
+		if i+1 < len(sections) {
+			end = sections[i+1].line - 1
+		}
+		chunks = append(chunks, window(rel, lines, s.line, end, s.symbol)...)
+	}
+	return chunks
+}
+
+// section marks where a declaration or heading starts.
+type section struct {
+	line   int // 1-based
+	symbol string
+}
+
+// sectionsWithPreamble makes sure the lines before the first section are
+// covered too.
+func sectionsWithPreamble(starts []section) []section {
+	if len(starts) == 0 || starts[0].line > 1 {
+		return append([]section{{line: 1}}, starts...)
+	}
+	return starts
+}
+
+// window emits lines[start..end] as one chunk, or several if it is longer
+// than maxChunkLines. Blank leading and trailing lines are trimmed.
+func window(rel string, lines []string, start, end int, symbol string) []Chunk {
+	for start <= end && strings.TrimSpace(lines[start-1]) == "" {
+		start++
+	}
+	for end >= start && strings.TrimSpace(lines[end-1]) == "" {
+		end--
+	}
+
+	var chunks []Chunk
+	for s := start; s <= end; s += maxChunkLines {
+		e := min(s+maxChunkLines-1, end)
+		chunks = append(chunks, Chunk{
+			Path:      rel,
+			StartLine: s,
+			EndLine:   e,
+			Symbol:    symbol,
+			Text:      strings.Join(lines[s-1:e], "\n"),
+		})
+	}
+	return chunks
+}
+
+// goSections returns the start of every top-level declaration, including
+// its doc comment.
+func goSections(rel, content string) []section {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, rel, content, parser.ParseComments|parser.SkipObjectResolution)
+	if err != nil {
+		return nil
+	}
+
+	var sections []section
+	for _, decl := range file.Decls {
+		pos := decl.Pos()
+		symbol := ""
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Doc != nil {
+				pos = d.Doc.Pos()
+			}
+			symbol = d.Name.Name
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				symbol = receiverName(d.Recv.List[0].Type) + "." + symbol
+			}
+		case *ast.GenDecl:
+			if d.Doc != nil {
+				pos = d.Doc.Pos()
+			}
+			if d.Tok == token.IMPORT {
+				continue
+			}
+			if len(d.Specs) == 1 {
+				if ts, ok := d.Specs[0].(*ast.TypeSpec); ok {
+					symbol = ts.Name.Name
+				}
+			}
+		}
+		sections = append(sections, section{line: fset.Position(pos).Line, symbol: symbol})
+	}
+	return sections
+}
+
+func receiverName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return receiverName(t.X)
+	case *ast.IndexExpr:
+		return receiverName(t.X)
+	case *ast.IndexListExpr:
+		return receiverName(t.X)
+	case *ast.Ident:
+		return t.Name
+	}
+	return ""
+}
+
+var (
+	tsDecl    = regexp.MustCompile(`^(?:export\s+(?:default\s+)?)?(?:async\s+)?(?:function\*?|class|interface|type|enum|const|let)\s+([A-Za-z_$][\w$]*)`)
+	mdHeading = regexp.MustCompile(`^#{1,6}\s+(.+?)\s*#*$`)
+)
+
+// matchSections starts a section at every line matching re; the first
+// submatch names it.
+func matchSections(lines []string, re *regexp.Regexp) []section {
+	var sections []section
+	inFence := false
+	for i, l := range lines {
+		if strings.HasPrefix(l, "```") {
+			inFence = !inFence
+		}
+		if inFence {
+			continue
+		}
+		if m := re.FindStringSubmatch(l); m != nil {
+			sections = append(sections, section{line: i + 1, symbol: m[1]})
+		}
+	}
+	return sections
+}
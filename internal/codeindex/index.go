@@ -0,0 +1,304 @@
+package codeindex
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yuki/flyagi/internal/codesearch"
+	"github.com/yuki/flyagi/internal/provider"
+)
+
+// Search limits.
+const (
+	DefaultK    = 8
+	MaxK        = 50
+	maxFileSize = 256 << 10
+)
+
+// Hit is a chunk returned by a search with its cosine similarity.
+type Hit struct {
+	Chunk
+	Score float32 `json:"score"`
+}
+
+// Status describes the current index.
+type Status struct {
+	Provider  string    `json:"provider"`
+	Model     string    `json:"model"`
+	Files     int       `json:"files"`
+	Chunks    int       `json:"chunks"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Updating  bool      `json:"updating"`
+}
+
+// UpdateStats summarizes an incremental update.
+type UpdateStats struct {
+	Files   int `json:"files"`   // files in the index after the update
+	Changed int `json:"changed"` // files (re-)embedded
+	Removed int `json:"removed"`
+	Chunks  int `json:"chunks"` // chunks embedded
+}
+
+// Index is a vector index of the repository persisted in a single file.
+// Updates only re-embed files whose content changed.
+type Index struct {
+	root     string
+	file     string
+	provider provider.EmbeddingProvider
+	exclude  func(rel string) bool
+
+	updateMu sync.Mutex // serializes Update
+	updating atomic.Bool
+	mu       sync.RWMutex
+	data     indexData
+}
+
+// indexData is the persisted form of the index.
+type indexData struct {
+	Provider  string
+	Model     string
+	Files     map[string]*fileEntry
+	UpdatedAt time.Time
+}
+
+type fileEntry struct {
+	Hash    string
+	Chunks  []Chunk
+	Vectors [][]float32
+}
+
+// New opens the index stored in dir for the repository at root, creating
+// an empty one if none exists or if it was built with another embedding
+// model. exclude hides files, e.g. protected paths; it may be nil.
+func New(root, dir string, p provider.EmbeddingProvider, exclude func(rel string) bool) (*Index, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create index directory: %w", err)
+	}
+
+	ix := &Index{
+		root:     root,
+		file:     filepath.Join(dir, "index.gob"),
+		provider: p,
+		exclude:  exclude,
+		data:     indexData{Provider: p.Name(), Model: p.Model(), Files: map[string]*fileEntry{}},
+	}
+
+	f, err := os.Open(ix.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return ix, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index: %w", err)
+	}
+	defer f.Close()
+
+	var data indexData
+	if err := gob.NewDecoder(f).Decode(&data); err != nil {
+		slog.Warn("discarding unreadable index", "path", ix.file, "error", err)
+		return ix, nil
+	}
+	if data.Provider != p.Name() || data.Model != p.Model() {
+		slog.Info("embedding model changed, rebuilding index", "old", data.Provider+"/"+data.Model, "new", p.Name()+"/"+p.Model())
+		return ix, nil
+	}
+	if data.Files == nil {
+		data.Files = map[string]*fileEntry{}
+	}
+	ix.data = data
+	return ix, nil
+}
+
+// Update re-embeds changed files, drops removed ones and saves the index.
+func (ix *Index) Update(ctx context.Context) (UpdateStats, error) {
+	ix.updateMu.Lock()
+	defer ix.updateMu.Unlock()
+	ix.updating.Store(true)
+	defer ix.updating.Store(false)
+
+	ix.mu.RLock()
+	old := ix.data.Files
+	ix.mu.RUnlock()
+
+	files := make(map[string]*fileEntry)
+	var changed []string
+	var texts []string
+
+	err := codesearch.Walk(ix.root, func(rel string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !Supported(rel) || (ix.exclude != nil && ix.exclude(rel)) {
+			return nil
+		}
+		content, err := os.ReadFile(filepath.Join(ix.root, filepath.FromSlash(rel)))
+		if err != nil || len(content) > maxFileSize {
+			return nil
+		}
+
+		sum := sha256.Sum256(content)
+		hash := hex.EncodeToString(sum[:])
+		if e, ok := old[rel]; ok && e.Hash == hash {
+			files[rel] = e
+			return nil
+		}
+
+		e := &fileEntry{Hash: hash, Chunks: ChunkFile(rel, string(content))}
+		files[rel] = e
+		changed = append(changed, rel)
+		for _, c := range e.Chunks {
+			texts = append(texts, embeddingText(c))
+		}
+		return nil
+	})
+	if err != nil {
+		return UpdateStats{}, fmt.Errorf("failed to walk repository: %w", err)
+	}
+
+	var vectors [][]float32
+	if len(texts) > 0 {
+		vectors, err = ix.provider.Embed(ctx, texts)
+		if err != nil {
+			return UpdateStats{}, err
+		}
+		if len(vectors) != len(texts) {
+			return UpdateStats{}, fmt.Errorf("embedding provider returned %d vectors for %d chunks", len(vectors), len(texts))
+		}
+	}
+	for _, rel := range changed {
+		e := files[rel]
+		e.Vectors, vectors = vectors[:len(e.Chunks)], vectors[len(e.Chunks):]
+	}
+
+	stats := UpdateStats{Files: len(files), Changed: len(changed), Chunks: len(texts)}
+	for rel := range old {
+		if _, ok := files[rel]; !ok {
+			stats.Removed++
+		}
+	}
+
+	ix.mu.Lock()
+	ix.data.Files = files
+	ix.data.UpdatedAt = time.Now()
+	data := ix.data
+	ix.mu.Unlock()
+
+	if stats.Changed > 0 || stats.Removed > 0 {
+		if err := ix.save(data); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// save writes the index atomically.
+func (ix *Index) save(data indexData) error {
+	tmp, err := os.CreateTemp(filepath.Dir(ix.file), "index-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save index: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save index: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save index: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), ix.file); err != nil {
+		return fmt.Errorf("failed to save index: %w", err)
+	}
+	return nil
+}
+
+// Search returns the k chunks most similar to query.
+func (ix *Index) Search(ctx context.Context, query string, k int) ([]Hit, error) {
+	if k <= 0 {
+		k = DefaultK
+	}
+	k = min(k, MaxK)
+
+	vectors, err := ix.provider.Embed(ctx, []string{query})
+	if err != nil {
+		return nil, err
+	}
+	if len(vectors) != 1 {
+		return nil, fmt.Errorf("embedding provider returned %d vectors for 1 query", len(vectors))
+	}
+	q := vectors[0]
+
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	hits := []Hit{}
+	for _, e := range ix.data.Files {
+		for i, c := range e.Chunks {
+			hits = append(hits, Hit{Chunk: c, Score: cosine(q, e.Vectors[i])})
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		if hits[i].Path != hits[j].Path {
+			return hits[i].Path < hits[j].Path
+		}
+		return hits[i].StartLine < hits[j].StartLine
+	})
+	return hits[:min(k, len(hits))], nil
+}
+
+// Status reports the size and freshness of the index.
+func (ix *Index) Status() Status {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	st := Status{
+		Provider:  ix.data.Provider,
+		Model:     ix.data.Model,
+		Files:     len(ix.data.Files),
+		UpdatedAt: ix.data.UpdatedAt,
+		Updating:  ix.updating.Load(),
+	}
+	for _, e := range ix.data.Files {
+		st.Chunks += len(e.Chunks)
+	}
+	return st
+}
+
+// embeddingText prefixes a chunk with its location so that file and symbol
+// names contribute to similarity.
+func embeddingText(c Chunk) string {
+	if c.Symbol != "" {
+		return c.Path + " " + c.Symbol + "\n" + c.Text
+	}
+	return c.Path + "\n" + c.Text
+}
+
+func cosine(a, b []float32) float32 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return float32(dot / (math.Sqrt(na) * math.Sqrt(nb)))
+}
@@ -0,0 +1,153 @@
+package codeindex_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/yuki/flyagi/internal/codeindex"
+	"github.com/yuki/flyagi/internal/provider/embedding"
+)
+
+func TestChunkFile_Go(t *testing.T) {
+	src := `package server
+
+import "net/http"
+
+// Server serves HTTP.
+type Server struct{}
+
+// Start runs the server.
+func (s *Server) Start() error {
+	return http.ListenAndServe(":8080", nil)
+}
+`
+	chunks := codeindex.ChunkFile("server.go", src)
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %+v", chunks)
+	}
+	if chunks[1].Symbol != "Server" || chunks[1].StartLine != 5 || chunks[1].EndLine != 6 {
+		t.Errorf("unexpected type chunk: %+v", chunks[1])
+	}
+	if chunks[2].Symbol != "Server.Start" || chunks[2].StartLine != 8 || chunks[2].EndLine != 11 {
+		t.Errorf("unexpected method chunk: %+v", chunks[2])
+	}
+}
+
+func TestChunkFile_TSAndMarkdown(t *testing.T) {
+	ts := "import x from 'y';\n\nexport function connect() {\n  return 1;\n}\n\nexport default class App {}\n"
+	chunks := codeindex.ChunkFile("app.ts", ts)
+	if len(chunks) != 3 || chunks[1].Symbol != "connect" || chunks[2].Symbol != "App" {
+		t.Errorf("unexpected ts chunks: %+v", chunks)
+	}
+
+	md := "# Title\n\nIntro\n\n## Setup\n\n```sh\n# not a heading\n```\n"
+	chunks = codeindex.ChunkFile("README.md", md)
+	if len(chunks) != 2 || chunks[0].Symbol != "Title" || chunks[1].Symbol != "Setup" || chunks[1].EndLine != 9 {
+		t.Errorf("unexpected markdown chunks: %+v", chunks)
+	}
+}
+
+func TestChunkFile_SplitsLongSections(t *testing.T) {
+	long := "# Log\n"
+	for i := 0; i < 100; i++ {
+		long += "line\n"
+	}
+	chunks := codeindex.ChunkFile("CHANGELOG.md", long)
+	if len(chunks) != 2 || chunks[0].EndLine != 80 || chunks[1].StartLine != 81 {
+		t.Errorf("unexpected windows: %d chunks", len(chunks))
+	}
+}
+
+// countingProvider records how many texts were embedded.
+type countingProvider struct {
+	*embedding.FakeProvider
+	model    string
+	embedded int
+}
+
+func (p *countingProvider) Model() string { return p.model }
+
+func (p *countingProvider) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	p.embedded += len(texts)
+	return p.FakeProvider.Embed(ctx, texts)
+}
+
+func TestIndex_IncrementalUpdateAndSearch(t *testing.T) {
+	root := t.TempDir()
+	dir := t.TempDir()
+	write := func(name, content string) {
+		os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755)
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("auth/login.go", "package auth\n\n// Login verifies the password.\nfunc Login(user, password string) bool { return false }\n")
+	write("docs/deploy.md", "# Deploy\n\nRun fly deploy to ship.\n")
+	write(".env", "SECRET=1\n")
+	write("image.png", "binary")
+
+	p := &countingProvider{FakeProvider: embedding.NewFakeProvider(0), model: "v1"}
+	exclude := func(rel string) bool { return rel == "docs/secret.md" }
+
+	ix, err := codeindex.New(root, dir, p, exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := ix.Update(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != 2 || stats.Changed != 2 {
+		t.Errorf("unexpected first update: %+v", stats)
+	}
+
+	hits, err := ix.Search(context.Background(), "where is the password login", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].Path != "auth/login.go" || hits[0].Symbol != "Login" {
+		t.Errorf("unexpected hits: %+v", hits)
+	}
+
+	// Only changed and new files are re-embedded.
+	before := p.embedded
+	write("docs/deploy.md", "# Deploy\n\nRun make deploy.\n")
+	write("docs/secret.md", "# Secret\n")
+	stats, err = ix.Update(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Changed != 1 || p.embedded-before != 1 {
+		t.Errorf("expected one re-embedded chunk, got %+v (%d embedded)", stats, p.embedded-before)
+	}
+
+	os.Remove(filepath.Join(root, "auth/login.go"))
+	if stats, err = ix.Update(context.Background()); err != nil || stats.Removed != 1 || stats.Files != 1 {
+		t.Errorf("unexpected update after removal: %+v, %v", stats, err)
+	}
+
+	// The index survives a restart without re-embedding.
+	before = p.embedded
+	reopened, err := codeindex.New(root, dir, p, exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := reopened.Status(); st.Files != 1 || st.Chunks != 1 {
+		t.Errorf("unexpected status after reload: %+v", st)
+	}
+	if _, err := reopened.Update(context.Background()); err != nil || p.embedded != before {
+		t.Errorf("reload re-embedded %d chunks, err %v", p.embedded-before, err)
+	}
+
+	// A different embedding model starts from scratch.
+	p.model = "v2"
+	rebuilt, err := codeindex.New(root, dir, p, exclude)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := rebuilt.Status(); st.Files != 0 || st.Model != "v2" {
+		t.Errorf("expected empty index for new model, got %+v", st)
+	}
+}
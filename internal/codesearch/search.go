@@ -0,0 +1,301 @@
+package codesearch
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Search modes.
+const (
+	ModeLiteral = "literal"
+	ModeRegex   = "regex"
+	ModeSymbol  = "symbol"
+)
+
+// Limits applied to every search.
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+	MaxContext   = 10
+	maxFileSize  = 1 << 20
+)
+
+// Options configures a search.
+type Options struct {
+	Query         string
+	Mode          string   // ModeLiteral (default), ModeRegex or ModeSymbol
+	Paths         []string // globs in MatchGlob syntax; empty searches every file
+	CaseSensitive bool
+	Context       int // lines of context around each match, up to MaxContext
+	Limit         int // defaults to DefaultLimit, capped at MaxLimit
+	// Exclude hides files from results, e.g. protected paths.
+	Exclude func(rel string) bool
+}
+
+// Match is a single search hit.
+type Match struct {
+	Path   string   `json:"path"`
+	Line   int      `json:"line"`
+	Column int      `json:"column"`
+	Text   string   `json:"text"`
+	Before []string `json:"before,omitempty"`
+	After  []string `json:"after,omitempty"`
+	Symbol *Symbol  `json:"symbol,omitempty"`
+}
+
+// Symbol describes a Go declaration found by a symbol search.
+type Symbol struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"` // "func", "method" or "type"
+	Receiver string `json:"receiver,omitempty"`
+}
+
+// Result holds the matches of a search.
+type Result struct {
+	Matches   []Match `json:"matches"`
+	Files     int     `json:"files"`     // files searched
+	Truncated bool    `json:"truncated"` // more matches exist beyond Limit
+}
+
+// ErrInvalidQuery is returned for an empty query, unknown mode or bad regex.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// errLimit stops the walk once enough matches were collected.
+var errLimit = errors.New("limit reached")
+
+// Search searches the files below root.
+func Search(ctx context.Context, root string, opts Options) (*Result, error) {
+	if opts.Query == "" {
+		return nil, fmt.Errorf("%w: query is required", ErrInvalidQuery)
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultLimit
+	}
+	opts.Limit = min(opts.Limit, MaxLimit)
+	opts.Context = min(max(opts.Context, 0), MaxContext)
+
+	var match func(rel string, content []byte) []Match
+	switch opts.Mode {
+	case "", ModeLiteral, ModeRegex:
+		re, err := compile(opts)
+		if err != nil {
+			return nil, err
+		}
+		match = func(rel string, content []byte) []Match {
+			return matchLines(rel, content, re, opts.Context)
+		}
+	case ModeSymbol:
+		match = func(rel string, content []byte) []Match {
+			if !strings.HasSuffix(rel, ".go") {
+				return nil
+			}
+			return matchSymbols(rel, content, opts)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown search mode %q", ErrInvalidQuery, opts.Mode)
+	}
+
+	res := &Result{Matches: []Match{}}
+	err := Walk(root, func(rel string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !included(rel, opts) {
+			return nil
+		}
+
+		content, ok := readText(filepath.Join(root, filepath.FromSlash(rel)))
+		if !ok {
+			return nil
+		}
+		res.Files++
+
+		for _, m := range match(rel, content) {
+			if len(res.Matches) == opts.Limit {
+				res.Truncated = true
+				return errLimit
+			}
+			res.Matches = append(res.Matches, m)
+		}
+		return nil
+	})
+	if err != nil && err != errLimit {
+		return nil, err
+	}
+	return res, nil
+}
+
+func compile(opts Options) (*regexp.Regexp, error) {
+	expr := opts.Query
+	if opts.Mode != ModeRegex {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if !opts.CaseSensitive {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+	return re, nil
+}
+
+func included(rel string, opts Options) bool {
+	if opts.Exclude != nil && opts.Exclude(rel) {
+		return false
+	}
+	if len(opts.Paths) == 0 {
+		return true
+	}
+	for _, pattern := range opts.Paths {
+		if MatchGlob(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// readText reads a file unless it is too large or looks binary.
+func readText(path string) ([]byte, bool) {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() > maxFileSize {
+		return nil, false
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	if bytes.IndexByte(content[:min(len(content), 8000)], 0) >= 0 {
+		return nil, false
+	}
+	return content, true
+}
+
+func splitLines(content []byte) []string {
+	var lines []string
+	sc := bufio.NewScanner(bytes.NewReader(content))
+	sc.Buffer(make([]byte, 0, 64*1024), maxFileSize)
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	return lines
+}
+
+func matchLines(rel string, content []byte, re *regexp.Regexp, context int) []Match {
+	lines := splitLines(content)
+
+	var matches []Match
+	for i, line := range lines {
+		loc := re.FindStringIndex(line)
+		if loc == nil {
+			continue
+		}
+		matches = append(matches, withContext(Match{
+			Path:   rel,
+			Line:   i + 1,
+			Column: loc[0] + 1,
+			Text:   line,
+		}, lines, context))
+	}
+	return matches
+}
+
+func withContext(m Match, lines []string, context int) Match {
+	if context == 0 {
+		return m
+	}
+	i := m.Line - 1
+	m.Before = lines[max(0, i-context):i]
+	m.After = lines[i+1 : min(len(lines), i+1+context)]
+	return m
+}
+
+// matchSymbols finds Go funcs, methods and types whose name contains the
+// query. A "Type.Method" query also matches on the receiver type.
+func matchSymbols(rel string, content []byte, opts Options) []Match {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, rel, content, parser.SkipObjectResolution)
+	if err != nil {
+		return nil
+	}
+
+	query := opts.Query
+	recvQuery := ""
+	if r, name, ok := strings.Cut(query, "."); ok {
+		recvQuery, query = r, name
+	}
+	contains := func(s, sub string) bool {
+		if opts.CaseSensitive {
+			return strings.Contains(s, sub)
+		}
+		return strings.Contains(strings.ToLower(s), strings.ToLower(sub))
+	}
+
+	var lines []string
+	var matches []Match
+	add := func(pos token.Pos, sym Symbol) {
+		if !contains(sym.Name, query) || (recvQuery != "" && !contains(sym.Receiver, recvQuery)) {
+			return
+		}
+		if lines == nil {
+			lines = splitLines(content)
+		}
+		p := fset.Position(pos)
+		text := ""
+		if p.Line-1 < len(lines) {
+			text = lines[p.Line-1]
+		}
+		matches = append(matches, withContext(Match{
+			Path:   rel,
+			Line:   p.Line,
+			Column: p.Column,
+			Text:   text,
+			Symbol: &sym,
+		}, lines, opts.Context))
+	}
+
+	for _, decl := range file.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			sym := Symbol{Name: d.Name.Name, Kind: "func"}
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				sym.Kind = "method"
+				sym.Receiver = receiverName(d.Recv.List[0].Type)
+			}
+			add(d.Name.Pos(), sym)
+		case *ast.GenDecl:
+			if d.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range d.Specs {
+				ts := spec.(*ast.TypeSpec)
+				add(ts.Name.Pos(), Symbol{Name: ts.Name.Name, Kind: "type"})
+			}
+		}
+	}
+	return matches
+}
+
+func receiverName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return receiverName(t.X)
+	case *ast.IndexExpr:
+		return receiverName(t.X)
+	case *ast.IndexListExpr:
+		return receiverName(t.X)
+	case *ast.Ident:
+		return t.Name
+	}
+	return ""
+}
@@ -0,0 +1,116 @@
+package codesearch_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/yuki/flyagi/internal/codesearch"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		full := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(full), 0755)
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+const serverGo = `package server
+
+type Server struct{}
+
+// Start runs the server.
+func (s *Server) Start() error {
+	return nil
+}
+
+func NewServer() *Server { return &Server{} }
+`
+
+func TestSearch(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"internal/server.go":       serverGo,
+		"web/app.ts":               "const server = new Server();\n",
+		"README.md":                "# Server docs\n",
+		".env":                     "SERVER_TOKEN=secret\n",
+		"node_modules/x/server.js": "server\n",
+		"bin/blob":                 "server\x00\x01",
+	})
+	exclude := func(rel string) bool { return rel == ".env" }
+
+	tests := []struct {
+		name string
+		opts codesearch.Options
+		want []string // path:line of each match
+	}{
+		{"literal case-insensitive", codesearch.Options{Query: "server"}, []string{"README.md:1", "internal/server.go:1", "internal/server.go:3", "internal/server.go:5", "internal/server.go:6", "internal/server.go:10", "web/app.ts:1"}},
+		{"case-sensitive", codesearch.Options{Query: "Server", CaseSensitive: true, Paths: []string{"*.ts", "*.md"}}, []string{"README.md:1", "web/app.ts:1"}},
+		{"regex", codesearch.Options{Query: `^func \w+\(`, Mode: codesearch.ModeRegex}, []string{"internal/server.go:10"}},
+		{"glob", codesearch.Options{Query: "server", Paths: []string{"web/**"}}, []string{"web/app.ts:1"}},
+		{"limit", codesearch.Options{Query: "server", Paths: []string{"*.go"}, Limit: 2}, []string{"internal/server.go:1", "internal/server.go:3"}},
+		{"symbol", codesearch.Options{Query: "start", Mode: codesearch.ModeSymbol}, []string{"internal/server.go:6"}},
+		{"symbol with receiver", codesearch.Options{Query: "Server.", Mode: codesearch.ModeSymbol}, []string{"internal/server.go:6"}},
+		{"symbol type", codesearch.Options{Query: "Server", Mode: codesearch.ModeSymbol, CaseSensitive: true}, []string{"internal/server.go:3", "internal/server.go:10"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Exclude = exclude
+			res, err := codesearch.Search(context.Background(), root, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, m := range res.Matches {
+				got = append(got, fmt.Sprintf("%s:%d", m.Path, m.Line))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+			if tt.opts.Limit > 0 && !res.Truncated {
+				t.Error("expected truncated result")
+			}
+		})
+	}
+}
+
+func TestSearch_ContextAndSymbol(t *testing.T) {
+	root := writeFiles(t, map[string]string{"server.go": serverGo})
+
+	res, err := codesearch.Search(context.Background(), root, codesearch.Options{Query: "Start", Mode: codesearch.ModeSymbol, Context: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Matches) != 1 {
+		t.Fatalf("expected 1 match, got %+v", res.Matches)
+	}
+	m := res.Matches[0]
+	if m.Symbol == nil || m.Symbol.Kind != "method" || m.Symbol.Receiver != "Server" {
+		t.Errorf("unexpected symbol: %+v", m.Symbol)
+	}
+	if len(m.Before) != 1 || m.Before[0] != "// Start runs the server." || len(m.After) != 1 || m.After[0] != "\treturn nil" {
+		t.Errorf("unexpected context: before %q after %q", m.Before, m.After)
+	}
+}
+
+func TestSearch_InvalidQuery(t *testing.T) {
+	root := t.TempDir()
+	for _, opts := range []codesearch.Options{
+		{},
+		{Query: "(", Mode: codesearch.ModeRegex},
+		{Query: "x", Mode: "fuzzy"},
+	} {
+		if _, err := codesearch.Search(context.Background(), root, opts); !errors.Is(err, codesearch.ErrInvalidQuery) {
+			t.Errorf("%+v: expected ErrInvalidQuery, got %v", opts, err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Package codesearch lists and searches the files of the repository.
+package codesearch
+
+import (
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SkipDir reports whether a directory is excluded from search and indexing:
+// hidden directories and dependency or build output.
+func SkipDir(name string) bool {
+	return SkipTreeDir(name) || name == "dist"
+}
+
+// SkipTreeDir reports whether a directory is excluded from the file tree:
+// hidden directories and dependencies. Build output is listed.
+func SkipTreeDir(name string) bool {
+	return strings.HasPrefix(name, ".") || name == "node_modules" || name == "vendor"
+}
+
+// Walk calls fn with the slash-separated path, relative to root, of every
+// file outside directories excluded by SkipDir.
+func Walk(root string, fn func(rel string) error) error {
+	return WalkSkipping(root, SkipDir, fn)
+}
+
+// WalkSkipping is Walk with the directories to exclude chosen by skip.
+func WalkSkipping(root string, skip func(name string) bool, fn func(rel string) error) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p != root && skip(d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel))
+	})
+}
+
+// MatchGlob reports whether file matches pattern. "dir/**" matches
+// everything below dir, and patterns without a slash match the base name.
+func MatchGlob(pattern, file string) bool {
+	if dir, ok := strings.CutSuffix(pattern, "/**"); ok {
+		return strings.HasPrefix(file, dir+"/")
+	}
+	target := file
+	if !strings.Contains(pattern, "/") {
+		target = path.Base(file)
+	}
+	ok, _ := path.Match(pattern, target)
+	return ok
+}
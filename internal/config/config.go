@@ -3,6 +3,9 @@ package config
 import (
 	"fmt"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -16,10 +19,113 @@ type Config struct {
 	// TTS
 	ElevenLabsAPIKey string
 
+	// Forge hosting the repository; token, owner and repo default to the
+	// GitHub settings below
+	ForgeType  string
+	ForgeURL   string
+	ForgeToken string
+	ForgeOwner string
+	ForgeRepo  string
+
 	// GitHub
 	GitHubToken string
 	GitHubOwner string
 	GitHubRepo  string
+	// GitHubWebhookSecret verifies signatures on /api/webhooks/github.
+	GitHubWebhookSecret string
+	// GitHubIssueLabel marks issues that should become selfmod requests.
+	GitHubIssueLabel string
+	// GitHubIssuePollInterval enables issue polling when non-zero.
+	GitHubIssuePollInterval time.Duration
+	// GitHub App credentials; used instead of a token when all are set.
+	GitHubAppID             int
+	GitHubAppInstallationID int
+	GitHubAppPrivateKeyPath string
+
+	// Git transport: "https" uses the forge token, "ssh" a deploy key
+	GitAuth             string
+	GitCloneURL         string
+	GitSSHUser          string
+	GitSSHKeyPath       string
+	GitSSHKeyPassphrase string
+	GitSSHKnownHosts    string
+
+	// Commit identity and optional signing ("ssh" or "openpgp")
+	GitAuthorName           string
+	GitAuthorEmail          string
+	GitSigningFormat        string
+	GitSigningKey           string
+	GitSigningKeyPassphrase string
+
+	// Pull requests opened for approved changes
+	PRTemplatePath string
+	PRTitlePrefix  string
+	PRBaseBranch   string
+	PRDraft        bool
+	PRLabels       []string
+	PRAssignees    []string
+	PRReviewers    []string
+	// PRPollInterval is how often pull requests are checked for merges
+	// when no GitHub webhook reports them; zero disables polling
+	PRPollInterval time.Duration
+
+	// DiffContextLines is the number of unchanged lines around selfmod diff hunks
+	DiffContextLines int
+	// ScanAllowedHosts are hosts the selfmod safety scanner accepts in new code
+	ScanAllowedHosts []string
+
+	// Verification commands run in a sandbox after selfmod changes are applied
+	VerifyCommands      []string
+	SandboxTimeout      time.Duration
+	SandboxCPUTime      time.Duration
+	SandboxMemoryMB     int
+	SandboxMaxProcesses int
+	SandboxOutputKB     int
+	SandboxNetwork      bool
+	SandboxCgroup       string
+	SandboxPassEnv      []string
+
+	// Concurrent selfmod generations, and how many one client may have queued
+	GenerationWorkers      int
+	GenerationMaxPerClient int
+	// Stream the LLM's raw reply text to the client during generations
+	GenerationProgressText bool
+
+	// Retention of selfmod change requests and sweeping of what they leave behind
+	PendingRequestTTL  time.Duration
+	HistoryMaxRequests int
+	HistoryMaxAge      time.Duration
+	SweepInterval      time.Duration
+
+	// Live update rebuilds and re-executes the server after selfmod changes land
+	LiveUpdate              bool
+	LiveUpdateBinDir        string
+	LiveUpdateTest          bool
+	LiveUpdateHealthTimeout time.Duration
+
+	// Auto-merge policy for selfmod pull requests; disabled when AutoMergeMode is empty
+	AutoMergeMode              string
+	AutoMergeAllowedPaths      []string
+	AutoMergeMaxLines          int
+	AutoMergeRequiredChecks    []string
+	AutoMergeRequiredApprovals int
+	AutoMergeMethod            string
+	AutoMergeInterval          time.Duration
+
+	// Embeddings for the semantic code index; EmbeddingBaseURL registers an
+	// OpenAI-compatible provider named "compatible"
+	DefaultEmbeddingProvider string
+	EmbeddingModel           string
+	EmbeddingBaseURL         string
+	EmbeddingAPIKey          string
+	IndexPath                string
+
+	// Chat intent routing; IntentClassifier is "llm", "rules" or "off",
+	// which leaves only slash commands. IntentProvider defaults to the
+	// conversation's provider
+	IntentClassifier string
+	IntentProvider   string
+	IntentThreshold  float64
 
 	// Google Cloud (for STT)
 	GoogleProjectID string
@@ -30,30 +136,182 @@ type Config struct {
 	DefaultSTTProvider string
 	RepoPath           string
 	AllowedOrigin      string
+
+	// AdminToken grants the admin role to WebSocket clients and API callers
+	// that present it; without one everybody is an admin
+	AdminToken string
 }
 
 func Load() (*Config, error) {
 	cfg := &Config{
-		Port:               getEnv("PORT", "8080"),
-		AnthropicAPIKey:    os.Getenv("ANTHROPIC_API_KEY"),
-		OpenAIAPIKey:       os.Getenv("OPENAI_API_KEY"),
-		GeminiAPIKey:       os.Getenv("GEMINI_API_KEY"),
-		ElevenLabsAPIKey:   os.Getenv("ELEVENLABS_API_KEY"),
-		GitHubToken:        os.Getenv("GITHUB_TOKEN"),
-		GitHubOwner:        os.Getenv("GITHUB_OWNER"),
-		GitHubRepo:         os.Getenv("GITHUB_REPO"),
-		GoogleProjectID:    os.Getenv("GOOGLE_PROJECT_ID"),
-		DefaultLLMProvider: getEnv("DEFAULT_LLM_PROVIDER", "anthropic"),
-		DefaultTTSProvider: getEnv("DEFAULT_TTS_PROVIDER", "openai"),
-		DefaultSTTProvider: getEnv("DEFAULT_STT_PROVIDER", "openai"),
-		RepoPath:           getEnv("REPO_PATH", "/tmp/flyagi-repo"),
-		AllowedOrigin:      getEnv("ALLOWED_ORIGIN", "*"),
+		Port:                    getEnv("PORT", "8080"),
+		AnthropicAPIKey:         os.Getenv("ANTHROPIC_API_KEY"),
+		OpenAIAPIKey:            os.Getenv("OPENAI_API_KEY"),
+		GeminiAPIKey:            os.Getenv("GEMINI_API_KEY"),
+		ElevenLabsAPIKey:        os.Getenv("ELEVENLABS_API_KEY"),
+		GitHubToken:             os.Getenv("GITHUB_TOKEN"),
+		GitHubOwner:             os.Getenv("GITHUB_OWNER"),
+		GitHubRepo:              os.Getenv("GITHUB_REPO"),
+		GitHubWebhookSecret:     os.Getenv("GITHUB_WEBHOOK_SECRET"),
+		GitHubIssueLabel:        getEnv("GITHUB_ISSUE_LABEL", "flyagi"),
+		GitHubAppPrivateKeyPath: os.Getenv("GITHUB_APP_PRIVATE_KEY_PATH"),
+		GitAuth:                 getEnv("GIT_AUTH", "https"),
+		GitCloneURL:             os.Getenv("GIT_CLONE_URL"),
+		GitSSHUser:              getEnv("GIT_SSH_USER", "git"),
+		GitSSHKeyPath:           os.Getenv("GIT_SSH_KEY_PATH"),
+		GitSSHKeyPassphrase:     os.Getenv("GIT_SSH_KEY_PASSPHRASE"),
+		GitSSHKnownHosts:        getEnv("GIT_SSH_KNOWN_HOSTS", os.ExpandEnv("$HOME/.ssh/known_hosts")),
+		GitAuthorName:           getEnv("GIT_AUTHOR_NAME", "FlyAGI"),
+		GitAuthorEmail:          getEnv("GIT_AUTHOR_EMAIL", "flyagi@bot.local"),
+		GitSigningFormat:        os.Getenv("GIT_SIGNING_FORMAT"),
+		GitSigningKey:           os.Getenv("GIT_SIGNING_KEY"),
+		GitSigningKeyPassphrase: os.Getenv("GIT_SIGNING_KEY_PASSPHRASE"),
+		PRTemplatePath:          os.Getenv("PR_TEMPLATE_PATH"),
+		PRTitlePrefix:           getEnv("PR_TITLE_PREFIX", "[selfmod] "),
+		PRBaseBranch:            getEnv("PR_BASE_BRANCH", "main"),
+		PRDraft:                 os.Getenv("PR_DRAFT") == "true",
+		PRLabels:                getList("PR_LABELS"),
+		PRAssignees:             getList("PR_ASSIGNEES"),
+		PRReviewers:             getList("PR_REVIEWERS"),
+		AutoMergeMode:           os.Getenv("AUTOMERGE_MODE"),
+		AutoMergeAllowedPaths:   getList("AUTOMERGE_ALLOWED_PATHS"),
+		AutoMergeRequiredChecks: getList("AUTOMERGE_REQUIRED_CHECKS"),
+		AutoMergeMethod:         getEnv("AUTOMERGE_METHOD", "squash"),
+		GoogleProjectID:         os.Getenv("GOOGLE_PROJECT_ID"),
+		DefaultLLMProvider:      getEnv("DEFAULT_LLM_PROVIDER", "anthropic"),
+		DefaultTTSProvider:      getEnv("DEFAULT_TTS_PROVIDER", "openai"),
+		DefaultSTTProvider:      getEnv("DEFAULT_STT_PROVIDER", "openai"),
+		RepoPath:                getEnv("REPO_PATH", "/tmp/flyagi-repo"),
+		AllowedOrigin:           getEnv("ALLOWED_ORIGIN", "*"),
 	}
 
 	if cfg.Port == "" {
 		return nil, fmt.Errorf("PORT must not be empty")
 	}
 
+	cfg.ForgeType = getEnv("FORGE_TYPE", "github")
+	cfg.ForgeURL = os.Getenv("FORGE_URL")
+	cfg.ForgeToken = getEnv("FORGE_TOKEN", cfg.GitHubToken)
+	cfg.ForgeOwner = getEnv("FORGE_OWNER", cfg.GitHubOwner)
+	cfg.ForgeRepo = getEnv("FORGE_REPO", cfg.GitHubRepo)
+
+	cfg.DefaultEmbeddingProvider = getEnv("DEFAULT_EMBEDDING_PROVIDER", "openai")
+	cfg.EmbeddingModel = os.Getenv("EMBEDDING_MODEL")
+	cfg.EmbeddingBaseURL = os.Getenv("EMBEDDING_BASE_URL")
+	cfg.EmbeddingAPIKey = os.Getenv("EMBEDDING_API_KEY")
+	cfg.IndexPath = getEnv("INDEX_PATH", "/tmp/flyagi-index")
+	cfg.AdminToken = os.Getenv("ADMIN_TOKEN")
+	cfg.IntentClassifier = getEnv("INTENT_CLASSIFIER", "llm")
+	cfg.IntentProvider = os.Getenv("INTENT_PROVIDER")
+
+	var err error
+	if cfg.GitHubIssuePollInterval, err = getDuration("GITHUB_ISSUE_POLL_INTERVAL", 0); err != nil {
+		return nil, err
+	}
+	if cfg.AutoMergeInterval, err = getDuration("AUTOMERGE_INTERVAL", time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.PRPollInterval, err = getDuration("PR_POLL_INTERVAL", 2*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.AutoMergeMaxLines, err = getInt("AUTOMERGE_MAX_LINES", 0); err != nil {
+		return nil, err
+	}
+	if cfg.AutoMergeRequiredApprovals, err = getInt("AUTOMERGE_REQUIRED_APPROVALS", 0); err != nil {
+		return nil, err
+	}
+	if cfg.DiffContextLines, err = getInt("DIFF_CONTEXT_LINES", 3); err != nil {
+		return nil, err
+	}
+	cfg.ScanAllowedHosts = getList("SCAN_ALLOWED_HOSTS")
+	cfg.VerifyCommands = getList("VERIFY_COMMANDS")
+	cfg.SandboxNetwork = os.Getenv("SANDBOX_NETWORK") == "true"
+	cfg.SandboxCgroup = os.Getenv("SANDBOX_CGROUP")
+	cfg.SandboxPassEnv = getList("SANDBOX_PASS_ENV")
+	if cfg.SandboxTimeout, err = getDuration("SANDBOX_TIMEOUT", 10*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.SandboxCPUTime, err = getDuration("SANDBOX_CPU_TIME", 10*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.SandboxMemoryMB, err = getInt("SANDBOX_MEMORY_MB", 4096); err != nil {
+		return nil, err
+	}
+	if cfg.SandboxMaxProcesses, err = getInt("SANDBOX_MAX_PROCESSES", 512); err != nil {
+		return nil, err
+	}
+	if cfg.SandboxOutputKB, err = getInt("SANDBOX_OUTPUT_KB", 64); err != nil {
+		return nil, err
+	}
+	if cfg.GenerationWorkers, err = getInt("GENERATION_WORKERS", 2); err != nil {
+		return nil, err
+	}
+	if cfg.GenerationMaxPerClient, err = getInt("GENERATION_MAX_PER_CLIENT", 3); err != nil {
+		return nil, err
+	}
+	cfg.GenerationProgressText = os.Getenv("GENERATION_PROGRESS_TEXT") == "true"
+	if cfg.PendingRequestTTL, err = getDuration("PENDING_REQUEST_TTL", 24*time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.HistoryMaxRequests, err = getInt("HISTORY_MAX_REQUESTS", 500); err != nil {
+		return nil, err
+	}
+	if cfg.HistoryMaxAge, err = getDuration("HISTORY_MAX_AGE", 30*24*time.Hour); err != nil {
+		return nil, err
+	}
+	if cfg.SweepInterval, err = getDuration("SWEEP_INTERVAL", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	cfg.LiveUpdate = os.Getenv("LIVE_UPDATE") == "true"
+	cfg.LiveUpdateBinDir = getEnv("LIVE_UPDATE_BIN_DIR", "/tmp/flyagi-bin")
+	cfg.LiveUpdateTest = os.Getenv("LIVE_UPDATE_TEST") != "false"
+	if cfg.LiveUpdateHealthTimeout, err = getDuration("LIVE_UPDATE_HEALTH_TIMEOUT", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.IntentThreshold, err = getFloat("INTENT_THRESHOLD", 0.7); err != nil {
+		return nil, err
+	}
+	if cfg.GitHubAppID, err = getInt("GITHUB_APP_ID", 0); err != nil {
+		return nil, err
+	}
+	if cfg.GitHubAppInstallationID, err = getInt("GITHUB_APP_INSTALLATION_ID", 0); err != nil {
+		return nil, err
+	}
+
+	switch cfg.GitAuth {
+	case "https":
+	case "ssh":
+		if cfg.GitSSHKeyPath == "" {
+			return nil, fmt.Errorf("GIT_SSH_KEY_PATH is required when GIT_AUTH=ssh")
+		}
+	default:
+		return nil, fmt.Errorf("invalid GIT_AUTH %q: must be https or ssh", cfg.GitAuth)
+	}
+
+	switch cfg.GitSigningFormat {
+	case "":
+	case "ssh", "openpgp", "gpg":
+		if cfg.GitSigningKey == "" {
+			return nil, fmt.Errorf("GIT_SIGNING_KEY is required when GIT_SIGNING_FORMAT is set")
+		}
+	default:
+		return nil, fmt.Errorf("invalid GIT_SIGNING_FORMAT %q: must be ssh or openpgp", cfg.GitSigningFormat)
+	}
+
+	switch cfg.IntentClassifier {
+	case "llm", "rules", "off":
+	default:
+		return nil, fmt.Errorf("invalid INTENT_CLASSIFIER %q: must be llm, rules or off", cfg.IntentClassifier)
+	}
+	switch cfg.AutoMergeMode {
+	case "", "merge", "auto":
+	default:
+		return nil, fmt.Errorf("invalid AUTOMERGE_MODE %q: must be merge or auto", cfg.AutoMergeMode)
+	}
+	if cfg.AutoMergeMode != "" && len(cfg.AutoMergeRequiredChecks) == 0 {
+		return nil, fmt.Errorf("AUTOMERGE_MODE %q requires at least one AUTOMERGE_REQUIRED_CHECKS entry", cfg.AutoMergeMode)
+	}
+
 	return cfg, nil
 }
 
@@ -63,3 +321,55 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getDuration(key string, fallback time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return d, nil
+}
+
+// getList reads a comma-separated list, dropping empty entries.
+func getList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func getInt(key string, fallback int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return n, nil
+}
+
+func getFloat(key string, fallback float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return f, nil
+}
+
+// GitHubAppConfigured reports whether GitHub App credentials are set.
+func (c *Config) GitHubAppConfigured() bool {
+	return c.GitHubAppID != 0 && c.GitHubAppInstallationID != 0 && c.GitHubAppPrivateKeyPath != ""
+}
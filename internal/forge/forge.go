@@ -0,0 +1,128 @@
+// Package forge abstracts the git hosting service that selfmod pushes
+// branches to and opens pull/merge requests on.
+package forge
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/yuki/flyagi/internal/git"
+)
+
+// Commit status states.
+const (
+	StatusPending = "pending"
+	StatusSuccess = "success"
+	StatusFailure = "failure"
+)
+
+// Forge is a git hosting service such as GitHub, GitLab or Gitea.
+type Forge interface {
+	// Name returns the forge identifier.
+	Name() string
+	// CloneURL returns the HTTPS clone URL of the repository.
+	CloneURL() string
+	// CreatePR opens a pull request (merge request on GitLab).
+	CreatePR(ctx context.Context, opts PROptions) (*PullRequest, error)
+	// Comment posts a comment on a pull request or issue.
+	Comment(ctx context.Context, number int, body string) error
+	// SetStatus reports a commit status on sha.
+	SetStatus(ctx context.Context, sha string, status Status) error
+	// PRState reports whether a pull request is PROpen, PRMerged or
+	// PRClosed.
+	PRState(ctx context.Context, number int) (string, error)
+}
+
+// Pull request states reported by PRState.
+const (
+	PROpen   = "open"
+	PRMerged = "merged"
+	PRClosed = "closed" // closed without merging
+)
+
+// PROptions configures a new pull request.
+type PROptions struct {
+	Title     string
+	Body      string
+	Head      string
+	Base      string
+	Draft     bool
+	Labels    []string
+	Assignees []string
+	Reviewers []string
+}
+
+// PullRequest identifies a created pull request.
+type PullRequest struct {
+	Number int
+	URL    string
+}
+
+// Status is a commit status reported to the forge.
+type Status struct {
+	State       string // StatusPending, StatusSuccess or StatusFailure
+	Context     string
+	Description string
+	TargetURL   string
+}
+
+// Config selects and configures a forge.
+type Config struct {
+	Type    string // "github", "gitlab" or "gitea"
+	BaseURL string // web URL of the instance; empty uses the public service
+	Token   string
+	Owner   string
+	Repo    string
+	// TokenSource replaces Token on GitHub, e.g. for GitHub App
+	// installation tokens.
+	TokenSource git.TokenSource
+}
+
+// New creates the forge selected by cfg.Type.
+func New(cfg Config) (Forge, error) {
+	switch cfg.Type {
+	case "", "github":
+		if cfg.TokenSource != nil {
+			return NewGitHubWithTokenSource(cfg.BaseURL, cfg.TokenSource, cfg.Owner, cfg.Repo)
+		}
+		return NewGitHub(cfg.BaseURL, cfg.Token, cfg.Owner, cfg.Repo)
+	case "gitlab":
+		return NewGitLab(cfg.BaseURL, cfg.Token, cfg.Owner, cfg.Repo), nil
+	case "gitea":
+		if cfg.BaseURL == "" {
+			return nil, fmt.Errorf("gitea forge requires a base URL")
+		}
+		return NewGitea(cfg.BaseURL, cfg.Token, cfg.Owner, cfg.Repo), nil
+	default:
+		return nil, fmt.Errorf("unknown forge type %q", cfg.Type)
+	}
+}
+
+func prState(open, merged bool) string {
+	switch {
+	case open:
+		return PROpen
+	case merged:
+		return PRMerged
+	}
+	return PRClosed
+}
+
+func cloneURL(baseURL, owner, repo string) string {
+	return fmt.Sprintf("%s/%s/%s.git", strings.TrimSuffix(baseURL, "/"), owner, repo)
+}
+
+// SSHCloneURL converts an HTTPS clone URL into the scp-style SSH form
+// (git@host:owner/repo.git) accepted by GitHub, GitLab and Gitea.
+func SSHCloneURL(httpsURL, user string) (string, error) {
+	u, err := url.Parse(httpsURL)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid clone URL %q", httpsURL)
+	}
+	if user == "" {
+		user = "git"
+	}
+	return fmt.Sprintf("%s@%s:%s", user, u.Hostname(), strings.TrimPrefix(u.Path, "/")), nil
+}
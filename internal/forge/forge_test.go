@@ -0,0 +1,202 @@
+package forge_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/yuki/flyagi/internal/forge"
+)
+
+// recorder is an httptest stand-in that records requests and serves canned
+// JSON responses keyed by "METHOD escaped-path".
+type recorder struct {
+	t         *testing.T
+	responses map[string]string
+	bodies    map[string]map[string]any
+	headers   map[string]http.Header
+}
+
+func newRecorder(t *testing.T, responses map[string]string) (*recorder, *httptest.Server) {
+	rec := &recorder{
+		t:         t,
+		responses: responses,
+		bodies:    make(map[string]map[string]any),
+		headers:   make(map[string]http.Header),
+	}
+	srv := httptest.NewServer(rec)
+	t.Cleanup(srv.Close)
+	return rec, srv
+}
+
+func (rec *recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Method + " " + r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		key += "?" + r.URL.RawQuery
+	}
+
+	resp, ok := rec.responses[key]
+	if !ok {
+		rec.t.Errorf("unexpected request: %s", key)
+		http.NotFound(w, r)
+		return
+	}
+
+	var body map[string]any
+	json.NewDecoder(r.Body).Decode(&body)
+	rec.bodies[key] = body
+	rec.headers[key] = r.Header.Clone()
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusCreated)
+	}
+	w.Write([]byte(resp))
+}
+
+func exercise(t *testing.T, f forge.Forge) *forge.PullRequest {
+	t.Helper()
+	ctx := context.Background()
+
+	pr, err := f.CreatePR(ctx, forge.PROptions{
+		Title:     "Add feature",
+		Body:      "body",
+		Head:      "selfmod/abcd1234",
+		Base:      "main",
+		Draft:     true,
+		Labels:    []string{"flyagi"},
+		Assignees: []string{"alice"},
+		Reviewers: []string{"bob"},
+	})
+	if err != nil {
+		t.Fatalf("CreatePR failed: %v", err)
+	}
+	if err := f.Comment(ctx, pr.Number, "pushed"); err != nil {
+		t.Fatalf("Comment failed: %v", err)
+	}
+	err = f.SetStatus(ctx, "deadbeef", forge.Status{State: forge.StatusFailure, Context: "flyagi/selfmod", Description: "checks failed"})
+	if err != nil {
+		t.Fatalf("SetStatus failed: %v", err)
+	}
+	if state, err := f.PRState(ctx, pr.Number); err != nil || state != forge.PRMerged {
+		t.Errorf("PRState = %q, %v; want merged", state, err)
+	}
+	return pr
+}
+
+func TestGitHub(t *testing.T) {
+	rec, srv := newRecorder(t, map[string]string{
+		"POST /api/v3/repos/acme/app/pulls":                        `{"number":12,"html_url":"https://gh.example/acme/app/pull/12"}`,
+		"POST /api/v3/repos/acme/app/issues/12/labels":             `[]`,
+		"POST /api/v3/repos/acme/app/issues/12/assignees":          `{}`,
+		"POST /api/v3/repos/acme/app/pulls/12/requested_reviewers": `{}`,
+		"POST /api/v3/repos/acme/app/issues/12/comments":           `{}`,
+		"POST /api/v3/repos/acme/app/statuses/deadbeef":            `{}`,
+		"GET /api/v3/repos/acme/app/pulls/12":                      `{"state":"closed","merged":true}`,
+	})
+
+	f, err := forge.New(forge.Config{Type: "github", BaseURL: srv.URL, Token: "tok", Owner: "acme", Repo: "app"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if got := f.CloneURL(); got != srv.URL+"/acme/app.git" {
+		t.Errorf("unexpected clone URL %q", got)
+	}
+
+	pr := exercise(t, f)
+	if pr.Number != 12 || pr.URL != "https://gh.example/acme/app/pull/12" {
+		t.Errorf("unexpected PR %+v", pr)
+	}
+
+	create := rec.bodies["POST /api/v3/repos/acme/app/pulls"]
+	if create["draft"] != true || create["head"] != "selfmod/abcd1234" {
+		t.Errorf("unexpected create body %v", create)
+	}
+	if got := rec.headers["POST /api/v3/repos/acme/app/pulls"].Get("Authorization"); got != "Bearer tok" {
+		t.Errorf("unexpected auth header %q", got)
+	}
+	if got := rec.bodies["POST /api/v3/repos/acme/app/statuses/deadbeef"]["state"]; got != "failure" {
+		t.Errorf("unexpected status state %v", got)
+	}
+}
+
+func TestGitLab(t *testing.T) {
+	rec, srv := newRecorder(t, map[string]string{
+		"GET /api/v4/users?username=alice":                        `[{"id":3}]`,
+		"GET /api/v4/users?username=bob":                          `[{"id":4}]`,
+		"POST /api/v4/projects/acme%2Fapp/merge_requests":         `{"iid":7,"web_url":"https://gl.example/acme/app/-/merge_requests/7"}`,
+		"POST /api/v4/projects/acme%2Fapp/merge_requests/7/notes": `{}`,
+		"POST /api/v4/projects/acme%2Fapp/statuses/deadbeef":      `{}`,
+		"GET /api/v4/projects/acme%2Fapp/merge_requests/7":        `{"state":"merged"}`,
+	})
+
+	f, err := forge.New(forge.Config{Type: "gitlab", BaseURL: srv.URL, Token: "tok", Owner: "acme", Repo: "app"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if got := f.CloneURL(); got != srv.URL+"/acme/app.git" {
+		t.Errorf("unexpected clone URL %q", got)
+	}
+
+	pr := exercise(t, f)
+	if pr.Number != 7 {
+		t.Errorf("unexpected MR %+v", pr)
+	}
+
+	create := rec.bodies["POST /api/v4/projects/acme%2Fapp/merge_requests"]
+	if create["title"] != "Draft: Add feature" || create["source_branch"] != "selfmod/abcd1234" || create["labels"] != "flyagi" {
+		t.Errorf("unexpected create body %v", create)
+	}
+	if ids, _ := create["reviewer_ids"].([]any); len(ids) != 1 || ids[0] != float64(4) {
+		t.Errorf("unexpected reviewer ids %v", create["reviewer_ids"])
+	}
+	if got := rec.headers["POST /api/v4/projects/acme%2Fapp/merge_requests"].Get("PRIVATE-TOKEN"); got != "tok" {
+		t.Errorf("unexpected token header %q", got)
+	}
+	if got := rec.bodies["POST /api/v4/projects/acme%2Fapp/statuses/deadbeef"]["state"]; got != "failed" {
+		t.Errorf("unexpected status state %v", got)
+	}
+}
+
+func TestGitea(t *testing.T) {
+	rec, srv := newRecorder(t, map[string]string{
+		"GET /api/v1/repos/acme/app/labels?limit=100":             `[{"id":5,"name":"flyagi"},{"id":6,"name":"bug"}]`,
+		"POST /api/v1/repos/acme/app/pulls":                       `{"number":3,"html_url":"https://gitea.example/acme/app/pulls/3"}`,
+		"POST /api/v1/repos/acme/app/pulls/3/requested_reviewers": `{}`,
+		"POST /api/v1/repos/acme/app/issues/3/comments":           `{}`,
+		"POST /api/v1/repos/acme/app/statuses/deadbeef":           `{}`,
+		"GET /api/v1/repos/acme/app/pulls/3":                      `{"state":"closed","merged":true}`,
+	})
+
+	f, err := forge.New(forge.Config{Type: "gitea", BaseURL: srv.URL, Token: "tok", Owner: "acme", Repo: "app"})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	pr := exercise(t, f)
+	if pr.Number != 3 {
+		t.Errorf("unexpected PR %+v", pr)
+	}
+
+	create := rec.bodies["POST /api/v1/repos/acme/app/pulls"]
+	if create["title"] != "WIP: Add feature" || create["base"] != "main" {
+		t.Errorf("unexpected create body %v", create)
+	}
+	if ids, _ := create["labels"].([]any); len(ids) != 1 || ids[0] != float64(5) {
+		t.Errorf("unexpected label ids %v", create["labels"])
+	}
+	if got := rec.headers["POST /api/v1/repos/acme/app/pulls"].Get("Authorization"); got != "token tok" {
+		t.Errorf("unexpected auth header %q", got)
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	if _, err := forge.New(forge.Config{Type: "bitbucket"}); err == nil {
+		t.Error("expected error for unknown forge type")
+	}
+	if _, err := forge.New(forge.Config{Type: "gitea"}); err == nil {
+		t.Error("expected error for gitea without base URL")
+	}
+}
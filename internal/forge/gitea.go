@@ -0,0 +1,149 @@
+package forge
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Gitea implements Forge for Gitea and Forgejo instances.
+type Gitea struct {
+	api     *apiClient
+	baseURL string
+	owner   string
+	repo    string
+}
+
+// NewGitea creates a Gitea forge for the instance at baseURL.
+func NewGitea(baseURL, token, owner, repo string) *Gitea {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	return &Gitea{
+		api: &apiClient{
+			client:  &http.Client{},
+			baseURL: baseURL + "/api/v1",
+			header:  "Authorization",
+			token:   "token " + token,
+		},
+		baseURL: baseURL,
+		owner:   owner,
+		repo:    repo,
+	}
+}
+
+func (g *Gitea) Name() string { return "gitea" }
+
+func (g *Gitea) CloneURL() string { return cloneURL(g.baseURL, g.owner, g.repo) }
+
+func (g *Gitea) repoPath() string {
+	return "/repos/" + g.owner + "/" + g.repo
+}
+
+// CreatePR opens a pull request. Draft pull requests are marked with the
+// "WIP:" title prefix.
+func (g *Gitea) CreatePR(ctx context.Context, opts PROptions) (*PullRequest, error) {
+	title := opts.Title
+	if opts.Draft {
+		title = "WIP: " + title
+	}
+
+	req := map[string]any{
+		"title": title,
+		"body":  opts.Body,
+		"head":  opts.Head,
+		"base":  opts.Base,
+	}
+	if len(opts.Assignees) > 0 {
+		req["assignees"] = opts.Assignees
+	}
+	if ids := g.labelIDs(ctx, opts.Labels); len(ids) > 0 {
+		req["labels"] = ids
+	}
+
+	var pr struct {
+		Number  int    `json:"number"`
+		HTMLURL string `json:"html_url"`
+	}
+	if err := g.api.do(ctx, http.MethodPost, g.repoPath()+"/pulls", req, &pr); err != nil {
+		return nil, fmt.Errorf("failed to create PR: %w", err)
+	}
+
+	if len(opts.Reviewers) > 0 {
+		path := fmt.Sprintf("%s/pulls/%d/requested_reviewers", g.repoPath(), pr.Number)
+		if err := g.api.do(ctx, http.MethodPost, path, map[string][]string{"reviewers": opts.Reviewers}, nil); err != nil {
+			slog.Warn("failed to request PR reviewers", "number", pr.Number, "error", err)
+		}
+	}
+
+	slog.Info("created pull request", "number", pr.Number, "url", pr.HTMLURL)
+	return &PullRequest{Number: pr.Number, URL: pr.HTMLURL}, nil
+}
+
+func (g *Gitea) Comment(ctx context.Context, number int, body string) error {
+	path := fmt.Sprintf("%s/issues/%d/comments", g.repoPath(), number)
+	if err := g.api.do(ctx, http.MethodPost, path, map[string]string{"body": body}, nil); err != nil {
+		return fmt.Errorf("failed to comment on #%d: %w", number, err)
+	}
+	return nil
+}
+
+func (g *Gitea) SetStatus(ctx context.Context, sha string, status Status) error {
+	req := map[string]string{
+		"state":       status.State,
+		"context":     status.Context,
+		"description": status.Description,
+	}
+	if status.TargetURL != "" {
+		req["target_url"] = status.TargetURL
+	}
+	if err := g.api.do(ctx, http.MethodPost, g.repoPath()+"/statuses/"+sha, req, nil); err != nil {
+		return fmt.Errorf("failed to set status on %s: %w", sha, err)
+	}
+	return nil
+}
+
+func (g *Gitea) PRState(ctx context.Context, number int) (string, error) {
+	var pr struct {
+		State  string `json:"state"` // open or closed
+		Merged bool   `json:"merged"`
+	}
+	path := fmt.Sprintf("%s/pulls/%d", g.repoPath(), number)
+	if err := g.api.do(ctx, http.MethodGet, path, nil, &pr); err != nil {
+		return "", fmt.Errorf("failed to get #%d: %w", number, err)
+	}
+	return prState(pr.State == "open", pr.Merged), nil
+}
+
+// labelIDs resolves label names to Gitea label IDs. Unknown labels are
+// logged and skipped.
+func (g *Gitea) labelIDs(ctx context.Context, names []string) []int64 {
+	if len(names) == 0 {
+		return nil
+	}
+
+	var labels []struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := g.api.do(ctx, http.MethodGet, g.repoPath()+"/labels?limit=100", nil, &labels); err != nil {
+		slog.Warn("failed to list gitea labels", "error", err)
+		return nil
+	}
+
+	var ids []int64
+	for _, name := range names {
+		found := false
+		for _, l := range labels {
+			if strings.EqualFold(l.Name, name) {
+				ids = append(ids, l.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			slog.Warn("gitea label not found", "label", name)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,75 @@
+package forge
+
+import (
+	"context"
+
+	"github.com/yuki/flyagi/internal/git"
+	"github.com/yuki/flyagi/internal/github"
+)
+
+// GitHub implements Forge for github.com and GitHub Enterprise Server.
+type GitHub struct {
+	client  *github.Client
+	baseURL string
+	owner   string
+	repo    string
+}
+
+// NewGitHub creates a GitHub forge. An empty baseURL targets github.com.
+func NewGitHub(baseURL, token, owner, repo string) (*GitHub, error) {
+	return NewGitHubWithTokenSource(baseURL, github.StaticToken(token), owner, repo)
+}
+
+// NewGitHubWithTokenSource creates a GitHub forge that authenticates with
+// the current token of ts, such as a GitHub App installation token.
+func NewGitHubWithTokenSource(baseURL string, ts git.TokenSource, owner, repo string) (*GitHub, error) {
+	client, err := github.NewClientWithTokenSource(baseURL, ts, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	if baseURL == "" {
+		baseURL = "https://github.com"
+	}
+	return &GitHub{client: client, baseURL: baseURL, owner: owner, repo: repo}, nil
+}
+
+// Client returns the underlying GitHub API client for GitHub-only features
+// such as webhooks, issues and auto-merge.
+func (g *GitHub) Client() *github.Client { return g.client }
+
+func (g *GitHub) Name() string { return "github" }
+
+func (g *GitHub) CloneURL() string { return cloneURL(g.baseURL, g.owner, g.repo) }
+
+func (g *GitHub) CreatePR(ctx context.Context, opts PROptions) (*PullRequest, error) {
+	pr, err := g.client.CreatePR(ctx, github.PROptions{
+		Title:     opts.Title,
+		Body:      opts.Body,
+		Head:      opts.Head,
+		Base:      opts.Base,
+		Draft:     opts.Draft,
+		Labels:    opts.Labels,
+		Assignees: opts.Assignees,
+		Reviewers: opts.Reviewers,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PullRequest{Number: pr.Number, URL: pr.URL}, nil
+}
+
+func (g *GitHub) Comment(ctx context.Context, number int, body string) error {
+	return g.client.CreateComment(ctx, number, body)
+}
+
+func (g *GitHub) SetStatus(ctx context.Context, sha string, status Status) error {
+	return g.client.SetStatus(ctx, sha, status.State, status.Context, status.Description, status.TargetURL)
+}
+
+func (g *GitHub) PRState(ctx context.Context, number int) (string, error) {
+	open, merged, err := g.client.PRStatus(ctx, number)
+	if err != nil {
+		return "", err
+	}
+	return prState(open, merged), nil
+}
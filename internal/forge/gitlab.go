@@ -0,0 +1,139 @@
+package forge
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// GitLab implements Forge for gitlab.com and self-managed GitLab.
+type GitLab struct {
+	api     *apiClient
+	baseURL string
+	owner   string
+	repo    string
+}
+
+// NewGitLab creates a GitLab forge. An empty baseURL targets gitlab.com.
+// Owner may be a nested group path such as "team/backend".
+func NewGitLab(baseURL, token, owner, repo string) *GitLab {
+	if baseURL == "" {
+		baseURL = "https://gitlab.com"
+	}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	return &GitLab{
+		api: &apiClient{
+			client:  &http.Client{},
+			baseURL: baseURL + "/api/v4",
+			header:  "PRIVATE-TOKEN",
+			token:   token,
+		},
+		baseURL: baseURL,
+		owner:   owner,
+		repo:    repo,
+	}
+}
+
+func (g *GitLab) Name() string { return "gitlab" }
+
+func (g *GitLab) CloneURL() string { return cloneURL(g.baseURL, g.owner, g.repo) }
+
+func (g *GitLab) project() string {
+	return "/projects/" + url.PathEscape(g.owner+"/"+g.repo)
+}
+
+// CreatePR opens a merge request. Draft merge requests are marked with the
+// "Draft:" title prefix.
+func (g *GitLab) CreatePR(ctx context.Context, opts PROptions) (*PullRequest, error) {
+	title := opts.Title
+	if opts.Draft {
+		title = "Draft: " + title
+	}
+
+	req := map[string]any{
+		"source_branch": opts.Head,
+		"target_branch": opts.Base,
+		"title":         title,
+		"description":   opts.Body,
+	}
+	if len(opts.Labels) > 0 {
+		req["labels"] = strings.Join(opts.Labels, ",")
+	}
+	if ids := g.userIDs(ctx, opts.Assignees); len(ids) > 0 {
+		req["assignee_ids"] = ids
+	}
+	if ids := g.userIDs(ctx, opts.Reviewers); len(ids) > 0 {
+		req["reviewer_ids"] = ids
+	}
+
+	var mr struct {
+		IID    int    `json:"iid"`
+		WebURL string `json:"web_url"`
+	}
+	if err := g.api.do(ctx, http.MethodPost, g.project()+"/merge_requests", req, &mr); err != nil {
+		return nil, fmt.Errorf("failed to create merge request: %w", err)
+	}
+
+	slog.Info("created merge request", "iid", mr.IID, "url", mr.WebURL)
+	return &PullRequest{Number: mr.IID, URL: mr.WebURL}, nil
+}
+
+func (g *GitLab) Comment(ctx context.Context, number int, body string) error {
+	path := fmt.Sprintf("%s/merge_requests/%d/notes", g.project(), number)
+	if err := g.api.do(ctx, http.MethodPost, path, map[string]string{"body": body}, nil); err != nil {
+		return fmt.Errorf("failed to comment on !%d: %w", number, err)
+	}
+	return nil
+}
+
+func (g *GitLab) SetStatus(ctx context.Context, sha string, status Status) error {
+	state := status.State
+	if state == StatusFailure {
+		state = "failed"
+	}
+
+	req := map[string]string{
+		"state":       state,
+		"name":        status.Context,
+		"description": status.Description,
+	}
+	if status.TargetURL != "" {
+		req["target_url"] = status.TargetURL
+	}
+	if err := g.api.do(ctx, http.MethodPost, g.project()+"/statuses/"+sha, req, nil); err != nil {
+		return fmt.Errorf("failed to set status on %s: %w", sha, err)
+	}
+	return nil
+}
+
+func (g *GitLab) PRState(ctx context.Context, number int) (string, error) {
+	var mr struct {
+		State string `json:"state"` // opened, closed, locked or merged
+	}
+	path := fmt.Sprintf("%s/merge_requests/%d", g.project(), number)
+	if err := g.api.do(ctx, http.MethodGet, path, nil, &mr); err != nil {
+		return "", fmt.Errorf("failed to get !%d: %w", number, err)
+	}
+	return prState(mr.State == "opened" || mr.State == "locked", mr.State == "merged"), nil
+}
+
+// userIDs resolves usernames to GitLab user IDs. Unknown users are logged
+// and skipped.
+func (g *GitLab) userIDs(ctx context.Context, usernames []string) []int {
+	var ids []int
+	for _, name := range usernames {
+		var users []struct {
+			ID int `json:"id"`
+		}
+		err := g.api.do(ctx, http.MethodGet, "/users?username="+url.QueryEscape(name), nil, &users)
+		if err != nil || len(users) == 0 {
+			slog.Warn("gitlab user not found", "username", name, "error", err)
+			continue
+		}
+		ids = append(ids, users[0].ID)
+	}
+	return ids
+}
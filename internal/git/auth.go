@@ -0,0 +1,72 @@
+package git
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+// Auth supplies credentials for operations against the remote.
+type Auth interface {
+	// Method returns the transport credentials for the next remote operation.
+	Method(ctx context.Context) (transport.AuthMethod, error)
+}
+
+// TokenSource returns a bearer token that may change over time, such as a
+// GitHub App installation token.
+type TokenSource interface {
+	Token(ctx context.Context) (string, error)
+}
+
+// TokenAuth authenticates over HTTPS with a token as the basic auth password.
+type TokenAuth struct {
+	Username string // defaults to "x-access-token"
+	Source   TokenSource
+}
+
+func (a *TokenAuth) Method(ctx context.Context) (transport.AuthMethod, error) {
+	token, err := a.Source.Token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get git token: %w", err)
+	}
+
+	username := a.Username
+	if username == "" {
+		username = "x-access-token"
+	}
+	return &http.BasicAuth{Username: username, Password: token}, nil
+}
+
+// SSHAuth authenticates with an SSH deploy key. Host keys are verified
+// against a known_hosts file; unknown hosts are rejected.
+type SSHAuth struct {
+	keys *ssh.PublicKeys
+}
+
+// NewSSHAuth loads a private key and the known_hosts file used to verify
+// the remote host.
+func NewSSHAuth(user, keyPath, passphrase, knownHostsPath string) (*SSHAuth, error) {
+	if knownHostsPath == "" {
+		return nil, fmt.Errorf("ssh auth requires a known_hosts file")
+	}
+
+	keys, err := ssh.NewPublicKeysFromFile(user, keyPath, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ssh key: %w", err)
+	}
+
+	callback, err := ssh.NewKnownHostsCallback(knownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known_hosts: %w", err)
+	}
+	keys.HostKeyCallback = callback
+
+	return &SSHAuth{keys: keys}, nil
+}
+
+func (a *SSHAuth) Method(context.Context) (transport.AuthMethod, error) {
+	return a.keys, nil
+}
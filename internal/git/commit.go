@@ -0,0 +1,108 @@
+package git
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Identity is the author and committer of selfmod commits.
+type Identity struct {
+	Name  string
+	Email string
+}
+
+// DefaultIdentity is used when no commit identity is configured.
+var DefaultIdentity = Identity{Name: "FlyAGI", Email: "flyagi@bot.local"}
+
+// Trailer is a "Key: value" line at the end of a commit message.
+type Trailer struct {
+	Key   string
+	Value string
+}
+
+// CoAuthor returns a Co-authored-by trailer crediting id.
+func CoAuthor(id Identity) Trailer {
+	return Trailer{Key: "Co-authored-by", Value: fmt.Sprintf("%s <%s>", id.Name, id.Email)}
+}
+
+const (
+	maxSubjectLen = 72
+	bodyWidth     = 72
+)
+
+// CommitMessage is a structured commit message: a single-line subject, a
+// wrapped body and a block of trailers.
+type CommitMessage struct {
+	Subject  string
+	Body     string
+	Trailers []Trailer
+}
+
+// String formats the message the way git expects it.
+func (m CommitMessage) String() string {
+	parts := []string{Subject(m.Subject)}
+	if body := strings.TrimSpace(m.Body); body != "" {
+		parts = append(parts, Wrap(body, bodyWidth))
+	}
+	if len(m.Trailers) > 0 {
+		lines := make([]string, len(m.Trailers))
+		for i, t := range m.Trailers {
+			lines[i] = t.Key + ": " + t.Value
+		}
+		parts = append(parts, strings.Join(lines, "\n"))
+	}
+	return strings.Join(parts, "\n\n") + "\n"
+}
+
+// Subject reduces s to its first line, truncated to 72 characters.
+func Subject(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	r := []rune(s)
+	if len(r) > maxSubjectLen {
+		return string(r[:maxSubjectLen-3]) + "..."
+	}
+	return s
+}
+
+// Wrap re-flows each paragraph of s to width columns. Lines that start
+// with list markers, quotes or indentation are kept as they are.
+func Wrap(s string, width int) string {
+	var out []string
+	for _, para := range strings.Split(s, "\n\n") {
+		out = append(out, wrapParagraph(para, width))
+	}
+	return strings.Join(out, "\n\n")
+}
+
+func wrapParagraph(para string, width int) string {
+	lines := strings.Split(para, "\n")
+	for _, l := range lines {
+		if isPreformatted(l) {
+			return para
+		}
+	}
+
+	var b strings.Builder
+	col := 0
+	for _, word := range strings.Fields(para) {
+		n := len([]rune(word))
+		if col > 0 && col+1+n > width {
+			b.WriteString("\n")
+			col = 0
+		} else if col > 0 {
+			b.WriteString(" ")
+			col++
+		}
+		b.WriteString(word)
+		col += n
+	}
+	return b.String()
+}
+
+func isPreformatted(line string) bool {
+	return strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* ") ||
+		strings.HasPrefix(line, "> ") || strings.HasPrefix(line, "  ") || strings.HasPrefix(line, "\t")
+}
@@ -0,0 +1,329 @@
+package git_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/yuki/flyagi/internal/git"
+)
+
+func TestCommitMessage_String(t *testing.T) {
+	msg := git.CommitMessage{
+		Subject: "selfmod: " + strings.Repeat("long subject ", 10),
+		Body:    strings.Repeat("word ", 30) + "\n\n- modify main.go\n- create util.go",
+		Trailers: []git.Trailer{
+			{Key: "Change-Request-ID", Value: "abc"},
+			git.CoAuthor(git.Identity{Name: "Yuki", Email: "yuki@example.com"}),
+		},
+	}
+
+	lines := strings.Split(msg.String(), "\n")
+	if len([]rune(lines[0])) > 72 || !strings.HasSuffix(lines[0], "...") {
+		t.Errorf("subject not truncated: %q", lines[0])
+	}
+	if lines[1] != "" {
+		t.Errorf("expected blank line after subject, got %q", lines[1])
+	}
+	for _, l := range lines {
+		if len(l) > 72 {
+			t.Errorf("line exceeds 72 columns: %q", l)
+		}
+	}
+
+	out := msg.String()
+	for _, want := range []string{
+		"\n- modify main.go\n- create util.go\n\n",
+		"\nChange-Request-ID: abc\nCo-authored-by: Yuki <yuki@example.com>\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("message missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestService_CommitAllSigned(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := gogit.PlainInit(dir, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshSigner, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc := git.NewService(dir, nil)
+	if err := svc.CloneOrOpen(""); err != nil {
+		t.Fatal(err)
+	}
+	svc.SetIdentity(git.Identity{Name: "Bot", Email: "bot@example.com"})
+	svc.SetSigner(git.NewSSHSignerFromKey(sshSigner))
+
+	hash, err := svc.CommitAll(git.CommitMessage{Subject: "initial"}.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := gogit.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit.Author.Email != "bot@example.com" || commit.Committer.Name != "Bot" {
+		t.Errorf("unexpected identity: author %v, committer %v", commit.Author, commit.Committer)
+	}
+
+	var payload plumbing.MemoryObject
+	if err := commit.EncodeWithoutSignature(&payload); err != nil {
+		t.Fatal(err)
+	}
+	r, _ := payload.Reader()
+	var content bytes.Buffer
+	content.ReadFrom(r)
+
+	verifySSHSig(t, commit.PGPSignature, content.Bytes(), sshSigner.PublicKey())
+}
+
+// verifySSHSig checks an armored sshsig signature over message.
+func verifySSHSig(t *testing.T, armored string, message []byte, pub ssh.PublicKey) {
+	t.Helper()
+
+	if !strings.HasPrefix(armored, "-----BEGIN SSH SIGNATURE-----\n") {
+		t.Fatalf("not an SSH signature: %q", armored)
+	}
+	b64 := strings.TrimSuffix(strings.TrimPrefix(armored, "-----BEGIN SSH SIGNATURE-----\n"), "-----END SSH SIGNATURE-----\n")
+	blob, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(b64, "\n", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.HasPrefix(blob, []byte("SSHSIG")) {
+		t.Fatal("missing SSHSIG magic")
+	}
+	rest := blob[6+4:] // magic and version
+	var fields [][]byte
+	for len(rest) > 0 {
+		n := binary.BigEndian.Uint32(rest)
+		fields = append(fields, rest[4:4+n])
+		rest = rest[4+n:]
+	}
+	if len(fields) != 5 || string(fields[1]) != "git" || string(fields[3]) != "sha512" {
+		t.Fatalf("unexpected sshsig fields: %q", fields[1:4])
+	}
+	if !bytes.Equal(fields[0], pub.Marshal()) {
+		t.Error("signature embeds the wrong public key")
+	}
+
+	var sig ssh.Signature
+	if err := ssh.Unmarshal(fields[4], &sig); err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha512.Sum512(message)
+	var signed bytes.Buffer
+	signed.WriteString("SSHSIG")
+	for _, f := range [][]byte{[]byte("git"), nil, []byte("sha512"), digest[:]} {
+		binary.Write(&signed, binary.BigEndian, uint32(len(f)))
+		signed.Write(f)
+	}
+	if err := pub.Verify(signed.Bytes(), &sig); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+}
+
+// newRepo creates a repository with one commit per entry of commits, each
+// writing the given files.
+func newRepo(t *testing.T, commits ...map[string]string) (string, *git.Service) {
+	t.Helper()
+	dir := t.TempDir()
+	if _, err := gogit.PlainInit(dir, false); err != nil {
+		t.Fatal(err)
+	}
+
+	svc := git.NewService(dir, nil)
+	if err := svc.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i, files := range commits {
+		for name, content := range files {
+			full := filepath.Join(dir, name)
+			os.MkdirAll(filepath.Dir(full), 0755)
+			if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := svc.CommitAll(git.CommitMessage{Subject: "commit " + string(rune('A'+i))}.String()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, svc
+}
+
+func TestService_Introspection(t *testing.T) {
+	dir, svc := newRepo(t,
+		map[string]string{"main.go": "package main\n", "docs/a.md": "a\n"},
+		map[string]string{"main.go": "package main\n\nfunc main() {}\n"},
+		map[string]string{"docs/a.md": "b\n"},
+	)
+
+	log, err := svc.Log(git.LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 3 || log[0].Subject != "commit C" {
+		t.Fatalf("unexpected log: %+v", log)
+	}
+
+	log, err = svc.Log(git.LogOptions{Path: "main.go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 2 || log[0].Subject != "commit B" {
+		t.Errorf("path filter: got %d commits, first %q", len(log), log[0].Subject)
+	}
+
+	page, err := svc.Log(git.LogOptions{Skip: 1, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 1 || page[0].Subject != "commit B" {
+		t.Errorf("paging: %+v", page)
+	}
+
+	old, err := svc.FileAt("main.go", "HEAD~2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old != "package main\n" {
+		t.Errorf("FileAt(HEAD~2) = %q", old)
+	}
+	if _, err := svc.FileAt("missing.go", ""); !errors.Is(err, git.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for missing file, got %v", err)
+	}
+	if _, err := svc.FileAt("main.go", "nope"); !errors.Is(err, git.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for unknown revision, got %v", err)
+	}
+
+	files, err := svc.Files("HEAD~2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(files, ",") != "docs/a.md,main.go" {
+		t.Errorf("Files(HEAD~2) = %v", files)
+	}
+
+	blame, err := svc.Blame("main.go", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blame) != 3 || blame[0].Hash != log[1].Hash || blame[2].Hash != log[0].Hash {
+		t.Errorf("unexpected blame: %+v", blame)
+	}
+
+	os.WriteFile(filepath.Join(dir, "new.txt"), []byte("x"), 0644)
+	status, err := svc.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Clean || status.Branch != "master" || len(status.Files) != 1 || status.Files[0].Path != "new.txt" {
+		t.Errorf("unexpected status: %+v", status)
+	}
+}
+
+func TestService_Branches(t *testing.T) {
+	dir, svc := newRepo(t, map[string]string{"main.go": "package main\n"})
+
+	for _, name := range []string{"selfmod/aaaa", "selfmod/bbbb", "feature"} {
+		if err := svc.CreateBranch(name, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	branches, err := svc.Branches("selfmod/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(branches, ",") != "selfmod/aaaa,selfmod/bbbb" {
+		t.Errorf("unexpected branches %v", branches)
+	}
+
+	if current, _ := svc.CurrentBranch(); current != "feature" {
+		t.Errorf("CurrentBranch() = %q", current)
+	}
+	if err := svc.DeleteBranch("feature"); err == nil {
+		t.Error("expected the checked out branch to be kept")
+	}
+	if err := svc.DeleteBranch("selfmod/aaaa"); err != nil {
+		t.Fatal(err)
+	}
+	if branches, _ := svc.Branches("selfmod/"); strings.Join(branches, ",") != "selfmod/bbbb" {
+		t.Errorf("unexpected branches after delete %v", branches)
+	}
+
+	os.WriteFile(filepath.Join(dir, "main.go"), []byte("broken"), 0644)
+	if err := svc.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "main.go")); string(data) != "package main\n" {
+		t.Errorf("Discard left %q", data)
+	}
+}
+
+func TestService_BaseBranch(t *testing.T) {
+	dir, svc := newRepo(t, map[string]string{"main.go": "package main\n"})
+
+	if err := svc.CreateBranch("develop", ""); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "dev.go"), []byte("package main\n"), 0644)
+	develop, err := svc.CommitAll("develop work")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.CheckoutMain(); err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := svc.CurrentBranch(); current != "master" {
+		t.Fatalf("CheckoutMain without a base checked out %q", current)
+	}
+
+	svc.SetBaseBranch("develop")
+	if err := svc.CreateBranch("selfmod/aaaa", "develop"); err != nil {
+		t.Fatal(err)
+	}
+	log, err := svc.Log(git.LogOptions{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if log[0].Hash != develop {
+		t.Errorf("branch starts at %s, want the develop tip %s", log[0].Hash, develop)
+	}
+	if err := svc.CheckoutMain(); err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := svc.CurrentBranch(); current != "develop" {
+		t.Errorf("CheckoutMain checked out %q, want develop", current)
+	}
+}
@@ -0,0 +1,289 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// ErrNotFound is returned when a revision or file does not exist.
+var ErrNotFound = errors.New("not found")
+
+// Log paging limits.
+const (
+	DefaultLogLimit = 50
+	MaxLogLimit     = 200
+)
+
+// RepoStatus describes the checked out branch and uncommitted changes.
+type RepoStatus struct {
+	Branch string       `json:"branch"` // empty when HEAD is detached
+	Head   string       `json:"head"`
+	Clean  bool         `json:"clean"`
+	Files  []FileStatus `json:"files"`
+}
+
+// FileStatus is the staging and worktree state of a changed file, using
+// git's short status codes (e.g. "M", "A", "D", "?").
+type FileStatus struct {
+	Path     string `json:"path"`
+	Staging  string `json:"staging"`
+	Worktree string `json:"worktree"`
+}
+
+// CommitInfo summarizes a commit.
+type CommitInfo struct {
+	Hash    string    `json:"hash"`
+	Author  string    `json:"author"`
+	Email   string    `json:"email"`
+	When    time.Time `json:"when"`
+	Subject string    `json:"subject"`
+	Message string    `json:"message"`
+}
+
+// LogOptions filters and pages the commit log.
+type LogOptions struct {
+	Rev   string // defaults to HEAD
+	Path  string // file or directory; empty for all commits
+	Skip  int
+	Limit int // defaults to DefaultLogLimit, capped at MaxLogLimit
+}
+
+// BlameLine attributes a line of a file to the commit that last changed it.
+type BlameLine struct {
+	Line   int       `json:"line"`
+	Hash   string    `json:"hash"`
+	Author string    `json:"author"`
+	Email  string    `json:"email"`
+	When   time.Time `json:"when"`
+	Text   string    `json:"text"`
+}
+
+// Status returns the current branch and the files with uncommitted changes.
+func (s *Service) Status() (*RepoStatus, error) {
+	if s.repo == nil {
+		return nil, fmt.Errorf("repository not initialized")
+	}
+
+	head, err := s.repo.Head()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get HEAD: %w", err)
+	}
+
+	wt, err := s.repo.Worktree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get worktree: %w", err)
+	}
+	st, err := wt.Status()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get status: %w", err)
+	}
+
+	rs := &RepoStatus{Head: head.Hash().String(), Clean: st.IsClean(), Files: []FileStatus{}}
+	if head.Name().IsBranch() {
+		rs.Branch = head.Name().Short()
+	}
+	for p, fs := range st {
+		if fs.Staging == gogit.Unmodified && fs.Worktree == gogit.Unmodified {
+			continue
+		}
+		rs.Files = append(rs.Files, FileStatus{
+			Path:     p,
+			Staging:  string(fs.Staging),
+			Worktree: string(fs.Worktree),
+		})
+	}
+	sort.Slice(rs.Files, func(i, j int) bool { return rs.Files[i].Path < rs.Files[j].Path })
+
+	return rs, nil
+}
+
+// Log lists commits reachable from opts.Rev, newest first.
+func (s *Service) Log(opts LogOptions) ([]CommitInfo, error) {
+	if s.repo == nil {
+		return nil, fmt.Errorf("repository not initialized")
+	}
+
+	from, err := s.resolve(opts.Rev)
+	if err != nil {
+		return nil, err
+	}
+
+	logOpts := &gogit.LogOptions{From: from}
+	if p := cleanPath(opts.Path); p != "" {
+		logOpts.PathFilter = func(f string) bool {
+			return f == p || strings.HasPrefix(f, p+"/")
+		}
+	}
+
+	iter, err := s.repo.Log(logOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read log: %w", err)
+	}
+	defer iter.Close()
+
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultLogLimit
+	}
+	limit = min(limit, MaxLogLimit)
+
+	commits := []CommitInfo{}
+	skipped := 0
+	err = iter.ForEach(func(c *object.Commit) error {
+		if skipped < opts.Skip {
+			skipped++
+			return nil
+		}
+		commits = append(commits, commitInfo(c))
+		if len(commits) == limit {
+			return storer.ErrStop
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read log: %w", err)
+	}
+
+	return commits, nil
+}
+
+// Blame attributes each line of file at rev to the commit that last changed it.
+func (s *Service) Blame(file, rev string) ([]BlameLine, error) {
+	if s.repo == nil {
+		return nil, fmt.Errorf("repository not initialized")
+	}
+
+	commit, err := s.commit(rev)
+	if err != nil {
+		return nil, err
+	}
+
+	p := cleanPath(file)
+	if _, err := commit.File(p); err != nil {
+		return nil, fmt.Errorf("%s at %s: %w", file, commit.Hash.String()[:8], ErrNotFound)
+	}
+
+	result, err := gogit.Blame(commit, p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to blame %s: %w", file, err)
+	}
+
+	lines := make([]BlameLine, len(result.Lines))
+	for i, l := range result.Lines {
+		lines[i] = BlameLine{
+			Line:   i + 1,
+			Hash:   l.Hash.String(),
+			Author: l.AuthorName,
+			Email:  l.Author,
+			When:   l.Date,
+			Text:   l.Text,
+		}
+	}
+	return lines, nil
+}
+
+// FileAt returns the content of file at rev.
+func (s *Service) FileAt(file, rev string) (string, error) {
+	if s.repo == nil {
+		return "", fmt.Errorf("repository not initialized")
+	}
+
+	commit, err := s.commit(rev)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := commit.File(cleanPath(file))
+	if err != nil {
+		return "", fmt.Errorf("%s at %s: %w", file, commit.Hash.String()[:8], ErrNotFound)
+	}
+
+	r, err := f.Reader()
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", file, err)
+	}
+	return string(content), nil
+}
+
+// Files lists the paths of the files in the tree at rev.
+func (s *Service) Files(rev string) ([]string, error) {
+	if s.repo == nil {
+		return nil, fmt.Errorf("repository not initialized")
+	}
+
+	commit, err := s.commit(rev)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := commit.Files()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tree: %w", err)
+	}
+	defer iter.Close()
+
+	var files []string
+	err = iter.ForEach(func(f *object.File) error {
+		files = append(files, f.Name)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tree: %w", err)
+	}
+	return files, nil
+}
+
+func (s *Service) resolve(rev string) (plumbing.Hash, error) {
+	if rev == "" {
+		rev = "HEAD"
+	}
+	hash, err := s.repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("revision %q: %w", rev, ErrNotFound)
+	}
+	return *hash, nil
+}
+
+func (s *Service) commit(rev string) (*object.Commit, error) {
+	hash, err := s.resolve(rev)
+	if err != nil {
+		return nil, err
+	}
+	commit, err := s.repo.CommitObject(hash)
+	if err != nil {
+		return nil, fmt.Errorf("revision %q is not a commit: %w", rev, ErrNotFound)
+	}
+	return commit, nil
+}
+
+func commitInfo(c *object.Commit) CommitInfo {
+	return CommitInfo{
+		Hash:    c.Hash.String(),
+		Author:  c.Author.Name,
+		Email:   c.Author.Email,
+		When:    c.Author.When,
+		Subject: strings.TrimSpace(strings.SplitN(c.Message, "\n", 2)[0]),
+		Message: c.Message,
+	}
+}
+
+// cleanPath normalizes a repository-relative path.
+func cleanPath(p string) string {
+	p = path.Clean("/" + strings.ReplaceAll(p, "\\", "/"))
+	return strings.TrimPrefix(p, "/")
+}
@@ -1,32 +1,55 @@
 package git
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"strings"
 	"time"
 
 	gogit "github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
-	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 )
 
 // Service handles git operations.
 type Service struct {
 	repoPath string
-	token    string
+	auth     Auth
+	identity Identity
+	signer   Signer
+	base     string // branch CheckoutMain returns to; "" tries main, then master
 	repo     *gogit.Repository
 }
 
 // NewService creates a new Git service.
-func NewService(repoPath, token string) *Service {
+func NewService(repoPath string, auth Auth) *Service {
 	return &Service{
 		repoPath: repoPath,
-		token:    token,
+		auth:     auth,
+		identity: DefaultIdentity,
 	}
 }
 
+// SetIdentity sets the author and committer of new commits.
+func (s *Service) SetIdentity(id Identity) {
+	s.identity = id
+}
+
+// SetSigner signs new commits with signer; nil disables signing.
+func (s *Service) SetSigner(signer Signer) {
+	s.signer = signer
+}
+
+// SetBaseBranch sets the branch pull requests are opened against, which
+// CheckoutMain checks out instead of main or master.
+func (s *Service) SetBaseBranch(name string) {
+	s.base = name
+}
+
 // CloneOrOpen clones the repository or opens an existing one.
 func (s *Service) CloneOrOpen(cloneURL string) error {
 	repo, err := gogit.PlainOpen(s.repoPath)
@@ -36,12 +59,14 @@ func (s *Service) CloneOrOpen(cloneURL string) error {
 		return nil
 	}
 
+	auth, err := s.authMethod()
+	if err != nil {
+		return err
+	}
+
 	repo, err = gogit.PlainClone(s.repoPath, false, &gogit.CloneOptions{
-		URL: cloneURL,
-		Auth: &http.BasicAuth{
-			Username: "x-access-token",
-			Password: s.token,
-		},
+		URL:      cloneURL,
+		Auth:     auth,
 		Progress: nil,
 	})
 	if err != nil {
@@ -53,19 +78,32 @@ func (s *Service) CloneOrOpen(cloneURL string) error {
 	return nil
 }
 
-// CreateBranch creates a new branch from the current HEAD.
-func (s *Service) CreateBranch(name string) error {
+// Open opens an existing local repository, e.g. for read-only
+// introspection when no forge is configured.
+func (s *Service) Open() error {
+	repo, err := gogit.PlainOpen(s.repoPath)
+	if err != nil {
+		return fmt.Errorf("failed to open repository: %w", err)
+	}
+	s.repo = repo
+	return nil
+}
+
+// CreateBranch creates a new branch from the tip of base and checks it out.
+// base is fetched from the remote first, if there is one; an empty base
+// branches from the current HEAD.
+func (s *Service) CreateBranch(name, base string) error {
 	if s.repo == nil {
 		return fmt.Errorf("repository not initialized")
 	}
 
-	headRef, err := s.repo.Head()
+	start, err := s.branchTip(base)
 	if err != nil {
-		return fmt.Errorf("failed to get HEAD: %w", err)
+		return err
 	}
 
 	branchRef := plumbing.NewBranchReferenceName(name)
-	ref := plumbing.NewHashReference(branchRef, headRef.Hash())
+	ref := plumbing.NewHashReference(branchRef, start)
 	if err := s.repo.Storer.SetReference(ref); err != nil {
 		return fmt.Errorf("failed to create branch: %w", err)
 	}
@@ -82,7 +120,87 @@ func (s *Service) CreateBranch(name string) error {
 		return fmt.Errorf("failed to checkout branch: %w", err)
 	}
 
-	slog.Info("created and checked out branch", "name", name)
+	slog.Info("created and checked out branch", "name", name, "base", base)
+	return nil
+}
+
+// branchTip returns the commit at the tip of branch: the remote's after
+// fetching it when the repository has an origin, the local one otherwise.
+// An empty branch resolves to HEAD.
+func (s *Service) branchTip(branch string) (plumbing.Hash, error) {
+	if branch == "" {
+		head, err := s.repo.Head()
+		if err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("failed to get HEAD: %w", err)
+		}
+		return head.Hash(), nil
+	}
+
+	refName := plumbing.NewBranchReferenceName(branch)
+	if _, err := s.repo.Remote("origin"); err == nil {
+		if err := s.FetchBranch(branch); err != nil {
+			return plumbing.ZeroHash, err
+		}
+		refName = plumbing.NewRemoteReferenceName("origin", branch)
+	}
+	ref, err := s.repo.Reference(refName, true)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("failed to resolve branch %s: %w", branch, err)
+	}
+	return ref.Hash(), nil
+}
+
+// FetchBranch fetches a branch from the remote into origin/<name> without
+// checking it out.
+func (s *Service) FetchBranch(name string) error {
+	if s.repo == nil {
+		return fmt.Errorf("repository not initialized")
+	}
+
+	auth, err := s.authMethod()
+	if err != nil {
+		return err
+	}
+
+	refSpec := config.RefSpec(fmt.Sprintf("+refs/heads/%s:refs/remotes/origin/%s", name, name))
+	err = s.repo.Fetch(&gogit.FetchOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{refSpec},
+		Auth:       auth,
+	})
+	if err != nil && err != gogit.NoErrAlreadyUpToDate {
+		return fmt.Errorf("failed to fetch branch: %w", err)
+	}
+	return nil
+}
+
+// CheckoutBranch fetches an existing branch from the remote and checks it
+// out, resetting the local branch to the remote head.
+func (s *Service) CheckoutBranch(name string) error {
+	if err := s.FetchBranch(name); err != nil {
+		return err
+	}
+
+	remoteRef, err := s.repo.Reference(plumbing.NewRemoteReferenceName("origin", name), true)
+	if err != nil {
+		return fmt.Errorf("failed to resolve remote branch: %w", err)
+	}
+
+	branchRef := plumbing.NewBranchReferenceName(name)
+	if err := s.repo.Storer.SetReference(plumbing.NewHashReference(branchRef, remoteRef.Hash())); err != nil {
+		return fmt.Errorf("failed to update branch: %w", err)
+	}
+
+	wt, err := s.repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("failed to get worktree: %w", err)
+	}
+
+	if err := wt.Checkout(&gogit.CheckoutOptions{Branch: branchRef, Force: true}); err != nil {
+		return fmt.Errorf("failed to checkout branch: %w", err)
+	}
+
+	slog.Info("checked out existing branch", "name", name, "hash", remoteRef.Hash().String()[:8])
 	return nil
 }
 
@@ -101,35 +219,41 @@ func (s *Service) CommitAll(message string) (string, error) {
 		return "", fmt.Errorf("failed to stage changes: %w", err)
 	}
 
-	hash, err := wt.Commit(message, &gogit.CommitOptions{
-		Author: &object.Signature{
-			Name:  "FlyAGI",
-			Email: "flyagi@bot.local",
-			When:  time.Now(),
-		},
-	})
+	sig := &object.Signature{
+		Name:  s.identity.Name,
+		Email: s.identity.Email,
+		When:  time.Now(),
+	}
+	opts := &gogit.CommitOptions{Author: sig, Committer: sig}
+	if s.signer != nil {
+		opts.Signer = s.signer
+	}
+
+	hash, err := wt.Commit(message, opts)
 	if err != nil {
 		return "", fmt.Errorf("failed to commit: %w", err)
 	}
 
-	slog.Info("committed changes", "hash", hash.String()[:8], "message", message)
+	slog.Info("committed changes", "hash", hash.String()[:8], "subject", Subject(message), "signed", s.signer != nil)
 	return hash.String(), nil
 }
 
-// Push pushes the current branch to the remote.
-func (s *Service) Push(branchName string) error {
+// Push pushes the current branch to the remote. It gives up when ctx ends.
+func (s *Service) Push(ctx context.Context, branchName string) error {
 	if s.repo == nil {
 		return fmt.Errorf("repository not initialized")
 	}
 
+	auth, err := s.authMethod()
+	if err != nil {
+		return err
+	}
+
 	refSpec := config.RefSpec(fmt.Sprintf("refs/heads/%s:refs/heads/%s", branchName, branchName))
-	err := s.repo.Push(&gogit.PushOptions{
+	err = s.repo.PushContext(ctx, &gogit.PushOptions{
 		RemoteName: "origin",
 		RefSpecs:   []config.RefSpec{refSpec},
-		Auth: &http.BasicAuth{
-			Username: "x-access-token",
-			Password: s.token,
-		},
+		Auth:       auth,
 	})
 	if err != nil {
 		return fmt.Errorf("failed to push: %w", err)
@@ -139,7 +263,34 @@ func (s *Service) Push(branchName string) error {
 	return nil
 }
 
-// CheckoutMain checks out the main/master branch.
+// DeleteRemoteBranch deletes a branch from the remote.
+func (s *Service) DeleteRemoteBranch(ctx context.Context, name string) error {
+	if s.repo == nil {
+		return fmt.Errorf("repository not initialized")
+	}
+
+	auth, err := s.authMethod()
+	if err != nil {
+		return err
+	}
+
+	refSpec := config.RefSpec(":refs/heads/" + name)
+	err = s.repo.PushContext(ctx, &gogit.PushOptions{
+		RemoteName: "origin",
+		RefSpecs:   []config.RefSpec{refSpec},
+		Auth:       auth,
+	})
+	if err != nil && !errors.Is(err, gogit.NoErrAlreadyUpToDate) {
+		return fmt.Errorf("failed to delete remote branch: %w", err)
+	}
+
+	slog.Info("deleted remote branch", "name", name)
+	return nil
+}
+
+// CheckoutMain checks out the base branch set by SetBaseBranch, or without
+// one the main/master branch. A base branch that only exists on the remote
+// is created locally from it.
 func (s *Service) CheckoutMain() error {
 	if s.repo == nil {
 		return fmt.Errorf("repository not initialized")
@@ -150,6 +301,23 @@ func (s *Service) CheckoutMain() error {
 		return fmt.Errorf("failed to get worktree: %w", err)
 	}
 
+	if s.base != "" {
+		branchRef := plumbing.NewBranchReferenceName(s.base)
+		if _, err := s.repo.Reference(branchRef, false); err != nil {
+			remote, rerr := s.repo.Reference(plumbing.NewRemoteReferenceName("origin", s.base), true)
+			if rerr != nil {
+				return fmt.Errorf("failed to resolve base branch %s: %w", s.base, rerr)
+			}
+			if err := s.repo.Storer.SetReference(plumbing.NewHashReference(branchRef, remote.Hash())); err != nil {
+				return fmt.Errorf("failed to create base branch: %w", err)
+			}
+		}
+		if err := wt.Checkout(&gogit.CheckoutOptions{Branch: branchRef}); err != nil {
+			return fmt.Errorf("failed to checkout base branch %s: %w", s.base, err)
+		}
+		return nil
+	}
+
 	// Try "main" first, then "master"
 	for _, branch := range []string{"main", "master"} {
 		err = wt.Checkout(&gogit.CheckoutOptions{
@@ -162,3 +330,111 @@ func (s *Service) CheckoutMain() error {
 
 	return fmt.Errorf("failed to checkout main branch: %w", err)
 }
+
+// Pull fast-forwards the current branch from the remote.
+func (s *Service) Pull() error {
+	if s.repo == nil {
+		return fmt.Errorf("repository not initialized")
+	}
+
+	wt, err := s.repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("failed to get worktree: %w", err)
+	}
+	auth, err := s.authMethod()
+	if err != nil {
+		return err
+	}
+
+	head, err := s.repo.Head()
+	if err != nil {
+		return fmt.Errorf("failed to get HEAD: %w", err)
+	}
+
+	// Without a reference name go-git pulls the remote's default branch.
+	err = wt.Pull(&gogit.PullOptions{RemoteName: "origin", ReferenceName: head.Name(), Auth: auth})
+	if err != nil && err != gogit.NoErrAlreadyUpToDate {
+		return fmt.Errorf("failed to pull: %w", err)
+	}
+	return nil
+}
+
+// Branches returns the local branches whose names start with prefix.
+func (s *Service) Branches(prefix string) ([]string, error) {
+	if s.repo == nil {
+		return nil, fmt.Errorf("repository not initialized")
+	}
+
+	iter, err := s.repo.Branches()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list branches: %w", err)
+	}
+	var names []string
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if name := ref.Name().Short(); strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// CurrentBranch returns the checked out branch, or "" when HEAD is detached.
+func (s *Service) CurrentBranch() (string, error) {
+	if s.repo == nil {
+		return "", fmt.Errorf("repository not initialized")
+	}
+
+	head, err := s.repo.Head()
+	if err != nil {
+		return "", fmt.Errorf("failed to get HEAD: %w", err)
+	}
+	if !head.Name().IsBranch() {
+		return "", nil
+	}
+	return head.Name().Short(), nil
+}
+
+// DeleteBranch deletes a local branch. The checked out branch cannot be
+// deleted.
+func (s *Service) DeleteBranch(name string) error {
+	current, err := s.CurrentBranch()
+	if err != nil {
+		return err
+	}
+	if name == current {
+		return fmt.Errorf("branch %s is checked out", name)
+	}
+
+	if err := s.repo.Storer.RemoveReference(plumbing.NewBranchReferenceName(name)); err != nil {
+		return fmt.Errorf("failed to delete branch: %w", err)
+	}
+	slog.Info("deleted branch", "name", name)
+	return nil
+}
+
+// Discard resets the worktree to HEAD, dropping uncommitted changes to
+// tracked files.
+func (s *Service) Discard() error {
+	if s.repo == nil {
+		return fmt.Errorf("repository not initialized")
+	}
+
+	wt, err := s.repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("failed to get worktree: %w", err)
+	}
+	if err := wt.Reset(&gogit.ResetOptions{Mode: gogit.HardReset}); err != nil {
+		return fmt.Errorf("failed to reset worktree: %w", err)
+	}
+	return nil
+}
+
+func (s *Service) authMethod() (transport.AuthMethod, error) {
+	if s.auth == nil {
+		return nil, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return s.auth.Method(ctx)
+}
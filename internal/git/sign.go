@@ -0,0 +1,166 @@
+package git
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Signer signs commit objects. It matches go-git's Signer interface.
+type Signer interface {
+	Sign(message io.Reader) ([]byte, error)
+}
+
+// NewSigner loads a signing key in the given format, "ssh" or "openpgp"
+// (alias "gpg"), as git's gpg.format setting does.
+func NewSigner(format, keyPath, passphrase string) (Signer, error) {
+	switch format {
+	case "ssh":
+		return NewSSHSigner(keyPath, passphrase)
+	case "openpgp", "gpg":
+		return NewGPGSigner(keyPath, passphrase)
+	default:
+		return nil, fmt.Errorf("unknown signing format %q", format)
+	}
+}
+
+// sshSigNamespace is the namespace git uses for SSH commit signatures.
+const sshSigNamespace = "git"
+
+// SSHSigner produces SSH signatures (the sshsig format of ssh-keygen -Y sign).
+type SSHSigner struct {
+	signer ssh.Signer
+}
+
+// NewSSHSigner loads an OpenSSH private key.
+func NewSSHSigner(keyPath, passphrase string) (*SSHSigner, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+
+	var signer ssh.Signer
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+	return &SSHSigner{signer: signer}, nil
+}
+
+// NewSSHSignerFromKey wraps an already loaded key.
+func NewSSHSignerFromKey(signer ssh.Signer) *SSHSigner {
+	return &SSHSigner{signer: signer}
+}
+
+func (s *SSHSigner) Sign(message io.Reader) ([]byte, error) {
+	h := sha512.New()
+	if _, err := io.Copy(h, message); err != nil {
+		return nil, err
+	}
+
+	signed := sshSigBlob(sshSigNamespace, "sha512", h.Sum(nil))
+
+	var sig *ssh.Signature
+	var err error
+	if as, ok := s.signer.(ssh.AlgorithmSigner); ok && s.signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		// ssh-rsa (SHA-1) signatures are rejected by git.
+		sig, err = as.SignWithAlgorithm(rand.Reader, signed, ssh.KeyAlgoRSASHA512)
+	} else {
+		sig, err = s.signer.Sign(rand.Reader, signed)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign commit: %w", err)
+	}
+
+	var blob bytes.Buffer
+	blob.WriteString("SSHSIG")
+	binary.Write(&blob, binary.BigEndian, uint32(1))
+	writeSSHString(&blob, s.signer.PublicKey().Marshal())
+	writeSSHString(&blob, []byte(sshSigNamespace))
+	writeSSHString(&blob, nil)
+	writeSSHString(&blob, []byte("sha512"))
+	writeSSHString(&blob, ssh.Marshal(sig))
+
+	return armorSSHSig(blob.Bytes()), nil
+}
+
+// sshSigBlob builds the data that is actually signed in the sshsig format.
+func sshSigBlob(namespace, hashAlg string, digest []byte) []byte {
+	var b bytes.Buffer
+	b.WriteString("SSHSIG")
+	writeSSHString(&b, []byte(namespace))
+	writeSSHString(&b, nil)
+	writeSSHString(&b, []byte(hashAlg))
+	writeSSHString(&b, digest)
+	return b.Bytes()
+}
+
+func writeSSHString(b *bytes.Buffer, s []byte) {
+	binary.Write(b, binary.BigEndian, uint32(len(s)))
+	b.Write(s)
+}
+
+func armorSSHSig(blob []byte) []byte {
+	enc := base64.StdEncoding.EncodeToString(blob)
+	var b strings.Builder
+	b.WriteString("-----BEGIN SSH SIGNATURE-----\n")
+	for len(enc) > 70 {
+		b.WriteString(enc[:70] + "\n")
+		enc = enc[70:]
+	}
+	b.WriteString(enc + "\n")
+	b.WriteString("-----END SSH SIGNATURE-----\n")
+	return []byte(b.String())
+}
+
+// GPGSigner produces armored OpenPGP detached signatures.
+type GPGSigner struct {
+	entity *openpgp.Entity
+}
+
+// NewGPGSigner loads an armored OpenPGP private key, decrypting it with
+// passphrase when it is protected.
+func NewGPGSigner(keyPath, passphrase string) (*GPGSigner, error) {
+	f, err := os.Open(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	defer f.Close()
+
+	entities, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key: %w", err)
+	}
+	if len(entities) == 0 || entities[0].PrivateKey == nil {
+		return nil, fmt.Errorf("signing key has no private key")
+	}
+
+	entity := entities[0]
+	if passphrase != "" {
+		if err := entity.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+			return nil, fmt.Errorf("failed to decrypt signing key: %w", err)
+		}
+	}
+	return &GPGSigner{entity: entity}, nil
+}
+
+func (s *GPGSigner) Sign(message io.Reader) ([]byte, error) {
+	var b bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&b, s.entity, message, nil); err != nil {
+		return nil, fmt.Errorf("failed to sign commit: %w", err)
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,125 @@
+package github_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yuki/flyagi/internal/github"
+)
+
+func newAppServer(t *testing.T, key *rsa.PrivateKey, ttl time.Duration) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/app/installations/42/access_tokens" {
+			http.NotFound(w, r)
+			return
+		}
+
+		jwt := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		parts := strings.Split(jwt, ".")
+		if len(parts) != 3 {
+			http.Error(w, "malformed jwt", http.StatusUnauthorized)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var c struct {
+			Iss string `json:"iss"`
+		}
+		if err := json.Unmarshal(claims, &c); err != nil || c.Iss != "7" {
+			http.Error(w, "bad issuer", http.StatusUnauthorized)
+			return
+		}
+
+		n := calls.Add(1)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{
+			"token":      fmt.Sprintf("ghs_%d", n),
+			"expires_at": time.Now().Add(ttl).UTC().Format(time.RFC3339),
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func generateKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return key, pemBytes
+}
+
+func TestAppTokenSource_CachesToken(t *testing.T) {
+	key, pemBytes := generateKey(t)
+	srv, calls := newAppServer(t, key, time.Hour)
+
+	ts, err := github.NewAppTokenSource(7, 42, pemBytes, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		token, err := ts.Token(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "ghs_1" {
+			t.Errorf("token = %q, want ghs_1", token)
+		}
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("token requests = %d, want 1", n)
+	}
+}
+
+func TestAppTokenSource_RefreshesNearExpiry(t *testing.T) {
+	key, pemBytes := generateKey(t)
+	srv, calls := newAppServer(t, key, 2*time.Minute)
+
+	ts, err := github.NewAppTokenSource(7, 42, pemBytes, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := ts.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := ts.Token(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second || calls.Load() != 2 {
+		t.Errorf("expected refresh, got %q then %q after %d requests", first, second, calls.Load())
+	}
+}
+
+func TestAppTokenSource_InvalidKey(t *testing.T) {
+	if _, err := github.NewAppTokenSource(7, 42, []byte("not a key"), ""); err == nil {
+		t.Error("expected error for invalid private key")
+	}
+}
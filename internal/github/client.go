@@ -4,8 +4,12 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net/http"
+	"strings"
 
 	gh "github.com/google/go-github/v68/github"
+
+	"github.com/yuki/flyagi/internal/git"
 )
 
 // Client wraps GitHub API operations.
@@ -17,26 +21,136 @@ type Client struct {
 
 // NewClient creates a new GitHub API client.
 func NewClient(token, owner, repo string) *Client {
-	client := gh.NewClient(nil).WithAuthToken(token)
+	client, _ := NewClientWithTokenSource("", StaticToken(token), owner, repo)
+	return client
+}
+
+// NewClientWithTokenSource creates a GitHub API client that authenticates
+// every request with the current token of ts, such as a GitHub App
+// installation token. An empty baseURL targets github.com.
+func NewClientWithTokenSource(baseURL string, ts git.TokenSource, owner, repo string) (*Client, error) {
+	client := gh.NewClient(&http.Client{
+		Transport: &tokenTransport{source: ts, base: http.DefaultTransport},
+	})
+	if baseURL != "" {
+		var err error
+		client, err = client.WithEnterpriseURLs(baseURL, baseURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GitHub Enterprise URL: %w", err)
+		}
+	}
 	return &Client{
 		client: client,
 		owner:  owner,
 		repo:   repo,
-	}
+	}, nil
+}
+
+// PROptions configures a new pull request.
+type PROptions struct {
+	Title     string
+	Body      string
+	Head      string
+	Base      string
+	Draft     bool
+	Labels    []string
+	Assignees []string
+	// Reviewers are user logins; entries of the form "org/team" request a
+	// review from a team.
+	Reviewers []string
 }
 
-// CreatePR creates a pull request.
-func (c *Client) CreatePR(ctx context.Context, title, body, head, base string) (string, error) {
+// PullRequest identifies a created pull request.
+type PullRequest struct {
+	Number int
+	URL    string
+}
+
+// CreatePR creates a pull request. Labels, assignees and reviewers are
+// applied after creation; failures there are logged but do not fail the call.
+func (c *Client) CreatePR(ctx context.Context, opts PROptions) (*PullRequest, error) {
 	pr, _, err := c.client.PullRequests.Create(ctx, c.owner, c.repo, &gh.NewPullRequest{
-		Title: gh.Ptr(title),
-		Body:  gh.Ptr(body),
-		Head:  gh.Ptr(head),
-		Base:  gh.Ptr(base),
+		Title: gh.Ptr(opts.Title),
+		Body:  gh.Ptr(opts.Body),
+		Head:  gh.Ptr(opts.Head),
+		Base:  gh.Ptr(opts.Base),
+		Draft: gh.Ptr(opts.Draft),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create PR: %w", err)
+	}
+	number := pr.GetNumber()
+
+	if len(opts.Labels) > 0 {
+		if _, _, err := c.client.Issues.AddLabelsToIssue(ctx, c.owner, c.repo, number, opts.Labels); err != nil {
+			slog.Warn("failed to add PR labels", "number", number, "error", err)
+		}
+	}
+	if len(opts.Assignees) > 0 {
+		if _, _, err := c.client.Issues.AddAssignees(ctx, c.owner, c.repo, number, opts.Assignees); err != nil {
+			slog.Warn("failed to add PR assignees", "number", number, "error", err)
+		}
+	}
+	if len(opts.Reviewers) > 0 {
+		var req gh.ReviewersRequest
+		for _, r := range opts.Reviewers {
+			if _, team, ok := strings.Cut(r, "/"); ok {
+				req.TeamReviewers = append(req.TeamReviewers, team)
+			} else {
+				req.Reviewers = append(req.Reviewers, r)
+			}
+		}
+		if _, _, err := c.client.PullRequests.RequestReviewers(ctx, c.owner, c.repo, number, req); err != nil {
+			slog.Warn("failed to request PR reviewers", "number", number, "error", err)
+		}
+	}
+
+	slog.Info("created pull request", "number", number, "url", pr.GetHTMLURL(), "draft", opts.Draft)
+	return &PullRequest{Number: number, URL: pr.GetHTMLURL()}, nil
+}
+
+// PRBranch returns the head branch name of a pull request.
+func (c *Client) PRBranch(ctx context.Context, number int) (string, error) {
+	pr, _, err := c.client.PullRequests.Get(ctx, c.owner, c.repo, number)
+	if err != nil {
+		return "", fmt.Errorf("failed to get PR #%d: %w", number, err)
+	}
+	return pr.GetHead().GetRef(), nil
+}
+
+// PRDiff returns the unified diff of a pull request.
+func (c *Client) PRDiff(ctx context.Context, number int) (string, error) {
+	diff, _, err := c.client.PullRequests.GetRaw(ctx, c.owner, c.repo, number, gh.RawOptions{Type: gh.Diff})
+	if err != nil {
+		return "", fmt.Errorf("failed to get diff for PR #%d: %w", number, err)
+	}
+	return diff, nil
+}
+
+// CreateComment posts a comment on an issue or pull request.
+func (c *Client) CreateComment(ctx context.Context, number int, body string) error {
+	_, _, err := c.client.Issues.CreateComment(ctx, c.owner, c.repo, number, &gh.IssueComment{
+		Body: gh.Ptr(body),
 	})
 	if err != nil {
-		return "", fmt.Errorf("failed to create PR: %w", err)
+		return fmt.Errorf("failed to comment on #%d: %w", number, err)
 	}
+	return nil
+}
 
-	slog.Info("created pull request", "number", pr.GetNumber(), "url", pr.GetHTMLURL())
-	return pr.GetHTMLURL(), nil
+// SetStatus sets a commit status on sha. State is one of "pending",
+// "success", "failure" or "error".
+func (c *Client) SetStatus(ctx context.Context, sha, state, statusContext, description, targetURL string) error {
+	status := &gh.RepoStatus{
+		State:       gh.Ptr(state),
+		Context:     gh.Ptr(statusContext),
+		Description: gh.Ptr(description),
+	}
+	if targetURL != "" {
+		status.TargetURL = gh.Ptr(targetURL)
+	}
+	if _, _, err := c.client.Repositories.CreateStatus(ctx, c.owner, c.repo, sha, status); err != nil {
+		return fmt.Errorf("failed to set status on %s: %w", sha, err)
+	}
+	return nil
 }
@@ -0,0 +1,123 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	gh "github.com/google/go-github/v68/github"
+)
+
+// Issue is a GitHub issue that FlyAGI should turn into a change request.
+type Issue struct {
+	Number int
+	Title  string
+	Body   string
+	URL    string
+}
+
+// ListLabeledIssues returns open issues carrying the given label.
+// Pull requests are excluded.
+func (c *Client) ListLabeledIssues(ctx context.Context, label string) ([]Issue, error) {
+	opts := &gh.IssueListByRepoOptions{
+		State:       "open",
+		Labels:      []string{label},
+		ListOptions: gh.ListOptions{PerPage: 100},
+	}
+
+	var issues []Issue
+	for {
+		page, resp, err := c.client.Issues.ListByRepo(ctx, c.owner, c.repo, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list issues: %w", err)
+		}
+		for _, i := range page {
+			if i.IsPullRequest() {
+				continue
+			}
+			issues = append(issues, issueFrom(i))
+		}
+		if resp.NextPage == 0 {
+			return issues, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// HasComment reports whether an issue has a comment containing marker,
+// e.g. CommentMarker once FlyAGI has handled it.
+func (c *Client) HasComment(ctx context.Context, number int, marker string) (bool, error) {
+	opts := &gh.IssueListCommentsOptions{ListOptions: gh.ListOptions{PerPage: 100}}
+	for {
+		comments, resp, err := c.client.Issues.ListComments(ctx, c.owner, c.repo, number, opts)
+		if err != nil {
+			return false, fmt.Errorf("failed to list comments on #%d: %w", number, err)
+		}
+		for _, comment := range comments {
+			if strings.Contains(comment.GetBody(), marker) {
+				return true, nil
+			}
+		}
+		if resp.NextPage == 0 {
+			return false, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// WatchLabeledIssues polls for open issues carrying label every interval and
+// calls fn for each one. It blocks until ctx is cancelled; callers are
+// responsible for ignoring issues they have already handled.
+func (c *Client) WatchLabeledIssues(ctx context.Context, label string, interval time.Duration, fn func(Issue)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		issues, err := c.ListLabeledIssues(ctx, label)
+		if err != nil {
+			slog.Error("issue poll failed", "label", label, "error", err)
+		}
+		for _, issue := range issues {
+			fn(issue)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// IssueFromEvent extracts an issue from an issues event when it was opened,
+// reopened or labeled and carries the given label.
+func IssueFromEvent(event any, label string) (Issue, bool) {
+	e, ok := event.(*gh.IssuesEvent)
+	if !ok {
+		return Issue{}, false
+	}
+
+	switch e.GetAction() {
+	case "opened", "reopened", "labeled":
+	default:
+		return Issue{}, false
+	}
+
+	for _, l := range e.GetIssue().Labels {
+		if strings.EqualFold(l.GetName(), label) {
+			return issueFrom(e.GetIssue()), true
+		}
+	}
+	return Issue{}, false
+}
+
+func issueFrom(i *gh.Issue) Issue {
+	return Issue{
+		Number: i.GetNumber(),
+		Title:  i.GetTitle(),
+		Body:   i.GetBody(),
+		URL:    i.GetHTMLURL(),
+	}
+}
@@ -0,0 +1,238 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	gh "github.com/google/go-github/v68/github"
+)
+
+// Check states reported in PRState.Checks.
+const (
+	CheckSuccess = "success"
+	CheckPending = "pending"
+	CheckFailure = "failure"
+)
+
+// PRFile is a file changed by a pull request.
+type PRFile struct {
+	Path      string
+	Additions int
+	Deletions int
+}
+
+// PRState is the merge-relevant state of a pull request.
+type PRState struct {
+	Number           int
+	NodeID           string
+	State            string // "open" or "closed"
+	Merged           bool
+	Draft            bool
+	HeadSHA          string
+	Files            []PRFile
+	Checks           map[string]string // check or status context name -> Check* state
+	Approvals        int
+	ChangesRequested bool
+}
+
+// Lines returns the total number of added and removed lines.
+func (s *PRState) Lines() int {
+	n := 0
+	for _, f := range s.Files {
+		n += f.Additions + f.Deletions
+	}
+	return n
+}
+
+// GetPRState fetches a pull request together with its changed files, check
+// results for the head commit and review approvals.
+func (c *Client) GetPRState(ctx context.Context, number int) (*PRState, error) {
+	pr, _, err := c.client.PullRequests.Get(ctx, c.owner, c.repo, number)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get PR #%d: %w", number, err)
+	}
+
+	state := &PRState{
+		Number:  number,
+		NodeID:  pr.GetNodeID(),
+		State:   pr.GetState(),
+		Merged:  pr.GetMerged(),
+		Draft:   pr.GetDraft(),
+		HeadSHA: pr.GetHead().GetSHA(),
+		Checks:  make(map[string]string),
+	}
+
+	opts := &gh.ListOptions{PerPage: 100}
+	for {
+		files, resp, err := c.client.PullRequests.ListFiles(ctx, c.owner, c.repo, number, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list files of PR #%d: %w", number, err)
+		}
+		for _, f := range files {
+			state.Files = append(state.Files, PRFile{
+				Path:      f.GetFilename(),
+				Additions: f.GetAdditions(),
+				Deletions: f.GetDeletions(),
+			})
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+
+	// A check that was re-run has a run per attempt; only the newest counts.
+	newest := make(map[string]*gh.CheckRun)
+	runOpts := &gh.ListCheckRunsOptions{ListOptions: gh.ListOptions{PerPage: 100}}
+	for {
+		runs, resp, err := c.client.Checks.ListCheckRunsForRef(ctx, c.owner, c.repo, state.HeadSHA, runOpts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list check runs of PR #%d: %w", number, err)
+		}
+		for _, run := range runs.CheckRuns {
+			if prev, ok := newest[run.GetName()]; !ok || newerRun(run, prev) {
+				newest[run.GetName()] = run
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		runOpts.Page = resp.NextPage
+	}
+	for name, run := range newest {
+		state.Checks[name] = checkRunState(run)
+	}
+
+	combined, _, err := c.client.Repositories.GetCombinedStatus(ctx, c.owner, c.repo, state.HeadSHA, &gh.ListOptions{PerPage: 100})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get statuses of PR #%d: %w", number, err)
+	}
+	for _, st := range combined.Statuses {
+		state.Checks[st.GetContext()] = commitStatusState(st.GetState())
+	}
+
+	// Only the latest review of each reviewer with write access counts.
+	latest := make(map[string]string)
+	opts = &gh.ListOptions{PerPage: 100}
+	for {
+		reviews, resp, err := c.client.PullRequests.ListReviews(ctx, c.owner, c.repo, number, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list reviews of PR #%d: %w", number, err)
+		}
+		for _, r := range reviews {
+			if !trusted(r.GetAuthorAssociation()) {
+				continue
+			}
+			switch r.GetState() {
+			case "APPROVED", "CHANGES_REQUESTED", "DISMISSED":
+				latest[r.GetUser().GetLogin()] = r.GetState()
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	for _, s := range latest {
+		switch s {
+		case "APPROVED":
+			state.Approvals++
+		case "CHANGES_REQUESTED":
+			state.ChangesRequested = true
+		}
+	}
+
+	return state, nil
+}
+
+// newerRun reports whether run started after prev, or, started at the same
+// time, was created after it.
+func newerRun(run, prev *gh.CheckRun) bool {
+	a, b := run.GetStartedAt().Time, prev.GetStartedAt().Time
+	if !a.Equal(b) {
+		return a.After(b)
+	}
+	return run.GetID() > prev.GetID()
+}
+
+// PRStatus reports whether a pull request is open and whether it was
+// merged, without the rest of GetPRState.
+func (c *Client) PRStatus(ctx context.Context, number int) (open, merged bool, err error) {
+	pr, _, err := c.client.PullRequests.Get(ctx, c.owner, c.repo, number)
+	if err != nil {
+		return false, false, fmt.Errorf("failed to get PR #%d: %w", number, err)
+	}
+	return pr.GetState() == "open", pr.GetMerged(), nil
+}
+
+// MergePR merges a pull request, failing if its head no longer matches sha.
+func (c *Client) MergePR(ctx context.Context, number int, method, sha string) error {
+	_, _, err := c.client.PullRequests.Merge(ctx, c.owner, c.repo, number, "", &gh.PullRequestOptions{
+		MergeMethod: method,
+		SHA:         sha,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to merge PR #%d: %w", number, err)
+	}
+
+	slog.Info("merged pull request", "number", number, "method", method)
+	return nil
+}
+
+// EnableAutoMerge turns on GitHub's auto-merge for a pull request so that it
+// is merged once branch protection requirements are met. This is only
+// available through the GraphQL API.
+func (c *Client) EnableAutoMerge(ctx context.Context, nodeID, method string) error {
+	query := struct {
+		Query     string         `json:"query"`
+		Variables map[string]any `json:"variables"`
+	}{
+		Query: `mutation($id: ID!, $method: PullRequestMergeMethod!) {
+  enablePullRequestAutoMerge(input: {pullRequestId: $id, mergeMethod: $method}) { clientMutationId }
+}`,
+		Variables: map[string]any{"id": nodeID, "method": strings.ToUpper(method)},
+	}
+
+	req, err := c.client.NewRequest("POST", "graphql", query)
+	if err != nil {
+		return fmt.Errorf("failed to build auto-merge request: %w", err)
+	}
+
+	var resp struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if _, err := c.client.Do(ctx, req, &resp); err != nil {
+		return fmt.Errorf("failed to enable auto-merge: %w", err)
+	}
+	if len(resp.Errors) > 0 {
+		return fmt.Errorf("failed to enable auto-merge: %s", resp.Errors[0].Message)
+	}
+	return nil
+}
+
+func checkRunState(run *gh.CheckRun) string {
+	if run.GetStatus() != "completed" {
+		return CheckPending
+	}
+	switch run.GetConclusion() {
+	case "success", "neutral", "skipped":
+		return CheckSuccess
+	default:
+		return CheckFailure
+	}
+}
+
+func commitStatusState(state string) string {
+	switch state {
+	case "success":
+		return CheckSuccess
+	case "pending":
+		return CheckPending
+	default:
+		return CheckFailure
+	}
+}
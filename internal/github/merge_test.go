@@ -0,0 +1,77 @@
+package github_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/yuki/flyagi/internal/github"
+)
+
+func TestClient_GetPRState(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	reply := func(w http.ResponseWriter, r *http.Request, next bool, v any) {
+		if next {
+			w.Header().Set("Link", fmt.Sprintf(`<%s%s?page=2>; rel="next"`, srv.URL, r.URL.Path))
+		}
+		json.NewEncoder(w).Encode(v)
+	}
+
+	mux.HandleFunc("GET /api/v3/repos/o/r/pulls/1", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, r, false, map[string]any{"number": 1, "state": "open", "head": map[string]any{"sha": "abc"}})
+	})
+	mux.HandleFunc("GET /api/v3/repos/o/r/pulls/1/files", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, r, false, []any{})
+	})
+	mux.HandleFunc("GET /api/v3/repos/o/r/commits/abc/status", func(w http.ResponseWriter, r *http.Request) {
+		reply(w, r, false, map[string]any{"statuses": []any{}})
+	})
+	// The test was re-run and passed; the failed attempt is on page 2.
+	mux.HandleFunc("GET /api/v3/repos/o/r/commits/abc/check-runs", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			reply(w, r, false, map[string]any{"check_runs": []any{
+				map[string]any{"id": 1, "name": "test", "status": "completed", "conclusion": "failure", "started_at": "2026-01-01T10:00:00Z"},
+				map[string]any{"id": 4, "name": "docs", "status": "completed", "conclusion": "skipped", "started_at": "2026-01-01T11:00:00Z"},
+			}})
+			return
+		}
+		reply(w, r, true, map[string]any{"check_runs": []any{
+			map[string]any{"id": 2, "name": "test", "status": "completed", "conclusion": "success", "started_at": "2026-01-01T11:00:00Z"},
+			map[string]any{"id": 3, "name": "lint", "status": "in_progress", "started_at": "2026-01-01T11:00:00Z"},
+		}})
+	})
+	// Only reviewers with write access count.
+	mux.HandleFunc("GET /api/v3/repos/o/r/pulls/1/reviews", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			reply(w, r, false, []any{
+				map[string]any{"user": map[string]any{"login": "outsider"}, "state": "CHANGES_REQUESTED", "author_association": "NONE"},
+				map[string]any{"user": map[string]any{"login": "owner"}, "state": "APPROVED", "author_association": "OWNER"},
+			})
+			return
+		}
+		reply(w, r, true, []any{
+			map[string]any{"user": map[string]any{"login": "maintainer"}, "state": "APPROVED", "author_association": "MEMBER"},
+			map[string]any{"user": map[string]any{"login": "drive-by"}, "state": "APPROVED", "author_association": "CONTRIBUTOR"},
+		})
+	})
+
+	client, err := github.NewClientWithTokenSource(srv.URL, github.StaticToken("t"), "o", "r")
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := client.GetPRState(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("GetPRState failed: %v", err)
+	}
+	if state.Checks["test"] != github.CheckSuccess || state.Checks["lint"] != github.CheckPending || state.Checks["docs"] != github.CheckSuccess {
+		t.Errorf("checks = %v, want the newest run of each", state.Checks)
+	}
+	if state.Approvals != 2 || state.ChangesRequested {
+		t.Errorf("approvals = %d, changes requested = %v; want the 2 trusted approvals only", state.Approvals, state.ChangesRequested)
+	}
+}
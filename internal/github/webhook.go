@@ -0,0 +1,141 @@
+package github
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	gh "github.com/google/go-github/v68/github"
+)
+
+// CommentMarker is embedded in comments posted by FlyAGI so that webhook
+// deliveries for our own comments can be ignored.
+const CommentMarker = "<!-- flyagi -->"
+
+// FailureMarker is embedded instead of CommentMarker in comments reporting
+// that FlyAGI could not handle an issue, which leaves it to be retried.
+const FailureMarker = "<!-- flyagi:failed -->"
+
+// ErrInvalidSignature is returned by ParseWebhook when a delivery is not
+// signed with the configured secret.
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// ReviewComment is a reviewer comment left on a pull request.
+type ReviewComment struct {
+	PRNumber int
+	Branch   string // head branch; empty when the event does not carry it
+	Author   string
+	Body     string
+	Path     string // set for inline review comments
+	Line     int
+	DiffHunk string
+}
+
+// ParseWebhook verifies the HMAC signature of a webhook delivery and
+// decodes its payload. It returns the event type and the parsed event.
+func ParseWebhook(r *http.Request, secret []byte) (string, any, error) {
+	payload, err := gh.ValidatePayload(r, secret)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+
+	eventType := gh.WebHookType(r)
+	event, err := gh.ParseWebHook(eventType, payload)
+	if err != nil {
+		return eventType, nil, fmt.Errorf("failed to parse %s event: %w", eventType, err)
+	}
+	return eventType, event, nil
+}
+
+// ReviewCommentFromEvent extracts a newly created pull request comment from
+// a pull_request_review_comment or issue_comment event. It reports false for
+// other events, edits and deletions, comments on plain issues, comments
+// written by bots or by FlyAGI itself, and comments by anyone who is not an
+// owner, member or collaborator of the repository, since each comment costs
+// a generation and may push to the pull request.
+func ReviewCommentFromEvent(event any) (ReviewComment, bool) {
+	switch e := event.(type) {
+	case *gh.PullRequestReviewCommentEvent:
+		c := e.GetComment()
+		if e.GetAction() != "created" || !trusted(c.GetAuthorAssociation()) || isOwnComment(c.GetUser(), c.GetBody()) {
+			return ReviewComment{}, false
+		}
+		return ReviewComment{
+			PRNumber: e.GetPullRequest().GetNumber(),
+			Branch:   e.GetPullRequest().GetHead().GetRef(),
+			Author:   c.GetUser().GetLogin(),
+			Body:     c.GetBody(),
+			Path:     c.GetPath(),
+			Line:     c.GetLine(),
+			DiffHunk: c.GetDiffHunk(),
+		}, true
+	case *gh.IssueCommentEvent:
+		c := e.GetComment()
+		if e.GetAction() != "created" || !e.GetIssue().IsPullRequest() || !trusted(c.GetAuthorAssociation()) || isOwnComment(c.GetUser(), c.GetBody()) {
+			return ReviewComment{}, false
+		}
+		return ReviewComment{
+			PRNumber: e.GetIssue().GetNumber(),
+			Author:   c.GetUser().GetLogin(),
+			Body:     c.GetBody(),
+		}, true
+	}
+	return ReviewComment{}, false
+}
+
+// ClosedPRFromEvent extracts the number of a pull request that was closed
+// from a pull_request event, and whether it was merged. It reports false
+// for other events and actions.
+func ClosedPRFromEvent(event any) (number int, merged, ok bool) {
+	e, isPR := event.(*gh.PullRequestEvent)
+	if !isPR || e.GetAction() != "closed" {
+		return 0, false, false
+	}
+	return e.GetPullRequest().GetNumber(), e.GetPullRequest().GetMerged(), true
+}
+
+func isOwnComment(user *gh.User, body string) bool {
+	return user.GetType() == "Bot" || strings.Contains(body, CommentMarker) || strings.Contains(body, FailureMarker)
+}
+
+// trusted reports whether an author_association, of a comment or review,
+// gives its author write access to the repository.
+func trusted(association string) bool {
+	switch association {
+	case "OWNER", "MEMBER", "COLLABORATOR":
+		return true
+	}
+	return false
+}
+
+// Deliveries remembers the IDs of recent webhook deliveries, from the
+// X-GitHub-Delivery header, so redelivered events are handled once.
+type Deliveries struct {
+	mu    sync.Mutex
+	seen  map[string]bool
+	order []string
+	max   int
+}
+
+// NewDeliveries creates a Deliveries that remembers the last n IDs.
+func NewDeliveries(n int) *Deliveries {
+	return &Deliveries{seen: make(map[string]bool), max: n}
+}
+
+// Seen records id and reports whether it had been recorded before.
+func (d *Deliveries) Seen(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seen[id] {
+		return true
+	}
+	d.seen[id] = true
+	d.order = append(d.order, id)
+	if len(d.order) > d.max {
+		delete(d.seen, d.order[0])
+		d.order = d.order[1:]
+	}
+	return false
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package liveupdate
+
+import (
+	"errors"
+	"os"
+)
+
+var errUnsupported = errors.New("live update is not supported on this platform")
+
+func execBinary(string, []string) error { return errUnsupported }
+
+func inheritable(*os.File) error { return errUnsupported }
@@ -0,0 +1,21 @@
+//go:build unix
+
+package liveupdate
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// execBinary replaces the process with binary, keeping the PID.
+func execBinary(binary string, env []string) error {
+	return syscall.Exec(binary, append([]string{binary}, os.Args[1:]...), env)
+}
+
+// inheritable lets f survive exec.
+func inheritable(f *os.File) error {
+	_, err := unix.FcntlInt(f.Fd(), unix.F_SETFD, 0)
+	return err
+}
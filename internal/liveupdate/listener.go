@@ -0,0 +1,129 @@
+package liveupdate
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Environment variables passed to the replacement process.
+const (
+	envListenFD  = "FLYAGI_LISTEN_FD"
+	envPrevious  = "FLYAGI_PREVIOUS_BINARY"
+	envPreflight = "FLYAGI_PREFLIGHT"
+)
+
+// Preflight reports whether this process is a new build started only to be
+// health-checked. It should serve requests but skip background work such
+// as polling and auto-merging.
+func Preflight() bool {
+	return os.Getenv(envPreflight) != ""
+}
+
+// Listener is a TCP listener that can stop accepting without closing the
+// socket, so connections queue up for the process that takes it over.
+type Listener struct {
+	*net.TCPListener
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+	closed bool
+}
+
+// Listen returns the listener handed over by the previous process, or a new
+// one on addr. inherited reports which.
+func Listen(addr string) (l *Listener, inherited bool, err error) {
+	var ln net.Listener
+	if v := os.Getenv(envListenFD); v != "" {
+		os.Unsetenv(envListenFD)
+		fd, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid %s: %w", envListenFD, err)
+		}
+		f := os.NewFile(uintptr(fd), "listener")
+		ln, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to use inherited listener: %w", err)
+		}
+		inherited = true
+	} else if ln, err = net.Listen("tcp", addr); err != nil {
+		return nil, false, err
+	}
+
+	tcp, ok := ln.(*net.TCPListener)
+	if !ok {
+		ln.Close()
+		return nil, false, fmt.Errorf("listener is not TCP")
+	}
+	l = &Listener{TCPListener: tcp}
+	l.cond = sync.NewCond(&l.mu)
+	return l, inherited, nil
+}
+
+// Accept waits while the listener is paused.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		l.mu.Lock()
+		for l.paused && !l.closed {
+			l.cond.Wait()
+		}
+		l.mu.Unlock()
+
+		c, err := l.TCPListener.Accept()
+		if err != nil && l.isPaused() {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue // interrupted by pause
+			}
+		}
+		return c, err
+	}
+}
+
+// Close closes the listener and releases a paused Accept.
+func (l *Listener) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	l.cond.Broadcast()
+	l.mu.Unlock()
+	return l.TCPListener.Close()
+}
+
+func (l *Listener) pause() {
+	l.mu.Lock()
+	l.paused = true
+	l.mu.Unlock()
+	// Interrupt an Accept in progress.
+	l.SetDeadline(time.Now())
+}
+
+func (l *Listener) resume() {
+	l.SetDeadline(time.Time{})
+	l.mu.Lock()
+	l.paused = false
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
+
+func (l *Listener) isPaused() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.paused
+}
+
+// loopbackURL returns the URL of path on this listener, as seen from the
+// same host.
+func loopbackURL(addr net.Addr, path string) string {
+	tcp := addr.(*net.TCPAddr)
+	host := tcp.IP.String()
+	if tcp.IP == nil || tcp.IP.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return "http://" + net.JoinHostPort(host, strconv.Itoa(tcp.Port)) + path
+}
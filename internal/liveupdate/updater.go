@@ -0,0 +1,494 @@
+// Package liveupdate rebuilds the server from its own source and replaces
+// the running process with the new build without closing the listening
+// socket.
+package liveupdate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuki/flyagi/internal/sandbox"
+)
+
+// Update stages reported to OnEvent.
+const (
+	StageWaiting    = "waiting"
+	StageSyncing    = "syncing"
+	StageBuilding   = "building"
+	StageTesting    = "testing"
+	StageChecking   = "checking"
+	StageRestarting = "restarting"
+	StageCompleted  = "completed"
+	StageFailed     = "failed"
+	StageRolledBack = "rolled_back"
+)
+
+// Event reports the progress of an update.
+type Event struct {
+	Stage   string `json:"stage"`
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// Runner runs build and test commands, e.g. a *sandbox.Sandbox.
+type Runner interface {
+	Run(ctx context.Context, cmd sandbox.Command) (*sandbox.Result, error)
+}
+
+// Config configures an Updater.
+type Config struct {
+	RepoPath string
+	// Package is the main package to build, relative to RepoPath.
+	Package string
+	// BinDir keeps the builds; the most recent Keep are retained.
+	BinDir string
+	Keep   int
+	// Test runs "go test ./..." before a build is used.
+	Test bool
+	// HealthPath must answer 200 once the server is ready.
+	HealthPath    string
+	HealthTimeout time.Duration
+	// DrainTimeout bounds the wait for in-flight requests before re-exec.
+	DrainTimeout time.Duration
+	// IdlePoll is how often an update waiting for the function set with
+	// SetBusy checks it again.
+	IdlePoll time.Duration
+}
+
+func (c *Config) defaults() {
+	if c.Package == "" {
+		c.Package = "./cmd/server"
+	}
+	if c.Keep < 1 {
+		c.Keep = 3
+	}
+	if c.HealthPath == "" {
+		c.HealthPath = "/api/health"
+	}
+	if c.HealthTimeout <= 0 {
+		c.HealthTimeout = 30 * time.Second
+	}
+	if c.DrainTimeout <= 0 {
+		c.DrainTimeout = 10 * time.Second
+	}
+	if c.IdlePoll <= 0 {
+		c.IdlePoll = 10 * time.Second
+	}
+}
+
+// Updater rebuilds, checks and re-executes the server. Updates run one at a
+// time; one requested during another is done after it.
+type Updater struct {
+	cfg    Config
+	runner Runner
+	ln     *Listener
+	sync   func(build func() error) error
+	busy   func() string
+	notify func(Event)
+
+	// exec replaces the process and only returns on failure.
+	exec func(binary string, env []string) error
+
+	mu      sync.Mutex
+	running bool
+	again   string // reason for an update requested while running
+
+	connMu sync.Mutex
+	conns  map[net.Conn]http.ConnState
+}
+
+// New creates an Updater that hands ln over to new builds.
+func New(cfg Config, runner Runner, ln *Listener) *Updater {
+	cfg.defaults()
+	return &Updater{
+		cfg:    cfg,
+		runner: runner,
+		ln:     ln,
+		exec:   execBinary,
+		conns:  make(map[net.Conn]http.ConnState),
+	}
+}
+
+// SetSync sets a function that brings RepoPath up to date before each
+// build, e.g. pulling a merged pull request, and then calls build. It must
+// keep RepoPath from changing until build returns.
+func (u *Updater) SetSync(fn func(build func() error) error) {
+	u.sync = fn
+}
+
+// SetBusy sets a function that describes what replacing the process would
+// lose, e.g. work that only lives in memory, or returns "" when nothing
+// would be lost. Updates wait for it before building and again before the
+// process is replaced.
+func (u *Updater) SetBusy(fn func() string) {
+	u.busy = fn
+}
+
+// OnEvent registers fn to be called as an update progresses.
+func (u *Updater) OnEvent(fn func(Event)) {
+	u.notify = fn
+}
+
+// ConnState tracks in-flight requests; set it as the http.Server's
+// ConnState.
+func (u *Updater) ConnState(c net.Conn, state http.ConnState) {
+	u.connMu.Lock()
+	defer u.connMu.Unlock()
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		delete(u.conns, c)
+	default:
+		u.conns[c] = state
+	}
+}
+
+func (u *Updater) active() int {
+	u.connMu.Lock()
+	defer u.connMu.Unlock()
+	n := 0
+	for _, s := range u.conns {
+		if s == http.StateActive {
+			n++
+		}
+	}
+	return n
+}
+
+func (u *Updater) event(stage, reason, message string) {
+	slog.Info("live update", "stage", stage, "reason", reason, "message", message)
+	if u.notify != nil {
+		u.notify(Event{Stage: stage, Reason: reason, Message: message})
+	}
+}
+
+// Update rebuilds the server and replaces this process with the new build.
+// It only returns if the update failed, was queued behind a running one, or
+// the process could not be replaced, in which case this process keeps
+// serving.
+func (u *Updater) Update(ctx context.Context, reason string) error {
+	u.mu.Lock()
+	if u.running {
+		u.again = reason
+		u.mu.Unlock()
+		return nil
+	}
+	u.running = true
+	u.mu.Unlock()
+
+	for {
+		err := u.update(ctx, reason)
+
+		u.mu.Lock()
+		reason, u.again = u.again, ""
+		if reason == "" {
+			u.running = false
+			u.mu.Unlock()
+			return err
+		}
+		u.mu.Unlock()
+	}
+}
+
+// update runs one update. It returns nil without replacing the process when
+// another update was requested meanwhile, so that one includes the newer
+// source.
+func (u *Updater) update(ctx context.Context, reason string) error {
+	fail := func(err error) error {
+		u.event(StageFailed, reason, err.Error())
+		return err
+	}
+
+	if err := u.waitIdle(ctx, reason); err != nil {
+		return fail(err)
+	}
+
+	// The build and tests read RepoPath, so they run inside the sync.
+	var binary string
+	var buildErr error
+	build := func() error {
+		binary, buildErr = u.build(ctx, reason)
+		return buildErr
+	}
+	var syncErr error
+	if u.sync != nil {
+		u.event(StageSyncing, reason, "")
+		syncErr = u.sync(build)
+	} else {
+		build()
+	}
+	keep := false
+	defer func() {
+		if binary != "" && !keep {
+			os.Remove(binary)
+		}
+	}()
+	switch {
+	case buildErr != nil:
+		return fail(buildErr)
+	case syncErr != nil:
+		return fail(fmt.Errorf("failed to sync repository: %w", syncErr))
+	case binary == "":
+		return fail(fmt.Errorf("repository was synced without building"))
+	}
+
+	u.event(StageChecking, reason, "")
+	if err := u.preflight(ctx, binary); err != nil {
+		return fail(fmt.Errorf("health check failed: %w", err))
+	}
+
+	if err := u.waitIdle(ctx, reason); err != nil {
+		return fail(err)
+	}
+	u.mu.Lock()
+	newer := u.again != ""
+	u.mu.Unlock()
+	if newer {
+		return nil
+	}
+
+	u.event(StageRestarting, reason, "")
+	self, err := os.Executable()
+	if err != nil {
+		return fail(fmt.Errorf("failed to locate the running binary: %w", err))
+	}
+	keep = true
+	u.prune(binary, self)
+	if err := u.handoff(binary, self); err != nil {
+		keep = false
+		return fail(err)
+	}
+	return nil
+}
+
+// waitIdle waits until the function set with SetBusy reports that nothing
+// would be lost by replacing the process.
+func (u *Updater) waitIdle(ctx context.Context, reason string) error {
+	if u.busy == nil {
+		return nil
+	}
+	reported := ""
+	for {
+		what := u.busy()
+		if what == "" {
+			return nil
+		}
+		if what != reported {
+			u.event(StageWaiting, reason, what)
+			reported = what
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("postponed while %s: %w", what, ctx.Err())
+		case <-time.After(u.cfg.IdlePoll):
+		}
+	}
+}
+
+// build builds the server into BinDir and, if configured, runs the tests.
+// The binary is removed again when they fail.
+func (u *Updater) build(ctx context.Context, reason string) (string, error) {
+	u.event(StageBuilding, reason, "")
+	if err := os.MkdirAll(u.cfg.BinDir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", u.cfg.BinDir, err)
+	}
+	binary, err := filepath.Abs(filepath.Join(u.cfg.BinDir, "flyagi-"+time.Now().Format("20060102-150405.000")))
+	if err != nil {
+		return "", err
+	}
+	if err := u.run(ctx, "go", "build", "-o", binary, u.cfg.Package); err != nil {
+		return "", fmt.Errorf("build failed: %w", err)
+	}
+
+	if u.cfg.Test {
+		u.event(StageTesting, reason, "")
+		if err := u.run(ctx, "go", "test", "./..."); err != nil {
+			os.Remove(binary)
+			return "", fmt.Errorf("tests failed: %w", err)
+		}
+	}
+	return binary, nil
+}
+
+// run runs a command in the repository and turns a failure into an error
+// carrying the end of its output.
+func (u *Updater) run(ctx context.Context, args ...string) error {
+	res, err := u.runner.Run(ctx, sandbox.Command{Dir: u.cfg.RepoPath, Args: args})
+	if err != nil {
+		return err
+	}
+	if !res.Passed() {
+		out := strings.TrimSpace(res.Output)
+		if len(out) > 2000 {
+			out = "..." + out[len(out)-2000:]
+		}
+		return fmt.Errorf("%s exited with %d: %s", strings.Join(args, " "), res.ExitCode, out)
+	}
+	return nil
+}
+
+// preflight starts binary on a loopback port and waits for it to answer the
+// health check.
+func (u *Updater) preflight(ctx context.Context, binary string) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		return fmt.Errorf("failed to get listener file: %w", err)
+	}
+	defer f.Close()
+
+	cmd := exec.Command(binary)
+	cmd.Env = append(withoutLiveUpdateEnv(os.Environ()), envListenFD+"=3", envPreflight+"=1")
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start: %w", err)
+	}
+	exited := make(chan struct{})
+	var waitErr error
+	go func() {
+		waitErr = cmd.Wait()
+		close(exited)
+	}()
+	defer func() {
+		cmd.Process.Kill()
+		<-exited
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, u.cfg.HealthTimeout)
+	defer cancel()
+	if err := waitHealthy(ctx, loopbackURL(ln.Addr(), u.cfg.HealthPath), exited); err != nil {
+		if errors.Is(err, errExited) && waitErr != nil {
+			return fmt.Errorf("%w: %w", err, waitErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// handoff stops accepting, waits for in-flight requests and re-executes
+// binary with the listener. If that fails, serving resumes.
+func (u *Updater) handoff(binary, previous string) error {
+	u.ln.pause()
+	deadline := time.Now().Add(u.cfg.DrainTimeout)
+	for u.active() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if n := u.active(); n > 0 {
+		slog.Warn("live update: in-flight requests will be dropped", "requests", n)
+	}
+
+	f, err := u.ln.File()
+	if err == nil {
+		err = inheritable(f)
+	}
+	if err != nil {
+		u.ln.resume()
+		return fmt.Errorf("failed to hand over listener: %w", err)
+	}
+	env := append(withoutLiveUpdateEnv(os.Environ()),
+		fmt.Sprintf("%s=%d", envListenFD, f.Fd()),
+		envPrevious+"="+previous,
+	)
+	if err := u.exec(binary, env); err != nil {
+		f.Close()
+		u.ln.resume()
+		return fmt.Errorf("failed to re-exec: %w", err)
+	}
+	return nil
+}
+
+// Confirm health-checks this process when it was started by a live update,
+// and re-executes the previous binary if the check fails. Call it once the
+// server is serving.
+func (u *Updater) Confirm(ctx context.Context) {
+	previous := os.Getenv(envPrevious)
+	if previous == "" {
+		return
+	}
+	os.Unsetenv(envPrevious)
+
+	ctx, cancel := context.WithTimeout(ctx, u.cfg.HealthTimeout)
+	defer cancel()
+	err := waitHealthy(ctx, loopbackURL(u.ln.Addr(), u.cfg.HealthPath), nil)
+	if err == nil {
+		u.event(StageCompleted, "", "")
+		return
+	}
+
+	slog.Error("live update: new build is unhealthy, rolling back", "previous", previous, "error", err)
+	u.event(StageRolledBack, "", err.Error())
+	if err := u.handoff(previous, ""); err != nil {
+		slog.Error("live update: rollback failed", "error", err)
+	}
+}
+
+// prune removes old builds, keeping the most recent ones and the running
+// binary.
+func (u *Updater) prune(binary, self string) {
+	builds, _ := filepath.Glob(filepath.Join(u.cfg.BinDir, "flyagi-*"))
+	sort.Sort(sort.Reverse(sort.StringSlice(builds))) // newest first
+	kept := 0
+	for _, b := range builds {
+		if b == binary || b == self {
+			continue
+		}
+		if kept++; kept >= u.cfg.Keep {
+			os.Remove(b)
+		}
+	}
+}
+
+// errExited reports that the process being health-checked exited.
+var errExited = errors.New("process exited")
+
+// waitHealthy polls url until it answers 200, ctx expires or exited is
+// closed.
+func waitHealthy(ctx context.Context, url string, exited <-chan struct{}) error {
+	client := &http.Client{Timeout: 2 * time.Second}
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("no healthy response from %s: %w", url, ctx.Err())
+		case <-exited:
+			return errExited
+		case <-ticker.C:
+		}
+	}
+}
+
+// withoutLiveUpdateEnv drops the variables used for handoffs from env.
+func withoutLiveUpdateEnv(env []string) []string {
+	var out []string
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		if key != envListenFD && key != envPrevious && key != envPreflight {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
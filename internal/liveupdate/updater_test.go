@@ -0,0 +1,207 @@
+package liveupdate_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yuki/flyagi/internal/liveupdate"
+	"github.com/yuki/flyagi/internal/sandbox"
+)
+
+// fakeRunner "builds" script to the -o path and fails commands listed in
+// fail.
+type fakeRunner struct {
+	script string
+	fail   map[string]bool
+	ran    []string
+}
+
+func (r *fakeRunner) Run(_ context.Context, cmd sandbox.Command) (*sandbox.Result, error) {
+	name := strings.Join(cmd.Args[:2], " ")
+	r.ran = append(r.ran, name)
+	if r.fail[name] {
+		return &sandbox.Result{ExitCode: 1, Output: name + ": boom"}, nil
+	}
+	if name == "go build" {
+		if err := os.WriteFile(cmd.Args[3], []byte(r.script), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &sandbox.Result{}, nil
+}
+
+func TestListener(t *testing.T) {
+	ln, inherited, err := liveupdate.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if inherited {
+		t.Error("expected a new listener")
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	resp, err := http.Get("http://" + ln.Addr().String())
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("unexpected body %q", body)
+	}
+}
+
+func TestUpdater_Failures(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("needs /bin/sh")
+	}
+	ln, _, err := liveupdate.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	tests := []struct {
+		name   string
+		script string
+		fail   string
+		want   string
+		ran    []string
+	}{
+		{
+			name: "build fails",
+			fail: "go build",
+			want: "build failed",
+			ran:  []string{"go build"},
+		},
+		{
+			name:   "tests fail",
+			script: "#!/bin/sh\nexit 0\n",
+			fail:   "go test",
+			want:   "tests failed",
+			ran:    []string{"go build", "go test"},
+		},
+		{
+			name:   "new build exits",
+			script: "#!/bin/sh\nexit 1\n",
+			want:   "health check failed",
+			ran:    []string{"go build", "go test"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			binDir := t.TempDir()
+			runner := &fakeRunner{script: tt.script, fail: map[string]bool{tt.fail: true}}
+			u := liveupdate.New(liveupdate.Config{
+				RepoPath:      t.TempDir(),
+				BinDir:        binDir,
+				Test:          true,
+				HealthTimeout: 5 * time.Second,
+			}, runner, ln)
+
+			synced := false
+			u.SetSync(func(build func() error) error { synced = true; return build() })
+			var stages []string
+			u.OnEvent(func(ev liveupdate.Event) {
+				if ev.Reason != "cr-1" {
+					t.Errorf("unexpected reason %q", ev.Reason)
+				}
+				stages = append(stages, ev.Stage)
+			})
+
+			err := u.Update(context.Background(), "cr-1")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected %q error, got %v", tt.want, err)
+			}
+			if !synced {
+				t.Error("repository was not synced")
+			}
+			if strings.Join(runner.ran, ",") != strings.Join(tt.ran, ",") {
+				t.Errorf("ran %v, want %v", runner.ran, tt.ran)
+			}
+			if last := stages[len(stages)-1]; last != liveupdate.StageFailed {
+				t.Errorf("expected the last stage to be failed, got %v", stages)
+			}
+			if builds, _ := filepath.Glob(filepath.Join(binDir, "*")); len(builds) != 0 {
+				t.Errorf("failed builds were kept: %v", builds)
+			}
+		})
+	}
+
+	// The listener keeps serving after failed updates.
+	srv := &http.Server{Handler: http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})}
+	go srv.Serve(ln)
+	defer srv.Close()
+	resp, err := http.Get("http://" + ln.Addr().String())
+	if err != nil {
+		t.Fatalf("listener stopped serving: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestUpdater_ConfirmWithoutUpdate(t *testing.T) {
+	ln, _, err := liveupdate.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	u := liveupdate.New(liveupdate.Config{}, &fakeRunner{}, ln)
+	called := false
+	u.OnEvent(func(liveupdate.Event) { called = true })
+	u.Confirm(context.Background())
+	if called {
+		t.Error("Confirm reported an event for a process not started by an update")
+	}
+}
+
+func TestUpdater_WaitsWhileBusy(t *testing.T) {
+	ln, _, err := liveupdate.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer ln.Close()
+
+	runner := &fakeRunner{fail: map[string]bool{"go build": true}}
+	u := liveupdate.New(liveupdate.Config{RepoPath: t.TempDir(), BinDir: t.TempDir(), IdlePoll: 10 * time.Millisecond}, runner, ln)
+	busy := 3
+	u.SetBusy(func() string {
+		if busy == 0 {
+			return ""
+		}
+		busy--
+		return "1 pending change request"
+	})
+	var stages []string
+	u.OnEvent(func(ev liveupdate.Event) { stages = append(stages, ev.Stage) })
+
+	// The update starts once nothing is pending any more.
+	if err := u.Update(context.Background(), "cr-1"); err == nil || !strings.Contains(err.Error(), "build failed") {
+		t.Fatalf("expected the build to run and fail, got %v", err)
+	}
+	if len(stages) == 0 || stages[0] != liveupdate.StageWaiting || strings.Count(strings.Join(stages, ","), liveupdate.StageWaiting) != 1 {
+		t.Errorf("unexpected stages %v", stages)
+	}
+
+	// It gives up when ctx ends first.
+	busy = -1
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	runner.ran = nil
+	if err := u.Update(ctx, "cr-2"); err == nil || !strings.Contains(err.Error(), "postponed") {
+		t.Fatalf("expected the update to be postponed, got %v", err)
+	}
+	if len(runner.ran) != 0 {
+		t.Errorf("built while busy: %v", runner.ran)
+	}
+}
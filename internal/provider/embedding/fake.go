@@ -0,0 +1,84 @@
+package embedding
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// FakeProvider is a deterministic, offline embedding provider. It hashes
+// words and the parts of camelCase identifiers into a fixed number of
+// buckets, so texts sharing identifiers end up close together. It is meant
+// for tests and local development.
+type FakeProvider struct {
+	dims int
+}
+
+// NewFakeProvider creates a fake provider producing vectors of dims
+// dimensions (256 when dims <= 0).
+func NewFakeProvider(dims int) *FakeProvider {
+	if dims <= 0 {
+		dims = 256
+	}
+	return &FakeProvider{dims: dims}
+}
+
+func (p *FakeProvider) Name() string  { return "fake" }
+func (p *FakeProvider) Model() string { return "fake-hash" }
+
+func (p *FakeProvider) Embed(_ context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, t := range texts {
+		vectors[i] = p.embed(t)
+	}
+	return vectors, nil
+}
+
+func (p *FakeProvider) embed(text string) []float32 {
+	v := make([]float32, p.dims)
+	words := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, w := range words {
+		p.add(v, w)
+		if parts := splitCamel(w); len(parts) > 1 {
+			for _, part := range parts {
+				p.add(v, part)
+			}
+		}
+	}
+
+	var norm float64
+	for _, x := range v {
+		norm += float64(x * x)
+	}
+	if norm > 0 {
+		scale := float32(1 / math.Sqrt(norm))
+		for i := range v {
+			v[i] *= scale
+		}
+	}
+	return v
+}
+
+func (p *FakeProvider) add(v []float32, word string) {
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(word)))
+	v[h.Sum32()%uint32(p.dims)]++
+}
+
+// splitCamel splits "HandleLogin" into "Handle" and "Login".
+func splitCamel(word string) []string {
+	var parts []string
+	start := 0
+	runes := []rune(word)
+	for i := 1; i < len(runes); i++ {
+		if unicode.IsUpper(runes[i]) && unicode.IsLower(runes[i-1]) {
+			parts = append(parts, string(runes[start:i]))
+			start = i
+		}
+	}
+	return append(parts, string(runes[start:]))
+}
@@ -0,0 +1,60 @@
+package embedding
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/genai"
+)
+
+// geminiMaxBatch is the Gemini API limit on contents per request.
+const geminiMaxBatch = 100
+
+// GeminiProvider implements EmbeddingProvider for Google Gemini.
+type GeminiProvider struct {
+	client *genai.Client
+	model  string
+}
+
+// NewGeminiProvider creates a Gemini embedding provider. An empty model
+// uses text-embedding-004.
+func NewGeminiProvider(ctx context.Context, apiKey, model string) (*GeminiProvider, error) {
+	client, err := genai.NewClient(ctx, &genai.ClientConfig{
+		APIKey:  apiKey,
+		Backend: genai.BackendGeminiAPI,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Gemini client: %w", err)
+	}
+	if model == "" {
+		model = "text-embedding-004"
+	}
+	return &GeminiProvider{client: client, model: model}, nil
+}
+
+func (p *GeminiProvider) Name() string  { return "gemini" }
+func (p *GeminiProvider) Model() string { return p.model }
+
+func (p *GeminiProvider) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += geminiMaxBatch {
+		batch := texts[start:min(start+geminiMaxBatch, len(texts))]
+
+		contents := make([]*genai.Content, len(batch))
+		for i, t := range batch {
+			contents[i] = genai.NewContentFromText(t, genai.RoleUser)
+		}
+
+		resp, err := p.client.Models.EmbedContent(ctx, p.model, contents, nil)
+		if err != nil {
+			return nil, fmt.Errorf("gemini embeddings request failed: %w", err)
+		}
+		if len(resp.Embeddings) != len(batch) {
+			return nil, fmt.Errorf("gemini returned %d embeddings for %d inputs", len(resp.Embeddings), len(batch))
+		}
+		for _, e := range resp.Embeddings {
+			vectors = append(vectors, e.Values)
+		}
+	}
+	return vectors, nil
+}
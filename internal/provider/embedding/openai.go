@@ -0,0 +1,72 @@
+package embedding
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
+)
+
+// maxBatch is the number of inputs sent per embeddings request.
+const maxBatch = 256
+
+// OpenAIProvider implements EmbeddingProvider for the OpenAI embeddings API
+// and OpenAI-compatible servers such as Ollama, vLLM or LM Studio.
+type OpenAIProvider struct {
+	client *openai.Client
+	name   string
+	model  string
+}
+
+// NewOpenAIProvider creates an OpenAI embedding provider. An empty model
+// uses text-embedding-3-small.
+func NewOpenAIProvider(apiKey, model string) *OpenAIProvider {
+	if model == "" {
+		model = openai.EmbeddingModelTextEmbedding3Small
+	}
+	client := openai.NewClient(option.WithAPIKey(apiKey))
+	return &OpenAIProvider{client: &client, name: "openai", model: model}
+}
+
+// NewCompatibleProvider creates an embedding provider for an
+// OpenAI-compatible server at baseURL (e.g. http://localhost:11434/v1).
+func NewCompatibleProvider(name, baseURL, apiKey, model string) *OpenAIProvider {
+	client := openai.NewClient(option.WithBaseURL(baseURL), option.WithAPIKey(apiKey))
+	return &OpenAIProvider{client: &client, name: name, model: model}
+}
+
+func (p *OpenAIProvider) Name() string  { return p.name }
+func (p *OpenAIProvider) Model() string { return p.model }
+
+func (p *OpenAIProvider) Embed(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += maxBatch {
+		batch := texts[start:min(start+maxBatch, len(texts))]
+
+		resp, err := p.client.Embeddings.New(ctx, openai.EmbeddingNewParams{
+			Model: openai.EmbeddingModel(p.model),
+			Input: openai.EmbeddingNewParamsInputUnion{OfArrayOfStrings: batch},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s embeddings request failed: %w", p.name, err)
+		}
+		if len(resp.Data) != len(batch) {
+			return nil, fmt.Errorf("%s returned %d embeddings for %d inputs", p.name, len(resp.Data), len(batch))
+		}
+
+		out := make([][]float32, len(batch))
+		for _, d := range resp.Data {
+			if d.Index < 0 || int(d.Index) >= len(batch) {
+				return nil, fmt.Errorf("%s returned embedding index %d out of range", p.name, d.Index)
+			}
+			v := make([]float32, len(d.Embedding))
+			for i, f := range d.Embedding {
+				v[i] = float32(f)
+			}
+			out[d.Index] = v
+		}
+		vectors = append(vectors, out...)
+	}
+	return vectors, nil
+}
@@ -27,7 +27,52 @@ func NewAnthropicProvider(apiKey string) *AnthropicProvider {
 
 func (p *AnthropicProvider) Name() string { return "anthropic" }
 
+// Model implements provider.ModelSwitcher.
+func (p *AnthropicProvider) Model() string { return p.model }
+
+// WithModel implements provider.ModelSwitcher.
+func (p *AnthropicProvider) WithModel(model string) provider.LLMProvider {
+	c := *p
+	c.model = model
+	return &c
+}
+
 func (p *AnthropicProvider) ChatStream(ctx context.Context, messages []provider.Message, onChunk func(provider.StreamChunk) error) error {
+	return p.stream(ctx, p.params(messages), func(d anthropic.MessageStreamEventUnionDelta) string {
+		return d.Text
+	}, onChunk)
+}
+
+// ChatStructured implements provider.StructuredLLM by forcing the model to
+// call a tool whose input is the response, and streaming that input.
+func (p *AnthropicProvider) ChatStructured(ctx context.Context, messages []provider.Message, schema provider.Schema, onChunk func(provider.StreamChunk) error) error {
+	inputSchema := anthropic.ToolInputSchemaParam{ExtraFields: map[string]any{}}
+	for k, v := range schema.Definition {
+		switch k {
+		case "type":
+		case "properties":
+			inputSchema.Properties = v
+		case "required":
+			inputSchema.Required, _ = v.([]string)
+		default:
+			inputSchema.ExtraFields[k] = v
+		}
+	}
+
+	params := p.params(messages)
+	params.Tools = []anthropic.ToolUnionParam{{OfTool: &anthropic.ToolParam{
+		Name:        schema.Name,
+		Description: anthropic.String(schema.Description),
+		InputSchema: inputSchema,
+	}}}
+	params.ToolChoice = anthropic.ToolChoiceUnionParam{OfTool: &anthropic.ToolChoiceToolParam{Name: schema.Name}}
+
+	return p.stream(ctx, params, func(d anthropic.MessageStreamEventUnionDelta) string {
+		return d.PartialJSON
+	}, onChunk)
+}
+
+func (p *AnthropicProvider) params(messages []provider.Message) anthropic.MessageNewParams {
 	// Separate system message from conversation messages
 	var systemPrompt string
 	var convMessages []anthropic.MessageParam
@@ -56,13 +101,23 @@ func (p *AnthropicProvider) ChatStream(ctx context.Context, messages []provider.
 			{Text: systemPrompt},
 		}
 	}
+	return params
+}
 
+// stream streams the content picked from each content block delta.
+func (p *AnthropicProvider) stream(ctx context.Context, params anthropic.MessageNewParams, content func(anthropic.MessageStreamEventUnionDelta) string, onChunk func(provider.StreamChunk) error) error {
+	var usage provider.Usage
 	stream := p.client.Messages.NewStreaming(ctx, params)
 	for stream.Next() {
 		event := stream.Current()
-		if event.Type == "content_block_delta" {
-			if delta := event.Delta; delta.Text != "" {
-				if err := onChunk(provider.StreamChunk{Content: delta.Text}); err != nil {
+		switch event.Type {
+		case "message_start":
+			usage.InputTokens = int(event.Message.Usage.InputTokens)
+		case "message_delta":
+			usage.OutputTokens = int(event.Usage.OutputTokens)
+		case "content_block_delta":
+			if text := content(event.Delta); text != "" {
+				if err := onChunk(provider.StreamChunk{Content: text}); err != nil {
 					return err
 				}
 			}
@@ -72,5 +127,5 @@ func (p *AnthropicProvider) ChatStream(ctx context.Context, messages []provider.
 		return fmt.Errorf("anthropic stream error: %w", err)
 	}
 
-	return onChunk(provider.StreamChunk{Done: true})
+	return onChunk(provider.StreamChunk{Done: true, Usage: &usage})
 }
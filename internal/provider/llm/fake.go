@@ -0,0 +1,95 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/yuki/flyagi/internal/provider"
+)
+
+// FakeProvider is a deterministic, offline LLM provider that replies with
+// canned responses. It is meant for tests and evaluations. Token usage is
+// estimated as one token per four bytes.
+type FakeProvider struct {
+	replies []fakeReply
+}
+
+type fakeReply struct {
+	match    string
+	response string
+}
+
+// NewFakeProvider creates a fake provider without replies.
+func NewFakeProvider() *FakeProvider {
+	return &FakeProvider{}
+}
+
+// Reply makes the provider answer response when the last message contains
+// match. Replies are tried in the order they were added; an empty match
+// answers everything.
+func (p *FakeProvider) Reply(match, response string) {
+	p.replies = append(p.replies, fakeReply{match: match, response: response})
+}
+
+func (p *FakeProvider) Name() string { return "fake" }
+
+// Model implements provider.ModelSwitcher.
+func (p *FakeProvider) Model() string { return "fake" }
+
+// WithModel implements provider.ModelSwitcher. There is only one model.
+func (p *FakeProvider) WithModel(string) provider.LLMProvider { return p }
+
+func (p *FakeProvider) ChatStream(ctx context.Context, messages []provider.Message, onChunk func(provider.StreamChunk) error) error {
+	if len(messages) == 0 {
+		return fmt.Errorf("fake: no messages")
+	}
+	last := messages[len(messages)-1].Content
+	for _, r := range p.replies {
+		if strings.Contains(last, r.match) {
+			return p.stream(ctx, messages, r.response, onChunk)
+		}
+	}
+	return fmt.Errorf("fake: no reply for %q", truncate(last, 80))
+}
+
+// ChatStructured implements provider.StructuredLLM. The canned response is
+// streamed as is, so it should be the bare JSON value.
+func (p *FakeProvider) ChatStructured(ctx context.Context, messages []provider.Message, _ provider.Schema, onChunk func(provider.StreamChunk) error) error {
+	return p.ChatStream(ctx, messages, onChunk)
+}
+
+// stream sends response in chunks of a few words, like a real provider.
+func (p *FakeProvider) stream(ctx context.Context, messages []provider.Message, response string, onChunk func(provider.StreamChunk) error) error {
+	const chunkSize = 32
+	for rest := response; rest != ""; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := min(chunkSize, len(rest))
+		for n < len(rest) && !utf8.RuneStart(rest[n]) {
+			n++
+		}
+		if err := onChunk(provider.StreamChunk{Content: rest[:n]}); err != nil {
+			return err
+		}
+		rest = rest[n:]
+	}
+
+	input := 0
+	for _, m := range messages {
+		input += len(m.Content)
+	}
+	return onChunk(provider.StreamChunk{Done: true, Usage: &provider.Usage{
+		InputTokens:  (input + 3) / 4,
+		OutputTokens: (len(response) + 3) / 4,
+	}})
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -3,6 +3,9 @@ package llm
 import (
 	"context"
 	"fmt"
+	"slices"
+	"sort"
+	"strings"
 
 	"google.golang.org/genai"
 
@@ -32,7 +35,31 @@ func NewGeminiProvider(ctx context.Context, apiKey string) (*GeminiProvider, err
 
 func (p *GeminiProvider) Name() string { return "gemini" }
 
+// Model implements provider.ModelSwitcher.
+func (p *GeminiProvider) Model() string { return p.model }
+
+// WithModel implements provider.ModelSwitcher.
+func (p *GeminiProvider) WithModel(model string) provider.LLMProvider {
+	c := *p
+	c.model = model
+	return &c
+}
+
 func (p *GeminiProvider) ChatStream(ctx context.Context, messages []provider.Message, onChunk func(provider.StreamChunk) error) error {
+	contents, config := p.request(messages)
+	return p.stream(ctx, contents, config, onChunk)
+}
+
+// ChatStructured implements provider.StructuredLLM with a JSON response
+// schema.
+func (p *GeminiProvider) ChatStructured(ctx context.Context, messages []provider.Message, schema provider.Schema, onChunk func(provider.StreamChunk) error) error {
+	contents, config := p.request(messages)
+	config.ResponseMIMEType = "application/json"
+	config.ResponseSchema = geminiSchema(schema.Definition)
+	return p.stream(ctx, contents, config, onChunk)
+}
+
+func (p *GeminiProvider) request(messages []provider.Message) ([]*genai.Content, *genai.GenerateContentConfig) {
 	var systemInstruction string
 	var contents []*genai.Content
 	for _, m := range messages {
@@ -64,11 +91,21 @@ func (p *GeminiProvider) ChatStream(ctx context.Context, messages []provider.Mes
 			},
 		}
 	}
+	return contents, config
+}
 
+func (p *GeminiProvider) stream(ctx context.Context, contents []*genai.Content, config *genai.GenerateContentConfig, onChunk func(provider.StreamChunk) error) error {
+	var usage provider.Usage
 	for result, err := range p.client.Models.GenerateContentStream(ctx, p.model, contents, config) {
 		if err != nil {
 			return fmt.Errorf("gemini stream error: %w", err)
 		}
+		if m := result.UsageMetadata; m != nil {
+			usage = provider.Usage{
+				InputTokens:  int(m.PromptTokenCount),
+				OutputTokens: int(m.CandidatesTokenCount + m.ThoughtsTokenCount),
+			}
+		}
 		for _, candidate := range result.Candidates {
 			if candidate.Content != nil {
 				for _, part := range candidate.Content.Parts {
@@ -82,5 +119,36 @@ func (p *GeminiProvider) ChatStream(ctx context.Context, messages []provider.Mes
 		}
 	}
 
-	return onChunk(provider.StreamChunk{Done: true})
+	return onChunk(provider.StreamChunk{Done: true, Usage: &usage})
+}
+
+// geminiSchema converts a JSON Schema to Gemini's schema type. Gemini
+// orders properties alphabetically unless told otherwise; required ones
+// keep the order they are listed in and come first.
+func geminiSchema(def map[string]any) *genai.Schema {
+	s := &genai.Schema{}
+	if t, ok := def["type"].(string); ok {
+		s.Type = genai.Type(strings.ToUpper(t))
+	}
+	s.Description, _ = def["description"].(string)
+	s.Required, _ = def["required"].([]string)
+	s.Enum, _ = def["enum"].([]string)
+	if items, ok := def["items"].(map[string]any); ok {
+		s.Items = geminiSchema(items)
+	}
+	if props, ok := def["properties"].(map[string]any); ok {
+		s.Properties = make(map[string]*genai.Schema, len(props))
+		var rest []string
+		for name, prop := range props {
+			if m, ok := prop.(map[string]any); ok {
+				s.Properties[name] = geminiSchema(m)
+			}
+			if !slices.Contains(s.Required, name) {
+				rest = append(rest, name)
+			}
+		}
+		sort.Strings(rest)
+		s.PropertyOrdering = append(slices.Clone(s.Required), rest...)
+	}
+	return s
 }
@@ -6,6 +6,7 @@ import (
 
 	"github.com/openai/openai-go"
 	"github.com/openai/openai-go/option"
+	"github.com/openai/openai-go/shared"
 
 	"github.com/yuki/flyagi/internal/provider"
 )
@@ -27,7 +28,37 @@ func NewOpenAIProvider(apiKey string) *OpenAIProvider {
 
 func (p *OpenAIProvider) Name() string { return "openai" }
 
+// Model implements provider.ModelSwitcher.
+func (p *OpenAIProvider) Model() string { return p.model }
+
+// WithModel implements provider.ModelSwitcher.
+func (p *OpenAIProvider) WithModel(model string) provider.LLMProvider {
+	c := *p
+	c.model = model
+	return &c
+}
+
 func (p *OpenAIProvider) ChatStream(ctx context.Context, messages []provider.Message, onChunk func(provider.StreamChunk) error) error {
+	return p.stream(ctx, p.params(messages), onChunk)
+}
+
+// ChatStructured implements provider.StructuredLLM with a JSON schema
+// response format.
+func (p *OpenAIProvider) ChatStructured(ctx context.Context, messages []provider.Message, schema provider.Schema, onChunk func(provider.StreamChunk) error) error {
+	params := p.params(messages)
+	params.ResponseFormat = openai.ChatCompletionNewParamsResponseFormatUnion{
+		OfJSONSchema: &shared.ResponseFormatJSONSchemaParam{
+			JSONSchema: shared.ResponseFormatJSONSchemaJSONSchemaParam{
+				Name:        schema.Name,
+				Description: openai.String(schema.Description),
+				Schema:      schema.Definition,
+			},
+		},
+	}
+	return p.stream(ctx, params, onChunk)
+}
+
+func (p *OpenAIProvider) params(messages []provider.Message) openai.ChatCompletionNewParams {
 	var chatMessages []openai.ChatCompletionMessageParamUnion
 	for _, m := range messages {
 		switch m.Role {
@@ -40,13 +71,25 @@ func (p *OpenAIProvider) ChatStream(ctx context.Context, messages []provider.Mes
 		}
 	}
 
-	stream := p.client.Chat.Completions.NewStreaming(ctx, openai.ChatCompletionNewParams{
-		Model:    openai.ChatModel(p.model),
-		Messages: chatMessages,
-	})
+	return openai.ChatCompletionNewParams{
+		Model:         openai.ChatModel(p.model),
+		Messages:      chatMessages,
+		StreamOptions: openai.ChatCompletionStreamOptionsParam{IncludeUsage: openai.Bool(true)},
+	}
+}
+
+func (p *OpenAIProvider) stream(ctx context.Context, params openai.ChatCompletionNewParams, onChunk func(provider.StreamChunk) error) error {
+	stream := p.client.Chat.Completions.NewStreaming(ctx, params)
 
+	var usage provider.Usage
 	for stream.Next() {
 		chunk := stream.Current()
+		if chunk.Usage.TotalTokens > 0 {
+			usage = provider.Usage{
+				InputTokens:  int(chunk.Usage.PromptTokens),
+				OutputTokens: int(chunk.Usage.CompletionTokens),
+			}
+		}
 		for _, choice := range chunk.Choices {
 			if choice.Delta.Content != "" {
 				if err := onChunk(provider.StreamChunk{Content: choice.Delta.Content}); err != nil {
@@ -59,5 +102,5 @@ func (p *OpenAIProvider) ChatStream(ctx context.Context, messages []provider.Mes
 		return fmt.Errorf("openai stream error: %w", err)
 	}
 
-	return onChunk(provider.StreamChunk{Done: true})
+	return onChunk(provider.StreamChunk{Done: true, Usage: &usage})
 }
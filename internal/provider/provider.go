@@ -15,6 +15,14 @@ type Message struct {
 type StreamChunk struct {
 	Content string `json:"content"`
 	Done    bool   `json:"done"`
+	// Usage is set on the final chunk by providers that report it.
+	Usage *Usage `json:"usage,omitempty"`
+}
+
+// Usage counts the tokens of one LLM request.
+type Usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
 }
 
 // LLMProvider defines the interface for language model providers.
@@ -41,3 +49,23 @@ type STTProvider interface {
 	// Transcribe converts audio to text.
 	Transcribe(ctx context.Context, audio io.Reader, contentType string) (string, error)
 }
+
+// EmbeddingProvider defines the interface for text embedding providers.
+type EmbeddingProvider interface {
+	// Name returns the provider identifier.
+	Name() string
+	// Model returns the embedding model, so stored vectors can be invalidated
+	// when it changes.
+	Model() string
+	// Embed returns one vector per input text, in order.
+	Embed(ctx context.Context, texts []string) ([][]float32, error)
+}
+
+// ModelSwitcher is implemented by LLM providers that can serve other models
+// than their default.
+type ModelSwitcher interface {
+	// Model returns the model the provider uses.
+	Model() string
+	// WithModel returns a copy of the provider that uses model.
+	WithModel(model string) LLMProvider
+}
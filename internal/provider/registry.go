@@ -11,6 +11,7 @@ type Registry struct {
 	llms map[string]LLMProvider
 	tts  map[string]TTSProvider
 	stt  map[string]STTProvider
+	emb  map[string]EmbeddingProvider
 }
 
 // NewRegistry creates a new empty Registry.
@@ -19,6 +20,7 @@ func NewRegistry() *Registry {
 		llms: make(map[string]LLMProvider),
 		tts:  make(map[string]TTSProvider),
 		stt:  make(map[string]STTProvider),
+		emb:  make(map[string]EmbeddingProvider),
 	}
 }
 
@@ -43,6 +45,13 @@ func (r *Registry) RegisterSTT(p STTProvider) {
 	r.stt[p.Name()] = p
 }
 
+// RegisterEmbedding registers a text embedding provider.
+func (r *Registry) RegisterEmbedding(p EmbeddingProvider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.emb[p.Name()] = p
+}
+
 // GetLLM returns the named LLM provider.
 func (r *Registry) GetLLM(name string) (LLMProvider, error) {
 	r.mu.RLock()
@@ -76,6 +85,17 @@ func (r *Registry) GetSTT(name string) (STTProvider, error) {
 	return p, nil
 }
 
+// GetEmbedding returns the named embedding provider.
+func (r *Registry) GetEmbedding(name string) (EmbeddingProvider, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.emb[name]
+	if !ok {
+		return nil, fmt.Errorf("embedding provider %q not found", name)
+	}
+	return p, nil
+}
+
 // ListLLMs returns names of all registered LLM providers.
 func (r *Registry) ListLLMs() []string {
 	r.mu.RLock()
@@ -108,3 +128,14 @@ func (r *Registry) ListSTT() []string {
 	}
 	return names
 }
+
+// ListEmbeddings returns names of all registered embedding providers.
+func (r *Registry) ListEmbeddings() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.emb))
+	for name := range r.emb {
+		names = append(names, name)
+	}
+	return names
+}
@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"github.com/yuki/flyagi/internal/provider"
+	"github.com/yuki/flyagi/internal/provider/embedding"
 )
 
 type mockLLM struct{ name string }
@@ -99,3 +100,32 @@ func TestRegistry_ListProviders(t *testing.T) {
 		t.Errorf("expected 1 STT, got %d", len(stts))
 	}
 }
+
+func TestRegistry_RegisterAndGetEmbedding(t *testing.T) {
+	reg := provider.NewRegistry()
+	reg.RegisterEmbedding(embedding.NewFakeProvider(8))
+
+	p, err := reg.GetEmbedding("fake")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	vectors, err := p.Embed(context.Background(), []string{"hello world", "hello world"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(vectors) != 2 || len(vectors[0]) != 8 {
+		t.Fatalf("unexpected vectors: %v", vectors)
+	}
+	for i := range vectors[0] {
+		if vectors[0][i] != vectors[1][i] {
+			t.Fatal("fake embeddings are not deterministic")
+		}
+	}
+
+	if names := reg.ListEmbeddings(); len(names) != 1 || names[0] != "fake" {
+		t.Errorf("unexpected embedding providers: %v", names)
+	}
+	if _, err := reg.GetEmbedding("missing"); err == nil {
+		t.Error("expected error for nonexistent provider")
+	}
+}
@@ -0,0 +1,23 @@
+package provider
+
+import "context"
+
+// Schema describes the JSON value a structured response must be.
+type Schema struct {
+	// Name identifies the schema to the provider, e.g. as a tool name. It
+	// must be a valid identifier.
+	Name        string
+	Description string
+	// Definition is a JSON Schema. Providers support the subset made of
+	// type, description, properties, required, items and enum.
+	Definition map[string]any
+}
+
+// StructuredLLM is implemented by LLM providers that can constrain a
+// response to a JSON schema with the provider's own structured output
+// facility.
+type StructuredLLM interface {
+	// ChatStructured is like ChatStream, but the streamed content is the
+	// JSON value only, without prose or markdown around it.
+	ChatStructured(ctx context.Context, messages []Message, schema Schema, onChunk func(StreamChunk) error) error
+}
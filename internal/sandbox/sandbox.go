@@ -0,0 +1,404 @@
+// Package sandbox runs untrusted commands, such as the tests of generated
+// code, in a constrained child process.
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits bound the resources of a sandboxed command. Zero values disable a
+// limit.
+type Limits struct {
+	// Timeout is the wall-clock limit; the command is killed with all its
+	// children when it expires.
+	Timeout time.Duration
+	// CPUTime limits the CPU time of each process (RLIMIT_CPU).
+	CPUTime time.Duration
+	// Memory in bytes is enforced by the cgroup, or by RLIMIT_AS on each
+	// process without one.
+	Memory int64
+	// Processes limits the number of tasks in the cgroup.
+	Processes int
+	// FileSize limits the size of files written (RLIMIT_FSIZE).
+	FileSize int64
+	// Output is the number of bytes of combined stdout and stderr kept.
+	Output int
+}
+
+// DefaultLimits are suitable for building and testing a Go module.
+func DefaultLimits() Limits {
+	return Limits{
+		Timeout:   10 * time.Minute,
+		CPUTime:   10 * time.Minute,
+		Memory:    4 << 30,
+		Processes: 512,
+		FileSize:  1 << 30,
+		Output:    64 << 10,
+	}
+}
+
+// DefaultPassEnv are the variables passed through from the server's
+// environment by default. The Go caches are left out so commands cannot
+// write to the server's; see Options.GoModCache.
+var DefaultPassEnv = []string{
+	"PATH", "LANG", "LC_ALL", "TZ",
+	"GOROOT", "GOFLAGS", "GOPROXY", "GOTOOLCHAIN",
+}
+
+// secretName matches variables that are never passed through, even when
+// listed.
+var secretName = regexp.MustCompile(`(?i)(TOKEN|SECRET|PASSWORD|PASSPHRASE|API_?KEY|PRIVATE_KEY|CREDENTIAL)`)
+
+// Options configure a Sandbox.
+type Options struct {
+	Limits Limits
+	// Network allows network access. Without it, commands run in a new
+	// network namespace when the kernel permits.
+	Network bool
+	// PassEnv lists the variables passed through from the server's
+	// environment; everything else is dropped.
+	PassEnv []string
+	// Env is added to the environment of every command, as KEY=VALUE.
+	Env []string
+	// GoModCache is a Go module cache that Go commands build against. It
+	// is mounted read-only where mount namespaces are available and copied
+	// for each command otherwise; either way each command gets its own
+	// build cache, with the toolchain pinned, the proxy off and go.mod
+	// read-only. Empty leaves the Go environment alone.
+	GoModCache string
+	// CgroupParent is a cgroup v2 directory delegated to the server, under
+	// which each command gets its own cgroup. Empty disables cgroups.
+	CgroupParent string
+}
+
+// Command is a command to run.
+type Command struct {
+	// Dir is copied, without its .git directory, and the command runs in
+	// the copy so it cannot change the original.
+	Dir string
+	// InPlace runs the command in Dir itself, for directories that are
+	// copies already, such as those made by Snapshot.
+	InPlace bool
+	Args    []string
+	// Env is added to the sandbox environment, as KEY=VALUE.
+	Env []string
+}
+
+// Result is the outcome of a command that ran.
+type Result struct {
+	ExitCode int // -1 when killed by a signal
+	Output   string
+	// Truncated is set when output beyond Limits.Output was dropped.
+	Truncated bool
+	TimedOut  bool
+	Duration  time.Duration
+	// Isolation lists the mechanisms that applied, e.g. "pidns", "netns",
+	// "cgroup" and "rlimit".
+	Isolation []string
+}
+
+// Passed reports whether the command exited successfully.
+func (r *Result) Passed() bool {
+	return r.ExitCode == 0 && !r.TimedOut
+}
+
+// Sandbox runs commands with a scrubbed environment, a temporary HOME and
+// resource limits.
+type Sandbox struct {
+	opts Options
+	env  []string
+
+	mu        sync.Mutex
+	noNetns   bool // network namespaces were refused by the kernel
+	noCgroups bool
+
+	probe sync.Once
+	pidns bool // commands can get their own PID namespace and /proc
+}
+
+// New creates a Sandbox. It also makes the server process non-dumpable, so
+// commands running as the same user cannot read its environment and
+// memory through /proc.
+func New(opts Options) *Sandbox {
+	if err := hideProcess(); err != nil {
+		slog.Warn("sandbox: failed to make the server non-dumpable", "error", err)
+	}
+	if opts.PassEnv == nil {
+		opts.PassEnv = DefaultPassEnv
+	}
+	s := &Sandbox{opts: opts}
+	for _, key := range opts.PassEnv {
+		if secretName.MatchString(key) {
+			slog.Warn("sandbox: refusing to pass through secret-looking variable", "name", key)
+			continue
+		}
+		if v, ok := os.LookupEnv(key); ok {
+			s.env = append(s.env, key+"="+v)
+		}
+	}
+	s.env = append(s.env, opts.Env...)
+	return s
+}
+
+// homePrefix names the temporary HOME directories of sandboxed commands,
+// snapshotPrefix the copies made by Snapshot.
+const (
+	homePrefix     = "flyagi-sandbox-"
+	snapshotPrefix = "flyagi-snapshot-"
+)
+
+// snapshotMaxAge is how old a snapshot must be before Sweep treats it as
+// left behind. Snapshots outlive single commands, so this is generous.
+const snapshotMaxAge = 24 * time.Hour
+
+// Snapshot copies the directory dir, leaving out .git, to a temporary
+// directory, so commands can run against it while dir changes. The returned
+// function removes the copy.
+func Snapshot(dir string) (string, func(), error) {
+	parent, err := os.MkdirTemp("", snapshotPrefix)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	cleanup := func() { removeAll(parent) }
+	work := parent + "/work"
+	if err := copyTree(dir, work); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to copy %s: %w", dir, err)
+	}
+	return work, cleanup, nil
+}
+
+// Run runs cmd and waits for it. An error is returned only when the command
+// could not be run; a failing command is reported in the Result.
+func (s *Sandbox) Run(ctx context.Context, cmd Command) (*Result, error) {
+	if len(cmd.Args) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+
+	home, err := os.MkdirTemp("", homePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sandbox home: %w", err)
+	}
+	defer removeAll(home)
+	tmp := home + "/tmp"
+	if err := os.Mkdir(tmp, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create sandbox tmp: %w", err)
+	}
+	if cmd.Dir != "" && !cmd.InPlace {
+		work := home + "/work"
+		if err := copyTree(cmd.Dir, work); err != nil {
+			return nil, fmt.Errorf("failed to copy %s: %w", cmd.Dir, err)
+		}
+		cmd.Dir = work
+	}
+
+	env := append([]string(nil), s.env...)
+	env = append(env,
+		"HOME="+home,
+		"TMPDIR="+tmp,
+		"XDG_CACHE_HOME="+home+"/.cache",
+		"XDG_CONFIG_HOME="+home+"/.config",
+	)
+	if modCache := s.opts.GoModCache; modCache != "" {
+		if s.readOnlyMounts() {
+			env = append(env, "SANDBOX_READONLY="+modCache)
+		} else {
+			modCache = home + "/gomodcache"
+			if err := copyTree(s.opts.GoModCache, modCache); err != nil {
+				return nil, fmt.Errorf("failed to copy the module cache: %w", err)
+			}
+		}
+		env = append(env,
+			"GOMODCACHE="+modCache,
+			"GOCACHE="+home+"/.cache/go-build",
+			"GOFLAGS=-mod=readonly",
+			"GOPROXY=off",
+			"GOTOOLCHAIN=local",
+		)
+	}
+	env = append(env, cmd.Env...)
+
+	if s.opts.Limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.opts.Limits.Timeout)
+		defer cancel()
+	}
+
+	out := &capWriter{limit: s.opts.Limits.Output}
+	start := time.Now()
+	isolation, err := s.run(ctx, cmd, env, out)
+	res := &Result{
+		Output:    out.String(),
+		Truncated: out.dropped > 0,
+		TimedOut:  errors.Is(ctx.Err(), context.DeadlineExceeded),
+		Duration:  time.Since(start),
+		Isolation: isolation,
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.As(err, &exitErr):
+		res.ExitCode = exitErr.ExitCode()
+	case ctx.Err() != nil:
+		res.ExitCode = -1
+	default:
+		return nil, fmt.Errorf("failed to run %s: %w", cmd.Args[0], err)
+	}
+	if res.Truncated {
+		res.Output += fmt.Sprintf("\n[%d bytes of output truncated]\n", out.dropped)
+	}
+	if res.TimedOut {
+		res.Output += "\n[killed: time limit exceeded]\n"
+	}
+	return res, nil
+}
+
+// capWriter keeps the first limit bytes written to it and counts the rest.
+type capWriter struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	limit   int
+	dropped int64
+}
+
+func (w *capWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	keep := len(p)
+	if w.limit > 0 {
+		keep = max(min(keep, w.limit-w.buf.Len()), 0)
+	}
+	w.buf.Write(p[:keep])
+	w.dropped += int64(len(p) - keep)
+	return len(p), nil
+}
+
+func (w *capWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return strings.ToValidUTF8(w.buf.String(), "")
+}
+
+// Sweep removes temporary HOME directories and snapshots left behind by
+// commands that could not be cleaned up, e.g. because the server was
+// restarted while they ran. Only HOME directories older than the time limit
+// are removed, so commands still running keep theirs. It returns how many
+// were removed.
+func (s *Sandbox) Sweep() int {
+	if s.opts.Limits.Timeout <= 0 {
+		return 0
+	}
+	return sweep(homePrefix, s.opts.Limits.Timeout+time.Minute) + sweep(snapshotPrefix, snapshotMaxAge)
+}
+
+func sweep(prefix string, maxAge time.Duration) int {
+	dirs, _ := filepath.Glob(filepath.Join(os.TempDir(), prefix+"*"))
+	removed := 0
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := removeAll(dir); err != nil {
+			slog.Warn("sandbox: failed to remove stale home", "path", dir, "error", err)
+			continue
+		}
+		removed++
+	}
+	return removed
+}
+
+// copyTree copies the directory src to dst, leaving out .git. Symlinks are
+// copied as they are; other special files are skipped.
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.Name() == ".git" && rel != "." {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.Mkdir(target, info.Mode().Perm()|0o700)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// removeAll removes path, including read-only directories such as those of
+// a Go module cache.
+func removeAll(path string) error {
+	if err := os.RemoveAll(path); err == nil {
+		return nil
+	}
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			os.Chmod(p, 0o700)
+		}
+		return nil
+	})
+	return os.RemoveAll(path)
+}
+
+// GoModCache returns the module cache of the server's Go toolchain, for
+// Options.GoModCache, or "" when it cannot be read.
+func GoModCache() string {
+	out, err := exec.Command("go", "env", "GOMODCACHE").Output()
+	if err != nil {
+		slog.Warn("sandbox: failed to read go env", "error", err)
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
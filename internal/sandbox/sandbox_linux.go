@@ -0,0 +1,293 @@
+//go:build linux
+
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitDelay bounds how long Wait waits for output after the process is
+// killed, in case a grandchild keeps the pipe open.
+const waitDelay = 5 * time.Second
+
+// hideProcess makes the server non-dumpable, which restricts its /proc
+// entries to root.
+func hideProcess() error {
+	return unix.Prctl(unix.PR_SET_DUMPABLE, 0, 0, 0, 0)
+}
+
+// dumpMu serializes starting commands in user namespaces, which makes the
+// server dumpable for a moment.
+var dumpMu sync.Mutex
+
+// start starts c. The ID maps of a user namespace are written through the
+// child's /proc entries, which are only accessible while the child, and so
+// the server it was cloned from, is dumpable.
+func start(c *exec.Cmd) error {
+	if c.SysProcAttr.Cloneflags&syscall.CLONE_NEWUSER == 0 {
+		return c.Start()
+	}
+	dumpMu.Lock()
+	defer dumpMu.Unlock()
+	if err := unix.Prctl(unix.PR_SET_DUMPABLE, 1, 0, 0, 0); err != nil {
+		return fmt.Errorf("failed to make the server dumpable: %w", err)
+	}
+	defer hideProcess()
+	return c.Start()
+}
+
+// procNamespaces reports whether commands can run in their own PID and
+// mount namespaces with a fresh /proc, trying it on first use.
+func (s *Sandbox) procNamespaces() bool {
+	s.probe.Do(func() {
+		env := s.env
+		if s.opts.GoModCache != "" {
+			env = append(slices.Clone(env), "SANDBOX_READONLY="+s.opts.GoModCache)
+		}
+		c := command(context.Background(), Command{Args: []string{"true"}}, env, io.Discard, nil, false, true, nil)
+		err := start(c)
+		if err == nil {
+			err = c.Wait()
+		}
+		if err != nil {
+			slog.Warn("sandbox: PID and mount namespaces unavailable, commands can see the server's processes", "error", err)
+			return
+		}
+		s.pidns = true
+	})
+	return s.pidns
+}
+
+func (s *Sandbox) run(ctx context.Context, cmd Command, env []string, out io.Writer) ([]string, error) {
+	pidns := s.procNamespaces()
+	s.mu.Lock()
+	netns := !s.opts.Network && !s.noNetns
+	useCgroup := s.opts.CgroupParent != "" && !s.noCgroups
+	s.mu.Unlock()
+
+	var cg *cgroup
+	if useCgroup {
+		var err error
+		if cg, err = newCgroup(s.opts.CgroupParent, s.opts.Limits); err != nil {
+			slog.Warn("sandbox: cgroups unavailable, using rlimits only", "error", err)
+			s.mu.Lock()
+			s.noCgroups = true
+			s.mu.Unlock()
+		} else {
+			defer cg.remove()
+		}
+	}
+
+	if _, err := exec.LookPath(cmd.Args[0]); err != nil {
+		return nil, err
+	}
+
+	for {
+		// The child waits on the gate until its rlimits are set, so they
+		// apply before the command runs.
+		gate, release, err := os.Pipe()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create pipe: %w", err)
+		}
+		c := command(ctx, cmd, env, out, gate, netns, pidns, cg)
+		err = start(c)
+		gate.Close()
+		if err != nil {
+			release.Close()
+			if netns && (errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOSPC)) {
+				slog.Warn("sandbox: network namespaces unavailable, commands keep network access", "error", err)
+				s.mu.Lock()
+				s.noNetns = true
+				s.mu.Unlock()
+				netns = false
+				continue
+			}
+			return nil, err
+		}
+
+		var isolation []string
+		if pidns {
+			isolation = append(isolation, "pidns")
+		}
+		if netns {
+			isolation = append(isolation, "netns")
+		}
+		if cg != nil {
+			isolation = append(isolation, "cgroup")
+		}
+		if err := setRlimits(c.Process.Pid, s.opts.Limits, cg == nil); err != nil {
+			slog.Warn("sandbox: failed to set rlimits", "error", err)
+		} else {
+			isolation = append(isolation, "rlimit")
+		}
+		release.Close()
+		return isolation, c.Wait()
+	}
+}
+
+// gateScript waits for stdin to close, then replaces the shell with the
+// command, which keeps the limits set on the shell.
+const gateScript = `read -r _; exec "$@"`
+
+// gateProcScript also mounts a /proc that shows only the command's PID
+// namespace, keeping the mount out of the server's namespace, and remounts
+// the directory in $SANDBOX_READONLY, if any, read-only.
+const gateProcScript = `read -r _; mount --make-rprivate / && mount -t proc proc /proc || exit 125
+if [ -n "$SANDBOX_READONLY" ]; then
+	mount --bind "$SANDBOX_READONLY" "$SANDBOX_READONLY" && mount -o remount,bind,ro "$SANDBOX_READONLY" || exit 125
+fi
+unset SANDBOX_READONLY; exec "$@"`
+
+// readOnlyMounts reports whether commands get their own mount namespace, in
+// which the module cache can be mounted read-only.
+func (s *Sandbox) readOnlyMounts() bool {
+	return s.procNamespaces()
+}
+
+func command(ctx context.Context, cmd Command, env []string, out io.Writer, gate *os.File, netns, pidns bool, cg *cgroup) *exec.Cmd {
+	script := gateScript
+	if pidns {
+		script = gateProcScript
+	}
+	args := append([]string{"-c", script, "sandbox"}, cmd.Args...)
+	c := exec.CommandContext(ctx, "/bin/sh", args...)
+	c.Dir = cmd.Dir
+	c.Env = env
+	if gate != nil {
+		c.Stdin = gate
+	}
+	c.Stdout = out
+	c.Stderr = out
+
+	attr := &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGKILL}
+	if netns {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	if pidns {
+		attr.Cloneflags |= syscall.CLONE_NEWPID | syscall.CLONE_NEWNS
+	}
+	if attr.Cloneflags != 0 && os.Geteuid() != 0 {
+		// Unprivileged users need a user namespace to own the other
+		// namespaces; map ourselves so files stay accessible. Mounting
+		// /proc needs root inside it.
+		uid, gid := os.Getuid(), os.Getgid()
+		if pidns {
+			uid, gid = 0, 0
+		}
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: os.Getuid(), Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: os.Getgid(), Size: 1}}
+	}
+	if cg != nil {
+		attr.UseCgroupFD = true
+		attr.CgroupFD = cg.fd
+	}
+	c.SysProcAttr = attr
+
+	// Kill the whole process group, and the cgroup, not just the child.
+	c.Cancel = func() error {
+		if cg != nil {
+			cg.kill()
+		}
+		return syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+	}
+	c.WaitDelay = waitDelay
+	return c
+}
+
+func setRlimits(pid int, l Limits, memory bool) error {
+	limits := map[int]uint64{unix.RLIMIT_CORE: 0}
+	if l.CPUTime > 0 {
+		limits[unix.RLIMIT_CPU] = uint64(l.CPUTime.Seconds())
+	}
+	if l.FileSize > 0 {
+		limits[unix.RLIMIT_FSIZE] = uint64(l.FileSize)
+	}
+	if memory && l.Memory > 0 {
+		limits[unix.RLIMIT_AS] = uint64(l.Memory)
+	}
+	for resource, value := range limits {
+		rl := unix.Rlimit{Cur: value, Max: value}
+		if err := unix.Prlimit(pid, resource, &rl, nil); err != nil {
+			return fmt.Errorf("failed to set rlimit %d: %w", resource, err)
+		}
+	}
+	return nil
+}
+
+// cgroup is a cgroup v2 created for one command.
+type cgroup struct {
+	path string
+	fd   int
+}
+
+func newCgroup(parent string, l Limits) (*cgroup, error) {
+	if _, err := os.Stat(filepath.Join(parent, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("%s is not a cgroup v2 directory: %w", parent, err)
+	}
+	path, err := os.MkdirTemp(parent, "sandbox-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %w", err)
+	}
+	cg := &cgroup{path: path, fd: -1}
+
+	settings := map[string]string{}
+	if l.Memory > 0 {
+		settings["memory.max"] = strconv.FormatInt(l.Memory, 10)
+		settings["memory.swap.max"] = "0"
+	}
+	if l.Processes > 0 {
+		settings["pids.max"] = strconv.Itoa(l.Processes)
+	}
+	for file, value := range settings {
+		if err := os.WriteFile(filepath.Join(path, file), []byte(value), 0); err != nil {
+			if file == "memory.swap.max" && errors.Is(err, os.ErrNotExist) {
+				continue // no swap accounting
+			}
+			cg.remove()
+			return nil, fmt.Errorf("failed to set %s: %w", file, err)
+		}
+	}
+
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		cg.remove()
+		return nil, fmt.Errorf("failed to open cgroup: %w", err)
+	}
+	cg.fd = fd
+	return cg, nil
+}
+
+// kill kills every process in the cgroup (Linux 5.14+).
+func (cg *cgroup) kill() {
+	os.WriteFile(filepath.Join(cg.path, "cgroup.kill"), []byte("1"), 0)
+}
+
+func (cg *cgroup) remove() {
+	cg.kill()
+	if cg.fd >= 0 {
+		unix.Close(cg.fd)
+	}
+	// The cgroup can only be removed once its processes have exited.
+	for range 50 {
+		if err := os.Remove(cg.path); err == nil || os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	slog.Warn("sandbox: failed to remove cgroup", "path", cg.path)
+}
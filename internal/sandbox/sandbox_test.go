@@ -0,0 +1,178 @@
+package sandbox_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yuki/flyagi/internal/sandbox"
+)
+
+func TestSandbox_Environment(t *testing.T) {
+	t.Setenv("GITHUB_TOKEN", "secret")
+	t.Setenv("FLYAGI_VISIBLE", "yes")
+	t.Setenv("ANTHROPIC_API_KEY", "secret")
+
+	sb := sandbox.New(sandbox.Options{
+		Limits:  sandbox.DefaultLimits(),
+		PassEnv: []string{"PATH", "FLYAGI_VISIBLE", "GITHUB_TOKEN"},
+		Env:     []string{"EXTRA=1"},
+	})
+	res, err := sb.Run(context.Background(), sandbox.Command{
+		Dir:  t.TempDir(),
+		Args: []string{"sh", "-c", "env; test -w \"$HOME\" && echo home-writable"},
+		Env:  []string{"PER_COMMAND=2"},
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if !res.Passed() {
+		t.Fatalf("command failed: %+v", res)
+	}
+
+	for _, want := range []string{"FLYAGI_VISIBLE=yes", "EXTRA=1", "PER_COMMAND=2", "home-writable"} {
+		if !strings.Contains(res.Output, want) {
+			t.Errorf("output missing %q:\n%s", want, res.Output)
+		}
+	}
+	if strings.Contains(res.Output, "secret") {
+		t.Errorf("secrets leaked into the sandbox:\n%s", res.Output)
+	}
+	if home, _ := os.UserHomeDir(); strings.Contains(res.Output, "HOME="+home+"\n") {
+		t.Errorf("sandbox uses the server's HOME:\n%s", res.Output)
+	}
+}
+
+func TestSandbox_Limits(t *testing.T) {
+	limits := sandbox.DefaultLimits()
+	limits.Output = 100
+	limits.Timeout = 300 * time.Millisecond
+	sb := sandbox.New(sandbox.Options{Limits: limits})
+
+	res, err := sb.Run(context.Background(), sandbox.Command{
+		Args: []string{"sh", "-c", "yes flyagi | head -c 10000; exit 3"},
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if res.ExitCode != 3 || res.Passed() {
+		t.Errorf("expected exit code 3, got %+v", res)
+	}
+	if !res.Truncated || !strings.HasPrefix(res.Output, strings.Repeat("flyagi\n", 14)) || len(res.Output) > 200 {
+		t.Errorf("expected output capped at 100 bytes, got %d bytes:\n%s", len(res.Output), res.Output)
+	}
+
+	// The background sleep holds the output pipe; it must be killed too.
+	start := time.Now()
+	res, err = sb.Run(context.Background(), sandbox.Command{
+		Args: []string{"sh", "-c", "sleep 30 & sleep 30"},
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if !res.TimedOut || res.Passed() {
+		t.Errorf("expected a timeout, got %+v", res)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("timed out command took %s to stop", elapsed)
+	}
+
+	// Cancelling the caller's context kills the command but is no timeout.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	res, err = sb.Run(ctx, sandbox.Command{Args: []string{"sleep", "30"}})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if res.TimedOut || res.Passed() {
+		t.Errorf("expected a cancelled command, got %+v", res)
+	}
+
+	if _, err := sb.Run(context.Background(), sandbox.Command{Args: []string{"flyagi-no-such-command"}}); err == nil {
+		t.Error("expected an error for a missing command")
+	}
+}
+
+func TestSandbox_Isolation(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "file"), []byte("original\n"), 0644)
+	os.Mkdir(filepath.Join(dir, ".git"), 0755)
+
+	sb := sandbox.New(sandbox.Options{Limits: sandbox.DefaultLimits()})
+	res, err := sb.Run(context.Background(), sandbox.Command{
+		Dir:  dir,
+		Args: []string{"sh", "-c", "test ! -e .git && cat file && echo changed > file && echo new > created && ls -d /proc/[0-9]* | wc -l"},
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if !res.Passed() || !strings.HasPrefix(res.Output, "original\n") {
+		t.Fatalf("command failed: %+v", res)
+	}
+
+	// The command ran in a copy.
+	if content, _ := os.ReadFile(filepath.Join(dir, "file")); string(content) != "original\n" {
+		t.Errorf("original changed: %q", content)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "created")); !os.IsNotExist(err) {
+		t.Errorf("file created in the original: %v", err)
+	}
+
+	if !slices.Contains(res.Isolation, "pidns") {
+		t.Skipf("PID namespaces unavailable: %v", res.Isolation)
+	}
+	// Only the command's own processes are visible in /proc.
+	var procs int
+	fmt.Sscan(strings.TrimPrefix(res.Output, "original\n"), &procs)
+	if procs == 0 || procs > 5 {
+		t.Errorf("command sees %d processes", procs)
+	}
+}
+
+func TestSandbox_InPlace(t *testing.T) {
+	dir, cleanup, err := sandbox.Snapshot(t.TempDir())
+	if err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	defer cleanup()
+
+	sb := sandbox.New(sandbox.Options{Limits: sandbox.DefaultLimits()})
+	res, err := sb.Run(context.Background(), sandbox.Command{Dir: dir, InPlace: true, Args: []string{"sh", "-c", "echo built > out"}})
+	if err != nil || !res.Passed() {
+		t.Fatalf("Run failed: %v %+v", err, res)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "out")); string(content) != "built\n" {
+		t.Errorf("command did not run in the directory: %q", content)
+	}
+}
+
+func TestSandbox_GoModCache(t *testing.T) {
+	t.Setenv("GOCACHE", "/server/cache")
+	modCache := t.TempDir()
+	os.WriteFile(filepath.Join(modCache, "module"), []byte("original\n"), 0644)
+
+	sb := sandbox.New(sandbox.Options{Limits: sandbox.DefaultLimits(), GoModCache: modCache})
+	res, err := sb.Run(context.Background(), sandbox.Command{
+		Args: []string{"sh", "-c", `cat "$GOMODCACHE/module"; echo poisoned > "$GOMODCACHE/module"; echo "cache=$GOCACHE proxy=$GOPROXY flags=$GOFLAGS"`},
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if !strings.HasPrefix(res.Output, "original\n") {
+		t.Fatalf("module cache not readable: %+v", res)
+	}
+	if !strings.Contains(res.Output, "proxy=off flags=-mod=readonly") {
+		t.Errorf("Go environment not locked down:\n%s", res.Output)
+	}
+	if strings.Contains(res.Output, "cache=/server/cache") {
+		t.Errorf("command uses the server's build cache:\n%s", res.Output)
+	}
+	if content, _ := os.ReadFile(filepath.Join(modCache, "module")); string(content) != "original\n" {
+		t.Errorf("module cache changed: %q", content)
+	}
+}
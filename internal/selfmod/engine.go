@@ -3,6 +3,7 @@ package selfmod
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
@@ -12,19 +13,21 @@ import (
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/sergi/go-diff/diffmatchpatch"
 
+	"github.com/yuki/flyagi/internal/codeindex"
+	"github.com/yuki/flyagi/internal/codesearch"
+	"github.com/yuki/flyagi/internal/git"
 	"github.com/yuki/flyagi/internal/provider"
 )
 
 // protectedPaths are files that cannot be modified.
 var protectedPaths = map[string]bool{
-	"Dockerfile":             true,
-	"fly.toml":               true,
-	".github":                true,
-	".env":                   true,
-	".env.local":             true,
-	".env.production":        true,
+	"Dockerfile":      true,
+	"fly.toml":        true,
+	".github":         true,
+	".env":            true,
+	".env.local":      true,
+	".env.production": true,
 }
 
 // FileChange represents a single file modification.
@@ -34,34 +37,214 @@ type FileChange struct {
 	NewContent string `json:"new_content,omitempty"`
 }
 
+// content returns the file content after the change.
+func (c FileChange) content() string {
+	if c.Action == "delete" {
+		return ""
+	}
+	return c.NewContent
+}
+
 // ChangeRequest represents a pending code modification.
 type ChangeRequest struct {
 	ID          string       `json:"id"`
 	Description string       `json:"description"`
+	Request     string       `json:"request"` // originating chat message, issue or review comment
+	Changes     []FileChange `json:"changes"`
+	Diffs       []FileDiff   `json:"diffs"`
+	Status      string       `json:"status"` // "pending", "approved", "rejected", "expired", "cancelled", "applied", "merged", "closed"
+	CreatedAt   time.Time    `json:"created_at"`
+
+	// Branch and PRNumber are set for follow-up requests that must be
+	// committed onto an existing selfmod pull request, and recorded once a
+	// pull request has been opened for an approved request. Base is the
+	// revision the request was diffed against, e.g. the branch of a
+	// follow-up; empty for the working tree.
+	Branch   string `json:"branch,omitempty"`
+	Base     string `json:"base,omitempty"`
+	PRNumber int    `json:"pr_number,omitempty"`
+	PRURL    string `json:"pr_url,omitempty"`
+
+	// IssueNumber is set when the request originates from a GitHub issue.
+	IssueNumber int `json:"issue_number,omitempty"`
+
+	// Verification holds the results of checks run against the change.
+	Verification []VerificationResult `json:"verification,omitempty"`
+
+	// MergeDecisions records every auto-merge policy decision for the
+	// request's pull request.
+	MergeDecisions []MergeDecision `json:"merge_decisions,omitempty"`
+
+	// Declined lists the parts of the proposal left out when the request
+	// was approved in part.
+	Declined []DeclinedChange `json:"declined,omitempty"`
+
+	// Findings are the safety scanner's results for the changes. High
+	// severity ones block approval unless Override is set.
+	Findings []Finding       `json:"findings,omitempty"`
+	Override *SafetyOverride `json:"override,omitempty"`
+
+	// RevertOf is set on requests created by Revert.
+	RevertOf string `json:"revert_of,omitempty"`
+
+	// Revision counts the proposals made for the request, starting at 1.
+	// Revisions keeps the earlier ones, oldest first.
+	Revision  int        `json:"revision"`
+	Revisions []Revision `json:"revisions,omitempty"`
+	RevisedAt time.Time  `json:"revised_at,omitempty"`
+
+	// previous holds the changes that undo this request, captured when it
+	// is applied.
+	previous []FileChange
+	// unselected keeps the whole proposal of a request approved in part, so
+	// Unapply can restore it.
+	unselected *unselected
+}
+
+// unselected is what ApproveSelection narrows a request from.
+type unselected struct {
+	changes  []FileChange
+	diffs    []FileDiff
+	declined []DeclinedChange
+	findings []Finding
+}
+
+// Revision is an earlier proposal for a change request, kept when the
+// request is refined.
+type Revision struct {
+	Number      int          `json:"number"`
+	Description string       `json:"description"`
 	Changes     []FileChange `json:"changes"`
 	Diffs       []FileDiff   `json:"diffs"`
-	Status      string       `json:"status"` // "pending", "approved", "rejected", "applied"
 	CreatedAt   time.Time    `json:"created_at"`
+	// Feedback is what the reviewer asked to change about this revision.
+	Feedback string `json:"feedback"`
 }
 
+// MergeDecision is the outcome of evaluating the merge policy for a pull request.
+type MergeDecision struct {
+	At     time.Time `json:"at"`
+	Action string    `json:"action"` // "merge", "auto_merge", "wait", "ineligible", "closed"
+	Reason string    `json:"reason"`
+}
+
+// VerificationResult is the outcome of a single verification command.
+type VerificationResult struct {
+	Name     string        `json:"name"`
+	Passed   bool          `json:"passed"`
+	Output   string        `json:"output,omitempty"`
+	TimedOut bool          `json:"timed_out,omitempty"`
+	Duration time.Duration `json:"duration,omitempty"`
+}
+
+// FollowUp describes a reviewer comment on an existing selfmod pull request.
+type FollowUp struct {
+	Branch   string
+	PRNumber int
+	Comment  string
+	Path     string // file the comment is attached to, if any
+	Line     int
+	Diff     string // current diff of the pull request
+	// Base is the revision of the branch tip, e.g. "origin/selfmod/...",
+	// which the follow-up is diffed and scanned against. Empty uses the
+	// working tree.
+	Base string
+}
+
+// maxFollowUpDiff bounds how much of the pull request diff is sent to the LLM.
+const maxFollowUpDiff = 64 << 10
+
 // FileDiff represents a unified diff for a file.
 type FileDiff struct {
-	Path string `json:"path"`
-	Diff string `json:"diff"`
+	Path       string `json:"path"`
+	OldPath    string `json:"old_path,omitempty"` // set for renames
+	Status     string `json:"status"`             // DiffAdded, DiffModified, DiffDeleted or DiffRenamed
+	Similarity int    `json:"similarity,omitempty"`
+	Binary     bool   `json:"binary,omitempty"`
+	Diff       string `json:"diff"` // git-style unified diff
+	Additions  int    `json:"additions"`
+	Deletions  int    `json:"deletions"`
+	Hunks      []Hunk `json:"hunks,omitempty"`
+}
+
+// GitHistory is the part of git.Service the engine uses as context and to
+// read the branches of follow-ups and the base revision.
+type GitHistory interface {
+	Log(opts git.LogOptions) ([]git.CommitInfo, error)
+	FileAt(file, rev string) (string, error)
+	Files(rev string) ([]string, error)
 }
 
+// Retriever finds code relevant to a request, e.g. a codeindex.Index.
+type Retriever interface {
+	Search(ctx context.Context, query string, k int) ([]codeindex.Hit, error)
+}
+
+// recentCommits is how many commits are included in the LLM context.
+const recentCommits = 10
+
+// Retrieval limits for the LLM context.
+const (
+	retrievalK      = 8
+	retrievalBudget = 24 << 10
+)
+
 // Engine handles self-modification of the codebase.
 type Engine struct {
-	mu       sync.Mutex
-	repoPath string
-	requests sync.Map // map[string]*ChangeRequest
-	history  []*ChangeRequest
-	histMu   sync.RWMutex
+	// mu guards the working tree: it is written with mu held and read
+	// with it held for reading.
+	mu        sync.RWMutex
+	repoPath  string
+	git       GitHistory
+	retriever Retriever
+	scanner   *Scanner
+	runner    Runner
+	checks    []Check
+	base      string // revision new requests are read and diffed at; "" is the working tree
+	onStatus  func(cr *ChangeRequest, status string)
+	retention Retention
+	requests  sync.Map // map[string]*ChangeRequest
+	// diffContext is the number of context lines around diff hunks.
+	diffContext int
+	history     []*ChangeRequest
+	histMu      sync.RWMutex
 }
 
 // NewEngine creates a new self-modification engine.
 func NewEngine(repoPath string) *Engine {
-	return &Engine{repoPath: repoPath}
+	return &Engine{repoPath: repoPath, diffContext: DefaultContextLines, scanner: NewScanner(nil)}
+}
+
+// SetScanner replaces the safety scanner run over proposed changes.
+func (e *Engine) SetScanner(s *Scanner) {
+	e.scanner = s
+}
+
+// SetDiffContext sets the number of unchanged lines shown around each diff
+// hunk. Hunk IDs used for partial approval depend on it.
+func (e *Engine) SetDiffContext(n int) {
+	if n >= 0 {
+		e.diffContext = n
+	}
+}
+
+// SetRetriever adds code snippets relevant to each request to the context
+// sent to the LLM.
+func (e *Engine) SetRetriever(r Retriever) {
+	e.retriever = r
+}
+
+// SetGit adds recent commit history to the context sent to the LLM.
+func (e *Engine) SetGit(g GitHistory) {
+	e.git = g
+}
+
+// SetBase makes new change requests take their context from rev and diff
+// against it, instead of the working tree. Set it to the pull request base
+// branch, e.g. "origin/main", when approvals switch the working tree to
+// other branches. It requires SetGit.
+func (e *Engine) SetBase(rev string) {
+	e.base = rev
 }
 
 const systemPrompt = `You are a code modification assistant. When the user asks for code changes, respond with a JSON object containing file modifications.
@@ -88,42 +271,152 @@ Rules:
 
 // GenerateChanges asks the LLM to generate code modifications.
 func (e *Engine) GenerateChanges(ctx context.Context, llm provider.LLMProvider, userRequest string) (*ChangeRequest, error) {
+	cr, err := e.generate(ctx, llm, userRequest, e.base)
+	if err != nil {
+		return nil, err
+	}
+
+	e.track(cr)
+	return cr, nil
+}
+
+// GenerateFollowUp asks the LLM to address a reviewer comment on an existing
+// pull request. The resulting change request targets the pull request's branch.
+func (e *Engine) GenerateFollowUp(ctx context.Context, llm provider.LLMProvider, f FollowUp) (*ChangeRequest, error) {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "This is a follow-up on pull request #%d (branch %s), which contains these changes:\n\n", f.PRNumber, f.Branch)
+	sb.WriteString("```diff\n" + truncate(f.Diff, maxFollowUpDiff) + "\n```\n\n")
+	if f.Path != "" {
+		if history := e.gitHistory(f.Base, f.Path, 5); history != "" {
+			fmt.Fprintf(&sb, "Recent commits touching %s:\n%s\n", f.Path, history)
+		}
+		fmt.Fprintf(&sb, "A reviewer commented on %s line %d:\n", f.Path, f.Line)
+	} else {
+		sb.WriteString("A reviewer commented:\n")
+	}
+	sb.WriteString(f.Comment + "\n\n")
+	sb.WriteString("Update the files to address the comment. Output the complete new content of every file you change, including the changes already in the pull request.")
+
+	cr, err := e.generate(ctx, llm, sb.String(), f.Base)
+	if err != nil {
+		return nil, err
+	}
+	cr.Request = f.Comment
+	cr.Branch = f.Branch
+	cr.PRNumber = f.PRNumber
+
+	e.track(cr)
+	return cr, nil
+}
+
+// Refine asks the LLM to revise a pending change request according to
+// reviewer feedback. The request keeps its ID; the current proposal is moved
+// to Revisions and replaced by the new one.
+func (e *Engine) Refine(ctx context.Context, llm provider.LLMProvider, requestID, feedback string) (*ChangeRequest, error) {
+	cr, ok := e.GetRequest(requestID)
+	if !ok {
+		return nil, fmt.Errorf("change request %q not found", requestID)
+	}
+
+	e.histMu.RLock()
+	status, revision, description := cr.Status, cr.Revision, cr.Description
+	changes := append([]FileChange(nil), cr.Changes...)
+	e.histMu.RUnlock()
+	if status != "pending" {
+		return nil, fmt.Errorf("change request is %s, not pending", status)
+	}
+
+	proposal, err := json.MarshalIndent(changes, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode proposal: %w", err)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Original request:\n%s\n\n", cr.Request)
+	fmt.Fprintf(&sb, "You proposed this change (revision %d): %s\n", revision, description)
+	sb.WriteString("```json\n" + truncate(string(proposal), maxFollowUpDiff) + "\n```\n\n")
+	fmt.Fprintf(&sb, "The reviewer's feedback on it:\n%s\n\n", feedback)
+	sb.WriteString("Produce a revised proposal that addresses the feedback. List every change the revised proposal makes, including the parts of the previous one you keep, with complete file contents. Files left out are not changed.")
+
+	revised, err := e.generate(ctx, llm, sb.String(), cr.Base)
+	if err != nil {
+		return nil, err
+	}
+
+	// The request may have been approved, expired or refined by someone
+	// else during generation.
 	e.mu.Lock()
 	defer e.mu.Unlock()
+	e.histMu.Lock()
+	defer e.histMu.Unlock()
+	if cr.Status != "pending" {
+		return nil, fmt.Errorf("change request is %s, not pending", cr.Status)
+	}
+	if cr.Revision != revision {
+		return nil, fmt.Errorf("change request was revised to revision %d meanwhile", cr.Revision)
+	}
+	created := cr.RevisedAt
+	if created.IsZero() {
+		created = cr.CreatedAt
+	}
+	cr.Revisions = append(cr.Revisions, Revision{
+		Number:      cr.Revision,
+		Description: cr.Description,
+		Changes:     cr.Changes,
+		Diffs:       cr.Diffs,
+		CreatedAt:   created,
+		Feedback:    feedback,
+	})
+	cr.Revision++
+	cr.Description = revised.Description
+	cr.Changes = revised.Changes
+	cr.Diffs = revised.Diffs
+	cr.Findings = revised.Findings
+	cr.Override = nil // overrides apply to the revision they were given for
+	cr.RevisedAt = revised.CreatedAt
+	return cr, nil
+}
+
+// GenerateFromIssue asks the LLM to implement the work described by an issue.
+func (e *Engine) GenerateFromIssue(ctx context.Context, llm provider.LLMProvider, number int, title, body string) (*ChangeRequest, error) {
+	cr, err := e.generate(ctx, llm, fmt.Sprintf("Issue #%d: %s\n\n%s", number, title, body), e.base)
+	if err != nil {
+		return nil, err
+	}
+	cr.Request = title + "\n\n" + body
+	cr.IssueNumber = number
+
+	e.track(cr)
+	return cr, nil
+}
 
+// generate asks the LLM for a proposal and diffs it against the files at
+// base, or in the working tree when base is empty.
+func (e *Engine) generate(ctx context.Context, llm provider.LLMProvider, userRequest, base string) (*ChangeRequest, error) {
 	// Collect codebase context
-	codeContext, err := e.collectContext()
+	e.mu.RLock()
+	codeContext, err := e.collectContext(base)
+	e.mu.RUnlock()
 	if err != nil {
 		return nil, fmt.Errorf("failed to collect context: %w", err)
 	}
 
+	if snippets := e.relevantCode(ctx, userRequest); snippets != "" {
+		codeContext += "\nRelevant code:\n" + snippets
+	}
+
 	messages := []provider.Message{
 		{Role: "system", Content: systemPrompt},
 		{Role: "user", Content: fmt.Sprintf("Project structure:\n%s\n\nRequest: %s", codeContext, userRequest)},
 	}
 
-	var response strings.Builder
-	err = llm.ChatStream(ctx, messages, func(chunk provider.StreamChunk) error {
-		response.WriteString(chunk.Content)
-		return nil
-	})
+	llmResp, err := e.complete(ctx, llm, messages, base)
 	if err != nil {
-		return nil, fmt.Errorf("LLM request failed: %w", err)
-	}
-
-	// Parse LLM response
-	var llmResp struct {
-		Description string       `json:"description"`
-		Changes     []FileChange `json:"changes"`
+		return nil, err
 	}
 
-	responseText := response.String()
-	// Try to extract JSON from response
-	responseText = extractJSON(responseText)
-
-	if err := json.Unmarshal([]byte(responseText), &llmResp); err != nil {
-		return nil, fmt.Errorf("failed to parse LLM response: %w (response: %s)", err, truncate(responseText, 200))
-	}
+	e.mu.RLock()
+	defer e.mu.RUnlock()
 
 	// Validate changes
 	for _, change := range llmResp.Changes {
@@ -133,31 +426,53 @@ func (e *Engine) GenerateChanges(ctx context.Context, llm provider.LLMProvider,
 	}
 
 	// Generate diffs
-	diffs, err := e.generateDiffs(llmResp.Changes)
+	diffs, err := e.generateDiffs(llmResp.Changes, base)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate diffs: %w", err)
 	}
 
+	findings, err := e.scan(llmResp.Changes, base)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan changes: %w", err)
+	}
+	if len(findings) > 0 {
+		slog.Warn("safety findings in proposed changes", "findings", len(findings), "blocking", HasBlocking(findings))
+	}
+
 	cr := &ChangeRequest{
 		ID:          uuid.New().String(),
 		Description: llmResp.Description,
+		Request:     userRequest,
 		Changes:     llmResp.Changes,
 		Diffs:       diffs,
+		Findings:    findings,
 		Status:      "pending",
 		CreatedAt:   time.Now(),
+		Base:        base,
+		Revision:    1,
 	}
 
+	return cr, nil
+}
+
+func (e *Engine) track(cr *ChangeRequest) {
 	e.requests.Store(cr.ID, cr)
 
 	e.histMu.Lock()
 	e.history = append(e.history, cr)
 	e.histMu.Unlock()
-
-	return cr, nil
 }
 
 // ApproveAndApply applies an approved change request to the filesystem.
 func (e *Engine) ApproveAndApply(requestID string) error {
+	return e.ApproveSelection(requestID, nil)
+}
+
+// ApproveSelection applies the selected parts of a change request, or all
+// of it when sel is nil. The request is narrowed to what was applied, so
+// commits and pull requests describe only that, and the rest is recorded in
+// Declined.
+func (e *Engine) ApproveSelection(requestID string, sel *Selection) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
@@ -171,7 +486,125 @@ func (e *Engine) ApproveAndApply(requestID string) error {
 		return fmt.Errorf("change request is %s, not pending", cr.Status)
 	}
 
-	for _, change := range cr.Changes {
+	if sel != nil {
+		changes, declined, err := e.selectChanges(cr, sel)
+		if err != nil {
+			return fmt.Errorf("invalid selection: %w", err)
+		}
+		diffs, err := e.generateDiffs(changes, "")
+		if err != nil {
+			return fmt.Errorf("failed to generate diffs: %w", err)
+		}
+		// Declined parts no longer count against the request.
+		findings, err := e.scan(changes, "")
+		if err != nil {
+			return fmt.Errorf("failed to scan changes: %w", err)
+		}
+		if HasBlocking(findings) && cr.Override == nil {
+			return fmt.Errorf("change request is %w", ErrBlocked)
+		}
+		e.histMu.Lock()
+		cr.unselected = &unselected{cr.Changes, cr.Diffs, cr.Declined, cr.Findings}
+		cr.Changes, cr.Diffs, cr.Declined, cr.Findings = changes, diffs, declined, findings
+		e.histMu.Unlock()
+		if len(declined) > 0 {
+			slog.Info("change request approved in part", "request_id", cr.ID, "applied", len(changes), "declined", len(declined))
+		}
+	} else if HasBlocking(cr.Findings) && cr.Override == nil {
+		return fmt.Errorf("change request is %w", ErrBlocked)
+	}
+
+	previous, err := e.inverse(cr.Changes)
+	if err != nil {
+		return err
+	}
+
+	if err := e.write(cr.Changes); err != nil {
+		return err
+	}
+
+	e.histMu.Lock()
+	cr.Status = "approved"
+	cr.previous = previous
+	e.histMu.Unlock()
+	return nil
+}
+
+// Cancel marks a change request as "cancelled". If it was applied by this
+// server, its files are first restored to what they were before.
+func (e *Engine) Cancel(requestID string) error {
+	cr, ok := e.GetRequest(requestID)
+	if !ok {
+		return fmt.Errorf("change request %q not found", requestID)
+	}
+
+	e.mu.Lock()
+	e.histMu.RLock()
+	previous, status := cr.previous, cr.Status
+	e.histMu.RUnlock()
+	if finished(status) {
+		e.mu.Unlock()
+		return fmt.Errorf("change request is already %s", status)
+	}
+	if previous != nil {
+		if err := e.write(previous); err != nil {
+			e.mu.Unlock()
+			return fmt.Errorf("failed to restore files: %w", err)
+		}
+	}
+	e.histMu.Lock()
+	cr.previous = nil
+	e.histMu.Unlock()
+	e.mu.Unlock()
+
+	return e.SetStatus(requestID, "cancelled")
+}
+
+// Unapply undoes ApproveSelection for a request whose approval failed
+// later on: its files are restored and it is pending again, with its whole
+// proposal if it was approved in part.
+func (e *Engine) Unapply(requestID string) error {
+	cr, ok := e.GetRequest(requestID)
+	if !ok {
+		return fmt.Errorf("change request %q not found", requestID)
+	}
+
+	e.mu.Lock()
+	e.histMu.RLock()
+	previous, status := cr.previous, cr.Status
+	e.histMu.RUnlock()
+	if status != "approved" {
+		e.mu.Unlock()
+		return fmt.Errorf("change request is %s, not approved", status)
+	}
+	if err := e.write(previous); err != nil {
+		e.mu.Unlock()
+		return fmt.Errorf("failed to restore files: %w", err)
+	}
+	e.histMu.Lock()
+	cr.previous = nil
+	if p := cr.unselected; p != nil {
+		cr.Changes, cr.Diffs, cr.Declined, cr.Findings = p.changes, p.diffs, p.declined, p.findings
+		cr.unselected = nil
+	}
+	e.histMu.Unlock()
+	e.mu.Unlock()
+
+	return e.SetStatus(requestID, "pending")
+}
+
+// LockTree runs fn with the working tree locked, for git operations that
+// rewrite it such as switching branches, so generations, approvals and
+// verification never see it half switched.
+func (e *Engine) LockTree(fn func() error) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return fn()
+}
+
+// write applies changes to the working tree. Callers must hold e.mu.
+func (e *Engine) write(changes []FileChange) error {
+	for _, change := range changes {
 		fullPath := filepath.Join(e.repoPath, change.Path)
 
 		switch change.Action {
@@ -191,22 +624,210 @@ func (e *Engine) ApproveAndApply(requestID string) error {
 			slog.Info("applied change", "action", "delete", "path", change.Path)
 		}
 	}
+	return nil
+}
 
-	cr.Status = "approved"
+// inverse returns the changes that restore the current contents of the
+// files touched by changes.
+func (e *Engine) inverse(changes []FileChange) ([]FileChange, error) {
+	var undo []FileChange
+	for _, change := range changes {
+		data, err := os.ReadFile(filepath.Join(e.repoPath, change.Path))
+		switch {
+		case os.IsNotExist(err):
+			if change.Action != "delete" {
+				undo = append(undo, FileChange{Path: change.Path, Action: "delete"})
+			}
+		case err != nil:
+			return nil, fmt.Errorf("failed to read %s: %w", change.Path, err)
+		case change.Action == "delete":
+			undo = append(undo, FileChange{Path: change.Path, Action: "create", NewContent: string(data)})
+		default:
+			undo = append(undo, FileChange{Path: change.Path, Action: "modify", NewContent: string(data)})
+		}
+	}
+	return undo, nil
+}
+
+// Revert creates a pending change request that undoes an applied or merged
+// one. It goes through the same approval flow as any other change. The
+// revert is the inverse of the request's changes, so it is refused when any
+// of its files changed since, at the base or in the working tree.
+func (e *Engine) Revert(requestID string) (*ChangeRequest, error) {
+	orig, ok := e.GetRequest(requestID)
+	if !ok {
+		return nil, fmt.Errorf("change request %q not found", requestID)
+	}
+
+	e.histMu.RLock()
+	previous, changes, status, description := orig.previous, orig.Changes, orig.Status, orig.Description
+	e.histMu.RUnlock()
+	if status != "applied" && status != "merged" {
+		return nil, fmt.Errorf("change request is %s, not applied or merged", status)
+	}
+	if previous == nil {
+		return nil, fmt.Errorf("change request %q has not been applied by this server", requestID)
+	}
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for _, c := range changes {
+		content, exists, err := e.fileAt(c.Path, e.base)
+		if err != nil {
+			return nil, err
+		}
+		if exists == (c.Action == "delete") || content != c.content() {
+			return nil, fmt.Errorf("%s changed since change request %q was applied", c.Path, requestID)
+		}
+	}
+
+	diffs, err := e.generateDiffs(previous, e.base)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate diffs: %w", err)
+	}
+	findings, err := e.scan(previous, e.base)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan changes: %w", err)
+	}
+
+	cr := &ChangeRequest{
+		ID:          uuid.New().String(),
+		Description: "Revert: " + description,
+		Request:     "/revert " + requestID,
+		Changes:     previous,
+		Diffs:       diffs,
+		Findings:    findings,
+		Status:      "pending",
+		CreatedAt:   time.Now(),
+		Base:        e.base,
+		RevertOf:    requestID,
+		Revision:    1,
+	}
+	e.track(cr)
+	return cr, nil
+}
+
+// OverrideFindings records that by accepts the high-severity findings of a
+// pending change request, so it can be approved. Callers must check that by
+// is an admin.
+func (e *Engine) OverrideFindings(requestID string, o SafetyOverride) error {
+	cr, ok := e.GetRequest(requestID)
+	if !ok {
+		return fmt.Errorf("change request %q not found", requestID)
+	}
+
+	e.histMu.Lock()
+	defer e.histMu.Unlock()
+	if cr.Status != "pending" {
+		return fmt.Errorf("change request is %s, not pending", cr.Status)
+	}
+	o.At = time.Now()
+	cr.Override = &o
+	slog.Warn("safety findings overridden", "request_id", cr.ID, "by", o.By, "role", o.Role, "name", o.Name, "findings", len(cr.Findings))
 	return nil
 }
 
-// Reject marks a change request as rejected.
+// Reject marks a pending change request as rejected.
 func (e *Engine) Reject(requestID string) error {
-	val, ok := e.requests.Load(requestID)
+	cr, ok := e.GetRequest(requestID)
 	if !ok {
 		return fmt.Errorf("change request %q not found", requestID)
 	}
-	cr := val.(*ChangeRequest)
-	cr.Status = "rejected"
+
+	// Approvals check the status under e.mu.
+	e.mu.Lock()
+	e.histMu.RLock()
+	status := cr.Status
+	e.histMu.RUnlock()
+	if status != "pending" {
+		e.mu.Unlock()
+		return fmt.Errorf("change request is %s, not pending", status)
+	}
+	err := e.SetStatus(requestID, "rejected")
+	e.mu.Unlock()
+	return err
+}
+
+// RecordPR records the pull request opened for an approved change request.
+func (e *Engine) RecordPR(requestID string, number int, url, branch string) error {
+	cr, ok := e.GetRequest(requestID)
+	if !ok {
+		return fmt.Errorf("change request %q not found", requestID)
+	}
+
+	e.histMu.Lock()
+	defer e.histMu.Unlock()
+	cr.PRNumber = number
+	cr.PRURL = url
+	cr.Branch = branch
 	return nil
 }
 
+// PRClosed records on the approved requests of pull request number that it
+// was merged, or closed without being merged. It returns how many requests
+// changed.
+func (e *Engine) PRClosed(number int, merged bool) int {
+	status := "closed"
+	if merged {
+		status = "merged"
+	}
+	n := 0
+	for _, cr := range e.Requests() {
+		if cr.PRNumber == number && cr.Status == "approved" && e.SetStatus(cr.ID, status) == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// RecordMergeDecision appends a merge decision to a change request unless it
+// repeats the previous one. It reports whether the decision was recorded.
+func (e *Engine) RecordMergeDecision(requestID string, d MergeDecision) bool {
+	cr, ok := e.GetRequest(requestID)
+	if !ok {
+		return false
+	}
+
+	e.histMu.Lock()
+	defer e.histMu.Unlock()
+	if n := len(cr.MergeDecisions); n > 0 {
+		last := cr.MergeDecisions[n-1]
+		if last.Action == d.Action && last.Reason == d.Reason {
+			return false
+		}
+	}
+	if d.At.IsZero() {
+		d.At = time.Now()
+	}
+	cr.MergeDecisions = append(cr.MergeDecisions, d)
+	return true
+}
+
+// SetStatus updates the status of a change request.
+func (e *Engine) SetStatus(requestID, status string) error {
+	cr, ok := e.GetRequest(requestID)
+	if !ok {
+		return fmt.Errorf("change request %q not found", requestID)
+	}
+
+	e.histMu.Lock()
+	changed := cr.Status != status
+	cr.Status = status
+	e.histMu.Unlock()
+
+	if changed && e.onStatus != nil {
+		e.onStatus(cr, status)
+	}
+	return nil
+}
+
+// OnStatusChange registers fn to be called when SetStatus changes the status
+// of a request, e.g. to "merged".
+func (e *Engine) OnStatusChange(fn func(cr *ChangeRequest, status string)) {
+	e.onStatus = fn
+}
+
 // GetRequest returns a change request by ID.
 func (e *Engine) GetRequest(id string) (*ChangeRequest, bool) {
 	val, ok := e.requests.Load(id)
@@ -225,43 +846,131 @@ func (e *Engine) History() []*ChangeRequest {
 	return result
 }
 
-func (e *Engine) collectContext() (string, error) {
+// Requests returns a copy of every change request, oldest first, taken
+// under histMu so it can be read while the requests change.
+func (e *Engine) Requests() []ChangeRequest {
+	e.histMu.RLock()
+	defer e.histMu.RUnlock()
+	result := make([]ChangeRequest, len(e.history))
+	for i, cr := range e.history {
+		result[i] = *cr
+	}
+	return result
+}
+
+// collectContext lists the files and recent commits at rev, or in the
+// working tree when rev is empty.
+func (e *Engine) collectContext(rev string) (string, error) {
 	var sb strings.Builder
 	sb.WriteString("File tree:\n")
 
-	err := filepath.Walk(e.repoPath, func(path string, info os.FileInfo, err error) error {
+	if rev != "" {
+		if e.git == nil {
+			return "", fmt.Errorf("cannot list files at %s: git is not configured", rev)
+		}
+		files, err := e.git.Files(rev)
 		if err != nil {
-			return err
+			return "", err
 		}
-		if info.IsDir() {
-			base := filepath.Base(path)
-			if strings.HasPrefix(base, ".") || base == "node_modules" || base == "vendor" || base == "dist" {
-				return filepath.SkipDir
+		for _, f := range files {
+			if !skipped(f) {
+				sb.WriteString("  " + f + "\n")
 			}
+		}
+	} else {
+		err := codesearch.Walk(e.repoPath, func(rel string) error {
+			sb.WriteString("  " + rel + "\n")
 			return nil
+		})
+		if err != nil {
+			return "", err
 		}
-		rel, _ := filepath.Rel(e.repoPath, path)
-		sb.WriteString("  " + rel + "\n")
-		return nil
-	})
-	if err != nil {
-		return "", err
+	}
+
+	if history := e.gitHistory(rev, "", recentCommits); history != "" {
+		sb.WriteString("\nRecent commits:\n" + history)
 	}
 
 	return sb.String(), nil
 }
 
-func (e *Engine) validateChange(change FileChange) error {
-	// Check protected paths
-	cleanPath := filepath.Clean(change.Path)
+// relevantCode formats the indexed chunks most similar to request, up to
+// retrievalBudget bytes. It returns "" when no retriever is configured or
+// retrieval fails.
+func (e *Engine) relevantCode(ctx context.Context, request string) string {
+	if e.retriever == nil {
+		return ""
+	}
+
+	hits, err := e.retriever.Search(ctx, request, retrievalK)
+	if err != nil {
+		slog.Warn("failed to retrieve relevant code", "error", err)
+		return ""
+	}
+
+	var sb strings.Builder
+	for _, h := range hits {
+		block := fmt.Sprintf("--- %s:%d-%d ---\n%s\n", h.Path, h.StartLine, h.EndLine, h.Text)
+		if sb.Len()+len(block) > retrievalBudget {
+			break
+		}
+		sb.WriteString(block)
+	}
+	return sb.String()
+}
+
+// skipped reports whether a file at a revision lies in a directory that
+// codesearch.Walk skips in the working tree.
+func skipped(file string) bool {
+	dirs := strings.Split(file, "/")
+	for _, d := range dirs[:len(dirs)-1] {
+		if codesearch.SkipDir(d) {
+			return true
+		}
+	}
+	return false
+}
+
+// gitHistory formats the latest n commits at rev touching path, one per
+// line. It returns "" when git is not configured or the log cannot be read.
+func (e *Engine) gitHistory(rev, path string, n int) string {
+	if e.git == nil {
+		return ""
+	}
+
+	commits, err := e.git.Log(git.LogOptions{Rev: rev, Path: path, Limit: n})
+	if err != nil {
+		slog.Warn("failed to read git history", "path", path, "error", err)
+		return ""
+	}
+
+	var sb strings.Builder
+	for _, c := range commits {
+		fmt.Fprintf(&sb, "  %s %s\n", c.Hash[:8], c.Subject)
+	}
+	return sb.String()
+}
+
+// IsProtected reports whether path falls under a protected path that
+// selfmod must never modify or expose.
+func IsProtected(path string) bool {
+	cleanPath := filepath.Clean(path)
 	for protected := range protectedPaths {
 		if strings.HasPrefix(cleanPath, protected) {
-			return fmt.Errorf("cannot modify protected path: %s", change.Path)
+			return true
 		}
 	}
+	return false
+}
+
+func (e *Engine) validateChange(change FileChange) error {
+	// Check protected paths
+	if IsProtected(change.Path) {
+		return fmt.Errorf("cannot modify protected path: %s", change.Path)
+	}
 
 	// Prevent path traversal
-	if strings.Contains(cleanPath, "..") {
+	if strings.Contains(filepath.Clean(change.Path), "..") {
 		return fmt.Errorf("path traversal not allowed: %s", change.Path)
 	}
 
@@ -281,54 +990,100 @@ func (e *Engine) validateChange(change FileChange) error {
 	return nil
 }
 
-func (e *Engine) generateDiffs(changes []FileChange) ([]FileDiff, error) {
-	dmp := diffmatchpatch.New()
-	var diffs []FileDiff
-
-	for _, change := range changes {
-		fullPath := filepath.Join(e.repoPath, change.Path)
-		var oldContent string
+// generateDiffs diffs changes against the files at rev, or in the working
+// tree when rev is empty.
+func (e *Engine) generateDiffs(changes []FileChange, rev string) ([]FileDiff, error) {
+	oldContents := make([]string, len(changes))
+	for i, change := range changes {
+		content, err := e.oldContent(change, rev)
+		if err != nil {
+			return nil, err
+		}
+		oldContents[i] = content
+	}
 
-		if change.Action == "modify" || change.Action == "delete" {
-			data, err := os.ReadFile(fullPath)
-			if err != nil && !os.IsNotExist(err) {
-				return nil, fmt.Errorf("failed to read %s: %w", change.Path, err)
+	// Pair each created file with the most similar deleted one, so moves
+	// show as renames instead of a full removal and addition.
+	renamedFrom := make(map[int]int) // create index -> delete index
+	paired := make(map[int]bool)
+	for i, c := range changes {
+		if c.Action != "create" {
+			continue
+		}
+		best, bestScore := -1, RenameThreshold-1
+		for j, d := range changes {
+			if d.Action != "delete" || paired[j] {
+				continue
+			}
+			if score := similarity(oldContents[j], c.NewContent); score > bestScore {
+				best, bestScore = j, score
 			}
-			oldContent = string(data)
 		}
-
-		newContent := change.NewContent
-		if change.Action == "delete" {
-			newContent = ""
+		if best != -1 {
+			renamedFrom[i] = best
+			paired[best] = true
 		}
+	}
 
-		d := dmp.DiffMain(oldContent, newContent, true)
-		patch := dmp.PatchMake(oldContent, d)
-		diffText := dmp.PatchToText(patch)
-
-		diffs = append(diffs, FileDiff{
-			Path: change.Path,
-			Diff: diffText,
-		})
+	var diffs []FileDiff
+	for i, change := range changes {
+		if paired[i] {
+			continue // shown with the file it was renamed to
+		}
+		fd := FileDiff{Path: change.Path, Status: DiffModified}
+		oldContent := oldContents[i]
+		switch change.Action {
+		case "create":
+			fd.Status = DiffAdded
+			if j, ok := renamedFrom[i]; ok {
+				fd.Status = DiffRenamed
+				fd.OldPath = changes[j].Path
+				oldContent = oldContents[j]
+				fd.Similarity = similarity(oldContent, change.NewContent)
+			}
+		case "delete":
+			fd.Status = DiffDeleted
+		}
+		diffs = append(diffs, fileDiff(fd, oldContent, change.content(), e.diffContext))
 	}
 
 	return diffs, nil
 }
 
-func extractJSON(s string) string {
-	// Try to find JSON block in markdown code fences
-	if idx := strings.Index(s, "```json"); idx != -1 {
-		s = s[idx+7:]
-		if end := strings.Index(s, "```"); end != -1 {
-			s = s[:end]
+// fileAt returns the content of a file at rev, or in the working tree when
+// rev is empty, and whether it exists there.
+func (e *Engine) fileAt(path, rev string) (string, bool, error) {
+	if rev != "" {
+		if e.git == nil {
+			return "", false, fmt.Errorf("cannot read %s at %s: git is not configured", path, rev)
+		}
+		content, err := e.git.FileAt(path, rev)
+		if errors.Is(err, git.ErrNotFound) {
+			return "", false, nil
 		}
-	} else if idx := strings.Index(s, "```"); idx != -1 {
-		s = s[idx+3:]
-		if end := strings.Index(s, "```"); end != -1 {
-			s = s[:end]
+		if err != nil {
+			return "", false, fmt.Errorf("failed to read %s at %s: %w", path, rev, err)
 		}
+		return content, true, nil
+	}
+	data, err := os.ReadFile(filepath.Join(e.repoPath, path))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return string(data), true, nil
+}
+
+// oldContent returns the content of the file a change replaces, at rev or
+// in the working tree when rev is empty.
+func (e *Engine) oldContent(change FileChange, rev string) (string, error) {
+	if change.Action != "modify" && change.Action != "delete" {
+		return "", nil
 	}
-	return strings.TrimSpace(s)
+	content, _, err := e.fileAt(change.Path, rev)
+	return content, err
 }
 
 func truncate(s string, n int) string {
@@ -0,0 +1,281 @@
+package selfmod
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+// DefaultContextLines is the number of unchanged lines around each hunk.
+const DefaultContextLines = 3
+
+// Line operations in a hunk.
+const (
+	OpContext = "context"
+	OpAdd     = "add"
+	OpDelete  = "delete"
+)
+
+// DiffLine is one line of a hunk, without its line terminator.
+type DiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+	// NoNewline marks the last line of a file that does not end in one.
+	NoNewline bool `json:"no_newline,omitempty"`
+}
+
+// Hunk is a group of nearby changed lines. IDs are numbered from 1 within a
+// file and identify the hunk in a partial approval.
+type Hunk struct {
+	ID       int        `json:"id"`
+	OldStart int        `json:"old_start"`
+	OldLines int        `json:"old_lines"`
+	NewStart int        `json:"new_start"`
+	NewLines int        `json:"new_lines"`
+	Lines    []DiffLine `json:"lines"`
+}
+
+// lineOp is a line of a line-level diff. line keeps its terminator so files
+// can be rebuilt exactly.
+type lineOp struct {
+	op   string
+	line string
+}
+
+// lineDiff computes a line-level diff between two file versions.
+func lineDiff(oldContent, newContent string) []lineOp {
+	dmp := diffmatchpatch.New()
+	a, b, lines := dmp.DiffLinesToChars(oldContent, newContent)
+	diffs := dmp.DiffCharsToLines(dmp.DiffMain(a, b, false), lines)
+
+	var ops []lineOp
+	for _, d := range diffs {
+		op := OpContext
+		switch d.Type {
+		case diffmatchpatch.DiffInsert:
+			op = OpAdd
+		case diffmatchpatch.DiffDelete:
+			op = OpDelete
+		}
+		for _, l := range splitLines(d.Text) {
+			ops = append(ops, lineOp{op: op, line: l})
+		}
+	}
+	return ops
+}
+
+// splitLines splits s after each newline.
+func splitLines(s string) []string {
+	var lines []string
+	for s != "" {
+		i := strings.IndexByte(s, '\n')
+		if i == -1 {
+			lines = append(lines, s)
+			break
+		}
+		lines = append(lines, s[:i+1])
+		s = s[i+1:]
+	}
+	return lines
+}
+
+// buildHunks groups the changed lines of ops into hunks with context lines
+// around them. owner maps each changed op to the ID of its hunk.
+func buildHunks(ops []lineOp, context int) (hunks []Hunk, owner []int) {
+	owner = make([]int, len(ops))
+	oldLine, newLine := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for i, op := range ops {
+		oldLine[i+1], newLine[i+1] = oldLine[i], newLine[i]
+		if op.op != OpAdd {
+			oldLine[i+1]++
+		}
+		if op.op != OpDelete {
+			newLine[i+1]++
+		}
+	}
+
+	for i := 0; i < len(ops); {
+		if ops[i].op == OpContext {
+			i++
+			continue
+		}
+
+		// Extend the hunk while the next change is close enough that the
+		// context of both would touch.
+		last := i
+		for j := i; j < len(ops); {
+			if ops[j].op != OpContext {
+				last = j
+				j++
+				continue
+			}
+			k := j
+			for k < len(ops) && ops[k].op == OpContext {
+				k++
+			}
+			if k == len(ops) || k-j > 2*context {
+				break
+			}
+			j = k
+		}
+
+		start, stop := max(i-context, 0), min(last+context+1, len(ops))
+		h := Hunk{
+			ID:       len(hunks) + 1,
+			OldStart: oldLine[start] + 1,
+			OldLines: oldLine[stop] - oldLine[start],
+			NewStart: newLine[start] + 1,
+			NewLines: newLine[stop] - newLine[start],
+		}
+		// Empty ranges point at the line before them, as in unified diffs.
+		if h.OldLines == 0 {
+			h.OldStart--
+		}
+		if h.NewLines == 0 {
+			h.NewStart--
+		}
+		for idx := start; idx < stop; idx++ {
+			text, ok := strings.CutSuffix(ops[idx].line, "\n")
+			h.Lines = append(h.Lines, DiffLine{Op: ops[idx].op, Text: text, NoNewline: !ok})
+			if ops[idx].op != OpContext {
+				owner[idx] = h.ID
+			}
+		}
+		hunks = append(hunks, h)
+		i = stop
+	}
+	return hunks, owner
+}
+
+// applyHunks rebuilds the file from ops, taking only the changes of the
+// selected hunks.
+func applyHunks(ops []lineOp, owner []int, selected map[int]bool) string {
+	var sb strings.Builder
+	for i, op := range ops {
+		switch {
+		case op.op == OpContext,
+			op.op == OpDelete && !selected[owner[i]],
+			op.op == OpAdd && selected[owner[i]]:
+			sb.WriteString(op.line)
+		}
+	}
+	return sb.String()
+}
+
+// Selection picks the parts of a change request to apply: whole files by
+// path, or hunks by ID within a file.
+type Selection struct {
+	Files []string         `json:"files,omitempty"`
+	Hunks map[string][]int `json:"hunks,omitempty"`
+}
+
+// DeclinedChange records a part of a proposal left out of a partial
+// approval.
+type DeclinedChange struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	// Hunks lists the declined hunks; empty when the whole file was declined.
+	Hunks []Hunk `json:"hunks,omitempty"`
+}
+
+// selectChanges narrows the changes of cr to sel, returning what is to be
+// applied and what was declined.
+func (e *Engine) selectChanges(cr *ChangeRequest, sel *Selection) ([]FileChange, []DeclinedChange, error) {
+	proposed := make(map[string]bool, len(cr.Changes))
+	for _, c := range cr.Changes {
+		proposed[c.Path] = true
+	}
+	whole := make(map[string]bool, len(sel.Files))
+	for _, path := range sel.Files {
+		if !proposed[path] {
+			return nil, nil, fmt.Errorf("%s is not part of the change request", path)
+		}
+		whole[path] = true
+	}
+	for path := range sel.Hunks {
+		if !proposed[path] {
+			return nil, nil, fmt.Errorf("%s is not part of the change request", path)
+		}
+	}
+
+	reviewed := make(map[string][]Hunk, len(cr.Diffs))
+	// A rename is one diff but two changes; both halves go together.
+	for _, d := range cr.Diffs {
+		reviewed[d.Path] = d.Hunks
+		if d.Status != DiffRenamed {
+			continue
+		}
+		if _, ok := sel.Hunks[d.Path]; ok && !whole[d.Path] {
+			return nil, nil, fmt.Errorf("cannot apply part of %s: renamed files must be selected as a whole", d.Path)
+		}
+		if whole[d.Path] {
+			whole[d.OldPath] = true
+		}
+	}
+
+	var changes []FileChange
+	var declined []DeclinedChange
+	for _, c := range cr.Changes {
+		if whole[c.Path] {
+			changes = append(changes, c)
+			continue
+		}
+		ids, ok := sel.Hunks[c.Path]
+		if !ok || len(ids) == 0 {
+			declined = append(declined, DeclinedChange{Path: c.Path, Action: c.Action})
+			continue
+		}
+
+		oldContent, err := e.oldContent(c, "")
+		if err != nil {
+			return nil, nil, err
+		}
+		if isBinary(oldContent) || isBinary(c.content()) {
+			return nil, nil, fmt.Errorf("cannot apply part of %s: binary files must be selected as a whole", c.Path)
+		}
+		ops := lineDiff(oldContent, c.content())
+		hunks, owner := buildHunks(ops, e.diffContext)
+		// Hunk IDs refer to the diff that was reviewed. If the file has
+		// changed since, the same ID may now select different lines.
+		if !slices.EqualFunc(hunks, reviewed[c.Path], equalHunks) {
+			return nil, nil, fmt.Errorf("cannot apply part of %s: the file has changed since the diff was generated", c.Path)
+		}
+
+		selected := make(map[int]bool, len(ids))
+		for _, id := range ids {
+			if id < 1 || id > len(hunks) {
+				return nil, nil, fmt.Errorf("%s has no hunk %d", c.Path, id)
+			}
+			selected[id] = true
+		}
+		var rejected []Hunk
+		for _, h := range hunks {
+			if !selected[h.ID] {
+				rejected = append(rejected, h)
+			}
+		}
+		if len(rejected) == 0 {
+			changes = append(changes, c)
+			continue
+		}
+		if c.Action != "modify" {
+			return nil, nil, fmt.Errorf("cannot apply part of %s: files to %s must be selected as a whole", c.Path, c.Action)
+		}
+
+		changes = append(changes, FileChange{Path: c.Path, Action: "modify", NewContent: applyHunks(ops, owner, selected)})
+		declined = append(declined, DeclinedChange{Path: c.Path, Action: c.Action, Hunks: rejected})
+	}
+
+	if len(changes) == 0 {
+		return nil, nil, fmt.Errorf("nothing selected")
+	}
+	return changes, declined, nil
+}
+
+// equalHunks reports whether two hunks cover the same lines.
+func equalHunks(a, b Hunk) bool {
+	return a.ID == b.ID && a.OldStart == b.OldStart && a.OldLines == b.OldLines &&
+		a.NewStart == b.NewStart && a.NewLines == b.NewLines && slices.Equal(a.Lines, b.Lines)
+}
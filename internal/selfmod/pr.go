@@ -0,0 +1,164 @@
+package selfmod
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// StatusContext is the commit status set on the commits of approved
+// requests. It records the approval; no tests run behind it.
+const StatusContext = "flyagi/selfmod"
+
+// DefaultPRTemplate renders the pull request description for an approved
+// change request.
+const DefaultPRTemplate = `## Self-Modification Request
+
+{{.Description}}
+{{- if .Request}}
+
+### Original request
+
+{{quote .Request}}
+{{- end}}
+
+### Files
+
+| File | Action | + | - |
+|------|--------|---|---|
+{{- range .Files}}
+| ` + "`{{.Path}}`" + ` | {{.Action}}{{if .OldPath}} from ` + "`{{.OldPath}}`" + `{{end}} | {{.Additions}} | {{.Deletions}} |
+{{- end}}
+{{- if .Declined}}
+
+### Declined in review
+
+{{- range .Declined}}
+- ` + "`{{.Path}}`" + `{{if .Hunks}}: {{.Hunks}} of its hunks{{else}} ({{.Action}}){{end}}
+{{- end}}
+{{- end}}
+{{- if .Findings}}
+
+### Safety findings
+{{- if .Override}}
+
+High-severity findings were overridden by client {{.Override.By}} ({{.Override.Role}}){{with .Override.Name}}, who gave the unverified name {{.}}{{end}}.
+{{- end}}
+
+{{- range .Findings}}
+- **{{.Severity}}** ` + "`{{.Path}}{{if .Line}}:{{.Line}}{{end}}`" + `: {{.Message}} ({{.Rule}})
+{{- end}}
+{{- end}}
+{{- if .Verification}}
+
+### Verification
+
+{{- range .Verification}}
+- {{if .Passed}}✅{{else}}❌{{end}} {{.Name}}
+{{- end}}
+{{- end}}
+{{- if .IssueNumber}}
+
+Closes #{{.IssueNumber}}
+{{- end}}
+
+Generated by FlyAGI self-modification engine (request ` + "`{{.RequestID}}`" + `).
+`
+
+// PRFile summarizes one changed file in a pull request description.
+type PRFile struct {
+	Path      string
+	OldPath   string // set for renames
+	Action    string
+	Additions int
+	Deletions int
+}
+
+// PRDeclined summarizes a part of the proposal left out in review.
+type PRDeclined struct {
+	Path   string
+	Action string
+	Hunks  int // 0 when the whole file was declined
+}
+
+// PRTemplateData is the data available to pull request templates.
+type PRTemplateData struct {
+	RequestID    string
+	Description  string
+	Request      string
+	Files        []PRFile
+	Declined     []PRDeclined
+	Findings     []Finding
+	Override     *SafetyOverride
+	Verification []VerificationResult
+	IssueNumber  int
+}
+
+// NewPRTemplateData collects template data from a change request.
+func NewPRTemplateData(cr *ChangeRequest) PRTemplateData {
+	actions := make(map[string]string, len(cr.Changes))
+	for _, c := range cr.Changes {
+		actions[c.Path] = c.Action
+	}
+
+	files := make([]PRFile, 0, len(cr.Diffs))
+	for _, d := range cr.Diffs {
+		action := actions[d.Path]
+		if d.Status == DiffRenamed {
+			action = "rename"
+		}
+		files = append(files, PRFile{
+			Path:      d.Path,
+			OldPath:   d.OldPath,
+			Action:    action,
+			Additions: d.Additions,
+			Deletions: d.Deletions,
+		})
+	}
+
+	var declined []PRDeclined
+	for _, d := range cr.Declined {
+		declined = append(declined, PRDeclined{Path: d.Path, Action: d.Action, Hunks: len(d.Hunks)})
+	}
+
+	return PRTemplateData{
+		RequestID:    cr.ID,
+		Description:  cr.Description,
+		Request:      cr.Request,
+		Files:        files,
+		Declined:     declined,
+		Findings:     cr.Findings,
+		Override:     cr.Override,
+		Verification: cr.Verification,
+		IssueNumber:  cr.IssueNumber,
+	}
+}
+
+// ParsePRTemplate parses a pull request body template.
+func ParsePRTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("pr").Funcs(template.FuncMap{
+		"quote": quote,
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PR template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// RenderPRBody renders a pull request description for a change request.
+func RenderPRBody(tmpl *template.Template, cr *ChangeRequest) (string, error) {
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, NewPRTemplateData(cr)); err != nil {
+		return "", fmt.Errorf("failed to render PR template: %w", err)
+	}
+	return sb.String(), nil
+}
+
+// quote formats text as a markdown blockquote.
+func quote(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	for i, l := range lines {
+		lines[i] = "> " + l
+	}
+	return strings.Join(lines, "\n")
+}
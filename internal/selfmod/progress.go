@@ -0,0 +1,111 @@
+package selfmod
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/yuki/flyagi/internal/provider"
+)
+
+// Kinds of generation progress.
+const (
+	ProgressText        = "text"        // raw reply text
+	ProgressDescription = "description" // the description is known
+	ProgressFile        = "file"        // a file change is complete
+)
+
+// Progress reports on a generation while the LLM's reply streams in.
+type Progress struct {
+	Kind string
+	// Text is the reply text received since the last report.
+	Text string
+	// Description is the change request's description.
+	Description string
+	// Index is the position of Change in the reply, and Diff its diff.
+	Index  int
+	Change *FileChange
+	Diff   *FileDiff
+}
+
+type progressKey struct{}
+
+// WithProgress returns a context under which generations, refinements and
+// follow-ups call fn as their reply streams in. fn is called from the
+// provider's stream and should return promptly.
+func WithProgress(ctx context.Context, fn func(Progress)) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// complete sends messages to llm and parses the reply as it streams in,
+// reporting progress to the function set with WithProgress. Providers with
+// structured output are held to responseSchema. Reported changes are
+// diffed against base, as in generate.
+func (e *Engine) complete(ctx context.Context, llm provider.LLMProvider, messages []provider.Message, base string) (*proposal, error) {
+	progress, _ := ctx.Value(progressKey{}).(func(Progress))
+
+	p := newResponseParser()
+	if progress != nil {
+		p.onField = func(key string, v any) {
+			if s, ok := v.(string); ok && key == "description" {
+				progress(Progress{Kind: ProgressDescription, Description: s})
+			}
+		}
+		p.onItem = func(key string, index int, v any) {
+			if key == "changes" {
+				e.reportChange(progress, index, v, base)
+			}
+		}
+	}
+
+	onChunk := func(chunk provider.StreamChunk) error {
+		if chunk.Content == "" {
+			return nil
+		}
+		if progress != nil {
+			progress(Progress{Kind: ProgressText, Text: chunk.Content})
+		}
+		// A parse error is kept and returned by Close.
+		p.Write(chunk.Content)
+		return nil
+	}
+	var err error
+	if s, ok := llm.(provider.StructuredLLM); ok {
+		err = s.ChatStructured(ctx, messages, responseSchema, onChunk)
+	} else {
+		err = llm.ChatStream(ctx, messages, onChunk)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("LLM request failed: %w", err)
+	}
+
+	v, err := p.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse LLM response: %w", err)
+	}
+	return proposalFrom(v)
+}
+
+// reportChange reports a file change parsed from a streaming reply, with
+// its diff. Changes the finished reply would be rejected for are skipped.
+func (e *Engine) reportChange(progress func(Progress), index int, v any, base string) {
+	if validate(changeSchema, v, "") != nil {
+		return
+	}
+	m := v.(map[string]any)
+	change := FileChange{}
+	change.Path, _ = m["path"].(string)
+	change.Action, _ = m["action"].(string)
+	change.NewContent, _ = m["new_content"].(string)
+
+	e.mu.RLock()
+	err := e.validateChange(change)
+	var diffs []FileDiff
+	if err == nil {
+		diffs, err = e.generateDiffs([]FileChange{change}, base)
+	}
+	e.mu.RUnlock()
+	if err != nil || len(diffs) == 0 {
+		return
+	}
+	progress(Progress{Kind: ProgressFile, Index: index, Change: &change, Diff: &diffs[0]})
+}
@@ -0,0 +1,52 @@
+package selfmod
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// PRStates reports whether pull requests are "open", "merged" or "closed",
+// e.g. a forge.Forge.
+type PRStates interface {
+	PRState(ctx context.Context, number int) (string, error)
+}
+
+// WatchPRs checks the pull requests of approved requests every interval
+// until ctx is cancelled, and records those that were merged or closed. It
+// stands in for webhooks on forges that do not deliver them.
+func (e *Engine) WatchPRs(ctx context.Context, prs PRStates, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.pollPRs(ctx, prs)
+		}
+	}
+}
+
+func (e *Engine) pollPRs(ctx context.Context, prs PRStates) {
+	// Follow-up requests share the pull request of the request that
+	// opened it.
+	seen := make(map[int]bool)
+	for _, cr := range e.Requests() {
+		if cr.PRNumber == 0 || cr.Status != "approved" || seen[cr.PRNumber] {
+			continue
+		}
+		seen[cr.PRNumber] = true
+
+		state, err := prs.PRState(ctx, cr.PRNumber)
+		if err != nil {
+			slog.Warn("failed to fetch PR state", "pr", cr.PRNumber, "error", err)
+			continue
+		}
+		if state == "merged" || state == "closed" {
+			n := e.PRClosed(cr.PRNumber, state == "merged")
+			slog.Info("pull request finished", "pr", cr.PRNumber, "state", state, "requests", n)
+		}
+	}
+}
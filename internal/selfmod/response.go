@@ -0,0 +1,551 @@
+package selfmod
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/yuki/flyagi/internal/provider"
+)
+
+// changeSchema is the JSON of one file change in responseSchema.
+var changeSchema = map[string]any{
+	"type": "object",
+	"properties": map[string]any{
+		"path": map[string]any{
+			"type":        "string",
+			"description": "Path relative to the project root",
+		},
+		"action": map[string]any{
+			"type": "string",
+			"enum": []string{"create", "modify", "delete"},
+		},
+		"new_content": map[string]any{
+			"type":        "string",
+			"description": "Complete file content for create and modify; omitted for delete",
+		},
+	},
+	"required": []string{"path", "action"},
+}
+
+// responseSchema is the JSON the LLM replies to a change request with.
+// Providers with structured output are held to it; other replies are
+// checked against it after parsing.
+var responseSchema = provider.Schema{
+	Name:        "propose_changes",
+	Description: "Propose the file changes that implement the request.",
+	Definition: map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"description": map[string]any{
+				"type":        "string",
+				"description": "Brief description of the changes",
+			},
+			"changes": map[string]any{
+				"type":  "array",
+				"items": changeSchema,
+			},
+		},
+		"required": []string{"description", "changes"},
+	},
+}
+
+// proposal is the LLM's reply to a change request.
+type proposal struct {
+	Description string       `json:"description"`
+	Changes     []FileChange `json:"changes"`
+}
+
+func proposalFrom(v map[string]any) (*proposal, error) {
+	if err := validate(responseSchema.Definition, v, ""); err != nil {
+		return nil, err
+	}
+	// The value is valid, so it maps onto proposal without surprises.
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode response: %w", err)
+	}
+	var prop proposal
+	if err := json.Unmarshal(data, &prop); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return &prop, nil
+}
+
+// SchemaError reports a parsed response that does not match the schema.
+type SchemaError struct {
+	Path string // e.g. "changes[1].action"
+	Msg  string
+}
+
+func (e *SchemaError) Error() string {
+	path := e.Path
+	if path == "" {
+		path = "response"
+	}
+	return fmt.Sprintf("%s: %s", path, e.Msg)
+}
+
+// validate checks v against the subset of JSON Schema that provider.Schema
+// documents.
+func validate(schema map[string]any, v any, path string) error {
+	switch schema["type"] {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return &SchemaError{Path: path, Msg: "expected an object, got " + jsonType(v)}
+		}
+		required, _ := schema["required"].([]string)
+		for _, name := range required {
+			if _, ok := obj[name]; !ok {
+				return &SchemaError{Path: path, Msg: fmt.Sprintf("missing required field %q", name)}
+			}
+		}
+		props, _ := schema["properties"].(map[string]any)
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			sub, ok := props[name].(map[string]any)
+			if !ok {
+				continue // unknown fields are ignored
+			}
+			field := name
+			if path != "" {
+				field = path + "." + name
+			}
+			if err := validate(sub, obj[name], field); err != nil {
+				return err
+			}
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			return &SchemaError{Path: path, Msg: "expected an array, got " + jsonType(v)}
+		}
+		items, _ := schema["items"].(map[string]any)
+		for i, item := range arr {
+			if err := validate(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			return &SchemaError{Path: path, Msg: "expected a string, got " + jsonType(v)}
+		}
+		if enum, ok := schema["enum"].([]string); ok && !slices.Contains(enum, s) {
+			return &SchemaError{Path: path, Msg: fmt.Sprintf("%q is not one of %s", s, strings.Join(enum, ", "))}
+		}
+	}
+	return nil
+}
+
+func jsonType(v any) string {
+	switch v.(type) {
+	case map[string]any:
+		return "an object"
+	case []any:
+		return "an array"
+	case string:
+		return "a string"
+	case float64:
+		return "a number"
+	case bool:
+		return "a boolean"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// ParseError reports where an LLM response stopped being valid JSON.
+type ParseError struct {
+	Offset int    // byte offset in the response
+	Line   int    // 1-based
+	Column int    // 1-based, in bytes
+	Path   string // the value being parsed, e.g. "changes[1].new_content"
+	Msg    string
+	Near   string // the response just before the failure
+	// Truncated is set when the response ended before the JSON did, e.g.
+	// because the model ran out of output tokens.
+	Truncated bool
+}
+
+func (e *ParseError) Error() string {
+	path := e.Path
+	if path == "" {
+		path = "top level"
+	}
+	return fmt.Sprintf("%s at line %d, column %d (offset %d, in %s) near %q", e.Msg, e.Line, e.Column, e.Offset, path, e.Near)
+}
+
+type parseState int
+
+const (
+	stSeek    parseState = iota // before the object
+	stValue                     // expecting a value
+	stKey                       // expecting a field name
+	stColon                     // expecting ':'
+	stAfter                     // after a value in an object or array
+	stString                    // in a string
+	stNumber                    // in a number
+	stLiteral                   // in true, false or null
+	stDone                      // after the object
+)
+
+// nearBytes is how much of the response a ParseError quotes.
+const nearBytes = 40
+
+type parseFrame struct {
+	obj   map[string]any
+	arr   []any
+	isArr bool
+	key   string // field whose value is being parsed
+}
+
+// responseParser incrementally parses the JSON object in an LLM response as
+// it streams in. Text before the object, such as prose or a markdown fence,
+// and text after it are skipped. An object that fails to parse before its
+// first field is taken for prose too, so "use {braces}" does not derail it.
+// Raw control characters in strings are accepted, since models emit them.
+type responseParser struct {
+	state      parseState
+	stack      []*parseFrame
+	root       map[string]any
+	allowClose bool // an empty object or array may close here
+	committed  bool // the top-level object has a field, so it is the one
+
+	buf   []byte // string, number or literal being read
+	isKey bool
+	esc   int // 1 after a backslash, 2 in a \u escape
+	hex   []byte
+	high  rune // pending high surrogate
+
+	off, line, col int
+	tail           []byte
+	err            *ParseError
+
+	// onField, if set, is called with each field of the object once its
+	// value is complete, and onItem with each item of an array field.
+	onField func(key string, v any)
+	onItem  func(key string, index int, v any)
+}
+
+func newResponseParser() *responseParser {
+	return &responseParser{line: 1, col: 1}
+}
+
+// Write feeds the next part of the response. It returns the parse error, if
+// any; later writes return it again.
+func (p *responseParser) Write(s string) error {
+	if p.err != nil {
+		return p.err
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		for !p.step(c) {
+		}
+		if p.err != nil {
+			return p.err
+		}
+		p.advance(c)
+	}
+	return nil
+}
+
+// Close ends the response and returns the parsed object.
+func (p *responseParser) Close() (map[string]any, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	switch {
+	case p.state == stDone:
+		return p.root, nil
+	case p.state == stSeek:
+		return nil, p.errorf("no JSON object found")
+	}
+	err := p.errorf("response ends before the JSON object is complete")
+	err.Truncated = true
+	p.err = err
+	return nil, err
+}
+
+func (p *responseParser) advance(c byte) {
+	p.off++
+	if c == '\n' {
+		p.line++
+		p.col = 1
+	} else {
+		p.col++
+	}
+	p.tail = append(p.tail, c)
+	if len(p.tail) > nearBytes {
+		p.tail = p.tail[len(p.tail)-nearBytes:]
+	}
+}
+
+// step handles c and reports whether it was consumed; if not, it is
+// handled again in the new state.
+func (p *responseParser) step(c byte) bool {
+	switch p.state {
+	case stDone:
+		return true
+	case stSeek:
+		if c == '{' {
+			p.open(false)
+		}
+		return true
+	case stString:
+		return p.stringByte(c)
+	case stNumber:
+		if c >= '0' && c <= '9' || c == '-' || c == '+' || c == '.' || c == 'e' || c == 'E' {
+			p.buf = append(p.buf, c)
+			return true
+		}
+		n, err := strconv.ParseFloat(string(p.buf), 64)
+		if err != nil {
+			return p.fail("invalid number " + strconv.Quote(string(p.buf)))
+		}
+		p.value(n)
+		return false
+	case stLiteral:
+		if c >= 'a' && c <= 'z' {
+			p.buf = append(p.buf, c)
+			return true
+		}
+		switch string(p.buf) {
+		case "true":
+			p.value(true)
+		case "false":
+			p.value(false)
+		case "null":
+			p.value(nil)
+		default:
+			return p.fail("invalid literal " + strconv.Quote(string(p.buf)))
+		}
+		return false
+	}
+
+	if c == ' ' || c == '\t' || c == '\n' || c == '\r' {
+		return true
+	}
+	top := p.stack[len(p.stack)-1]
+	switch p.state {
+	case stValue:
+		switch {
+		case c == '{':
+			p.open(false)
+		case c == '[':
+			p.open(true)
+		case c == '"':
+			p.startString(false)
+		case c == '-' || c >= '0' && c <= '9':
+			p.state = stNumber
+			p.buf = append(p.buf[:0], c)
+		case c == 't' || c == 'f' || c == 'n':
+			p.state = stLiteral
+			p.buf = append(p.buf[:0], c)
+		case c == ']' && top.isArr && p.allowClose:
+			p.close()
+		default:
+			return p.fail(fmt.Sprintf("expected a value, got %q", c))
+		}
+	case stKey:
+		switch {
+		case c == '"':
+			p.startString(true)
+		case c == '}' && p.allowClose:
+			p.close()
+		default:
+			return p.fail(fmt.Sprintf("expected a field name, got %q", c))
+		}
+	case stColon:
+		if c != ':' {
+			return p.fail(fmt.Sprintf("expected ':', got %q", c))
+		}
+		if len(p.stack) == 1 {
+			p.committed = true
+		}
+		p.state = stValue
+	case stAfter:
+		switch {
+		case c == ',' && top.isArr:
+			p.state, p.allowClose = stValue, false
+		case c == ',':
+			p.state, p.allowClose = stKey, false
+		case c == '}' && !top.isArr, c == ']' && top.isArr:
+			p.close()
+		case top.isArr:
+			return p.fail(fmt.Sprintf("expected ',' or ']', got %q", c))
+		default:
+			return p.fail(fmt.Sprintf("expected ',' or '}', got %q", c))
+		}
+	}
+	return true
+}
+
+func (p *responseParser) startString(isKey bool) {
+	p.state = stString
+	p.isKey = isKey
+	p.buf = p.buf[:0]
+}
+
+func (p *responseParser) stringByte(c byte) bool {
+	switch {
+	case p.esc == 1:
+		p.esc = 0
+		switch c {
+		case '"', '\\', '/':
+			p.buf = append(p.buf, c)
+		case 'b':
+			p.buf = append(p.buf, '\b')
+		case 'f':
+			p.buf = append(p.buf, '\f')
+		case 'n':
+			p.buf = append(p.buf, '\n')
+		case 'r':
+			p.buf = append(p.buf, '\r')
+		case 't':
+			p.buf = append(p.buf, '\t')
+		case 'u':
+			p.esc = 2
+			p.hex = p.hex[:0]
+		default:
+			return p.fail(fmt.Sprintf("invalid escape \\%c", c))
+		}
+	case p.esc == 2:
+		p.hex = append(p.hex, c)
+		if len(p.hex) < 4 {
+			return true
+		}
+		p.esc = 0
+		n, err := strconv.ParseUint(string(p.hex), 16, 16)
+		if err != nil {
+			return p.fail("invalid escape \\u" + string(p.hex))
+		}
+		p.appendRune(rune(n))
+	case c == '\\':
+		p.esc = 1
+	case c == '"':
+		if p.high != 0 {
+			p.buf = utf8.AppendRune(p.buf, utf8.RuneError)
+			p.high = 0
+		}
+		s := string(p.buf)
+		if p.isKey {
+			p.stack[len(p.stack)-1].key = s
+			p.state = stColon
+		} else {
+			p.value(s)
+		}
+	default:
+		p.buf = append(p.buf, c)
+	}
+	return true
+}
+
+func (p *responseParser) appendRune(r rune) {
+	switch {
+	case p.high != 0:
+		r = utf16.DecodeRune(p.high, r)
+		p.high = 0
+	case utf16.IsSurrogate(r):
+		p.high = r
+		return
+	}
+	p.buf = utf8.AppendRune(p.buf, r)
+}
+
+func (p *responseParser) open(isArr bool) {
+	f := &parseFrame{isArr: isArr}
+	if isArr {
+		f.arr = []any{}
+		p.state = stValue
+	} else {
+		f.obj = map[string]any{}
+		p.state = stKey
+	}
+	p.stack = append(p.stack, f)
+	p.allowClose = true
+}
+
+func (p *responseParser) close() {
+	f := p.stack[len(p.stack)-1]
+	p.stack = p.stack[:len(p.stack)-1]
+	if len(p.stack) == 0 {
+		p.root = f.obj
+		p.state = stDone
+		return
+	}
+	if f.isArr {
+		p.value(f.arr)
+	} else {
+		p.value(f.obj)
+	}
+}
+
+// value stores a parsed value in the enclosing object or array.
+func (p *responseParser) value(v any) {
+	top := p.stack[len(p.stack)-1]
+	if top.isArr {
+		top.arr = append(top.arr, v)
+		if len(p.stack) == 2 && p.onItem != nil {
+			p.onItem(p.stack[0].key, len(top.arr)-1, v)
+		}
+	} else {
+		if len(p.stack) == 1 && p.onField != nil {
+			p.onField(top.key, v)
+		}
+		top.obj[top.key] = v
+		top.key = ""
+	}
+	p.state = stAfter
+}
+
+// fail records a parse error at the current byte. Before the object has a
+// field it is taken for prose instead, and the byte is looked at again.
+func (p *responseParser) fail(msg string) bool {
+	if !p.committed {
+		p.stack = p.stack[:0]
+		p.state = stSeek
+		p.esc, p.high = 0, 0
+		return false
+	}
+	p.err = p.errorf(msg)
+	return true
+}
+
+func (p *responseParser) errorf(msg string) *ParseError {
+	return &ParseError{
+		Offset: p.off,
+		Line:   p.line,
+		Column: p.col,
+		Path:   p.path(),
+		Msg:    msg,
+		Near:   string(p.tail),
+	}
+}
+
+// path describes where in the object the parser is.
+func (p *responseParser) path() string {
+	var sb strings.Builder
+	for _, f := range p.stack {
+		switch {
+		case f.isArr:
+			fmt.Fprintf(&sb, "[%d]", len(f.arr))
+		case f.key != "":
+			if sb.Len() > 0 {
+				sb.WriteByte('.')
+			}
+			sb.WriteString(f.key)
+		}
+	}
+	return sb.String()
+}
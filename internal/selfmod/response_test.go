@@ -0,0 +1,163 @@
+package selfmod_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/yuki/flyagi/internal/provider"
+	"github.com/yuki/flyagi/internal/selfmod"
+)
+
+// structuredLLM streams its response in small pieces through ChatStructured
+// and fails plain chat requests.
+type structuredLLM struct {
+	mockLLM
+	schema provider.Schema
+}
+
+func (m *structuredLLM) ChatStream(context.Context, []provider.Message, func(provider.StreamChunk) error) error {
+	return errors.New("structured output not used")
+}
+
+func (m *structuredLLM) ChatStructured(_ context.Context, messages []provider.Message, schema provider.Schema, onChunk func(provider.StreamChunk) error) error {
+	m.messages, m.schema = messages, schema
+	for s := m.response; s != ""; {
+		n := min(len(s), 7)
+		if err := onChunk(provider.StreamChunk{Content: s[:n]}); err != nil {
+			return err
+		}
+		s = s[n:]
+	}
+	return onChunk(provider.StreamChunk{Done: true})
+}
+
+func TestEngine_ResponseParsing(t *testing.T) {
+	const content = "# Notes\\n\\n```go\\nfmt.Println(\\\"{}\\\")\\n```\\n\\u00e9\\ud83d\\ude00"
+
+	for _, tc := range []struct {
+		name     string
+		response string
+	}{
+		{"bare", `{"description": "Add notes", "changes": [{"path": "NOTES.md", "action": "create", "new_content": "` + content + `"}]}`},
+		{"prose and fence", "Sure, here it is {as requested}:\n```json\n" +
+			`{"description": "Add notes", "changes": [{"path": "NOTES.md", "action": "create", "new_content": "` + content + `"}]}` +
+			"\n```\nLet me know if you need anything else."},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			engine := selfmod.NewEngine(t.TempDir())
+			cr, err := engine.GenerateChanges(context.Background(), &mockLLM{response: tc.response}, "Add notes")
+			if err != nil {
+				t.Fatalf("GenerateChanges failed: %v", err)
+			}
+			want := "# Notes\n\n```go\nfmt.Println(\"{}\")\n```\né😀"
+			if len(cr.Changes) != 1 || cr.Changes[0].NewContent != want {
+				t.Errorf("unexpected changes: %+v", cr.Changes)
+			}
+		})
+	}
+
+	t.Run("structured output", func(t *testing.T) {
+		llm := &structuredLLM{}
+		llm.response = `{"description": "Remove old", "changes": [{"path": "old.txt", "action": "delete"}]}`
+		cr, err := selfmod.NewEngine(t.TempDir()).GenerateChanges(context.Background(), llm, "Remove old")
+		if err != nil {
+			t.Fatalf("GenerateChanges failed: %v", err)
+		}
+		if llm.schema.Name == "" || llm.schema.Definition["type"] != "object" {
+			t.Errorf("unexpected schema: %+v", llm.schema)
+		}
+		if cr.Description != "Remove old" || len(cr.Changes) != 1 || cr.Changes[0].Action != "delete" {
+			t.Errorf("unexpected change request: %+v", cr)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		response := "{\n  \"description\": \"Add notes\",\n  \"changes\": [\n    {\"path\": \"a.txt\", \"action\": \"create\", \"new_content\": \"a\"},\n    {\"path\": \"b.txt\", \"action\": \"create\", \"new_content\": \"unfinished"
+		_, err := selfmod.NewEngine(t.TempDir()).GenerateChanges(context.Background(), &mockLLM{response: response}, "Add notes")
+		var perr *selfmod.ParseError
+		if !errors.As(err, &perr) {
+			t.Fatalf("expected a ParseError, got %v", err)
+		}
+		if !perr.Truncated || perr.Line != 5 || perr.Offset != len(response) || perr.Path != "changes[1].new_content" {
+			t.Errorf("unexpected error: %+v", perr)
+		}
+	})
+
+	t.Run("syntax error", func(t *testing.T) {
+		response := "{\"description\": \"x\",\n \"changes\": [} ]}"
+		_, err := selfmod.NewEngine(t.TempDir()).GenerateChanges(context.Background(), &mockLLM{response: response}, "x")
+		var perr *selfmod.ParseError
+		if !errors.As(err, &perr) {
+			t.Fatalf("expected a ParseError, got %v", err)
+		}
+		if perr.Truncated || perr.Line != 2 || perr.Column != 14 || !strings.Contains(perr.Msg, "expected a value") {
+			t.Errorf("unexpected error: %+v", perr)
+		}
+	})
+
+	t.Run("schema violation", func(t *testing.T) {
+		response := `{"description": "x", "changes": [{"path": "a.txt", "action": "create"}, {"path": "b.txt", "action": "rename"}]}`
+		_, err := selfmod.NewEngine(t.TempDir()).GenerateChanges(context.Background(), &mockLLM{response: response}, "x")
+		var serr *selfmod.SchemaError
+		if !errors.As(err, &serr) || serr.Path != "changes[1].action" {
+			t.Fatalf("expected a SchemaError at changes[1].action, got %v", err)
+		}
+	})
+
+	t.Run("no JSON", func(t *testing.T) {
+		_, err := selfmod.NewEngine(t.TempDir()).GenerateChanges(context.Background(), &mockLLM{response: "I can't help with that."}, "x")
+		var perr *selfmod.ParseError
+		if !errors.As(err, &perr) || perr.Truncated {
+			t.Fatalf("expected a ParseError, got %v", err)
+		}
+	})
+}
+
+func TestEngine_Progress(t *testing.T) {
+	llm := &structuredLLM{}
+	llm.response = `{"description": "Add files", "changes": [` +
+		`{"path": "a.txt", "action": "create", "new_content": "a\n"}, ` +
+		`{"path": "b.txt", "action": "create", "new_content": "b\n"}]}`
+
+	var events []selfmod.Progress
+	ctx := selfmod.WithProgress(context.Background(), func(p selfmod.Progress) {
+		events = append(events, p)
+	})
+	if _, err := selfmod.NewEngine(t.TempDir()).GenerateChanges(ctx, llm, "Add files"); err != nil {
+		t.Fatalf("GenerateChanges failed: %v", err)
+	}
+
+	var text strings.Builder
+	var order []string
+	firstFile, lastText := -1, -1
+	for i, e := range events {
+		switch e.Kind {
+		case selfmod.ProgressText:
+			text.WriteString(e.Text)
+			lastText = i
+		case selfmod.ProgressDescription:
+			order = append(order, "description:"+e.Description)
+		case selfmod.ProgressFile:
+			if e.Diff == nil || e.Diff.Path != e.Change.Path {
+				t.Errorf("file event without its diff: %+v", e)
+			}
+			order = append(order, fmt.Sprintf("file%d:%s", e.Index, e.Change.Path))
+			if firstFile < 0 {
+				firstFile = i
+			}
+		}
+	}
+	if firstFile < 0 || firstFile > lastText {
+		t.Error("the first file was not reported while the reply was still streaming")
+	}
+	if text.String() != llm.response {
+		t.Errorf("text events do not add up to the reply: %q", text.String())
+	}
+	if want := []string{"description:Add files", "file0:a.txt", "file1:b.txt"}; !slices.Equal(order, want) {
+		t.Errorf("events %v, want %v", order, want)
+	}
+}
@@ -0,0 +1,107 @@
+package selfmod
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Retention bounds how long change requests are kept in memory.
+type Retention struct {
+	// PendingTTL is how long a pending request may wait for review after it
+	// was last proposed before it expires. Zero keeps pending requests.
+	PendingTTL time.Duration
+	// MaxHistory is the number of finished requests kept. Zero keeps all.
+	MaxHistory int
+	// MaxAge drops finished requests created longer ago. Zero keeps all.
+	MaxAge time.Duration
+}
+
+// SetRetention sets the limits applied by Expire and Prune.
+func (e *Engine) SetRetention(r Retention) {
+	e.retention = r
+}
+
+// finished reports whether a request with status can no longer change.
+// Approved requests are not finished; their pull request may still be open.
+func finished(status string) bool {
+	switch status {
+	case "rejected", "expired", "cancelled", "applied", "merged", "closed":
+		return true
+	}
+	return false
+}
+
+// Expire marks pending requests that have waited longer than the pending TTL
+// as "expired" and returns them. It does nothing while the working tree is
+// in use.
+func (e *Engine) Expire(now time.Time) []*ChangeRequest {
+	ttl := e.retention.PendingTTL
+	if ttl <= 0 {
+		return nil
+	}
+
+	// Approvals and refinements check the status under e.mu. Rather than
+	// wait behind a long verification, try again on the next sweep.
+	if !e.mu.TryLock() {
+		return nil
+	}
+	var expired []*ChangeRequest
+	e.histMu.Lock()
+	for _, cr := range e.history {
+		proposed := cr.RevisedAt
+		if proposed.IsZero() {
+			proposed = cr.CreatedAt
+		}
+		if cr.Status == "pending" && now.Sub(proposed) > ttl {
+			cr.Status = "expired"
+			expired = append(expired, cr)
+		}
+	}
+	e.histMu.Unlock()
+	e.mu.Unlock()
+
+	for _, cr := range expired {
+		slog.Info("change request expired", "request_id", cr.ID, "created_at", cr.CreatedAt)
+		if e.onStatus != nil {
+			e.onStatus(cr, "expired")
+		}
+	}
+	return expired
+}
+
+// Prune forgets finished requests beyond the history limits, oldest first,
+// and returns how many were dropped.
+func (e *Engine) Prune(now time.Time) int {
+	r := e.retention
+	e.histMu.Lock()
+	defer e.histMu.Unlock()
+
+	done := 0
+	for _, cr := range e.history {
+		if finished(cr.Status) {
+			done++
+		}
+	}
+
+	kept := e.history[:0]
+	dropped := 0
+	for _, cr := range e.history {
+		// History is in creation order, so the oldest go first.
+		drop := finished(cr.Status) &&
+			((r.MaxHistory > 0 && done-dropped > r.MaxHistory) ||
+				(r.MaxAge > 0 && now.Sub(cr.CreatedAt) > r.MaxAge))
+		if drop {
+			e.requests.Delete(cr.ID)
+			dropped++
+			continue
+		}
+		kept = append(kept, cr)
+	}
+	clear(e.history[len(kept):])
+	e.history = kept
+
+	if dropped > 0 {
+		slog.Info("pruned change request history", "dropped", dropped, "kept", len(kept))
+	}
+	return dropped
+}
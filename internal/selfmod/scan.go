@@ -0,0 +1,369 @@
+package selfmod
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Finding severities. High-severity findings block approval until an admin
+// overrides them.
+const (
+	SeverityLow    = "low"
+	SeverityMedium = "medium"
+	SeverityHigh   = "high"
+)
+
+// Scanner rules.
+const (
+	RuleSecret        = "secret"
+	RuleRiskyImport   = "risky-import"
+	RuleRiskyCall     = "risky-call"
+	RuleEgress        = "egress"
+	RuleSensitivePath = "sensitive-path"
+	RuleUnparsable    = "unparsable"
+)
+
+// ErrBlocked is returned when approving a change request with high-severity
+// findings that have not been overridden.
+var ErrBlocked = errors.New("blocked by high-severity safety findings")
+
+// Finding is a potential safety problem in a proposed change.
+type Finding struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Path     string `json:"path"`
+	Line     int    `json:"line,omitempty"`
+	Message  string `json:"message"`
+}
+
+// SafetyOverride records an admin's decision to approve a change request
+// despite high-severity findings. By and Role identify the client as the
+// server knows it; Name is the display name the client gave, which is not
+// verified.
+type SafetyOverride struct {
+	By   string    `json:"by"`
+	Role string    `json:"role"`
+	Name string    `json:"name,omitempty"`
+	At   time.Time `json:"at"`
+}
+
+// HasBlocking reports whether findings include a high-severity one.
+func HasBlocking(findings []Finding) bool {
+	for _, f := range findings {
+		if f.Severity == SeverityHigh {
+			return true
+		}
+	}
+	return false
+}
+
+var secretPatterns = []struct {
+	name string
+	re   *regexp.Regexp
+}{
+	{"private key", regexp.MustCompile(`-----BEGIN (?:RSA |EC |DSA |OPENSSH |PGP |ENCRYPTED )?PRIVATE KEY(?: BLOCK)?-----`)},
+	{"AWS access key", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"GitHub token", regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{"Anthropic API key", regexp.MustCompile(`\bsk-ant-[A-Za-z0-9_-]{20,}`)},
+	{"OpenAI API key", regexp.MustCompile(`\bsk-(?:proj-)?[A-Za-z0-9]{20,}`)},
+	{"Google API key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`)},
+	{"Slack token", regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`)},
+}
+
+// riskyImports are Go packages that let code escape the process's normal
+// behaviour.
+var riskyImports = map[string]struct {
+	severity string
+	reason   string
+}{
+	"os/exec": {SeverityHigh, "runs external commands"},
+	"syscall": {SeverityHigh, "makes raw system calls"},
+	"plugin":  {SeverityHigh, "loads code at run time"},
+	"C":       {SeverityHigh, "enables cgo"},
+	"unsafe":  {SeverityMedium, "bypasses type safety"},
+}
+
+// riskyCalls are calls to flag wherever they are added, keyed by package
+// path and function name.
+var riskyCalls = map[string]struct {
+	severity string
+	reason   string
+}{
+	"os.StartProcess":        {SeverityHigh, "starts a process"},
+	"syscall.Exec":           {SeverityHigh, "replaces the process"},
+	"os.Environ":             {SeverityMedium, "reads the whole environment"},
+	"os.RemoveAll":           {SeverityMedium, "deletes a directory tree"},
+	"net.Listen":             {SeverityMedium, "opens a listener"},
+	"reflect.NewAt":          {SeverityMedium, "bypasses type safety"},
+	"os.Getenv":              {"", ""}, // flagged only for secret-looking names
+	"os.LookupEnv":           {"", ""},
+	"os/exec.Command":        {SeverityHigh, "runs an external command"},
+	"os/exec.CommandContext": {SeverityHigh, "runs an external command"},
+}
+
+var (
+	secretEnv = regexp.MustCompile(`(?i)(TOKEN|SECRET|PASSWORD|PASSWD|API_?KEY|PRIVATE_KEY|CREDENTIAL)`)
+	urlHost   = regexp.MustCompile(`\b(?:https?|wss?)://[^\s"'` + "`" + `<>)\]]+`)
+)
+
+// sensitivePaths are code whose changes deserve a closer look, matched
+// against the path or, for patterns without a slash, its base name.
+var sensitivePaths = []struct {
+	pattern  string
+	severity string
+	reason   string
+}{
+	{"internal/selfmod/*", SeverityHigh, "selfmod safety checks"},
+	{"internal/config/*", SeverityMedium, "configuration"},
+	{"internal/ws/hub.go", SeverityMedium, "client authentication"},
+	{"internal/api/middleware.go", SeverityMedium, "HTTP middleware"},
+	{"auth*", SeverityMedium, "authentication"},
+	{"*_auth*", SeverityMedium, "authentication"},
+	{"*oauth*", SeverityMedium, "authentication"},
+	{"*secret*", SeverityMedium, "secret handling"},
+	{"*credential*", SeverityMedium, "credential handling"},
+	{"go.mod", SeverityMedium, "dependencies"},
+	{"go.sum", SeverityLow, "dependency checksums"},
+	{"*.env*", SeverityMedium, "environment configuration"},
+}
+
+// Scanner looks for secrets, risky Go code, network egress and changes to
+// sensitive code in proposed changes. Only added lines are inspected, so
+// existing code is not reported again.
+type Scanner struct {
+	allowedHosts map[string]bool
+}
+
+// NewScanner creates a Scanner. Hosts in allowedHosts, and hosts already
+// referenced by a file, are not reported as egress. A leading "*." matches
+// any subdomain.
+func NewScanner(allowedHosts []string) *Scanner {
+	s := &Scanner{allowedHosts: map[string]bool{"localhost": true, "127.0.0.1": true, "example.com": true}}
+	for _, h := range allowedHosts {
+		s.allowedHosts[strings.ToLower(h)] = true
+	}
+	return s
+}
+
+// Scan returns the findings for changing the file at path from oldContent to
+// newContent, ordered by line.
+func (s *Scanner) Scan(path, oldContent, newContent string) []Finding {
+	var findings []Finding
+	if f, ok := sensitivePath(path); ok {
+		findings = append(findings, f)
+	}
+	if isBinary(newContent) {
+		return findings
+	}
+
+	added := addedLines(oldContent, newContent)
+	lines := strings.Split(newContent, "\n")
+	knownHosts := make(map[string]bool)
+	for _, host := range hosts(oldContent) {
+		knownHosts[host] = true
+	}
+	for n, line := range lines {
+		if !added[n+1] {
+			continue
+		}
+		for _, p := range secretPatterns {
+			if p.re.MatchString(line) {
+				findings = append(findings, Finding{
+					Rule:     RuleSecret,
+					Severity: SeverityHigh,
+					Path:     path,
+					Line:     n + 1,
+					Message:  "possible " + p.name + " in source",
+				})
+			}
+		}
+		for _, host := range hosts(line) {
+			if !knownHosts[host] && !s.allowed(host) {
+				findings = append(findings, Finding{
+					Rule:     RuleEgress,
+					Severity: SeverityMedium,
+					Path:     path,
+					Line:     n + 1,
+					Message:  "new network destination " + host,
+				})
+			}
+		}
+	}
+
+	if strings.HasSuffix(path, ".go") {
+		findings = append(findings, scanGo(path, newContent, added)...)
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].Line < findings[j].Line })
+	return findings
+}
+
+func (s *Scanner) allowed(host string) bool {
+	if s.allowedHosts[host] {
+		return true
+	}
+	for i := strings.IndexByte(host, '.'); i != -1; i = strings.IndexByte(host, '.') {
+		host = host[i+1:]
+		if s.allowedHosts["*."+host] {
+			return true
+		}
+	}
+	return false
+}
+
+// scanGo applies the Go AST rules to the added lines of a Go file.
+func scanGo(path, content string, added map[int]bool) []Finding {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, path, content, parser.SkipObjectResolution)
+	if err != nil {
+		return []Finding{{
+			Rule:     RuleUnparsable,
+			Severity: SeverityLow,
+			Path:     path,
+			Message:  "Go file does not parse, so its code was not inspected",
+		}}
+	}
+
+	var findings []Finding
+	report := func(node ast.Node, rule, severity, message string) {
+		line := fset.Position(node.Pos()).Line
+		if added[line] {
+			findings = append(findings, Finding{Rule: rule, Severity: severity, Path: path, Line: line, Message: message})
+		}
+	}
+
+	// Map local package names to import paths to resolve selector calls.
+	imports := make(map[string]string)
+	for _, spec := range file.Imports {
+		importPath, _ := strconv.Unquote(spec.Path.Value)
+		name := pathBase(importPath)
+		if spec.Name != nil {
+			name = spec.Name.Name
+		}
+		imports[name] = importPath
+		if r, ok := riskyImports[importPath]; ok {
+			report(spec, RuleRiskyImport, r.severity, fmt.Sprintf("imports %s, which %s", importPath, r.reason))
+		}
+	}
+
+	ast.Inspect(file, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		sel, ok := call.Fun.(*ast.SelectorExpr)
+		if !ok {
+			return true
+		}
+		pkg, ok := sel.X.(*ast.Ident)
+		if !ok || imports[pkg.Name] == "" {
+			return true
+		}
+		name := imports[pkg.Name] + "." + sel.Sel.Name
+		r, ok := riskyCalls[name]
+		if !ok {
+			return true
+		}
+		if r.severity != "" {
+			report(call, RuleRiskyCall, r.severity, fmt.Sprintf("calls %s, which %s", name, r.reason))
+			return true
+		}
+		// os.Getenv and os.LookupEnv matter when they read secrets.
+		if len(call.Args) == 1 {
+			if lit, ok := call.Args[0].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				if env, _ := strconv.Unquote(lit.Value); secretEnv.MatchString(env) {
+					report(call, RuleRiskyCall, SeverityHigh, fmt.Sprintf("reads the secret environment variable %s", env))
+				}
+			}
+		}
+		return true
+	})
+	return findings
+}
+
+// pathBase returns the default package name of an import path.
+func pathBase(importPath string) string {
+	name := path.Base(importPath)
+	if len(name) > 1 && name[0] == 'v' && strings.Trim(name[1:], "0123456789") == "" {
+		// Major version suffix, e.g. github.com/x/y/v2.
+		name = path.Base(path.Dir(importPath))
+	}
+	return name
+}
+
+// sensitivePath returns a finding when path is sensitive code.
+func sensitivePath(p string) (Finding, bool) {
+	lower := strings.ToLower(p)
+	for _, s := range sensitivePaths {
+		target := lower
+		if !strings.Contains(s.pattern, "/") {
+			target = path.Base(lower)
+		}
+		if ok, _ := path.Match(s.pattern, target); ok {
+			return Finding{
+				Rule:     RuleSensitivePath,
+				Severity: s.severity,
+				Path:     p,
+				Message:  "changes " + s.reason,
+			}, true
+		}
+	}
+	return Finding{}, false
+}
+
+// addedLines returns the line numbers, from 1, of the lines of newContent
+// that are not in oldContent.
+func addedLines(oldContent, newContent string) map[int]bool {
+	added := make(map[int]bool)
+	line := 0
+	for _, op := range lineDiff(oldContent, newContent) {
+		if op.op == OpDelete {
+			continue
+		}
+		line++
+		if op.op == OpAdd {
+			added[line] = true
+		}
+	}
+	return added
+}
+
+// hosts returns the hosts of the URLs in s, in order of appearance.
+func hosts(s string) []string {
+	var found []string
+	for _, raw := range urlHost.FindAllString(s, -1) {
+		u, err := url.Parse(raw)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		if host := strings.ToLower(u.Hostname()); !slices.Contains(found, host) {
+			found = append(found, host)
+		}
+	}
+	return found
+}
+
+// scan runs the scanner over changes to the files at rev, or in the
+// working tree when rev is empty.
+func (e *Engine) scan(changes []FileChange, rev string) ([]Finding, error) {
+	var findings []Finding
+	for _, c := range changes {
+		oldContent, err := e.oldContent(c, rev)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, e.scanner.Scan(c.Path, oldContent, c.content())...)
+	}
+	return findings, nil
+}
@@ -0,0 +1,126 @@
+package selfmod
+
+import (
+	"fmt"
+	"strings"
+)
+
+// FileDiff statuses.
+const (
+	DiffAdded    = "added"
+	DiffModified = "modified"
+	DiffDeleted  = "deleted"
+	DiffRenamed  = "renamed"
+)
+
+// RenameThreshold is the minimum similarity, in percent, for a deleted and
+// a created file to be shown as a rename.
+const RenameThreshold = 50
+
+// binaryProbe is how much of a file is checked for NUL bytes, as git does.
+const binaryProbe = 8000
+
+func isBinary(s string) bool {
+	return strings.IndexByte(s[:min(len(s), binaryProbe)], 0) != -1
+}
+
+// fileDiff describes the change from oldContent at oldPath to newContent at
+// fd.Path.
+func fileDiff(fd FileDiff, oldContent, newContent string, context int) FileDiff {
+	if isBinary(oldContent) || isBinary(newContent) {
+		fd.Binary = true
+	} else {
+		ops := lineDiff(oldContent, newContent)
+		for _, op := range ops {
+			switch op.op {
+			case OpAdd:
+				fd.Additions++
+			case OpDelete:
+				fd.Deletions++
+			}
+		}
+		fd.Hunks, _ = buildHunks(ops, context)
+	}
+	fd.Diff = unified(fd)
+	return fd
+}
+
+// similarity returns how much of two texts is shared, in percent of their
+// lines.
+func similarity(a, b string) int {
+	if isBinary(a) || isBinary(b) {
+		if a == b {
+			return 100
+		}
+		return 0
+	}
+	var common, total int
+	for _, op := range lineDiff(a, b) {
+		if op.op == OpContext {
+			common += 2
+		}
+		total++
+	}
+	total += common / 2 // context lines count once on each side
+	if total == 0 {
+		return 100
+	}
+	return common * 100 / total
+}
+
+// unified renders fd as a git-style unified diff.
+func unified(fd FileDiff) string {
+	oldPath := fd.Path
+	if fd.OldPath != "" {
+		oldPath = fd.OldPath
+	}
+	a, b := "a/"+oldPath, "b/"+fd.Path
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "diff --git a/%s b/%s\n", oldPath, fd.Path)
+	switch fd.Status {
+	case DiffAdded:
+		sb.WriteString("new file mode 100644\n")
+		a = "/dev/null"
+	case DiffDeleted:
+		sb.WriteString("deleted file mode 100644\n")
+		b = "/dev/null"
+	case DiffRenamed:
+		fmt.Fprintf(&sb, "similarity index %d%%\nrename from %s\nrename to %s\n", fd.Similarity, oldPath, fd.Path)
+	}
+
+	if fd.Binary {
+		fmt.Fprintf(&sb, "Binary files %s and %s differ\n", a, b)
+		return sb.String()
+	}
+	if len(fd.Hunks) == 0 {
+		return sb.String()
+	}
+
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", a, b)
+	for _, h := range fd.Hunks {
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(h.OldStart, h.OldLines), hunkRange(h.NewStart, h.NewLines))
+		for _, l := range h.Lines {
+			switch l.Op {
+			case OpAdd:
+				sb.WriteByte('+')
+			case OpDelete:
+				sb.WriteByte('-')
+			default:
+				sb.WriteByte(' ')
+			}
+			sb.WriteString(l.Text + "\n")
+			if l.NoNewline {
+				sb.WriteString("\\ No newline at end of file\n")
+			}
+		}
+	}
+	return sb.String()
+}
+
+func hunkRange(start, lines int) string {
+	if lines == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, lines)
+}
@@ -0,0 +1,91 @@
+package selfmod
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/yuki/flyagi/internal/sandbox"
+)
+
+// Check is a verification command run against applied changes.
+type Check struct {
+	Name string
+	Args []string
+}
+
+// ParseChecks turns commands such as "go test ./..." into checks named
+// after them. Arguments are split on spaces; no shell is involved.
+func ParseChecks(commands []string) []Check {
+	var checks []Check
+	for _, c := range commands {
+		if args := strings.Fields(c); len(args) > 0 {
+			checks = append(checks, Check{Name: strings.Join(args, " "), Args: args})
+		}
+	}
+	return checks
+}
+
+// Runner runs verification commands, e.g. a *sandbox.Sandbox.
+type Runner interface {
+	Run(ctx context.Context, cmd sandbox.Command) (*sandbox.Result, error)
+}
+
+// SetVerifier runs checks with r after a change request is applied. The
+// commands run code written by the LLM, so r should be a sandbox.
+func (e *Engine) SetVerifier(r Runner, checks []Check) {
+	e.runner = r
+	e.checks = checks
+}
+
+// HasChecks reports whether verification checks are configured.
+func (e *Engine) HasChecks() bool {
+	return e.runner != nil && len(e.checks) > 0
+}
+
+// Verify runs the verification checks against a copy of the repository,
+// which must hold the applied changes of the request, and records the
+// results on it. It returns nil when no checks are configured.
+func (e *Engine) Verify(ctx context.Context, requestID string) ([]VerificationResult, error) {
+	cr, ok := e.GetRequest(requestID)
+	if !ok {
+		return nil, fmt.Errorf("change request %q not found", requestID)
+	}
+	if !e.HasChecks() {
+		return nil, nil
+	}
+
+	// The checks run against a copy of the working tree, so it is locked
+	// only while being copied rather than for as long as they run. They
+	// share the copy, in order, like the steps of a CI job.
+	e.mu.RLock()
+	dir, cleanup, err := sandbox.Snapshot(e.repoPath)
+	e.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	var results []VerificationResult
+	for _, check := range e.checks {
+		res, err := e.runner.Run(ctx, sandbox.Command{Dir: dir, InPlace: true, Args: check.Args})
+		if err != nil {
+			return nil, fmt.Errorf("failed to run %s: %w", check.Name, err)
+		}
+		results = append(results, VerificationResult{
+			Name:     check.Name,
+			Passed:   res.Passed(),
+			Output:   res.Output,
+			TimedOut: res.TimedOut,
+			Duration: res.Duration,
+		})
+		slog.Info("verification", "request_id", cr.ID, "check", check.Name, "passed", res.Passed(),
+			"exit_code", res.ExitCode, "duration", res.Duration, "isolation", res.Isolation)
+	}
+
+	e.histMu.Lock()
+	cr.Verification = results
+	e.histMu.Unlock()
+	return results, nil
+}
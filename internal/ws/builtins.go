@@ -0,0 +1,380 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/yuki/flyagi/internal/provider"
+)
+
+// SessionPayload is the payload for "chat.session" messages, sent when a
+// command changes the client's provider or model.
+type SessionPayload struct {
+	ProviderID string `json:"provider_id"`
+	Model      string `json:"model,omitempty"`
+}
+
+// chatSession holds per-client settings changed by commands.
+type chatSession struct {
+	providerID string
+	model      string
+}
+
+func (h *ChatHandler) session(client *Client) chatSession {
+	if v, ok := h.sessions.Load(client.ID); ok {
+		return v.(chatSession)
+	}
+	return chatSession{}
+}
+
+func (h *ChatHandler) setSession(client *Client, s chatSession) {
+	h.sessions.Store(client.ID, s)
+	payload, _ := json.Marshal(SessionPayload{ProviderID: s.providerID, Model: s.model})
+	client.Send(Envelope{Type: "chat.session", Payload: payload})
+}
+
+// resolveLLM returns the provider a client's message should use: the one
+// picked with /provider, else the requested one, else "anthropic", switched
+// to the /model choice when there is one.
+func (h *ChatHandler) resolveLLM(client *Client, requested string) (provider.LLMProvider, string, error) {
+	s := h.session(client)
+	providerID := s.providerID
+	if providerID == "" {
+		providerID = requested
+	}
+	if providerID == "" {
+		providerID = "anthropic"
+	}
+
+	llm, err := h.registry.GetLLM(providerID)
+	if err != nil {
+		return nil, providerID, err
+	}
+	if ms, ok := llm.(provider.ModelSwitcher); ok && s.model != "" {
+		llm = ms.WithModel(s.model)
+	}
+	return llm, providerID, nil
+}
+
+func (h *ChatHandler) registerBuiltins() {
+	for _, cmd := range []*Command{
+		{
+			Name: "help",
+			Args: []CommandArg{{Name: "command", Description: "command to describe"}},
+			Help: "List commands or describe one",
+			Run:  h.cmdHelp,
+		},
+		{
+			Name:    "selfmod",
+			Aliases: []string{"change", "modify"},
+			Args:    []CommandArg{{Name: "request", Description: "change to make", Required: true, Rest: true}},
+			Help:    "Generate a code change for approval",
+			Role:    RoleAdmin,
+			Run:     h.cmdIntent(IntentSelfMod),
+		},
+		{
+			Name: "ask",
+			Args: []CommandArg{{Name: "question", Required: true, Rest: true}},
+			Help: "Answer a question about this codebase with citations",
+			Run:  h.cmdIntent(IntentCodebase),
+		},
+		{
+			Name: "chat",
+			Args: []CommandArg{{Name: "message", Required: true, Rest: true}},
+			Help: "Send a message as plain chat, skipping intent detection",
+			Run:  h.cmdIntent(IntentChat),
+		},
+		{
+			Name: "provider",
+			Args: []CommandArg{{Name: "id", Description: "LLM provider to use"}},
+			Help: "Show or switch the LLM provider",
+			Run:  h.cmdProvider,
+		},
+		{
+			Name: "model",
+			Args: []CommandArg{{Name: "name", Description: "model of the current provider"}},
+			Help: "Show or switch the model",
+			Run:  h.cmdModel,
+		},
+		{
+			Name: "history",
+			Args: []CommandArg{{Name: "limit", Description: "number of requests, default 10"}},
+			Help: "List recent change requests",
+			Run:  h.cmdHistory,
+		},
+		{
+			Name: "refine",
+			Args: []CommandArg{
+				{Name: "request_id", Description: "pending change request, or an ID prefix", Required: true},
+				{Name: "feedback", Description: "what to change about the proposal", Required: true, Rest: true},
+			},
+			Help: "Revise a pending change request with feedback",
+			Role: RoleAdmin,
+			Run:  h.cmdRefine,
+		},
+		{
+			Name: "revert",
+			Args: []CommandArg{{Name: "request_id", Description: "applied change request, or an ID prefix", Required: true}},
+			Help: "Propose a change that undoes an applied change request",
+			Role: RoleAdmin,
+			Run:  h.cmdRevert,
+		},
+		{
+			Name: "status",
+			Help: "Show provider, repository and index status",
+			Run:  h.cmdStatus,
+		},
+	} {
+		if err := h.commands.Register(cmd); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (h *ChatHandler) cmdHelp(c *CommandContext) error {
+	if name := c.Args["command"]; name != "" {
+		cmd, ok := h.commands.Lookup(name)
+		if !ok {
+			return fmt.Errorf("unknown command %q", name)
+		}
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "`%s` — %s\n", cmd.Usage(), cmd.Help)
+		for _, a := range cmd.Args {
+			if a.Description != "" {
+				fmt.Fprintf(&sb, "- `%s`: %s\n", a.Name, a.Description)
+			}
+		}
+		if len(cmd.Aliases) > 0 {
+			fmt.Fprintf(&sb, "別名: /%s\n", strings.Join(cmd.Aliases, ", /"))
+		}
+		if cmd.Role == RoleAdmin {
+			sb.WriteString("管理者のみ実行できます。\n")
+		}
+		c.Reply(sb.String())
+		return nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("利用できるコマンド:\n")
+	for _, cmd := range h.commands.List(c.Client.Role) {
+		fmt.Fprintf(&sb, "- `%s` — %s\n", cmd.Usage(), cmd.Help)
+	}
+	c.Reply(sb.String())
+	return nil
+}
+
+// cmdIntent returns a command that routes its argument with a fixed intent.
+func (h *ChatHandler) cmdIntent(intent string) func(*CommandContext) error {
+	return func(c *CommandContext) error {
+		llm, providerID, err := c.LLM()
+		if err != nil {
+			return err
+		}
+		var request string
+		for _, v := range c.Args {
+			request = v // every intent command has a single argument
+		}
+		switch {
+		case intent == IntentSelfMod && h.engine == nil:
+			return fmt.Errorf("self-modification not configured")
+		case intent == IntentCodebase && h.repoPath == "":
+			return fmt.Errorf("codebase mode not configured")
+		}
+		h.route(c.Client, llm, providerID, c.Messages, IntentDecision{
+			Intent:     intent,
+			Confidence: 1,
+			Source:     SourceCommand,
+			Request:    request,
+		})
+		return nil
+	}
+}
+
+func (h *ChatHandler) cmdProvider(c *CommandContext) error {
+	s := h.session(c.Client)
+	id := c.Args["id"]
+	if id == "" {
+		_, current, _ := c.LLM()
+		var sb strings.Builder
+		sb.WriteString("LLMプロバイダー:\n")
+		for _, name := range h.registry.ListLLMs() {
+			marker := ""
+			if name == current {
+				marker = " (使用中)"
+			}
+			fmt.Fprintf(&sb, "- %s%s\n", name, marker)
+		}
+		c.Reply(sb.String())
+		return nil
+	}
+
+	if _, err := h.registry.GetLLM(id); err != nil {
+		return err
+	}
+	if id != s.providerID {
+		s.model = "" // models belong to a provider
+	}
+	s.providerID = id
+	h.setSession(c.Client, s)
+	c.Reply(fmt.Sprintf("プロバイダーを %s に切り替えました。", id))
+	return nil
+}
+
+func (h *ChatHandler) cmdModel(c *CommandContext) error {
+	llm, providerID, err := c.LLM()
+	if err != nil {
+		return err
+	}
+	ms, ok := llm.(provider.ModelSwitcher)
+	if !ok {
+		return fmt.Errorf("provider %s does not support switching models", providerID)
+	}
+
+	name := c.Args["name"]
+	if name == "" {
+		c.Reply(fmt.Sprintf("%s のモデル: %s", providerID, ms.Model()))
+		return nil
+	}
+
+	s := h.session(c.Client)
+	s.providerID = providerID
+	s.model = name
+	h.setSession(c.Client, s)
+	c.Reply(fmt.Sprintf("%s のモデルを %s に切り替えました。", providerID, name))
+	return nil
+}
+
+func (h *ChatHandler) cmdHistory(c *CommandContext) error {
+	if h.engine == nil {
+		return fmt.Errorf("self-modification not configured")
+	}
+	limit := 10
+	if v := c.Args["limit"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid limit %q", v)
+		}
+		limit = n
+	}
+
+	history := h.engine.Requests()
+	if len(history) == 0 {
+		c.Reply("変更リクエストはまだありません。")
+		return nil
+	}
+	var sb strings.Builder
+	sb.WriteString("最近の変更リクエスト:\n")
+	for i := len(history) - 1; i >= 0 && i >= len(history)-limit; i-- {
+		cr := history[i]
+		fmt.Fprintf(&sb, "- `%s` %s %s", cr.ID[:8], cr.CreatedAt.Format("01/02 15:04"), cr.Status)
+		if cr.Revision > 1 {
+			fmt.Fprintf(&sb, " (r%d)", cr.Revision)
+		}
+		fmt.Fprintf(&sb, " — %s", cr.Description)
+		if cr.PRURL != "" {
+			fmt.Fprintf(&sb, " ([PR #%d](%s))", cr.PRNumber, cr.PRURL)
+		}
+		sb.WriteString("\n")
+	}
+	c.Reply(sb.String())
+	return nil
+}
+
+func (h *ChatHandler) cmdRefine(c *CommandContext) error {
+	if h.engine == nil {
+		return fmt.Errorf("self-modification not configured")
+	}
+	id, err := h.findRequest(c.Args["request_id"])
+	if err != nil {
+		return err
+	}
+	llm, _, err := c.LLM()
+	if err != nil {
+		return err
+	}
+	h.refine(c.Client, llm, id, c.Args["feedback"])
+	return nil
+}
+
+func (h *ChatHandler) cmdRevert(c *CommandContext) error {
+	if h.engine == nil {
+		return fmt.Errorf("self-modification not configured")
+	}
+	id, err := h.findRequest(c.Args["request_id"])
+	if err != nil {
+		return err
+	}
+	cr, err := h.engine.Revert(id)
+	if err != nil {
+		return err
+	}
+	c.Reply(fmt.Sprintf("取り消しの変更を生成しました: %s\n以下のDiffを確認して承認/拒否してください。", cr.Description))
+	c.Client.Send(diffEnvelope(cr))
+	return nil
+}
+
+// findRequest resolves a change request ID or unique ID prefix.
+func (h *ChatHandler) findRequest(prefix string) (string, error) {
+	var found string
+	for _, cr := range h.engine.Requests() {
+		if !strings.HasPrefix(cr.ID, prefix) {
+			continue
+		}
+		if found != "" {
+			return "", fmt.Errorf("request ID %q is ambiguous", prefix)
+		}
+		found = cr.ID
+	}
+	if found == "" {
+		return "", fmt.Errorf("change request %q not found", prefix)
+	}
+	return found, nil
+}
+
+func (h *ChatHandler) cmdStatus(c *CommandContext) error {
+	var sb strings.Builder
+
+	llm, providerID, err := c.LLM()
+	if err != nil {
+		fmt.Fprintf(&sb, "- プロバイダー: %s (利用不可: %s)\n", providerID, err)
+	} else if ms, ok := llm.(provider.ModelSwitcher); ok {
+		fmt.Fprintf(&sb, "- プロバイダー: %s (%s)\n", providerID, ms.Model())
+	} else {
+		fmt.Fprintf(&sb, "- プロバイダー: %s\n", providerID)
+	}
+	fmt.Fprintf(&sb, "- 権限: %s\n", c.Client.Role)
+
+	if h.engine != nil {
+		pending := 0
+		for _, cr := range h.engine.Requests() {
+			if cr.Status == "pending" {
+				pending++
+			}
+		}
+		fmt.Fprintf(&sb, "- 自己改変: 有効 (承認待ち %d件)\n", pending)
+	} else {
+		sb.WriteString("- 自己改変: 無効\n")
+	}
+
+	if h.gitSvc != nil {
+		if st, err := h.gitSvc.Status(); err == nil {
+			state := "clean"
+			if !st.Clean {
+				state = fmt.Sprintf("%d files changed", len(st.Files))
+			}
+			fmt.Fprintf(&sb, "- Git: %s @ %.8s (%s)\n", st.Branch, st.Head, state)
+		}
+	}
+	if h.forge != nil {
+		sb.WriteString("- Forge: 接続済み\n")
+	}
+	if h.index != nil {
+		st := h.index.Status()
+		fmt.Fprintf(&sb, "- インデックス: %d files, %d chunks\n", st.Files, st.Chunks)
+	}
+
+	c.Reply(sb.String())
+	return nil
+}
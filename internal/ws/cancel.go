@@ -0,0 +1,182 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/yuki/flyagi/internal/selfmod"
+)
+
+// SelfModCancelPayload is the payload for "selfmod.cancel" messages. It
+// cancels the refinement or approval running for RequestID, or without one,
+// the client's generations that have not produced a change request yet.
+type SelfModCancelPayload struct {
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// selfmodOp is a cancellable selfmod generation, refinement or approval.
+type selfmodOp struct {
+	client     string
+	generation bool // a new change request, not yet known by ID
+	cancel     context.CancelFunc
+}
+
+// startOp registers an operation under key, which is the request ID for
+// refinements and approvals. It returns nil if one is already running.
+func (h *ChatHandler) startOp(key, clientID string, generation bool, cancel context.CancelFunc) *selfmodOp {
+	op := &selfmodOp{client: clientID, generation: generation, cancel: cancel}
+	if _, loaded := h.ops.LoadOrStore(key, op); loaded {
+		return nil
+	}
+	return op
+}
+
+func (h *ChatHandler) endOp(key string, op *selfmodOp) {
+	h.ops.CompareAndDelete(key, op)
+}
+
+// CancelSelfMod cancels the refinement or approval running for a change
+// request. It reports whether there was one.
+func (h *ChatHandler) CancelSelfMod(requestID string) bool {
+	v, ok := h.ops.Load(requestID)
+	if !ok {
+		return false
+	}
+	v.(*selfmodOp).cancel()
+	slog.Info("selfmod operation cancelled", "request_id", requestID)
+	return true
+}
+
+// cancelGenerations cancels the client's queued or running generations and
+// returns how many there were.
+func (h *ChatHandler) cancelGenerations(clientID string) int {
+	n := 0
+	h.ops.Range(func(_, v any) bool {
+		if op := v.(*selfmodOp); op.generation && op.client == clientID {
+			op.cancel()
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+func (h *ChatHandler) handleSelfModCancel(client *Client, payload json.RawMessage) {
+	var p SelfModCancelPayload
+	if len(payload) > 0 {
+		if err := json.Unmarshal(payload, &p); err != nil {
+			sendError(client, "Invalid cancel payload")
+			return
+		}
+	}
+
+	if p.RequestID == "" {
+		if h.cancelGenerations(client.ID) == 0 {
+			sendError(client, "No generation to cancel")
+		}
+		return
+	}
+
+	// Only admins may cancel what another client started.
+	v, ok := h.ops.Load(p.RequestID)
+	if ok && v.(*selfmodOp).client != client.ID && client.Role != RoleAdmin {
+		h.sendStatus(client, p.RequestID, "error", "他のクライアントの処理をキャンセルするには管理者権限が必要です", "")
+		return
+	}
+	if !ok || !h.CancelSelfMod(p.RequestID) {
+		h.sendStatus(client, p.RequestID, "error", "キャンセルできる処理がありません", "")
+	}
+}
+
+// generationCancelled ends the chat stream of a cancelled generation or
+// refinement. A refined request stays pending with its last revision.
+func (h *ChatHandler) generationCancelled(client *Client, requestID string) {
+	donePayload, _ := json.Marshal(ChatChunkPayload{Done: true})
+	client.Send(Envelope{Type: "chat.chunk", Payload: donePayload})
+
+	msg := "変更の生成をキャンセルしました"
+	if requestID != "" {
+		msg = "変更の修正をキャンセルしました（前のリビジョンのまま保留中です）"
+	}
+	h.sendStatus(client, requestID, "cancelled", msg, "")
+}
+
+// approvalUndo records what an approval has done to the repository, so that
+// a cancelled or failed one can be rolled back.
+type approvalUndo struct {
+	branch  string // checked out for the approval
+	created bool   // the branch was created by it
+	applied bool   // the changes were written to the working tree
+	pushed  bool
+}
+
+// rollBack undoes a cancelled or failed approval: the applied files are
+// restored, the branch is left and, if the approval created it, deleted
+// locally and on the remote. A cancelled request ends up "cancelled"; a
+// failed one is pending again, so it can be approved once the failure is
+// fixed. failure is the error that stopped the approval, or "" if it was
+// cancelled. Callers hold repoMu.
+func (h *ChatHandler) rollBack(client *Client, cr *selfmod.ChangeRequest, u approvalUndo, failure string) {
+	if failure != "" && u.branch == "" && !u.applied {
+		h.sendStatus(client, cr.ID, "error", failure, "")
+		return
+	}
+	if failure == "" {
+		slog.Info("selfmod approval cancelled", "request_id", cr.ID, "branch", u.branch, "pushed", u.pushed)
+	} else {
+		slog.Info("selfmod approval failed, rolling back", "request_id", cr.ID, "branch", u.branch, "pushed", u.pushed)
+	}
+
+	clean := true
+	var err error
+	switch {
+	case failure == "":
+		err = h.engine.Cancel(cr.ID)
+	case u.applied:
+		err = h.engine.Unapply(cr.ID)
+	}
+	if err != nil {
+		slog.Error("failed to roll back change request", "request_id", cr.ID, "error", err)
+		clean = false
+	}
+
+	if u.branch != "" {
+		if err := h.engine.LockTree(h.gitSvc.Discard); err != nil {
+			slog.Error("failed to discard rolled back changes", "error", err)
+			clean = false
+		}
+		if err := h.engine.LockTree(h.gitSvc.CheckoutMain); err != nil {
+			slog.Error("failed to checkout main after rollback", "error", err)
+			clean = false
+		} else if u.created {
+			if err := h.gitSvc.DeleteBranch(u.branch); err != nil {
+				slog.Warn("failed to delete rolled back branch", "branch", u.branch, "error", err)
+				clean = false
+			}
+		}
+		if u.pushed && u.created {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := h.gitSvc.DeleteRemoteBranch(ctx, u.branch); err != nil {
+				slog.Warn("failed to delete rolled back remote branch", "branch", u.branch, "error", err)
+				clean = false
+			}
+		}
+	}
+
+	if failure != "" {
+		msg := failure + "（変更を取り消し、保留中に戻しました）"
+		if !clean {
+			msg = failure + "（一部の取り消しに失敗しました）"
+		}
+		h.sendStatus(client, cr.ID, "error", msg, "")
+		return
+	}
+	msg := "承認をキャンセルし、変更を取り消しました"
+	if !clean {
+		msg = "承認をキャンセルしましたが、一部の取り消しに失敗しました"
+	}
+	h.sendStatus(client, cr.ID, "cancelled", msg, "")
+}
@@ -0,0 +1,325 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/yuki/flyagi/internal/codeindex"
+	"github.com/yuki/flyagi/internal/codesearch"
+	"github.com/yuki/flyagi/internal/provider"
+	"github.com/yuki/flyagi/internal/selfmod"
+)
+
+// ModeCodebase is the chat.send mode that answers questions about the
+// repository from retrieved code.
+const ModeCodebase = "codebase"
+
+// Retrieval limits for codebase chat.
+const (
+	codebaseK       = 12
+	codebaseBudget  = 32 << 10
+	keywordContext  = 8
+	keywordsPerTerm = 5
+)
+
+const codebasePrompt = `You answer questions about the FlyAGI code repository.
+Base your answer on the numbered code excerpts below. Cite every claim with the file and line numbers it comes from, written as path:line or path:start-end (for example internal/ws/hub.go:42-57).
+If the excerpts do not contain the answer, say so instead of guessing.
+
+`
+
+// Citation points at a range of lines in the repository.
+type Citation struct {
+	Path      string `json:"path"`
+	StartLine int    `json:"start_line"`
+	EndLine   int    `json:"end_line"`
+	Symbol    string `json:"symbol,omitempty"`
+	URL       string `json:"url"` // /api/code/file link for the UI
+}
+
+// ChatCitationsPayload is the payload for "chat.citations" messages sent
+// after a codebase answer.
+type ChatCitationsPayload struct {
+	// Sources are the excerpts given to the LLM.
+	Sources []Citation `json:"sources"`
+	// Cited are the references found in the answer that point at existing
+	// files.
+	Cited []Citation `json:"cited"`
+}
+
+// SetCodebase enables the codebase chat mode for the repository at
+// repoPath. index may be nil, in which case keyword search is used.
+func (h *ChatHandler) SetCodebase(repoPath string, index *codeindex.Index) {
+	h.repoPath = repoPath
+	h.index = index
+}
+
+// Reindex updates the code index. The repository is held meanwhile, so the
+// index is read from the base branch and never from a branch an approval
+// has checked out.
+func (h *ChatHandler) Reindex(ctx context.Context) (codeindex.UpdateStats, error) {
+	if h.index == nil {
+		return codeindex.UpdateStats{}, fmt.Errorf("code index not configured")
+	}
+	h.repoMu.Lock()
+	defer h.repoMu.Unlock()
+	return h.index.Update(ctx)
+}
+
+// reindex updates the code index, if there is one, once the repository is
+// free, e.g. after the base branch was pulled.
+func (h *ChatHandler) reindex() {
+	if h.index == nil {
+		return
+	}
+	go func() {
+		stats, err := h.Reindex(context.Background())
+		if err != nil {
+			slog.Error("code index update failed", "error", err)
+			return
+		}
+		slog.Info("code index updated", "files", stats.Files, "changed", stats.Changed, "removed", stats.Removed, "chunks", stats.Chunks)
+	}()
+}
+
+// handleCodebaseChat answers the last message from code retrieved from the
+// repository and sends the citations once the answer is complete.
+func (h *ChatHandler) handleCodebaseChat(client *Client, llm provider.LLMProvider, messages []provider.Message) {
+	if h.repoPath == "" {
+		sendError(client, "Codebase mode not configured")
+		return
+	}
+
+	question := ""
+	if len(messages) > 0 {
+		question = messages[len(messages)-1].Content
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancels.Store(client.ID, cancel)
+
+	go func() {
+		defer func() {
+			h.cancels.Delete(client.ID)
+			cancel()
+		}()
+
+		sources := h.retrieve(ctx, question)
+		prompt := provider.Message{Role: "system", Content: codebasePrompt + formatExcerpts(sources)}
+
+		var answer strings.Builder
+		err := llm.ChatStream(ctx, append([]provider.Message{prompt}, messages...), func(chunk provider.StreamChunk) error {
+			answer.WriteString(chunk.Content)
+			chunkPayload, _ := json.Marshal(ChatChunkPayload{
+				Content: chunk.Content,
+				Done:    chunk.Done,
+			})
+			return client.Send(Envelope{Type: "chat.chunk", Payload: chunkPayload})
+		})
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Error("codebase chat stream error", "error", err, "client", client.ID)
+			sendError(client, "Stream error: "+err.Error())
+			return
+		}
+
+		payload, _ := json.Marshal(ChatCitationsPayload{
+			Sources: citations(sources),
+			Cited:   h.citedRefs(answer.String()),
+		})
+		client.Send(Envelope{Type: "chat.citations", Payload: payload})
+	}()
+}
+
+// retrieve returns excerpts relevant to question from the semantic index,
+// falling back to keyword search, trimmed to codebaseBudget.
+func (h *ChatHandler) retrieve(ctx context.Context, question string) []codeindex.Chunk {
+	var chunks []codeindex.Chunk
+	if h.index != nil {
+		hits, err := h.index.Search(ctx, question, codebaseK)
+		if err != nil {
+			slog.Warn("index search failed, using keyword search", "error", err)
+		}
+		for _, hit := range hits {
+			chunks = append(chunks, hit.Chunk)
+		}
+	}
+	if len(chunks) == 0 {
+		h.ReadRepo(func() error {
+			chunks = keywordSearch(ctx, h.repoPath, question)
+			return nil
+		})
+	}
+
+	var out []codeindex.Chunk
+	size := 0
+	for _, c := range chunks {
+		if size+len(c.Text) > codebaseBudget {
+			continue
+		}
+		size += len(c.Text)
+		out = append(out, c)
+	}
+	return out
+}
+
+// keywordSearch finds the lines mentioning the question's terms and returns
+// the surrounding code, preferring files that match the most terms.
+func keywordSearch(ctx context.Context, repoPath, question string) []codeindex.Chunk {
+	type fileHits struct {
+		terms   map[string]bool
+		matches []codesearch.Match
+	}
+	files := map[string]*fileHits{}
+
+	for _, term := range searchTerms(question) {
+		res, err := codesearch.Search(ctx, repoPath, codesearch.Options{
+			Query:   term,
+			Context: keywordContext,
+			Limit:   keywordsPerTerm,
+			Exclude: selfmod.IsProtected,
+		})
+		if err != nil {
+			continue
+		}
+		for _, m := range res.Matches {
+			f, ok := files[m.Path]
+			if !ok {
+				f = &fileHits{terms: map[string]bool{}}
+				files[m.Path] = f
+			}
+			f.terms[term] = true
+			f.matches = append(f.matches, m)
+		}
+	}
+
+	paths := make([]string, 0, len(files))
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		a, b := files[paths[i]], files[paths[j]]
+		if len(a.terms) != len(b.terms) {
+			return len(a.terms) > len(b.terms)
+		}
+		return paths[i] < paths[j]
+	})
+
+	var chunks []codeindex.Chunk
+	for _, p := range paths {
+		ms := files[p].matches
+		sort.Slice(ms, func(i, j int) bool { return ms[i].Line < ms[j].Line })
+		for _, m := range ms {
+			start := m.Line - len(m.Before)
+			end := m.Line + len(m.After)
+			lines := append(append(append([]string{}, m.Before...), m.Text), m.After...)
+
+			// Merge overlapping windows within the same file.
+			if n := len(chunks); n > 0 && chunks[n-1].Path == p && start <= chunks[n-1].EndLine+1 {
+				last := &chunks[n-1]
+				if end > last.EndLine {
+					last.Text += "\n" + strings.Join(lines[last.EndLine-start+1:], "\n")
+					last.EndLine = end
+				}
+				continue
+			}
+			chunks = append(chunks, codeindex.Chunk{Path: p, StartLine: start, EndLine: end, Text: strings.Join(lines, "\n")})
+		}
+	}
+	return chunks
+}
+
+// stopWords are ignored when turning a question into search terms.
+var stopWords = map[string]bool{
+	"the": true, "and": true, "for": true, "are": true, "how": true, "what": true,
+	"where": true, "which": true, "does": true, "this": true, "that": true, "with": true,
+	"from": true, "when": true, "why": true, "who": true, "can": true, "code": true,
+	"file": true, "files": true, "handled": true, "defined": true, "used": true,
+}
+
+// searchTerms extracts identifier-like words of at least three characters.
+func searchTerms(question string) []string {
+	seen := map[string]bool{}
+	var terms []string
+	for _, w := range strings.FieldsFunc(question, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '.'
+	}) {
+		w = strings.Trim(w, ".")
+		if len([]rune(w)) < 3 || stopWords[strings.ToLower(w)] || seen[strings.ToLower(w)] {
+			continue
+		}
+		seen[strings.ToLower(w)] = true
+		terms = append(terms, w)
+	}
+	return terms
+}
+
+func formatExcerpts(chunks []codeindex.Chunk) string {
+	if len(chunks) == 0 {
+		return "(no relevant code was found)\n"
+	}
+	var sb strings.Builder
+	for i, c := range chunks {
+		fmt.Fprintf(&sb, "[%d] %s:%d-%d\n```\n%s\n```\n\n", i+1, c.Path, c.StartLine, c.EndLine, c.Text)
+	}
+	return sb.String()
+}
+
+func citations(chunks []codeindex.Chunk) []Citation {
+	out := make([]Citation, len(chunks))
+	for i, c := range chunks {
+		out[i] = newCitation(c.Path, c.StartLine, c.EndLine)
+		out[i].Symbol = c.Symbol
+	}
+	return out
+}
+
+func newCitation(path string, start, end int) Citation {
+	return Citation{
+		Path:      path,
+		StartLine: start,
+		EndLine:   end,
+		URL:       fmt.Sprintf("/api/code/file?path=%s#L%d-L%d", url.QueryEscape(path), start, end),
+	}
+}
+
+// citationRef matches path:line and path:start-end references.
+var citationRef = regexp.MustCompile(`([\w./-]+\.\w+):(\d+)(?:-(\d+))?`)
+
+// citedRefs extracts the references in answer that point at existing,
+// non-protected files in the repository.
+func (h *ChatHandler) citedRefs(answer string) []Citation {
+	seen := map[string]bool{}
+	cited := []Citation{}
+	for _, m := range citationRef.FindAllStringSubmatch(answer, -1) {
+		path := strings.TrimPrefix(m[1], "./")
+		start, _ := strconv.Atoi(m[2])
+		end := start
+		if m[3] != "" {
+			end, _ = strconv.Atoi(m[3])
+		}
+		key := m[0]
+		if seen[key] || start == 0 || end < start || selfmod.IsProtected(path) || strings.Contains(path, "..") {
+			continue
+		}
+		seen[key] = true
+
+		if info, err := os.Stat(filepath.Join(h.repoPath, filepath.FromSlash(path))); err != nil || info.IsDir() {
+			continue
+		}
+		cited = append(cited, newCitation(path, start, end))
+	}
+	return cited
+}
@@ -0,0 +1,233 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/yuki/flyagi/internal/provider"
+)
+
+// CommandArg describes a positional command argument.
+type CommandArg struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Required    bool     `json:"required,omitempty"`
+	Rest        bool     `json:"rest,omitempty"` // takes the rest of the line
+	Choices     []string `json:"choices,omitempty"`
+}
+
+// Command is a slash command typed into the chat.
+type Command struct {
+	Name    string                        `json:"name"` // without the leading slash
+	Aliases []string                      `json:"aliases,omitempty"`
+	Args    []CommandArg                  `json:"args,omitempty"`
+	Help    string                        `json:"help"`
+	Role    string                        `json:"role"` // RoleUser or RoleAdmin
+	Run     func(c *CommandContext) error `json:"-"`
+}
+
+// Usage returns a one-line synopsis such as "/revert <request_id>".
+func (cmd *Command) Usage() string {
+	var sb strings.Builder
+	sb.WriteString("/" + cmd.Name)
+	for _, a := range cmd.Args {
+		name := a.Name
+		if a.Rest {
+			name += "..."
+		}
+		if a.Required {
+			fmt.Fprintf(&sb, " <%s>", name)
+		} else {
+			fmt.Fprintf(&sb, " [%s]", name)
+		}
+	}
+	return sb.String()
+}
+
+// Allowed reports whether a client with role may run the command.
+func (cmd *Command) Allowed(role string) bool {
+	return cmd.Role == RoleUser || role == RoleAdmin
+}
+
+// parse splits input into the command's arguments.
+func (cmd *Command) parse(input string) (map[string]string, error) {
+	args := make(map[string]string)
+	rest := strings.TrimSpace(input)
+	for _, a := range cmd.Args {
+		var v string
+		if a.Rest {
+			v, rest = rest, ""
+		} else if i := strings.IndexFunc(rest, unicode.IsSpace); i != -1 {
+			v, rest = rest[:i], strings.TrimSpace(rest[i:])
+		} else {
+			v, rest = rest, ""
+		}
+		if v == "" {
+			if a.Required {
+				return nil, fmt.Errorf("missing argument <%s>", a.Name)
+			}
+			continue
+		}
+		if len(a.Choices) > 0 && !slices.Contains(a.Choices, v) {
+			return nil, fmt.Errorf("invalid %s %q: must be one of %s", a.Name, v, strings.Join(a.Choices, ", "))
+		}
+		args[a.Name] = v
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected argument %q", rest)
+	}
+	return args, nil
+}
+
+// CommandContext is passed to a running command.
+type CommandContext struct {
+	Context  context.Context
+	Handler  *ChatHandler
+	Client   *Client
+	Args     map[string]string
+	Messages []provider.Message // conversation the command was typed in
+
+	providerID string // requested by the client, before session overrides
+}
+
+// Reply sends text to the client as a complete chat message.
+func (c *CommandContext) Reply(text string) {
+	payload, _ := json.Marshal(ChatChunkPayload{Content: text, Done: true})
+	c.Client.Send(Envelope{Type: "chat.chunk", Payload: payload})
+}
+
+// LLM resolves the provider the client is chatting with.
+func (c *CommandContext) LLM() (provider.LLMProvider, string, error) {
+	return c.Handler.resolveLLM(c.Client, c.providerID)
+}
+
+// CommandRegistry holds the slash commands available in the chat.
+type CommandRegistry struct {
+	mu       sync.RWMutex
+	commands map[string]*Command
+	aliases  map[string]string
+}
+
+// NewCommandRegistry creates an empty registry.
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{
+		commands: make(map[string]*Command),
+		aliases:  make(map[string]string),
+	}
+}
+
+// Register adds a command. Role defaults to RoleUser.
+func (r *CommandRegistry) Register(cmd *Command) error {
+	if cmd.Name == "" || strings.ContainsAny(cmd.Name, "/ ") {
+		return fmt.Errorf("invalid command name %q", cmd.Name)
+	}
+	if cmd.Run == nil {
+		return fmt.Errorf("command /%s has no Run function", cmd.Name)
+	}
+	if cmd.Role == "" {
+		cmd.Role = RoleUser
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+		if _, ok := r.lookup(name); ok {
+			return fmt.Errorf("command /%s already registered", name)
+		}
+	}
+	r.commands[cmd.Name] = cmd
+	for _, alias := range cmd.Aliases {
+		r.aliases[alias] = cmd.Name
+	}
+	return nil
+}
+
+// Lookup returns the command registered under name or one of its aliases.
+func (r *CommandRegistry) Lookup(name string) (*Command, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.lookup(strings.TrimPrefix(strings.ToLower(name), "/"))
+}
+
+func (r *CommandRegistry) lookup(name string) (*Command, bool) {
+	if target, ok := r.aliases[name]; ok {
+		name = target
+	}
+	cmd, ok := r.commands[name]
+	return cmd, ok
+}
+
+// List returns the commands a client with role may run, sorted by name.
+// An empty role lists every command.
+func (r *CommandRegistry) List(role string) []*Command {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	var list []*Command
+	for _, cmd := range r.commands {
+		if role == "" || cmd.Allowed(role) {
+			list = append(list, cmd)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// CommandsPayload is the payload for "commands.list" messages.
+type CommandsPayload struct {
+	Commands []*Command `json:"commands"`
+}
+
+func (h *ChatHandler) handleCommandsList(client *Client) {
+	payload, _ := json.Marshal(CommandsPayload{Commands: h.commands.List(client.Role)})
+	client.Send(Envelope{Type: "commands.list", Payload: payload})
+}
+
+// runCommand runs the slash command in the last message, if any. It reports
+// false when the message is not a registered command, so it can be handled
+// as chat.
+func (h *ChatHandler) runCommand(client *Client, p ChatSendPayload) bool {
+	if len(p.Messages) == 0 {
+		return false
+	}
+	text := strings.TrimSpace(p.Messages[len(p.Messages)-1].Content)
+	if !strings.HasPrefix(text, "/") {
+		return false
+	}
+	name, input := text, ""
+	if i := strings.IndexFunc(text, unicode.IsSpace); i != -1 {
+		name, input = text[:i], text[i:]
+	}
+	cmd, ok := h.commands.Lookup(name)
+	if !ok {
+		return false
+	}
+
+	if !cmd.Allowed(client.Role) {
+		sendError(client, fmt.Sprintf("/%s requires the %s role", cmd.Name, cmd.Role))
+		return true
+	}
+	args, err := cmd.parse(input)
+	if err != nil {
+		sendError(client, fmt.Sprintf("%s (usage: %s)", err, cmd.Usage()))
+		return true
+	}
+
+	ctx := &CommandContext{
+		Context:    context.Background(),
+		Handler:    h,
+		Client:     client,
+		Args:       args,
+		Messages:   p.Messages,
+		providerID: p.ProviderID,
+	}
+	if err := cmd.Run(ctx); err != nil {
+		sendError(client, fmt.Sprintf("/%s: %s", cmd.Name, err))
+	}
+	return true
+}
@@ -0,0 +1,29 @@
+package ws
+
+// NewTestClient registers a client without a connection or pumps, whose
+// send buffer holds buffer messages.
+func NewTestClient(h *Hub, buffer int) *Client {
+	c := &Client{ID: "test", hub: h, send: make(chan []byte, buffer), done: make(chan struct{})}
+	h.register(c)
+	return c
+}
+
+// Unregister disconnects c as its read pump does.
+func (h *Hub) Unregister(c *Client) {
+	h.unregister(c)
+}
+
+// SelfModBranch is the branch an approval of requestID creates.
+var SelfModBranch = selfmodBranch
+
+// NewRoleClient registers a connless client with id and role.
+func NewRoleClient(h *Hub, id, role string) *Client {
+	c := &Client{ID: id, Role: role, hub: h, send: make(chan []byte, 1), done: make(chan struct{})}
+	h.register(c)
+	return c
+}
+
+// Queued returns how many messages wait in c's send buffer.
+func (c *Client) Queued() int {
+	return len(c.send)
+}
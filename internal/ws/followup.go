@@ -0,0 +1,165 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/yuki/flyagi/internal/github"
+	"github.com/yuki/flyagi/internal/selfmod"
+)
+
+// HandleReviewComment turns a reviewer comment on a selfmod pull request into
+// a follow-up change request and broadcasts its diff to connected admins for
+// approval. Comments on branches not created by selfmod are ignored.
+func (h *ChatHandler) HandleReviewComment(providerID string, rc github.ReviewComment) {
+	if h.engine == nil || h.ghClient == nil {
+		slog.Warn("review comment ignored: selfmod not configured", "pr", rc.PRNumber)
+		return
+	}
+
+	llm, err := h.registry.GetLLM(providerID)
+	if err != nil {
+		slog.Error("review comment ignored: LLM provider not found", "provider", providerID, "error", err)
+		return
+	}
+
+	// Comments on one pull request queue as one owner, so a busy review
+	// does not crowd out chat users.
+	owner := fmt.Sprintf("pr#%d", rc.PRNumber)
+	generate := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+		defer cancel()
+
+		branch := rc.Branch
+		if branch == "" {
+			b, err := h.ghClient.PRBranch(ctx, rc.PRNumber)
+			if err != nil {
+				slog.Error("failed to resolve PR branch", "pr", rc.PRNumber, "error", err)
+				return
+			}
+			branch = b
+		}
+		if !strings.HasPrefix(branch, branchPrefix) {
+			slog.Info("review comment ignored: not a selfmod branch", "pr", rc.PRNumber, "branch", branch)
+			return
+		}
+
+		diff, err := h.ghClient.PRDiff(ctx, rc.PRNumber)
+		if err != nil {
+			slog.Error("failed to fetch PR diff", "pr", rc.PRNumber, "error", err)
+			return
+		}
+
+		// The follow-up is diffed against the pull request, not main.
+		var base string
+		if h.gitSvc != nil {
+			h.repoMu.Lock()
+			err := h.gitSvc.FetchBranch(branch)
+			h.repoMu.Unlock()
+			if err != nil {
+				slog.Error("failed to fetch PR branch", "pr", rc.PRNumber, "branch", branch, "error", err)
+				return
+			}
+			base = "origin/" + branch
+		}
+
+		comment := rc.Body
+		if rc.DiffHunk != "" {
+			comment = fmt.Sprintf("```diff\n%s\n```\n%s", rc.DiffHunk, rc.Body)
+		}
+
+		cr, err := h.engine.GenerateFollowUp(ctx, llm, selfmod.FollowUp{
+			Branch:   branch,
+			PRNumber: rc.PRNumber,
+			Comment:  comment,
+			Path:     rc.Path,
+			Line:     rc.Line,
+			Diff:     diff,
+			Base:     base,
+		})
+		if err != nil {
+			slog.Error("selfmod follow-up failed", "pr", rc.PRNumber, "error", err)
+			return
+		}
+
+		slog.Info("selfmod follow-up generated", "request_id", cr.ID, "pr", rc.PRNumber, "author", rc.Author)
+		h.broadcastAdmins(diffEnvelope(cr))
+	}
+	go func() {
+		if err := h.queue.Do(context.Background(), owner, nil, generate); err != nil {
+			slog.Warn("review comment dropped: generation queue full", "pr", rc.PRNumber, "author", rc.Author)
+		}
+	}()
+}
+
+// finishFollowUp reports a follow-up commit that was pushed onto an existing
+// pull request branch.
+func (h *ChatHandler) finishFollowUp(ctx context.Context, client *Client, cr *selfmod.ChangeRequest, hash string) {
+	body := fmt.Sprintf("%s\nPushed %s to address review feedback: %s", github.CommentMarker, hash[:8], cr.Description)
+	if err := h.forge.Comment(ctx, cr.PRNumber, body); err != nil {
+		slog.Warn("failed to comment on PR", "pr", cr.PRNumber, "error", err)
+	}
+
+	h.sendStatus(client, cr.ID, "pr_updated", fmt.Sprintf("PR #%d に変更をpushしました", cr.PRNumber), "")
+
+	if err := h.engine.LockTree(h.gitSvc.CheckoutMain); err != nil {
+		slog.Warn("failed to checkout main after follow-up", "error", err)
+	}
+}
+
+// HandlePRClosed records that a selfmod pull request was merged, or closed
+// without being merged, e.g. from a webhook delivery.
+func (h *ChatHandler) HandlePRClosed(number int, merged bool) {
+	if h.engine == nil {
+		return
+	}
+	if n := h.engine.PRClosed(number, merged); n > 0 {
+		slog.Info("pull request finished", "pr", number, "merged", merged, "requests", n)
+	}
+}
+
+// broadcastAdmins sends env to the connected admins, the only clients that
+// may see and act on change requests.
+func (h *ChatHandler) broadcastAdmins(env Envelope) {
+	if h.hub == nil {
+		return
+	}
+	h.hub.BroadcastRole(RoleAdmin, env)
+}
+
+func diffEnvelope(cr *selfmod.ChangeRequest) Envelope {
+	payload, _ := json.Marshal(SelfModDiffPayload{
+		RequestID:   cr.ID,
+		Description: cr.Description,
+		Diffs:       cr.Diffs,
+		Branch:      cr.Branch,
+		PRNumber:    cr.PRNumber,
+		Revision:    cr.Revision,
+		Revisions:   cr.Revisions,
+		Findings:    cr.Findings,
+	})
+	return Envelope{Type: "selfmod.diff", Payload: payload}
+}
+
+// findingsNote summarizes the safety findings of a change request for chat,
+// or returns "" when there are none.
+func findingsNote(cr *selfmod.ChangeRequest) string {
+	if len(cr.Findings) == 0 {
+		return ""
+	}
+	high := 0
+	for _, f := range cr.Findings {
+		if f.Severity == selfmod.SeverityHigh {
+			high++
+		}
+	}
+	note := fmt.Sprintf("\n安全性チェックで %d 件の指摘があります（高リスク %d 件）。", len(cr.Findings), high)
+	if high > 0 {
+		note += "承認するには管理者が指摘を確認して上書きする必要があります。"
+	}
+	return note
+}
@@ -3,12 +3,15 @@ package ws
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/yuki/flyagi/internal/codeindex"
+	"github.com/yuki/flyagi/internal/forge"
 	"github.com/yuki/flyagi/internal/git"
 	"github.com/yuki/flyagi/internal/github"
 	"github.com/yuki/flyagi/internal/provider"
@@ -19,6 +22,10 @@ import (
 type ChatSendPayload struct {
 	Messages   []provider.Message `json:"messages"`
 	ProviderID string             `json:"provider_id"`
+	Mode       string             `json:"mode,omitempty"` // "" or ModeCodebase
+	// Intent overrides the intent router: IntentChat, IntentSelfMod or
+	// IntentCodebase.
+	Intent string `json:"intent,omitempty"`
 }
 
 // ChatChunkPayload is the payload for "chat.chunk" messages.
@@ -29,55 +36,180 @@ type ChatChunkPayload struct {
 
 // SelfModDiffPayload is the payload for "selfmod.diff" messages sent to the client.
 type SelfModDiffPayload struct {
-	RequestID   string            `json:"request_id"`
-	Description string            `json:"description"`
+	RequestID   string             `json:"request_id"`
+	Description string             `json:"description"`
 	Diffs       []selfmod.FileDiff `json:"diffs"`
+	Branch      string             `json:"branch,omitempty"`
+	PRNumber    int                `json:"pr_number,omitempty"`
+	// Revision is the proposal number; Revisions holds the earlier ones
+	// for comparison.
+	Revision  int                `json:"revision,omitempty"`
+	Revisions []selfmod.Revision `json:"revisions,omitempty"`
+	// Findings are the safety scanner's results; high severity ones must
+	// be overridden to approve.
+	Findings []selfmod.Finding `json:"findings,omitempty"`
+}
+
+// SelfModRefinePayload is the payload for "selfmod.refine" messages, which
+// ask for a new revision of a pending change request.
+type SelfModRefinePayload struct {
+	RequestID  string `json:"request_id"`
+	Feedback   string `json:"feedback"`
+	ProviderID string `json:"provider_id"`
 }
 
 // SelfModApprovePayload is the payload for "selfmod.approve" messages.
 type SelfModApprovePayload struct {
-	RequestID string `json:"request_id"`
+	RequestID string       `json:"request_id"`
+	PR        *PROverrides `json:"pr,omitempty"`
+	// Approver is credited with a Co-authored-by trailer when set.
+	Approver *Approver `json:"approver,omitempty"`
+	// Selection approves only some files or hunks; the rest is declined.
+	Selection *selfmod.Selection `json:"selection,omitempty"`
+	// Override accepts high-severity safety findings. Admins only.
+	Override bool `json:"override,omitempty"`
+}
+
+// Approver is who the client says approved a change. It is credited as
+// co-author but not verified; the approving client is recorded separately.
+type Approver struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
 }
 
 // SelfModStatusPayload is the payload for "selfmod.status" messages.
 type SelfModStatusPayload struct {
 	RequestID string `json:"request_id"`
-	Status    string `json:"status"` // "applying", "pushing", "pr_created", "error"
+	Status    string `json:"status"` // "applying", "verifying", "pushing", "pr_created", "cancelled", "error"
 	Message   string `json:"message,omitempty"`
 	PRURL     string `json:"pr_url,omitempty"`
 }
 
+// SelfModQueuePayload is the payload for "selfmod.queue" messages, sent
+// while a generation waits for a worker. Position is 1 for the next to start
+// and 0 once it has started. RequestID is set when refining a request.
+type SelfModQueuePayload struct {
+	RequestID string `json:"request_id,omitempty"`
+	Position  int    `json:"position"`
+}
+
+// SelfModProgressPayload is the payload for "selfmod.progress" messages,
+// sent while a change request is generated. Kind is "text" for raw reply
+// text, which is only sent when enabled and then in batches, "description"
+// once the description is known and "file" as soon as each file change is
+// complete. RequestID is set when refining a request.
+type SelfModProgressPayload struct {
+	RequestID   string            `json:"request_id,omitempty"`
+	Kind        string            `json:"kind"`
+	Text        string            `json:"text,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Index       int               `json:"index"`
+	Diff        *selfmod.FileDiff `json:"diff,omitempty"`
+}
+
 // ChatHandler implements MessageHandler for chat interactions.
 type ChatHandler struct {
 	registry *provider.Registry
 	engine   *selfmod.Engine
 	gitSvc   *git.Service
-	ghClient *github.Client
-	cancels  sync.Map // map[clientID]context.CancelFunc
+	forge    forge.Forge
+	ghClient *github.Client // set when the forge is GitHub
+	hub      *Hub
+
+	prDefaults PRDefaults
+
+	repoPath string           // enables the codebase chat mode
+	index    *codeindex.Index // optional semantic retrieval for it
+
+	router   *IntentRouter
+	pending  sync.Map // map[clientID]pendingChat, messages awaiting clarification
+	commands *CommandRegistry
+	sessions sync.Map // map[clientID]chatSession
+
+	cancels sync.Map // map[clientID]context.CancelFunc
+	ops     sync.Map // map[requestID or generation key]*selfmodOp
+	issues  sync.Map // map[issueNumber]bool, issues already picked up
+
+	// queue bounds concurrent generations; repoMu is held while an
+	// approval works on the repository's branches and working tree, and
+	// read-locked by searches of the working tree.
+	queue  *GenerationQueue
+	repoMu sync.RWMutex
+
+	progressText bool // stream raw reply text as selfmod.progress
 }
 
-// NewChatHandler creates a new ChatHandler.
-func NewChatHandler(registry *provider.Registry, engine *selfmod.Engine, gitSvc *git.Service, ghClient *github.Client) *ChatHandler {
-	return &ChatHandler{
-		registry: registry,
-		engine:   engine,
-		gitSvc:   gitSvc,
-		ghClient: ghClient,
+// NewChatHandler creates a new ChatHandler. GitHub-only features such as
+// review comment follow-ups and issue intake are available when fg is a
+// *forge.GitHub.
+func NewChatHandler(registry *provider.Registry, engine *selfmod.Engine, gitSvc *git.Service, fg forge.Forge) *ChatHandler {
+	h := &ChatHandler{
+		registry:   registry,
+		engine:     engine,
+		gitSvc:     gitSvc,
+		forge:      fg,
+		prDefaults: defaultPRDefaults(),
+		router:     NewIntentRouter(nil, 0),
+		commands:   NewCommandRegistry(),
+		queue:      NewGenerationQueue(0, 0),
+	}
+	if g, ok := fg.(*forge.GitHub); ok {
+		h.ghClient = g.Client()
 	}
+	h.registerBuiltins()
+	return h
+}
+
+// SetHub attaches the hub used to broadcast events that do not originate
+// from a client, such as webhook-triggered change requests.
+func (h *ChatHandler) SetHub(hub *Hub) {
+	h.hub = hub
+}
+
+// SetGenerationQueue replaces the queue selfmod generations wait in.
+func (h *ChatHandler) SetGenerationQueue(q *GenerationQueue) {
+	h.queue = q
+}
+
+// SetProgressText makes generations stream the LLM's raw reply text to the
+// client as well as the parsed file changes.
+func (h *ChatHandler) SetProgressText(on bool) {
+	h.progressText = on
+}
+
+// Commands returns the slash command registry, for registering commands
+// beyond the built-ins.
+func (h *ChatHandler) Commands() *CommandRegistry {
+	return h.commands
+}
+
+// SetIntentRouter replaces the router that decides whether a chat message
+// is plain chat, a codebase question or a change request. The default treats
+// everything that is not a slash command as chat.
+func (h *ChatHandler) SetIntentRouter(r *IntentRouter) {
+	h.router = r
 }
 
 func (h *ChatHandler) HandleMessage(client *Client, env Envelope) {
 	switch env.Type {
 	case "chat.send":
 		h.handleChatSend(client, env.Payload)
+	case "chat.resolve":
+		h.handleChatResolve(client, env.Payload)
+	case "commands.list":
+		h.handleCommandsList(client)
 	case "chat.cancel":
 		h.handleChatCancel(client)
 	case "selfmod.request":
 		h.handleSelfModRequest(client, env.Payload)
+	case "selfmod.refine":
+		h.handleSelfModRefine(client, env.Payload)
 	case "selfmod.approve":
 		h.handleSelfModApprove(client, env.Payload)
 	case "selfmod.reject":
 		h.handleSelfModReject(client, env.Payload)
+	case "selfmod.cancel":
+		h.handleSelfModCancel(client, env.Payload)
 	default:
 		slog.Warn("unknown message type", "type", env.Type, "client", client.ID)
 	}
@@ -93,29 +225,112 @@ func (h *ChatHandler) handleChatSend(client *Client, payload json.RawMessage) {
 	// Cancel any existing stream for this client
 	h.handleChatCancel(client)
 
-	providerID := p.ProviderID
-	if providerID == "" {
-		providerID = "anthropic"
+	if h.runCommand(client, p) {
+		return
 	}
 
-	llm, err := h.registry.GetLLM(providerID)
+	llm, providerID, err := h.resolveLLM(client, p.ProviderID)
 	if err != nil {
 		slog.Error("LLM provider not found", "provider", providerID, "error", err)
 		sendError(client, "LLM provider not found: "+providerID)
 		return
 	}
 
-	// Check if the last user message looks like a code change request
-	lastMsg := ""
-	if len(p.Messages) > 0 {
-		lastMsg = p.Messages[len(p.Messages)-1].Content
+	override := p.Intent
+	if override == "" && p.Mode == ModeCodebase {
+		override = IntentCodebase
 	}
-	if h.engine != nil && isCodeChangeRequest(lastMsg) {
-		// Respond with acknowledgment then generate changes
-		h.handleSelfModFromChat(client, llm, lastMsg, providerID)
+	classify := llm
+	if h.engine == nil && h.repoPath == "" {
+		classify = nil // nothing but plain chat is available
+	}
+
+	// Classification may take a model round trip, so it runs off the read
+	// loop and can be cancelled like a stream.
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancels.Store(client.ID, cancel)
+
+	go func() {
+		d := h.router.Route(ctx, classify, p.Messages, override)
+		canceled := ctx.Err() != nil
+		cancel()
+		if canceled {
+			return
+		}
+		h.route(client, llm, providerID, p.Messages, d)
+	}()
+}
+
+// ChatResolvePayload is the payload for "chat.resolve" messages, which
+// answer a clarifying question by picking the intent for the held message.
+type ChatResolvePayload struct {
+	Intent string `json:"intent"`
+}
+
+type pendingChat struct {
+	llm        provider.LLMProvider
+	providerID string
+	messages   []provider.Message
+	decision   IntentDecision
+}
+
+func (h *ChatHandler) handleChatResolve(client *Client, payload json.RawMessage) {
+	var p ChatResolvePayload
+	if err := json.Unmarshal(payload, &p); err != nil || !validIntent(p.Intent) {
+		sendError(client, "Invalid resolve payload")
+		return
+	}
+	v, ok := h.pending.LoadAndDelete(client.ID)
+	if !ok {
+		sendError(client, "No message is waiting for clarification")
 		return
 	}
+	pc := v.(pendingChat)
+	d := pc.decision
+	d.Intent, d.Confidence, d.Source, d.Clarify = p.Intent, 1, SourceOverride, ""
+	h.route(client, pc.llm, pc.providerID, pc.messages, d)
+}
+
+// route reports the decision to the client and acts on it, holding the
+// message when the router asked for clarification.
+func (h *ChatHandler) route(client *Client, llm provider.LLMProvider, providerID string, messages []provider.Message, d IntentDecision) {
+	switch {
+	case d.Intent == IntentSelfMod && h.engine == nil:
+		d = IntentDecision{Intent: IntentChat, Confidence: 1, Source: SourceDefault, Reason: "selfmod is not configured", Request: d.Request}
+	case d.Intent == IntentSelfMod && client.Role != RoleAdmin:
+		d = IntentDecision{Intent: IntentChat, Confidence: 1, Source: SourceDefault, Reason: "selfmod requires the admin role", Request: d.Request}
+	case d.Intent == IntentCodebase && h.repoPath == "":
+		d = IntentDecision{Intent: IntentChat, Confidence: 1, Source: SourceDefault, Reason: "codebase mode is not configured", Request: d.Request}
+	}
+
+	payload, _ := json.Marshal(d)
+	client.Send(Envelope{Type: "chat.intent", Payload: payload})
+	slog.Info("chat intent", "intent", d.Intent, "confidence", d.Confidence, "source", d.Source, "clarify", d.Clarify != "", "client", client.ID)
 
+	if d.Clarify != "" {
+		h.pending.Store(client.ID, pendingChat{llm: llm, providerID: providerID, messages: messages, decision: d})
+		chunk, _ := json.Marshal(ChatChunkPayload{Content: d.Clarify, Done: true})
+		client.Send(Envelope{Type: "chat.chunk", Payload: chunk})
+		return
+	}
+	h.pending.Delete(client.ID)
+
+	// A slash command is not part of what the model should see.
+	if n := len(messages); n > 0 && messages[n-1].Content != d.Request {
+		messages = append(messages[:n-1:n-1], provider.Message{Role: messages[n-1].Role, Content: d.Request})
+	}
+
+	switch d.Intent {
+	case IntentSelfMod:
+		h.handleSelfModFromChat(client, llm, d.Request, providerID)
+	case IntentCodebase:
+		h.handleCodebaseChat(client, llm, messages)
+	default:
+		h.streamChat(client, llm, messages)
+	}
+}
+
+func (h *ChatHandler) streamChat(client *Client, llm provider.LLMProvider, messages []provider.Message) {
 	ctx, cancel := context.WithCancel(context.Background())
 	h.cancels.Store(client.ID, cancel)
 
@@ -125,7 +340,7 @@ func (h *ChatHandler) handleChatSend(client *Client, payload json.RawMessage) {
 			cancel()
 		}()
 
-		err := llm.ChatStream(ctx, p.Messages, func(chunk provider.StreamChunk) error {
+		err := llm.ChatStream(ctx, messages, func(chunk provider.StreamChunk) error {
 			chunkPayload, _ := json.Marshal(ChatChunkPayload{
 				Content: chunk.Content,
 				Done:    chunk.Done,
@@ -154,11 +369,18 @@ func (h *ChatHandler) handleSelfModFromChat(client *Client, llm provider.LLMProv
 	})
 	client.Send(Envelope{Type: "chat.chunk", Payload: ackPayload})
 
-	go func() {
-		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	go h.queued(client, "", func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
 		defer cancel()
+		report, flush := h.progress(client, "")
+		ctx = selfmod.WithProgress(ctx, report)
 
 		cr, err := h.engine.GenerateChanges(ctx, llm, request)
+		flush()
+		if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+			h.generationCancelled(client, "")
+			return
+		}
 		if err != nil {
 			slog.Error("selfmod generate failed", "error", err)
 			errPayload, _ := json.Marshal(ChatChunkPayload{
@@ -171,21 +393,16 @@ func (h *ChatHandler) handleSelfModFromChat(client *Client, llm provider.LLMProv
 
 		// Send done for the chat stream
 		donePayload, _ := json.Marshal(ChatChunkPayload{
-			Content: fmt.Sprintf("\n変更を生成しました: %s\n以下のDiffを確認して承認/拒否してください。", cr.Description),
+			Content: fmt.Sprintf("\n変更を生成しました: %s\n以下のDiffを確認して承認/拒否してください。", cr.Description) + findingsNote(cr),
 			Done:    true,
 		})
 		client.Send(Envelope{Type: "chat.chunk", Payload: donePayload})
 
 		// Send the diff for approval
-		diffPayload, _ := json.Marshal(SelfModDiffPayload{
-			RequestID:   cr.ID,
-			Description: cr.Description,
-			Diffs:       cr.Diffs,
-		})
-		client.Send(Envelope{Type: "selfmod.diff", Payload: diffPayload})
+		client.Send(diffEnvelope(cr))
 
 		slog.Info("selfmod diff sent", "request_id", cr.ID, "changes", len(cr.Changes))
-	}()
+	})
 }
 
 func (h *ChatHandler) handleSelfModRequest(client *Client, payload json.RawMessage) {
@@ -199,12 +416,16 @@ func (h *ChatHandler) handleSelfModRequest(client *Client, payload json.RawMessa
 		return
 	}
 
-	providerID := p.ProviderID
-	if providerID == "" {
-		providerID = "anthropic"
+	if h.engine == nil {
+		sendError(client, "Self-modification not configured")
+		return
+	}
+	if client.Role != RoleAdmin {
+		sendError(client, "Self-modification requires the admin role")
+		return
 	}
 
-	llm, err := h.registry.GetLLM(providerID)
+	llm, providerID, err := h.resolveLLM(client, p.ProviderID)
 	if err != nil {
 		sendError(client, "LLM provider not found: "+providerID)
 		return
@@ -213,6 +434,76 @@ func (h *ChatHandler) handleSelfModRequest(client *Client, payload json.RawMessa
 	h.handleSelfModFromChat(client, llm, p.Request, providerID)
 }
 
+func (h *ChatHandler) handleSelfModRefine(client *Client, payload json.RawMessage) {
+	var p SelfModRefinePayload
+	if err := json.Unmarshal(payload, &p); err != nil || p.RequestID == "" || strings.TrimSpace(p.Feedback) == "" {
+		sendError(client, "Invalid refine payload")
+		return
+	}
+	if h.engine == nil {
+		sendError(client, "Self-modification not configured")
+		return
+	}
+	if client.Role != RoleAdmin {
+		sendError(client, "Self-modification requires the admin role")
+		return
+	}
+
+	llm, providerID, err := h.resolveLLM(client, p.ProviderID)
+	if err != nil {
+		sendError(client, "LLM provider not found: "+providerID)
+		return
+	}
+
+	h.refine(client, llm, p.RequestID, p.Feedback)
+}
+
+// refine generates a new revision of a pending change request and sends it
+// for review.
+func (h *ChatHandler) refine(client *Client, llm provider.LLMProvider, requestID, feedback string) {
+	ackPayload, _ := json.Marshal(ChatChunkPayload{
+		Content: "フィードバックをもとに変更を修正しています...\n",
+		Done:    false,
+	})
+	client.Send(Envelope{Type: "chat.chunk", Payload: ackPayload})
+
+	go h.queued(client, requestID, func(ctx context.Context) {
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+		defer cancel()
+		report, flush := h.progress(client, requestID)
+		ctx = selfmod.WithProgress(ctx, report)
+
+		cr, err := h.engine.Refine(ctx, llm, requestID, feedback)
+		flush()
+		if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+			h.generationCancelled(client, requestID)
+			return
+		}
+		if err != nil {
+			slog.Error("selfmod refine failed", "request_id", requestID, "error", err)
+			errPayload, _ := json.Marshal(ChatChunkPayload{
+				Content: fmt.Sprintf("\n変更の修正に失敗しました: %s", err.Error()),
+				Done:    true,
+			})
+			client.Send(Envelope{Type: "chat.chunk", Payload: errPayload})
+			return
+		}
+
+		donePayload, _ := json.Marshal(ChatChunkPayload{
+			Content: fmt.Sprintf("\nリビジョン %d を生成しました: %s\n以下のDiffを確認して承認/拒否してください。", cr.Revision, cr.Description) + findingsNote(cr),
+			Done:    true,
+		})
+		client.Send(Envelope{Type: "chat.chunk", Payload: donePayload})
+		client.Send(diffEnvelope(cr))
+
+		slog.Info("selfmod revision sent", "request_id", cr.ID, "revision", cr.Revision, "changes", len(cr.Changes))
+	})
+}
+
+// blockedMessage explains why a change request with high-severity findings
+// cannot be approved.
+const blockedMessage = "高リスクの安全性の指摘があるため承認できません。管理者による上書きが必要です"
+
 func (h *ChatHandler) handleSelfModApprove(client *Client, payload json.RawMessage) {
 	var p SelfModApprovePayload
 	if err := json.Unmarshal(payload, &p); err != nil {
@@ -225,6 +516,10 @@ func (h *ChatHandler) handleSelfModApprove(client *Client, payload json.RawMessa
 		sendError(client, "Self-modification not configured")
 		return
 	}
+	if client.Role != RoleAdmin {
+		sendError(client, "Self-modification requires the admin role")
+		return
+	}
 
 	go func() {
 		cr, ok := h.engine.GetRequest(p.RequestID)
@@ -233,87 +528,369 @@ func (h *ChatHandler) handleSelfModApprove(client *Client, payload json.RawMessa
 			return
 		}
 
-		// If git/github are configured, create branch FIRST (before applying changes)
-		var branchName string
-		if h.gitSvc != nil && h.ghClient != nil {
-			branchName = fmt.Sprintf("selfmod/%s", p.RequestID[:8])
-			h.sendStatus(client, p.RequestID, "pushing", "ブランチを作成中...", "")
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		op := h.startOp(p.RequestID, client.ID, false, cancel)
+		if op == nil {
+			h.sendStatus(client, p.RequestID, "error", "この変更リクエストは別の処理中です", "")
+			return
+		}
+		defer h.endOp(p.RequestID, op)
+
+		h.repoMu.Lock()
+		defer h.repoMu.Unlock()
+
+		// Unless the approval completes, what it has done so far is rolled
+		// back, whether it was cancelled or failed with failure.
+		var (
+			undo    approvalUndo
+			failure string
+			done    bool
+		)
+		defer func() {
+			switch {
+			case done:
+			case ctx.Err() != nil:
+				h.rollBack(client, cr, undo, "")
+			default:
+				h.rollBack(client, cr, undo, failure)
+			}
+		}()
+		if ctx.Err() != nil {
+			return
+		}
 
-			if err := h.gitSvc.CreateBranch(branchName); err != nil {
-				slog.Error("git branch failed", "error", err)
-				h.sendStatus(client, p.RequestID, "error", "ブランチ作成に失敗: "+err.Error(), "")
+		if p.Override {
+			o := selfmod.SafetyOverride{By: client.ID, Role: client.Role}
+			if p.Approver != nil {
+				o.Name = p.Approver.Name
+			}
+			if err := h.engine.OverrideFindings(p.RequestID, o); err != nil {
+				failure = "上書きに失敗: " + err.Error()
 				return
 			}
+		} else if p.Selection == nil && selfmod.HasBlocking(cr.Findings) && cr.Override == nil {
+			// Checked before branching; partial approvals are rescanned
+			// by the engine.
+			failure = blockedMessage
+			return
+		}
+
+		// If git and a forge are configured, create branch FIRST (before applying changes).
+		// Follow-up requests go onto the existing pull request branch instead.
+		var branchName string
+		if h.gitSvc != nil && h.forge != nil {
+			if cr.Branch != "" {
+				branchName = cr.Branch
+				h.sendStatus(client, p.RequestID, "pushing", "既存のブランチを取得中...", "")
+
+				if err := h.engine.LockTree(func() error { return h.gitSvc.CheckoutBranch(branchName) }); err != nil {
+					slog.Error("git checkout failed", "error", err)
+					failure = "ブランチの取得に失敗: " + err.Error()
+					return
+				}
+				undo.branch = branchName
+			} else {
+				branchName = selfmodBranch(p.RequestID)
+				h.sendStatus(client, p.RequestID, "pushing", "ブランチを作成中...", "")
+
+				if err := h.engine.LockTree(func() error { return h.gitSvc.CreateBranch(branchName, h.prBase(p.PR)) }); err != nil {
+					slog.Error("git branch failed", "error", err)
+					failure = "ブランチ作成に失敗: " + err.Error()
+					return
+				}
+				undo.branch, undo.created = branchName, true
+			}
+		}
+		if ctx.Err() != nil {
+			return
 		}
 
 		// Apply changes to the repo
 		h.sendStatus(client, p.RequestID, "applying", "変更を適用中...", "")
-		if err := h.engine.ApproveAndApply(p.RequestID); err != nil {
+		if err := h.engine.ApproveSelection(p.RequestID, p.Selection); err != nil {
+			if errors.Is(err, selfmod.ErrBlocked) {
+				failure = blockedMessage
+				return
+			}
 			slog.Error("selfmod apply failed", "error", err)
-			h.sendStatus(client, p.RequestID, "error", "変更の適用に失敗: "+err.Error(), "")
+			failure = "変更の適用に失敗: " + err.Error()
+			return
+		}
+		undo.applied = true
+
+		h.verify(ctx, client, p.RequestID)
+		if ctx.Err() != nil {
 			return
 		}
 
 		// Commit, push, and create PR
-		if h.gitSvc != nil && h.ghClient != nil {
+		if h.gitSvc != nil && h.forge != nil {
 			h.sendStatus(client, p.RequestID, "pushing", "コミットしてpush中...", "")
 
-			commitMsg := fmt.Sprintf("selfmod: %s", cr.Description)
-			if _, err := h.gitSvc.CommitAll(commitMsg); err != nil {
+			hash, err := h.gitSvc.CommitAll(commitMessage(cr, client, p.Approver))
+			if err != nil {
 				slog.Error("git commit failed", "error", err)
-				h.sendStatus(client, p.RequestID, "error", "コミットに失敗: "+err.Error(), "")
+				failure = "コミットに失敗: " + err.Error()
+				return
+			}
+			if ctx.Err() != nil {
 				return
 			}
 
-			if err := h.gitSvc.Push(branchName); err != nil {
+			if err := h.gitSvc.Push(ctx, branchName); err != nil {
 				slog.Error("git push failed", "error", err)
-				h.sendStatus(client, p.RequestID, "error", "pushに失敗: "+err.Error(), "")
+				failure = "pushに失敗: " + err.Error()
 				return
 			}
+			undo.pushed = true
+			if cr.PRNumber != 0 {
+				// A commit pushed onto an open pull request is not
+				// taken back.
+				ctx = context.WithoutCancel(ctx)
+			}
 
-			// Create PR
-			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 			defer cancel()
 
-			prTitle := fmt.Sprintf("[selfmod] %s", cr.Description)
-			prBody := fmt.Sprintf("## Self-Modification Request\n\n%s\n\nGenerated by FlyAGI self-modification engine.", cr.Description)
+			status := forge.Status{
+				State:       forge.StatusSuccess,
+				Context:     selfmod.StatusContext,
+				Description: "Approved in FlyAGI",
+			}
+			if err := h.forge.SetStatus(ctx, hash, status); err != nil {
+				slog.Warn("failed to set commit status", "error", err)
+			}
+
+			if cr.PRNumber != 0 {
+				done = true
+				h.finishFollowUp(ctx, client, cr, hash)
+				return
+			}
 
-			prURL, err := h.ghClient.CreatePR(ctx, prTitle, prBody, branchName, "main")
+			// Create PR
+			prOpts, err := h.prOptions(cr, branchName, p.PR)
 			if err != nil {
-				slog.Error("github PR failed", "error", err)
-				h.sendStatus(client, p.RequestID, "error", "PR作成に失敗: "+err.Error(), "")
+				slog.Error("PR template failed", "error", err)
+				failure = "PR本文の生成に失敗: " + err.Error()
 				return
 			}
 
-			h.sendStatus(client, p.RequestID, "pr_created", "PRが作成されました！", prURL)
+			pr, err := h.forge.CreatePR(ctx, prOpts)
+			if err != nil {
+				slog.Error("PR creation failed", "error", err)
+				failure = "PR作成に失敗: " + err.Error()
+				return
+			}
+			done = true
+
+			if err := h.engine.RecordPR(cr.ID, pr.Number, pr.URL, branchName); err != nil {
+				slog.Warn("failed to record PR", "request_id", cr.ID, "error", err)
+			}
+			h.sendStatus(client, p.RequestID, "pr_created", "PRが作成されました！", pr.URL)
 
 			// Checkout back to main
-			if err := h.gitSvc.CheckoutMain(); err != nil {
+			if err := h.engine.LockTree(h.gitSvc.CheckoutMain); err != nil {
 				slog.Warn("failed to checkout main after PR", "error", err)
 			}
 		} else {
-			h.sendStatus(client, p.RequestID, "applied", "変更が適用されました（GitHub未設定のためPRは作成されません）", "")
+			done = true
+			h.reindex()
+			h.sendStatus(client, p.RequestID, "applied", "変更が適用されました（フォージ未設定のためPRは作成されません）", "")
+			if err := h.engine.SetStatus(cr.ID, "applied"); err != nil {
+				slog.Warn("failed to record applied status", "request_id", cr.ID, "error", err)
+			}
 		}
 	}()
 }
 
+// SyncMain checks out the base branch, pulls it and then runs fn, if not
+// nil, e.g. a build of the server, holding the repository so that no
+// approval switches branches or writes changes until fn returns. The code
+// index is updated from the pulled branch afterwards.
+func (h *ChatHandler) SyncMain(fn func() error) error {
+	h.repoMu.Lock()
+	defer h.repoMu.Unlock()
+
+	err := h.engine.LockTree(func() error {
+		if err := h.gitSvc.CheckoutMain(); err != nil {
+			return err
+		}
+		return h.gitSvc.Pull()
+	})
+	if err != nil {
+		return err
+	}
+	h.reindex()
+	if fn == nil {
+		return nil
+	}
+	return fn()
+}
+
+// HoldRepo runs fn, e.g. a build of the server, holding the repository so
+// that no approval writes changes until fn returns.
+func (h *ChatHandler) HoldRepo(fn func() error) error {
+	h.repoMu.Lock()
+	defer h.repoMu.Unlock()
+	return fn()
+}
+
+// ReadRepo runs fn, e.g. a search of the working tree, while no approval or
+// sync is changing it, so fn sees the base branch rather than a change
+// that is being applied.
+func (h *ChatHandler) ReadRepo(fn func() error) error {
+	h.repoMu.RLock()
+	defer h.repoMu.RUnlock()
+	return fn()
+}
+
+// Busy describes the work that only lives in this process and would be lost
+// if it were replaced: pending change requests and running or queued
+// generations, refinements and approvals. It returns "" when there is none.
+func (h *ChatHandler) Busy() string {
+	ops := 0
+	h.ops.Range(func(_, _ any) bool {
+		ops++
+		return true
+	})
+	pending := 0
+	if h.engine != nil {
+		for _, cr := range h.engine.Requests() {
+			if cr.Status == "pending" {
+				pending++
+			}
+		}
+	}
+	if ops == 0 && pending == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d pending change requests and %d running operations", pending, ops)
+}
+
+// verify runs the configured verification checks against the applied
+// changes and reports the outcome. Failures are recorded for the pull
+// request rather than stopping it.
+func (h *ChatHandler) verify(ctx context.Context, client *Client, requestID string) {
+	if !h.engine.HasChecks() {
+		return
+	}
+	h.sendStatus(client, requestID, "verifying", "検証中...", "")
+	results, err := h.engine.Verify(ctx, requestID)
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		slog.Error("selfmod verification failed", "request_id", requestID, "error", err)
+		h.sendStatus(client, requestID, "verifying", "検証を実行できませんでした: "+err.Error(), "")
+		return
+	}
+	var failed []string
+	for _, r := range results {
+		if !r.Passed {
+			failed = append(failed, r.Name)
+		}
+	}
+	msg := fmt.Sprintf("検証: %d/%d 件成功", len(results)-len(failed), len(results))
+	if len(failed) > 0 {
+		msg += "（失敗: " + strings.Join(failed, ", ") + "）"
+	}
+	h.sendStatus(client, requestID, "verifying", msg, "")
+}
+
 func (h *ChatHandler) handleSelfModReject(client *Client, payload json.RawMessage) {
 	var p SelfModApprovePayload
 	if err := json.Unmarshal(payload, &p); err != nil {
 		slog.Error("invalid selfmod.reject payload", "error", err)
 		return
 	}
+	if client.Role != RoleAdmin {
+		sendError(client, "Self-modification requires the admin role")
+		return
+	}
 
 	if h.engine != nil {
-		h.engine.Reject(p.RequestID)
+		if err := h.engine.Reject(p.RequestID); err != nil {
+			h.sendStatus(client, p.RequestID, "error", "拒否できません: "+err.Error(), "")
+			return
+		}
 	}
 	h.sendStatus(client, p.RequestID, "rejected", "変更は拒否されました", "")
 }
 
+// HandleDisconnect stops the client's chat stream and forgets its session
+// and any message awaiting clarification.
+func (h *ChatHandler) HandleDisconnect(client *Client) {
+	if cancel, ok := h.cancels.LoadAndDelete(client.ID); ok {
+		cancel.(context.CancelFunc)()
+	}
+	h.pending.Delete(client.ID)
+	h.sessions.Delete(client.ID)
+}
+
+// handleChatCancel stops the client's chat stream and any selfmod
+// generations it is waiting on. Approvals are cancelled by selfmod.cancel.
 func (h *ChatHandler) handleChatCancel(client *Client) {
 	if cancel, ok := h.cancels.LoadAndDelete(client.ID); ok {
 		cancel.(context.CancelFunc)()
 	}
+	h.cancelGenerations(client.ID)
+}
+
+// Progress text is sent in messages of at least progressTextSize bytes or
+// after progressTextDelay, rather than one per streamed token. Descriptions
+// and files wait up to progressSendWait for room in the client's buffer.
+const (
+	progressTextSize  = 512
+	progressTextDelay = 100 * time.Millisecond
+	progressSendWait  = 5 * time.Second
+)
+
+// progress returns the function that reports a generation's progress to
+// client as "selfmod.progress" messages, and one that sends text still
+// held back, to be called once the generation has finished.
+func (h *ChatHandler) progress(client *Client, requestID string) (func(selfmod.Progress), func()) {
+	var (
+		text strings.Builder
+		last time.Time
+	)
+	flush := func() {
+		if text.Len() == 0 {
+			return
+		}
+		payload, _ := json.Marshal(SelfModProgressPayload{RequestID: requestID, Kind: selfmod.ProgressText, Text: text.String()})
+		// Text that does not fit is kept for the next message.
+		if err := client.Send(Envelope{Type: "selfmod.progress", Payload: payload}); err == nil || errors.Is(err, ErrClientClosed) {
+			text.Reset()
+		}
+		last = time.Now()
+	}
+
+	report := func(p selfmod.Progress) {
+		if p.Kind == selfmod.ProgressText {
+			if !h.progressText {
+				return
+			}
+			text.WriteString(p.Text)
+			if text.Len() >= progressTextSize || time.Since(last) >= progressTextDelay {
+				flush()
+			}
+			return
+		}
+		// Text streamed before a file or description is sent first.
+		flush()
+		payload, _ := json.Marshal(SelfModProgressPayload{
+			RequestID:   requestID,
+			Kind:        p.Kind,
+			Description: p.Description,
+			Index:       p.Index,
+			Diff:        p.Diff,
+		})
+		if err := client.SendWait(Envelope{Type: "selfmod.progress", Payload: payload}, progressSendWait); err != nil {
+			slog.Warn("failed to send selfmod progress", "client", client.ID, "kind", p.Kind, "error", err)
+		}
+	}
+	return report, flush
 }
 
 func (h *ChatHandler) sendStatus(client *Client, requestID, status, message, prURL string) {
@@ -333,21 +910,3 @@ func sendError(client *Client, msg string) {
 		Payload: errPayload,
 	})
 }
-
-// isCodeChangeRequest checks if a message looks like a code change request.
-func isCodeChangeRequest(msg string) bool {
-	msg = strings.ToLower(msg)
-	keywords := []string{
-		"変更して", "修正して", "追加して", "削除して", "変えて",
-		"コードを", "ファイルを", "実装して", "リファクタ",
-		"change the", "modify the", "add a", "remove the", "update the",
-		"refactor", "implement", "fix the code", "edit the",
-		"/change", "/modify", "/selfmod",
-	}
-	for _, kw := range keywords {
-		if strings.Contains(msg, kw) {
-			return true
-		}
-	}
-	return false
-}
@@ -0,0 +1,561 @@
+package ws_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	gogitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/gorilla/websocket"
+
+	"github.com/yuki/flyagi/internal/forge"
+	"github.com/yuki/flyagi/internal/git"
+	"github.com/yuki/flyagi/internal/provider"
+	"github.com/yuki/flyagi/internal/selfmod"
+	"github.com/yuki/flyagi/internal/ws"
+)
+
+// scriptedLLM replies with a fixed answer and records the last request.
+type scriptedLLM struct {
+	answer   string
+	messages chan []provider.Message
+}
+
+func (m *scriptedLLM) Name() string { return "scripted" }
+func (m *scriptedLLM) ChatStream(_ context.Context, messages []provider.Message, onChunk func(provider.StreamChunk) error) error {
+	m.messages <- messages
+	if err := onChunk(provider.StreamChunk{Content: m.answer}); err != nil {
+		return err
+	}
+	return onChunk(provider.StreamChunk{Done: true})
+}
+
+func dialHandler(t *testing.T, handler *ws.ChatHandler) *websocket.Conn {
+	t.Helper()
+	hub := ws.NewHub(handler, "*")
+	handler.SetHub(hub)
+	srv := httptest.NewServer(http.HandlerFunc(hub.ServeWS))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func send(t *testing.T, conn *websocket.Conn, typ string, payload any) {
+	t.Helper()
+	raw, _ := json.Marshal(payload)
+	data, _ := json.Marshal(ws.Envelope{Type: typ, Payload: raw})
+	if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+}
+
+// readUntil reads envelopes until one of type typ arrives.
+func readUntil(t *testing.T, conn *websocket.Conn, typ string) ws.Envelope {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		var env ws.Envelope
+		json.Unmarshal(data, &env)
+		if env.Type == typ {
+			return env
+		}
+	}
+}
+
+func TestChatHandler_CodebaseMode(t *testing.T) {
+	repo := t.TempDir()
+	os.MkdirAll(filepath.Join(repo, "internal/auth"), 0755)
+	os.WriteFile(filepath.Join(repo, "internal/auth/login.go"), []byte("package auth\n\n// VerifyPassword checks a password hash.\nfunc VerifyPassword(hash, pw string) bool {\n\treturn false\n}\n"), 0644)
+	os.WriteFile(filepath.Join(repo, ".env"), []byte("VerifyPassword=secret\n"), 0644)
+
+	llm := &scriptedLLM{
+		answer:   "It is in internal/auth/login.go:4-6, not in missing.go:1.",
+		messages: make(chan []provider.Message, 1),
+	}
+	reg := provider.NewRegistry()
+	reg.RegisterLLM(llm)
+	handler := ws.NewChatHandler(reg, nil, nil, nil)
+	handler.SetCodebase(repo, nil)
+	conn := dialHandler(t, handler)
+
+	send(t, conn, "chat.send", ws.ChatSendPayload{
+		Messages:   []provider.Message{{Role: "user", Content: "Where is VerifyPassword handled?"}},
+		ProviderID: "scripted",
+		Mode:       ws.ModeCodebase,
+	})
+
+	env := readUntil(t, conn, "chat.citations")
+	var citations ws.ChatCitationsPayload
+	json.Unmarshal(env.Payload, &citations)
+
+	messages := <-llm.messages
+	system := messages[0]
+	if system.Role != "system" || !strings.Contains(system.Content, "[1] internal/auth/login.go:") || strings.Contains(system.Content, "secret") {
+		t.Errorf("unexpected system prompt:\n%s", system.Content)
+	}
+
+	if len(citations.Sources) != 1 || citations.Sources[0].Path != "internal/auth/login.go" {
+		t.Errorf("unexpected sources: %+v", citations.Sources)
+	}
+	if len(citations.Cited) != 1 {
+		t.Fatalf("expected one valid citation, got %+v", citations.Cited)
+	}
+	c := citations.Cited[0]
+	if c.StartLine != 4 || c.EndLine != 6 || c.URL != "/api/code/file?path=internal%2Fauth%2Flogin.go#L4-L6" {
+		t.Errorf("unexpected citation: %+v", c)
+	}
+}
+
+type stubClassifier struct {
+	decision ws.IntentDecision
+	err      error
+}
+
+func (c stubClassifier) Classify(context.Context, provider.LLMProvider, []provider.Message) (ws.IntentDecision, error) {
+	return c.decision, c.err
+}
+
+func TestIntentRouter(t *testing.T) {
+	llm := &scriptedLLM{}
+	msgs := func(s string) []provider.Message { return []provider.Message{{Role: "user", Content: s}} }
+
+	tests := []struct {
+		name       string
+		classifier ws.IntentClassifier
+		message    string
+		override   string
+		want       ws.IntentDecision
+		clarify    bool
+	}{
+		{"no classifier", nil, "add a health check", "", ws.IntentDecision{Intent: ws.IntentChat, Source: ws.SourceDefault, Request: "add a health check"}, false},
+		{"override", stubClassifier{decision: ws.IntentDecision{Intent: ws.IntentSelfMod, Confidence: 1}}, "tell me a joke", ws.IntentChat, ws.IntentDecision{Intent: ws.IntentChat, Source: ws.SourceOverride, Request: "tell me a joke"}, false},
+		{"confident", stubClassifier{decision: ws.IntentDecision{Intent: ws.IntentSelfMod, Confidence: 0.9}}, "rename the handler", "", ws.IntentDecision{Intent: ws.IntentSelfMod, Source: ws.SourceClassifier, Request: "rename the handler"}, false},
+		{"unsure", stubClassifier{decision: ws.IntentDecision{Intent: ws.IntentSelfMod, Confidence: 0.4}}, "can you add a joke?", "", ws.IntentDecision{Intent: ws.IntentSelfMod, Source: ws.SourceClassifier, Request: "can you add a joke?"}, true},
+		{"classifier error", stubClassifier{err: context.DeadlineExceeded}, "hi", "", ws.IntentDecision{Intent: ws.IntentChat, Source: ws.SourceDefault, Request: "hi"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := ws.NewIntentRouter(tt.classifier, 0).Route(context.Background(), llm, msgs(tt.message), tt.override)
+			if d.Intent != tt.want.Intent || d.Source != tt.want.Source || d.Request != tt.want.Request {
+				t.Errorf("got %+v, want %+v", d, tt.want)
+			}
+			if (d.Clarify != "") != tt.clarify {
+				t.Errorf("clarify = %q, want %v", d.Clarify, tt.clarify)
+			}
+		})
+	}
+}
+
+func TestLLMClassifier(t *testing.T) {
+	llm := &scriptedLLM{
+		answer:   "```json\n{\"intent\": \"SelfMod\", \"confidence\": 1.4, \"reason\": \"asks for a code change\"}\n```",
+		messages: make(chan []provider.Message, 1),
+	}
+	d, err := (&ws.LLMClassifier{}).Classify(context.Background(), llm, []provider.Message{{Role: "user", Content: "add a /health endpoint"}})
+	if err != nil {
+		t.Fatalf("Classify failed: %v", err)
+	}
+	if d.Intent != ws.IntentSelfMod || d.Confidence != 1 {
+		t.Errorf("unexpected decision: %+v", d)
+	}
+	if prompt := <-llm.messages; !strings.Contains(prompt[1].Content, "user: add a /health endpoint") {
+		t.Errorf("conversation not passed to the classifier: %+v", prompt)
+	}
+}
+
+func TestRulesClassifier(t *testing.T) {
+	tests := []struct {
+		message string
+		intent  string
+		clarify bool
+	}{
+		{"add a /health endpoint to the router", ws.IntentSelfMod, false},
+		{"Please fix the typo", ws.IntentSelfMod, true},
+		{"README.md にセクションを追加して", ws.IntentSelfMod, false},
+		{"where is the login handled in the code?", ws.IntentCodebase, false},
+		{"認証の処理はどこで実装されていますか", ws.IntentCodebase, false},
+		{"tell me a joke", ws.IntentChat, false},
+	}
+	router := ws.NewIntentRouter(ws.RulesClassifier{}, 0)
+	for _, tt := range tests {
+		d := router.Route(context.Background(), &scriptedLLM{}, []provider.Message{{Role: "user", Content: tt.message}}, "")
+		if d.Intent != tt.intent || (d.Clarify != "") != tt.clarify {
+			t.Errorf("%q: got %+v, want %s (clarify %v)", tt.message, d, tt.intent, tt.clarify)
+		}
+	}
+}
+
+func TestChatHandler_IntentClarify(t *testing.T) {
+	llm := &scriptedLLM{answer: "Why did the gopher cross the road?", messages: make(chan []provider.Message, 1)}
+	reg := provider.NewRegistry()
+	reg.RegisterLLM(llm)
+	handler := ws.NewChatHandler(reg, nil, nil, nil)
+	handler.SetCodebase(t.TempDir(), nil)
+	handler.SetIntentRouter(ws.NewIntentRouter(stubClassifier{decision: ws.IntentDecision{Intent: ws.IntentCodebase, Confidence: 0.5}}, 0.7))
+	conn := dialHandler(t, handler)
+
+	send(t, conn, "chat.send", ws.ChatSendPayload{
+		Messages:   []provider.Message{{Role: "user", Content: "tell me a joke about this code"}},
+		ProviderID: "scripted",
+	})
+
+	var d ws.IntentDecision
+	json.Unmarshal(readUntil(t, conn, "chat.intent").Payload, &d)
+	if d.Intent != ws.IntentCodebase || d.Clarify == "" {
+		t.Fatalf("expected a clarifying question, got %+v", d)
+	}
+	select {
+	case <-llm.messages:
+		t.Fatal("message answered before clarification")
+	default:
+	}
+
+	send(t, conn, "chat.resolve", ws.ChatResolvePayload{Intent: ws.IntentChat})
+	json.Unmarshal(readUntil(t, conn, "chat.intent").Payload, &d)
+	if d.Intent != ws.IntentChat || d.Source != ws.SourceOverride {
+		t.Errorf("unexpected resolved decision: %+v", d)
+	}
+	if messages := <-llm.messages; messages[0].Content != "tell me a joke about this code" {
+		t.Errorf("held message not replayed: %+v", messages)
+	}
+}
+
+func TestChatHandler_Commands(t *testing.T) {
+	scripted := &scriptedLLM{answer: "from scripted", messages: make(chan []provider.Message, 1)}
+	other := &namedLLM{scriptedLLM{answer: "from other", messages: make(chan []provider.Message, 1)}, "other"}
+	reg := provider.NewRegistry()
+	reg.RegisterLLM(scripted)
+	reg.RegisterLLM(other)
+
+	handler := ws.NewChatHandler(reg, nil, nil, nil)
+	err := handler.Commands().Register(&ws.Command{
+		Name: "echo",
+		Args: []ws.CommandArg{{Name: "text", Required: true, Rest: true}},
+		Help: "Repeat text",
+		Run: func(c *ws.CommandContext) error {
+			c.Reply(c.Args["text"])
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if err := handler.Commands().Register(&ws.Command{Name: "x", Aliases: []string{"help"}, Run: func(*ws.CommandContext) error { return nil }}); err == nil {
+		t.Error("expected an error for a duplicate alias")
+	}
+
+	hub := ws.NewHub(handler, "*")
+	hub.SetAdminToken("secret")
+	handler.SetHub(hub)
+	srv := httptest.NewServer(http.HandlerFunc(hub.ServeWS))
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	chat := func(text string) {
+		send(t, conn, "chat.send", ws.ChatSendPayload{
+			Messages:   []provider.Message{{Role: "user", Content: text}},
+			ProviderID: "scripted",
+		})
+	}
+
+	send(t, conn, "commands.list", nil)
+	var list ws.CommandsPayload
+	json.Unmarshal(readUntil(t, conn, "commands.list").Payload, &list)
+	var names []string
+	for _, c := range list.Commands {
+		names = append(names, c.Name)
+	}
+	if got := strings.Join(names, ","); got != "ask,chat,echo,help,history,model,provider,status" {
+		t.Errorf("user commands = %s", got)
+	}
+
+	chat("/echo  hello\tthere ")
+	var chunk ws.ChatChunkPayload
+	json.Unmarshal(readUntil(t, conn, "chat.chunk").Payload, &chunk)
+	if chunk.Content != "hello\tthere" || !chunk.Done {
+		t.Errorf("unexpected reply: %+v", chunk)
+	}
+
+	chat("/modify everything")
+	var errPayload map[string]string
+	json.Unmarshal(readUntil(t, conn, "error").Payload, &errPayload)
+	if !strings.Contains(errPayload["error"], "requires the admin role") {
+		t.Errorf("unexpected error: %v", errPayload)
+	}
+
+	chat("/echo")
+	json.Unmarshal(readUntil(t, conn, "error").Payload, &errPayload)
+	if !strings.Contains(errPayload["error"], "usage: /echo <text...>") {
+		t.Errorf("unexpected error: %v", errPayload)
+	}
+
+	chat("/provider other")
+	var session ws.SessionPayload
+	json.Unmarshal(readUntil(t, conn, "chat.session").Payload, &session)
+	if session.ProviderID != "other" {
+		t.Errorf("unexpected session: %+v", session)
+	}
+	readUntil(t, conn, "chat.chunk") // confirmation
+
+	chat("hello")
+	select {
+	case <-other.messages:
+	case <-time.After(2 * time.Second):
+		t.Fatal("chat did not use the provider picked with /provider")
+	}
+	json.Unmarshal(readUntil(t, conn, "chat.chunk").Payload, &chunk)
+	if chunk.Content != "from other" {
+		t.Errorf("unexpected reply: %+v", chunk)
+	}
+	readUntil(t, conn, "chat.chunk") // done
+}
+
+// namedLLM is a scriptedLLM registered under another name.
+type namedLLM struct {
+	scriptedLLM
+	name string
+}
+
+func (m *namedLLM) Name() string { return m.name }
+
+func TestChatHandler_SelfModRequiresAdmin(t *testing.T) {
+	dir := t.TempDir()
+	engine := selfmod.NewEngine(dir)
+	llm := &scriptedLLM{
+		answer:   `{"description": "Add notes", "changes": [{"path": "NOTES.md", "action": "create", "new_content": "notes\n"}]}`,
+		messages: make(chan []provider.Message, 1),
+	}
+	cr, err := engine.GenerateChanges(context.Background(), llm, "Add notes")
+	if err != nil {
+		t.Fatalf("GenerateChanges failed: %v", err)
+	}
+
+	handler := ws.NewChatHandler(provider.NewRegistry(), engine, nil, nil)
+	hub := ws.NewHub(handler, "*")
+	hub.SetAdminToken("secret")
+	handler.SetHub(hub)
+	srv := httptest.NewServer(http.HandlerFunc(hub.ServeWS))
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	for _, typ := range []string{"selfmod.approve", "selfmod.reject"} {
+		send(t, conn, typ, ws.SelfModApprovePayload{RequestID: cr.ID})
+		var errPayload map[string]string
+		json.Unmarshal(readUntil(t, conn, "error").Payload, &errPayload)
+		if !strings.Contains(errPayload["error"], "requires the admin role") {
+			t.Errorf("%s: unexpected error: %v", typ, errPayload)
+		}
+	}
+
+	if got, _ := engine.GetRequest(cr.ID); got.Status != "pending" {
+		t.Errorf("status = %q, want pending", got.Status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "NOTES.md")); !os.IsNotExist(err) {
+		t.Errorf("change was applied: %v", err)
+	}
+}
+
+// tokenLLM streams its answer one byte at a time.
+type tokenLLM struct{ answer string }
+
+func (m *tokenLLM) Name() string { return "tokens" }
+func (m *tokenLLM) ChatStream(_ context.Context, _ []provider.Message, onChunk func(provider.StreamChunk) error) error {
+	for i := range len(m.answer) {
+		if err := onChunk(provider.StreamChunk{Content: m.answer[i : i+1]}); err != nil {
+			return err
+		}
+	}
+	return onChunk(provider.StreamChunk{Done: true})
+}
+
+func TestChatHandler_ProgressCoalesced(t *testing.T) {
+	llm := &tokenLLM{answer: `{"description": "Add notes", "changes": [{"path": "NOTES.md", "action": "create", "new_content": "` + strings.Repeat("notes ", 200) + `\n"}]}`}
+	reg := provider.NewRegistry()
+	reg.RegisterLLM(llm)
+	handler := ws.NewChatHandler(reg, selfmod.NewEngine(t.TempDir()), nil, nil)
+	handler.SetProgressText(true)
+	conn := dialHandler(t, handler)
+
+	send(t, conn, "selfmod.request", map[string]string{"request": "Add notes", "provider_id": "tokens"})
+
+	var text strings.Builder
+	messages, files := 0, 0
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for selfmod.diff: %v", err)
+		}
+		var env ws.Envelope
+		json.Unmarshal(data, &env)
+		if env.Type == "selfmod.diff" {
+			break
+		}
+		if env.Type != "selfmod.progress" {
+			continue
+		}
+		var p ws.SelfModProgressPayload
+		json.Unmarshal(env.Payload, &p)
+		switch p.Kind {
+		case selfmod.ProgressText:
+			text.WriteString(p.Text)
+			messages++
+		case selfmod.ProgressFile:
+			files++
+		}
+	}
+
+	if text.String() != llm.answer {
+		t.Errorf("progress text differs from the reply:\n%s", text.String())
+	}
+	if messages == 0 || messages > len(llm.answer)/100 {
+		t.Errorf("reply of %d bytes sent in %d messages", len(llm.answer), messages)
+	}
+	if files != 1 {
+		t.Errorf("expected one file progress, got %d", files)
+	}
+}
+
+// prFailingForge accepts commit statuses but fails to open pull requests.
+type prFailingForge struct{}
+
+func (prFailingForge) Name() string     { return "test" }
+func (prFailingForge) CloneURL() string { return "" }
+func (prFailingForge) CreatePR(context.Context, forge.PROptions) (*forge.PullRequest, error) {
+	return nil, errors.New("forge unavailable")
+}
+func (prFailingForge) Comment(context.Context, int, string) error            { return nil }
+func (prFailingForge) SetStatus(context.Context, string, forge.Status) error { return nil }
+func (prFailingForge) PRState(context.Context, int) (string, error)          { return forge.PROpen, nil }
+
+func TestChatHandler_ApprovalFailureRollsBack(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		diverged bool // the remote branch exists, so the push is rejected
+	}{
+		{name: "push fails", diverged: true},
+		{name: "pull request fails"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			remote := t.TempDir()
+			if _, err := gogit.PlainInit(remote, true); err != nil {
+				t.Fatal(err)
+			}
+			dir := t.TempDir()
+			repo, err := gogit.PlainInitWithOptions(dir, &gogit.PlainInitOptions{
+				InitOptions: gogit.InitOptions{DefaultBranch: plumbing.Main},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := repo.CreateRemote(&gogitconfig.RemoteConfig{Name: "origin", URLs: []string{remote}}); err != nil {
+				t.Fatal(err)
+			}
+			svc := git.NewService(dir, nil)
+			if err := svc.Open(); err != nil {
+				t.Fatal(err)
+			}
+			os.WriteFile(filepath.Join(dir, "README.md"), []byte("readme\n"), 0644)
+			if _, err := svc.CommitAll("initial"); err != nil {
+				t.Fatal(err)
+			}
+			if err := svc.Push(context.Background(), "main"); err != nil {
+				t.Fatal(err)
+			}
+
+			engine := selfmod.NewEngine(dir)
+			llm := &scriptedLLM{
+				answer:   `{"description": "Add notes", "changes": [{"path": "NOTES.md", "action": "create", "new_content": "notes\n"}]}`,
+				messages: make(chan []provider.Message, 1),
+			}
+			cr, err := engine.GenerateChanges(context.Background(), llm, "Add notes")
+			if err != nil {
+				t.Fatalf("GenerateChanges failed: %v", err)
+			}
+			branch := ws.SelfModBranch(cr.ID)
+
+			var diverged plumbing.Hash
+			if tc.diverged {
+				if err := svc.CreateBranch(branch, ""); err != nil {
+					t.Fatal(err)
+				}
+				os.WriteFile(filepath.Join(dir, "OTHER.md"), []byte("other\n"), 0644)
+				hash, err := svc.CommitAll("other")
+				if err != nil {
+					t.Fatal(err)
+				}
+				diverged = plumbing.NewHash(hash)
+				if err := svc.Push(context.Background(), branch); err != nil {
+					t.Fatal(err)
+				}
+				if err := svc.CheckoutMain(); err != nil {
+					t.Fatal(err)
+				}
+				if err := svc.DeleteBranch(branch); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			conn := dialHandler(t, ws.NewChatHandler(provider.NewRegistry(), engine, svc, prFailingForge{}))
+			send(t, conn, "selfmod.approve", ws.SelfModApprovePayload{RequestID: cr.ID})
+			for {
+				var status ws.SelfModStatusPayload
+				json.Unmarshal(readUntil(t, conn, "selfmod.status").Payload, &status)
+				if status.Status == "error" {
+					break
+				}
+			}
+
+			if got, _ := engine.GetRequest(cr.ID); got.Status != "pending" {
+				t.Errorf("status = %q, want pending", got.Status)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "NOTES.md")); !os.IsNotExist(err) {
+				t.Errorf("change was left in the working tree: %v", err)
+			}
+			if current, _ := svc.CurrentBranch(); current != "main" {
+				t.Errorf("checked out %q, want main", current)
+			}
+			if branches, _ := svc.Branches(branch); len(branches) > 0 {
+				t.Errorf("local branches left behind: %v", branches)
+			}
+
+			bare, err := gogit.PlainOpen(remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ref, err := bare.Reference(plumbing.NewBranchReferenceName(branch), true)
+			switch {
+			case tc.diverged && (err != nil || ref.Hash() != diverged):
+				t.Errorf("remote branch changed: %v", err)
+			case !tc.diverged && err == nil:
+				t.Errorf("remote branch left behind at %s", ref.Hash())
+			}
+		})
+	}
+}
@@ -1,9 +1,12 @@
 package ws
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -24,12 +27,25 @@ type Envelope struct {
 	Payload json.RawMessage `json:"payload,omitempty"`
 }
 
+// Roles a client can hold.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 // Client represents a connected WebSocket client.
 type Client struct {
 	ID   string
+	Role string
 	hub  *Hub
 	conn *websocket.Conn
 	send chan []byte
+
+	// mu guards closed. done is closed when the client disconnects and
+	// stops the write pump; send is never closed, so no send races it.
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
 }
 
 // Hub manages WebSocket connections and message routing.
@@ -38,11 +54,15 @@ type Hub struct {
 	clients       map[string]*Client
 	handler       MessageHandler
 	allowedOrigin string
+	adminToken    string
 }
 
 // MessageHandler processes incoming WebSocket messages.
 type MessageHandler interface {
 	HandleMessage(client *Client, env Envelope)
+	// HandleDisconnect is called once the client has disconnected, to
+	// drop what the handler keeps for it.
+	HandleDisconnect(client *Client)
 }
 
 // NewHub creates a new WebSocket hub.
@@ -54,11 +74,48 @@ func NewHub(handler MessageHandler, allowedOrigin string) *Hub {
 	}
 }
 
+// SetAdminToken sets the token that grants the admin role. Without one every
+// client is an admin.
+func (h *Hub) SetAdminToken(token string) {
+	h.adminToken = token
+}
+
+// Subprotocol is the WebSocket subprotocol the server selects. Browsers
+// cannot set headers on WebSocket upgrades, so they offer the admin token as
+// a second subprotocol, TokenProtocolPrefix followed by the token, next to
+// Subprotocol. Unlike a query parameter it is not written to request logs.
+const (
+	Subprotocol         = "flyagi"
+	TokenProtocolPrefix = "flyagi.token."
+)
+
+// RoleFor returns the role of an HTTP request. The admin token is read from
+// an "Authorization: Bearer" header or a TokenProtocolPrefix subprotocol.
+func RoleFor(r *http.Request, adminToken string) string {
+	if adminToken == "" {
+		return RoleAdmin
+	}
+	var token string
+	for _, p := range websocket.Subprotocols(r) {
+		if t, ok := strings.CutPrefix(p, TokenProtocolPrefix); ok {
+			token = t
+		}
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+		return RoleAdmin
+	}
+	return RoleUser
+}
+
 // ServeWS handles WebSocket upgrade requests.
 func (h *Hub) ServeWS(w http.ResponseWriter, r *http.Request) {
 	upgrader := websocket.Upgrader{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
+		Subprotocols:    []string{Subprotocol}, // never echo the token back
 		CheckOrigin: func(r *http.Request) bool {
 			if h.allowedOrigin == "*" || h.allowedOrigin == "" {
 				return true
@@ -76,9 +133,11 @@ func (h *Hub) ServeWS(w http.ResponseWriter, r *http.Request) {
 
 	client := &Client{
 		ID:   uuid.New().String(),
+		Role: RoleFor(r, h.adminToken),
 		hub:  h,
 		conn: conn,
 		send: make(chan []byte, 256),
+		done: make(chan struct{}),
 	}
 
 	h.register(client)
@@ -91,16 +150,48 @@ func (h *Hub) register(c *Client) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	h.clients[c.ID] = c
-	slog.Info("client connected", "id", c.ID)
+	slog.Info("client connected", "id", c.ID, "role", c.Role)
 }
 
 func (h *Hub) unregister(c *Client) {
 	h.mu.Lock()
-	defer h.mu.Unlock()
-	if _, ok := h.clients[c.ID]; ok {
+	_, ok := h.clients[c.ID]
+	if ok {
 		delete(h.clients, c.ID)
-		close(c.send)
+		c.mu.Lock()
+		c.closed = true
+		close(c.done)
+		c.mu.Unlock()
+	}
+	h.mu.Unlock()
+	if ok {
 		slog.Info("client disconnected", "id", c.ID)
+		h.handler.HandleDisconnect(c)
+	}
+}
+
+// Broadcast sends an envelope to every connected client.
+func (h *Hub) Broadcast(env Envelope) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, c := range h.clients {
+		if err := c.Send(env); err != nil {
+			slog.Warn("broadcast failed", "client", c.ID, "error", err)
+		}
+	}
+}
+
+// BroadcastRole sends an envelope to every connected client with role.
+func (h *Hub) BroadcastRole(role string, env Envelope) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, c := range h.clients {
+		if c.Role != role {
+			continue
+		}
+		if err := c.Send(env); err != nil {
+			slog.Warn("broadcast failed", "client", c.ID, "error", err)
+		}
 	}
 }
 
@@ -110,6 +201,11 @@ func (c *Client) Send(env Envelope) error {
 	if err != nil {
 		return err
 	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.closed {
+		return ErrClientClosed
+	}
 	select {
 	case c.send <- data:
 		return nil
@@ -118,6 +214,37 @@ func (c *Client) Send(env Envelope) error {
 	}
 }
 
+// SendWait is like Send but waits up to timeout for room in the send
+// buffer, for messages that should not be dropped. It returns early when
+// the client disconnects.
+func (c *Client) SendWait(env Envelope, timeout time.Duration) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	c.mu.RLock()
+	closed := c.closed
+	c.mu.RUnlock()
+	if closed {
+		return ErrClientClosed
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case c.send <- data:
+		return nil
+	case <-c.done:
+		return ErrClientClosed
+	case <-timer.C:
+		return ErrSendBufferFull
+	}
+}
+
+// Done returns a channel that is closed when the client disconnects.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
 func (c *Client) readPump() {
 	defer func() {
 		c.hub.unregister(c)
@@ -159,12 +286,12 @@ func (c *Client) writePump() {
 
 	for {
 		select {
-		case message, ok := <-c.send:
+		case <-c.done:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		case message := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
 			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				return
 			}
@@ -177,6 +304,9 @@ func (c *Client) writePump() {
 	}
 }
 
+// ErrClientClosed is returned by Send after the client has disconnected.
+var ErrClientClosed = errors.New("client disconnected")
+
 var ErrSendBufferFull = &sendBufferFullError{}
 
 type sendBufferFullError struct{}
@@ -2,6 +2,7 @@ package ws_test
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -12,12 +13,19 @@ import (
 	"github.com/yuki/flyagi/internal/ws"
 )
 
-type echoHandler struct{}
+// echoHandler echoes messages back and records disconnected clients.
+type echoHandler struct {
+	disconnected []string
+}
 
 func (h *echoHandler) HandleMessage(client *ws.Client, env ws.Envelope) {
 	client.Send(env) // echo back
 }
 
+func (h *echoHandler) HandleDisconnect(client *ws.Client) {
+	h.disconnected = append(h.disconnected, client.ID)
+}
+
 func TestHub_ConnectAndEcho(t *testing.T) {
 	hub := ws.NewHub(&echoHandler{}, "*")
 
@@ -57,3 +65,104 @@ func TestHub_ConnectAndEcho(t *testing.T) {
 		t.Errorf("expected type %q, got %q", "test.ping", echo.Type)
 	}
 }
+
+func TestRoleFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		query  string
+		role   string
+	}{
+		{"bearer", http.Header{"Authorization": {"Bearer secret"}}, "", ws.RoleAdmin},
+		{"subprotocol", http.Header{"Sec-Websocket-Protocol": {"flyagi, flyagi.token.secret"}}, "", ws.RoleAdmin},
+		{"wrong token", http.Header{"Authorization": {"Bearer nope"}}, "", ws.RoleUser},
+		{"query is ignored", nil, "?token=secret", ws.RoleUser},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/ws"+tt.query, nil)
+		for k, v := range tt.header {
+			r.Header[k] = v
+		}
+		if role := ws.RoleFor(r, "secret"); role != tt.role {
+			t.Errorf("%s: got %q, want %q", tt.name, role, tt.role)
+		}
+	}
+}
+
+func TestHub_TokenSubprotocol(t *testing.T) {
+	hub := ws.NewHub(&echoHandler{}, "*")
+	hub.SetAdminToken("secret")
+
+	server := httptest.NewServer(http.HandlerFunc(hub.ServeWS))
+	defer server.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{ws.Subprotocol, ws.TokenProtocolPrefix + "secret"}}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	if got := resp.Header.Get("Sec-Websocket-Protocol"); got != ws.Subprotocol {
+		t.Errorf("selected subprotocol %q, want %q", got, ws.Subprotocol)
+	}
+}
+
+func TestHub_UnregisterDuringSendWait(t *testing.T) {
+	hub := ws.NewHub(&echoHandler{}, "*")
+	client := ws.NewTestClient(hub, 1)
+	env := ws.Envelope{Type: "test.ping"}
+	if err := client.Send(env); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+
+	// The buffer is full, so this waits until the client goes away.
+	result := make(chan error, 1)
+	go func() { result <- client.SendWait(env, 10*time.Second) }()
+	time.Sleep(50 * time.Millisecond)
+
+	unregistered := make(chan struct{})
+	go func() {
+		hub.Unregister(client)
+		close(unregistered)
+	}()
+	select {
+	case <-unregistered:
+	case <-time.After(time.Second):
+		t.Fatal("unregister blocked behind SendWait")
+	}
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, ws.ErrClientClosed) {
+			t.Errorf("expected ErrClientClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("SendWait did not return on disconnect")
+	}
+	if err := client.Send(env); !errors.Is(err, ws.ErrClientClosed) {
+		t.Errorf("expected ErrClientClosed after disconnect, got %v", err)
+	}
+}
+
+func TestHub_DisconnectHook(t *testing.T) {
+	handler := &echoHandler{}
+	hub := ws.NewHub(handler, "*")
+	client := ws.NewTestClient(hub, 1)
+
+	hub.Unregister(client)
+	hub.Unregister(client)
+	if len(handler.disconnected) != 1 || handler.disconnected[0] != client.ID {
+		t.Errorf("disconnected = %v, want [%s] once", handler.disconnected, client.ID)
+	}
+}
+
+func TestHub_BroadcastRole(t *testing.T) {
+	hub := ws.NewHub(&echoHandler{}, "*")
+	admin := ws.NewRoleClient(hub, "admin", ws.RoleAdmin)
+	user := ws.NewRoleClient(hub, "user", ws.RoleUser)
+
+	hub.BroadcastRole(ws.RoleAdmin, ws.Envelope{Type: "selfmod.diff"})
+	if admin.Queued() != 1 || user.Queued() != 0 {
+		t.Errorf("queued: admin %d, user %d; want only the admin", admin.Queued(), user.Queued())
+	}
+}
@@ -0,0 +1,214 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/yuki/flyagi/internal/provider"
+)
+
+// Chat intents.
+const (
+	IntentChat     = "chat"
+	IntentSelfMod  = "selfmod"
+	IntentCodebase = "codebase"
+)
+
+// Decision sources.
+const (
+	SourceCommand    = "command"
+	SourceOverride   = "override"
+	SourceClassifier = "classifier"
+	SourceDefault    = "default"
+)
+
+// DefaultIntentThreshold is the confidence below which the router asks the
+// user instead of acting on a non-chat intent.
+const DefaultIntentThreshold = 0.7
+
+// IntentDecision is the router's verdict for a chat message. It is sent to
+// the client as "chat.intent" so the user can override it.
+type IntentDecision struct {
+	Intent     string  `json:"intent"`
+	Confidence float64 `json:"confidence"`
+	Source     string  `json:"source"`
+	Reason     string  `json:"reason,omitempty"`
+	// Request is the text the chosen handler acts on: the message, or the
+	// argument of a slash command.
+	Request string `json:"request"`
+	// Clarify is set when the decision is not confident enough to act on;
+	// the message waits for a "chat.resolve" from the client.
+	Clarify string `json:"clarify,omitempty"`
+}
+
+// IntentClassifier guesses the intent of the last message in a conversation.
+type IntentClassifier interface {
+	Classify(ctx context.Context, llm provider.LLMProvider, messages []provider.Message) (IntentDecision, error)
+}
+
+// IntentRouter decides how a chat message that is not a slash command is
+// handled: a client override first, then a classifier, falling back to plain
+// chat.
+type IntentRouter struct {
+	classifier IntentClassifier
+	threshold  float64
+}
+
+// NewIntentRouter creates a router. classifier may be nil, in which case
+// only overrides leave plain chat.
+func NewIntentRouter(classifier IntentClassifier, threshold float64) *IntentRouter {
+	if threshold <= 0 {
+		threshold = DefaultIntentThreshold
+	}
+	return &IntentRouter{
+		classifier: classifier,
+		threshold:  threshold,
+	}
+}
+
+// Route decides the intent of the last message. override, when it names a
+// known intent, wins over everything else.
+func (r *IntentRouter) Route(ctx context.Context, llm provider.LLMProvider, messages []provider.Message, override string) IntentDecision {
+	text := ""
+	if len(messages) > 0 {
+		text = messages[len(messages)-1].Content
+	}
+
+	if validIntent(override) {
+		return IntentDecision{Intent: override, Confidence: 1, Source: SourceOverride, Request: text}
+	}
+
+	if r.classifier == nil || llm == nil || strings.TrimSpace(text) == "" {
+		return IntentDecision{Intent: IntentChat, Confidence: 1, Source: SourceDefault, Request: text}
+	}
+
+	d, err := r.classifier.Classify(ctx, llm, messages)
+	if err != nil || !validIntent(d.Intent) {
+		reason := "classifier returned an unknown intent"
+		if err != nil {
+			reason = err.Error()
+		}
+		return IntentDecision{Intent: IntentChat, Confidence: 0, Source: SourceDefault, Reason: reason, Request: text}
+	}
+	d.Source = SourceClassifier
+	d.Request = text
+	if d.Intent != IntentChat && d.Confidence < r.threshold {
+		d.Clarify = clarifyQuestion(d)
+	}
+	return d
+}
+
+func clarifyQuestion(d IntentDecision) string {
+	action := "コードを変更"
+	if d.Intent == IntentCodebase {
+		action = "コードベースを検索して回答"
+	}
+	return fmt.Sprintf("この依頼は%sしますか？それとも通常の会話として回答しますか？（確信度 %.0f%%）", action, d.Confidence*100)
+}
+
+func validIntent(s string) bool {
+	return s == IntentChat || s == IntentSelfMod || s == IntentCodebase
+}
+
+// RulesClassifier guesses the intent from keywords, without a model call.
+// It is an opt-in cheaper alternative to LLMClassifier and misroutes more
+// phrasings. A change request that does not also name code stays below the
+// default threshold, so the user is asked to confirm it.
+type RulesClassifier struct{}
+
+var (
+	changeVerb   = regexp.MustCompile(`(?i)^(please\s+|can you\s+|could you\s+)?(add|fix|change|remove|delete|rename|refactor|implement|update|replace|move|create)\b`)
+	changeVerbJa = regexp.MustCompile(`(追加|修正|変更|削除|実装|リファクタ|置き換え|作成)(して|しろ|お願い)`)
+	codeNoun     = regexp.MustCompile(`(?i)\.(go|ts|tsx|js|md|json|ya?ml)\b|\b(func|function|method|endpoint|handler|tests?|file|package|struct)\b|関数|ファイル|エンドポイント|テスト|ハンドラ`)
+	codeQuestion = regexp.MustCompile(`(?i)^(how|where|what|why|which)\b.*\b(code|implemented|handled|defined|works?|function|file|package|repo)\b|(どこ|どうやって|どのように|仕組み|なぜ).*(コード|実装|処理|関数|ファイル)`)
+)
+
+// Classify implements IntentClassifier.
+func (RulesClassifier) Classify(_ context.Context, _ provider.LLMProvider, messages []provider.Message) (IntentDecision, error) {
+	if len(messages) == 0 {
+		return IntentDecision{Intent: IntentChat, Confidence: 1}, nil
+	}
+	text := strings.TrimSpace(messages[len(messages)-1].Content)
+	switch {
+	case changeVerb.MatchString(text) || changeVerbJa.MatchString(text):
+		if codeNoun.MatchString(text) {
+			return IntentDecision{Intent: IntentSelfMod, Confidence: 0.8, Reason: "asks to change code"}, nil
+		}
+		return IntentDecision{Intent: IntentSelfMod, Confidence: 0.5, Reason: "asks for a change"}, nil
+	case codeQuestion.MatchString(text):
+		return IntentDecision{Intent: IntentCodebase, Confidence: 0.8, Reason: "asks about the code"}, nil
+	}
+	return IntentDecision{Intent: IntentChat, Confidence: 0.6, Reason: "no rule matched"}, nil
+}
+
+// LLMClassifier asks a language model for the intent. When LLM is nil the
+// provider of the conversation is used.
+type LLMClassifier struct {
+	LLM     provider.LLMProvider
+	Timeout time.Duration
+}
+
+const classifierPrompt = `You route messages sent to FlyAGI, an assistant that can modify its own source code.
+Classify the user's LAST message into exactly one intent:
+- "selfmod": the user asks to change, add, fix or remove code or files in this repository
+- "codebase": the user asks a question about how this repository's code works
+- "chat": anything else, including general coding questions and requests for text
+
+Respond with only JSON: {"intent": "...", "confidence": 0.0-1.0, "reason": "short reason"}`
+
+// Classify implements IntentClassifier.
+func (c *LLMClassifier) Classify(ctx context.Context, llm provider.LLMProvider, messages []provider.Message) (IntentDecision, error) {
+	if c.LLM != nil {
+		llm = c.LLM
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 15 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// A few turns of context are enough to resolve "do it" style follow-ups.
+	if len(messages) > 4 {
+		messages = messages[len(messages)-4:]
+	}
+	var convo strings.Builder
+	for _, m := range messages {
+		fmt.Fprintf(&convo, "%s: %s\n", m.Role, truncate(m.Content, 2000))
+	}
+
+	var out strings.Builder
+	err := llm.ChatStream(ctx, []provider.Message{
+		{Role: "system", Content: classifierPrompt},
+		{Role: "user", Content: convo.String()},
+	}, func(chunk provider.StreamChunk) error {
+		out.WriteString(chunk.Content)
+		return nil
+	})
+	if err != nil {
+		return IntentDecision{}, fmt.Errorf("failed to classify intent: %w", err)
+	}
+
+	var d IntentDecision
+	if err := json.Unmarshal([]byte(jsonObject(out.String())), &d); err != nil {
+		return IntentDecision{}, fmt.Errorf("failed to parse intent: %w", err)
+	}
+	d.Intent = strings.ToLower(strings.TrimSpace(d.Intent))
+	d.Confidence = min(max(d.Confidence, 0), 1)
+	return d, nil
+}
+
+// jsonObject returns the outermost {...} in s, tolerating code fences and
+// surrounding prose.
+func jsonObject(s string) string {
+	start := strings.Index(s, "{")
+	end := strings.LastIndex(s, "}")
+	if start == -1 || end < start {
+		return s
+	}
+	return s[start : end+1]
+}
@@ -0,0 +1,131 @@
+package ws
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/yuki/flyagi/internal/github"
+	"github.com/yuki/flyagi/internal/provider"
+	"github.com/yuki/flyagi/internal/selfmod"
+)
+
+// maxIssueCommentDiff bounds the diff text included in an issue comment.
+const maxIssueCommentDiff = 16 << 10
+
+// HandleIssue turns a labeled GitHub issue into a change request, posts the
+// generated diff summary back to the issue and broadcasts the diff to
+// connected admins for approval. Each issue is handled at most once, whether
+// it arrives via webhook or polling.
+func (h *ChatHandler) HandleIssue(providerID string, issue github.Issue) {
+	if h.engine == nil || h.ghClient == nil {
+		slog.Warn("issue ignored: selfmod not configured", "issue", issue.Number)
+		return
+	}
+	if _, seen := h.issues.LoadOrStore(issue.Number, true); seen {
+		return
+	}
+
+	llm, err := h.registry.GetLLM(providerID)
+	if err != nil {
+		slog.Error("issue ignored: LLM provider not found", "provider", providerID, "error", err)
+		return
+	}
+
+	go func() {
+		// Issues queue as one owner; one left out when the queue is full is
+		// picked up again by the next poll.
+		err := h.queue.Do(context.Background(), "issues", nil, func() { h.generateFromIssue(llm, issue) })
+		if err != nil {
+			slog.Warn("issue deferred: generation queue full", "issue", issue.Number)
+			h.issues.Delete(issue.Number)
+		}
+	}()
+}
+
+// generateFromIssue generates a change request for issue and reports it on
+// the issue and to connected clients.
+func (h *ChatHandler) generateFromIssue(llm provider.LLMProvider, issue github.Issue) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	// After a restart the in-memory record is gone; the marker comment
+	// tells us the issue was already picked up.
+	handled, err := h.ghClient.HasComment(ctx, issue.Number, github.CommentMarker)
+	if err != nil {
+		slog.Error("failed to check issue comments", "issue", issue.Number, "error", err)
+		h.issues.Delete(issue.Number)
+		return
+	}
+	if handled {
+		return
+	}
+
+	cr, err := h.engine.GenerateFromIssue(ctx, llm, issue.Number, issue.Title, issue.Body)
+	if err != nil {
+		slog.Error("selfmod issue generation failed", "issue", issue.Number, "error", err)
+		h.issues.Delete(issue.Number) // retried by the next poll or delivery
+		h.reportIssueFailure(issue.Number)
+		return
+	}
+
+	if err := h.ghClient.CreateComment(ctx, issue.Number, issueSummary(cr)); err != nil {
+		slog.Warn("failed to comment on issue", "issue", issue.Number, "error", err)
+	}
+
+	slog.Info("selfmod issue request generated", "request_id", cr.ID, "issue", issue.Number)
+	h.broadcastAdmins(diffEnvelope(cr))
+}
+
+// issueFailureComment is posted once on an issue whose generation failed.
+// The error itself is only logged: it may quote model output.
+var issueFailureComment = github.FailureMarker + "\n変更の生成に失敗しました。後で再試行します / Failed to generate changes; FlyAGI will try again later."
+
+// reportIssueFailure comments on an issue that its generation failed,
+// unless an earlier attempt already did. The comment does not mark the issue
+// as handled.
+func (h *ChatHandler) reportIssueFailure(number int) {
+	// The generation's context may have run out.
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	reported, err := h.ghClient.HasComment(ctx, number, github.FailureMarker)
+	if err != nil {
+		slog.Warn("failed to check issue comments", "issue", number, "error", err)
+		return
+	}
+	if reported {
+		return
+	}
+	if err := h.ghClient.CreateComment(ctx, number, issueFailureComment); err != nil {
+		slog.Warn("failed to comment on issue", "issue", number, "error", err)
+	}
+}
+
+// issueSummary renders the comment posted on an issue once changes have been
+// generated for it.
+func issueSummary(cr *selfmod.ChangeRequest) string {
+	var sb strings.Builder
+	sb.WriteString(github.CommentMarker + "\n")
+	fmt.Fprintf(&sb, "### FlyAGI proposed changes\n\n%s\n\n", cr.Description)
+	for _, c := range cr.Changes {
+		fmt.Fprintf(&sb, "- `%s` (%s)\n", c.Path, c.Action)
+	}
+
+	var diff strings.Builder
+	for _, d := range cr.Diffs {
+		diff.WriteString(d.Diff)
+	}
+	fmt.Fprintf(&sb, "\n<details><summary>Diff</summary>\n\n```diff\n%s\n```\n</details>\n\n", truncate(diff.String(), maxIssueCommentDiff))
+	fmt.Fprintf(&sb, "Request ID: `%s` — a pull request will be opened once the change is approved in FlyAGI.\n", cr.ID)
+	return sb.String()
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "\n..."
+}
@@ -0,0 +1,146 @@
+package ws
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/yuki/flyagi/internal/forge"
+	"github.com/yuki/flyagi/internal/git"
+	"github.com/yuki/flyagi/internal/selfmod"
+)
+
+// PRDefaults configures pull requests opened for approved change requests.
+type PRDefaults struct {
+	TitlePrefix string
+	Template    *template.Template // nil uses selfmod.DefaultPRTemplate
+	Base        string
+	Draft       bool
+	Labels      []string
+	Assignees   []string
+	Reviewers   []string
+}
+
+// PROverrides lets an approver adjust the pull request for a single change
+// request. Unset fields keep the configured defaults.
+type PROverrides struct {
+	Title     string   `json:"title,omitempty"`
+	Base      string   `json:"base,omitempty"`
+	Draft     *bool    `json:"draft,omitempty"`
+	Labels    []string `json:"labels,omitempty"`
+	Assignees []string `json:"assignees,omitempty"`
+	Reviewers []string `json:"reviewers,omitempty"`
+}
+
+var defaultPRTemplate = template.Must(selfmod.ParsePRTemplate(selfmod.DefaultPRTemplate))
+
+func defaultPRDefaults() PRDefaults {
+	return PRDefaults{
+		TitlePrefix: "[selfmod] ",
+		Template:    defaultPRTemplate,
+		Base:        "main",
+	}
+}
+
+// SetPRDefaults replaces the pull request defaults.
+func (h *ChatHandler) SetPRDefaults(d PRDefaults) {
+	if d.Template == nil {
+		d.Template = defaultPRTemplate
+	}
+	if d.Base == "" {
+		d.Base = "main"
+	}
+	h.prDefaults = d
+}
+
+// prOptions builds the pull request for an approved change request from the
+// configured defaults and the approver's overrides.
+func (h *ChatHandler) prOptions(cr *selfmod.ChangeRequest, branch string, o *PROverrides) (forge.PROptions, error) {
+	d := h.prDefaults
+
+	body, err := selfmod.RenderPRBody(d.Template, cr)
+	if err != nil {
+		return forge.PROptions{}, err
+	}
+
+	opts := forge.PROptions{
+		Title:     d.TitlePrefix + cr.Description,
+		Body:      body,
+		Head:      branch,
+		Base:      h.prBase(o),
+		Draft:     d.Draft,
+		Labels:    d.Labels,
+		Assignees: d.Assignees,
+		Reviewers: d.Reviewers,
+	}
+	if o == nil {
+		return opts, nil
+	}
+
+	if o.Title != "" {
+		opts.Title = o.Title
+	}
+	if o.Draft != nil {
+		opts.Draft = *o.Draft
+	}
+	if o.Labels != nil {
+		opts.Labels = o.Labels
+	}
+	if o.Assignees != nil {
+		opts.Assignees = o.Assignees
+	}
+	if o.Reviewers != nil {
+		opts.Reviewers = o.Reviewers
+	}
+	return opts, nil
+}
+
+// prBase returns the branch a pull request is opened against, and so the
+// one its branch is cut from.
+func (h *ChatHandler) prBase(o *PROverrides) string {
+	if o != nil && o.Base != "" {
+		return o.Base
+	}
+	return h.prDefaults.Base
+}
+
+// commitMessage builds the commit message for an approved change: the
+// description as subject, the original request and changed files as body,
+// and trailers linking the change request, naming the approving client and
+// crediting the approver it gave.
+func commitMessage(cr *selfmod.ChangeRequest, client *Client, approver *Approver) string {
+	var body strings.Builder
+	if subject := git.Subject(cr.Description); subject != strings.TrimSpace(cr.Description) {
+		body.WriteString(strings.TrimSpace(cr.Description) + "\n\n")
+	}
+	if req := strings.TrimSpace(cr.Request); req != "" && req != strings.TrimSpace(cr.Description) {
+		body.WriteString("Requested: " + req + "\n\n")
+	}
+	for _, c := range cr.Changes {
+		fmt.Fprintf(&body, "- %s %s\n", c.Action, c.Path)
+	}
+	for _, d := range cr.Declined {
+		if len(d.Hunks) > 0 {
+			fmt.Fprintf(&body, "- declined %d hunks of %s\n", len(d.Hunks), d.Path)
+		} else {
+			fmt.Fprintf(&body, "- declined %s %s\n", d.Action, d.Path)
+		}
+	}
+
+	msg := git.CommitMessage{
+		Subject: "selfmod: " + cr.Description,
+		Body:    body.String(),
+		Trailers: []git.Trailer{
+			{Key: "Change-Request-ID", Value: cr.ID},
+			{Key: "Approved-by-Client", Value: fmt.Sprintf("%s (%s)", client.ID, client.Role)},
+		},
+	}
+	if approver != nil && approver.Email != "" {
+		name := approver.Name
+		if name == "" {
+			name = approver.Email
+		}
+		msg.Trailers = append(msg.Trailers, git.CoAuthor(git.Identity{Name: name, Email: approver.Email}))
+	}
+	return msg.String()
+}
@@ -0,0 +1,247 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// ErrQueueFull is returned when an owner already has as many generations
+// queued or running as it may.
+var ErrQueueFull = errors.New("too many generations queued")
+
+// Default generation queue limits.
+const (
+	DefaultGenerationWorkers  = 2
+	DefaultGenerationPerOwner = 3
+)
+
+// GenerationQueue runs selfmod generations on a bounded number of workers.
+// Waiting jobs are started round-robin across owners, so one client's
+// backlog does not hold up everyone else's, and each owner may have only a
+// few jobs queued or running at once.
+type GenerationQueue struct {
+	workers  int
+	perOwner int
+
+	mu      sync.Mutex
+	running int
+	owned   map[string]int          // queued and running jobs per owner
+	waiting map[string][]*queuedJob // per owner, oldest first
+	owners  []string                // owners with waiting jobs, in start order
+}
+
+type queuedJob struct {
+	start      chan struct{}
+	started    bool
+	position   int
+	onPosition func(int)
+}
+
+// NewGenerationQueue creates a queue running up to workers jobs at once and
+// holding up to perOwner jobs per owner. Values below 1 use the defaults.
+func NewGenerationQueue(workers, perOwner int) *GenerationQueue {
+	if workers < 1 {
+		workers = DefaultGenerationWorkers
+	}
+	if perOwner < 1 {
+		perOwner = DefaultGenerationPerOwner
+	}
+	return &GenerationQueue{
+		workers:  workers,
+		perOwner: perOwner,
+		owned:    make(map[string]int),
+		waiting:  make(map[string][]*queuedJob),
+	}
+}
+
+// Do runs fn once a worker is free. While the job waits, onPosition, if not
+// nil, is called with its 1-based place in line whenever that changes, and
+// with 0 when it starts. Do returns ErrQueueFull when owner has too many jobs,
+// or ctx's error if ctx ends before the job starts.
+func (q *GenerationQueue) Do(ctx context.Context, owner string, onPosition func(int), fn func()) error {
+	q.mu.Lock()
+	if q.owned[owner] >= q.perOwner {
+		q.mu.Unlock()
+		return ErrQueueFull
+	}
+	q.owned[owner]++
+
+	if q.running < q.workers && len(q.owners) == 0 {
+		q.running++
+		q.mu.Unlock()
+		defer q.done(owner)
+		fn()
+		return nil
+	}
+
+	job := &queuedJob{start: make(chan struct{}), onPosition: onPosition}
+	if len(q.waiting[owner]) == 0 {
+		q.owners = append(q.owners, owner)
+	}
+	q.waiting[owner] = append(q.waiting[owner], job)
+	q.reposition()
+	q.mu.Unlock()
+
+	select {
+	case <-job.start:
+	case <-ctx.Done():
+		q.mu.Lock()
+		if job.started {
+			// Started as ctx ended; give the worker back.
+			q.mu.Unlock()
+			q.done(owner)
+			return ctx.Err()
+		}
+		q.remove(owner, job)
+		q.owned[owner]--
+		if q.owned[owner] == 0 {
+			delete(q.owned, owner)
+		}
+		q.reposition()
+		q.mu.Unlock()
+		return ctx.Err()
+	}
+
+	defer q.done(owner)
+	fn()
+	return nil
+}
+
+// done releases the worker of a finished job and starts waiting ones.
+func (q *GenerationQueue) done(owner string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running--
+	q.owned[owner]--
+	if q.owned[owner] == 0 {
+		delete(q.owned, owner)
+	}
+
+	for q.running < q.workers && len(q.owners) > 0 {
+		next := q.owners[0]
+		q.owners = q.owners[1:]
+		job := q.waiting[next][0]
+		q.waiting[next] = q.waiting[next][1:]
+		if len(q.waiting[next]) > 0 {
+			q.owners = append(q.owners, next) // back of the line
+		} else {
+			delete(q.waiting, next)
+		}
+		job.started = true
+		q.running++
+		close(job.start)
+		q.notify(job, 0)
+	}
+	q.reposition()
+}
+
+func (q *GenerationQueue) remove(owner string, job *queuedJob) {
+	jobs := q.waiting[owner]
+	for i, j := range jobs {
+		if j == job {
+			jobs = append(jobs[:i], jobs[i+1:]...)
+			break
+		}
+	}
+	if len(jobs) > 0 {
+		q.waiting[owner] = jobs
+		return
+	}
+	delete(q.waiting, owner)
+	for i, o := range q.owners {
+		if o == owner {
+			q.owners = append(q.owners[:i], q.owners[i+1:]...)
+			break
+		}
+	}
+}
+
+// reposition works out the order in which waiting jobs will start and
+// reports changed positions.
+func (q *GenerationQueue) reposition() {
+	pos := 0
+	for round := 0; ; round++ {
+		more := false
+		for _, owner := range q.owners {
+			jobs := q.waiting[owner]
+			if round >= len(jobs) {
+				continue
+			}
+			more = true
+			pos++
+			q.notify(jobs[round], pos)
+		}
+		if !more {
+			return
+		}
+	}
+}
+
+// notify is called with q.mu held; callbacks must not block.
+func (q *GenerationQueue) notify(job *queuedJob, position int) {
+	if job.position == position && position != 0 {
+		return
+	}
+	job.position = position
+	if job.onPosition != nil {
+		job.onPosition(position)
+	}
+}
+
+// queued runs fn on the generation queue on behalf of client, which is told
+// its place in line while it waits. fn does not run if the client has too
+// many generations queued, which it is told, or disconnects first. The
+// context passed to fn ends when the generation is cancelled.
+func (h *ChatHandler) queued(client *Client, requestID string, fn func(ctx context.Context)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-client.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	key := requestID
+	if key == "" {
+		key = "generation/" + uuid.NewString()
+	}
+	op := h.startOp(key, client.ID, requestID == "", cancel)
+	if op == nil {
+		payload, _ := json.Marshal(ChatChunkPayload{
+			Content: "\nこの変更リクエストは別の処理中です。完了してから再度お試しください。",
+			Done:    true,
+		})
+		client.Send(Envelope{Type: "chat.chunk", Payload: payload})
+		return
+	}
+	defer h.endOp(key, op)
+
+	onPosition := func(position int) {
+		payload, _ := json.Marshal(SelfModQueuePayload{RequestID: requestID, Position: position})
+		client.Send(Envelope{Type: "selfmod.queue", Payload: payload})
+	}
+	err := h.queue.Do(ctx, client.ID, onPosition, func() { fn(ctx) })
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrQueueFull):
+		payload, _ := json.Marshal(ChatChunkPayload{
+			Content: "\n生成待ちのリクエストが多すぎます。先に送ったリクエストが完了してから再度お試しください。",
+			Done:    true,
+		})
+		client.Send(Envelope{Type: "chat.chunk", Payload: payload})
+	default:
+		select {
+		case <-client.Done():
+			slog.Info("queued generation dropped: client disconnected", "client", client.ID)
+		default:
+			h.generationCancelled(client, requestID)
+		}
+	}
+}
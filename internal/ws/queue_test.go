@@ -0,0 +1,92 @@
+package ws_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/yuki/flyagi/internal/ws"
+)
+
+func TestGenerationQueue(t *testing.T) {
+	q := ws.NewGenerationQueue(1, 3)
+
+	// Occupy the only worker.
+	release := make(chan struct{})
+	running := make(chan struct{})
+	go q.Do(context.Background(), "a", nil, func() {
+		close(running)
+		<-release
+	})
+	<-running
+
+	var mu sync.Mutex
+	var started []string
+	positions := make(map[string][]int)
+	var wg sync.WaitGroup
+	submit := func(owner, name string) {
+		wg.Add(1)
+		queued := make(chan struct{})
+		go func() {
+			defer wg.Done()
+			err := q.Do(context.Background(), owner, func(p int) {
+				mu.Lock()
+				positions[name] = append(positions[name], p)
+				mu.Unlock()
+				if p > 0 {
+					select {
+					case <-queued:
+					default:
+						close(queued)
+					}
+				}
+			}, func() {
+				mu.Lock()
+				started = append(started, name)
+				mu.Unlock()
+			})
+			if err != nil {
+				t.Errorf("Do(%s) failed: %v", name, err)
+			}
+		}()
+		<-queued
+	}
+
+	// a fills its share of the queue before b arrives; b still goes second.
+	submit("a", "a1")
+	submit("a", "a2")
+	if err := q.Do(context.Background(), "a", nil, func() {}); !errors.Is(err, ws.ErrQueueFull) {
+		t.Errorf("expected ErrQueueFull for a fourth job, got %v", err)
+	}
+	submit("b", "b1")
+
+	// A job abandoned while waiting leaves the line.
+	ctx, cancel := context.WithCancel(context.Background())
+	abandoned := make(chan error)
+	go func() {
+		abandoned <- q.Do(ctx, "c", func(int) { cancel() }, func() { t.Error("abandoned job ran") })
+	}()
+	if err := <-abandoned; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	close(release)
+	wg.Wait()
+
+	if want := []string{"a1", "b1", "a2"}; !slices.Equal(started, want) {
+		t.Errorf("started %v, want %v", started, want)
+	}
+	// b1 and c overtake a2 when they arrive, and everyone moves up as jobs
+	// leave the line.
+	for name, want := range map[string][]int{
+		"a1": {1, 0},
+		"a2": {2, 3, 4, 3, 2, 1, 0},
+		"b1": {2, 1, 0},
+	} {
+		if got := positions[name]; !slices.Equal(got, want) {
+			t.Errorf("positions of %s = %v, want %v", name, got, want)
+		}
+	}
+}
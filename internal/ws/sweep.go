@@ -0,0 +1,104 @@
+package ws
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// branchPrefix is the prefix of branches created for selfmod pull requests.
+const branchPrefix = "selfmod/"
+
+// Sweep expires change requests left waiting for review, prunes the request
+// history and deletes local selfmod branches no pending request needs.
+// Clients are told about expired requests.
+func (h *ChatHandler) Sweep(now time.Time) {
+	if h.engine == nil {
+		return
+	}
+
+	for _, cr := range h.engine.Expire(now) {
+		payload, _ := json.Marshal(SelfModStatusPayload{
+			RequestID: cr.ID,
+			Status:    "expired",
+			Message:   "レビューされないまま有効期限が切れたため、変更リクエストを破棄しました",
+		})
+		h.broadcastAdmins(Envelope{Type: "selfmod.status", Payload: payload})
+	}
+	h.engine.Prune(now)
+
+	if h.gitSvc != nil && h.forge != nil {
+		h.sweepBranches()
+	}
+}
+
+// sweepBranches deletes local selfmod branches that do not belong to a
+// pending request. Pull requests keep their branch on the remote, from which
+// follow-ups check it out again. A branch left checked out by a failed
+// approval is abandoned first, discarding its uncommitted changes.
+func (h *ChatHandler) sweepBranches() {
+	// Skip the sweep while an approval is using the repository.
+	if !h.repoMu.TryLock() {
+		return
+	}
+	defer h.repoMu.Unlock()
+
+	branches, err := h.gitSvc.Branches(branchPrefix)
+	if err != nil {
+		slog.Warn("failed to list selfmod branches", "error", err)
+		return
+	}
+	if len(branches) == 0 {
+		return
+	}
+
+	keep := make(map[string]bool)
+	for _, cr := range h.engine.Requests() {
+		if cr.Status != "pending" {
+			continue
+		}
+		keep[selfmodBranch(cr.ID)] = true
+		if cr.Branch != "" {
+			keep[cr.Branch] = true
+		}
+	}
+
+	current, err := h.gitSvc.CurrentBranch()
+	if err != nil {
+		slog.Warn("failed to read current branch", "error", err)
+		return
+	}
+	if strings.HasPrefix(current, branchPrefix) && !keep[current] {
+		err := h.engine.LockTree(func() error {
+			if err := h.gitSvc.Discard(); err != nil {
+				return fmt.Errorf("failed to discard changes: %w", err)
+			}
+			return h.gitSvc.CheckoutMain()
+		})
+		if err != nil {
+			slog.Warn("failed to leave stale branch", "branch", current, "error", err)
+			return
+		}
+		slog.Info("left stale selfmod branch", "branch", current)
+	}
+
+	for _, b := range branches {
+		if keep[b] {
+			continue
+		}
+		if err := h.gitSvc.DeleteBranch(b); err != nil {
+			slog.Warn("failed to delete stale branch", "branch", b, "error", err)
+		}
+	}
+}
+
+// selfmodBranch returns the branch a change request's pull request is opened
+// from.
+func selfmodBranch(requestID string) string {
+	if len(requestID) > 8 {
+		requestID = requestID[:8]
+	}
+	return branchPrefix + requestID
+}
@@ -37,6 +37,8 @@ function App() {
     messages,
     isStreaming,
     pendingDiff,
+    draftDiff,
+    queuePosition,
     sendMessage,
     cancelStream,
     approveDiff,
@@ -99,6 +101,7 @@ function App() {
         <ChatContainer
           messages={messages}
           isStreaming={isStreaming}
+          queuePosition={queuePosition}
           onSend={sendMessage}
           onCancel={cancelStream}
           isRecording={isRecording}
@@ -108,6 +111,16 @@ function App() {
         />
       </main>
 
+      {draftDiff && !pendingDiff && (
+        <DiffViewer
+          requestId={draftDiff.requestId}
+          description={draftDiff.description}
+          diffs={draftDiff.diffs}
+          generating
+          onApprove={approveDiff}
+          onReject={rejectDiff}
+        />
+      )}
       {pendingDiff && (
         <DiffViewer
           requestId={pendingDiff.requestId}
@@ -2,10 +2,12 @@ import { useRef, useEffect } from 'react'
 import { MessageBubble } from './MessageBubble'
 import { ChatInput } from './ChatInput'
 import type { ChatMessage } from '../../hooks/useChat'
+import { useLanguage } from '../../contexts/LanguageContext'
 
 interface Props {
   messages: ChatMessage[]
   isStreaming: boolean
+  queuePosition?: number
   onSend: (text: string) => void
   onCancel: () => void
   isRecording: boolean
@@ -17,6 +19,7 @@ interface Props {
 export function ChatContainer({
   messages,
   isStreaming,
+  queuePosition = 0,
   onSend,
   onCancel,
   isRecording,
@@ -25,6 +28,7 @@ export function ChatContainer({
   onStopRecording,
 }: Props) {
   const scrollRef = useRef<HTMLDivElement>(null)
+  const { t } = useLanguage()
 
   useEffect(() => {
     scrollRef.current?.scrollTo({
@@ -50,6 +54,11 @@ export function ChatContainer({
               <span className="h-2 w-2 rounded-full bg-gray-500 animate-bounce [animation-delay:150ms]" />
               <span className="h-2 w-2 rounded-full bg-gray-500 animate-bounce [animation-delay:300ms]" />
             </div>
+            {queuePosition > 0 && (
+              <span className="ml-2 self-center text-xs text-gray-500">
+                {t('chat.queued').replace('{position}', String(queuePosition))}
+              </span>
+            )}
           </div>
         )}
       </div>
@@ -1,4 +1,4 @@
-import { Check, X } from 'lucide-react'
+import { Check, Loader2, X } from 'lucide-react'
 import { useLanguage } from '../../contexts/LanguageContext'
 
 interface FileDiff {
@@ -6,15 +6,26 @@ interface FileDiff {
   diff: string
 }
 
+function lineClass(line: string): string {
+  if (line.startsWith('+++') || line.startsWith('---') || line.startsWith('diff --git')) {
+    return 'text-gray-500'
+  }
+  if (line.startsWith('@@')) return 'text-blue-400'
+  if (line.startsWith('+')) return 'bg-green-900/30 text-green-300'
+  if (line.startsWith('-')) return 'bg-red-900/30 text-red-300'
+  return ''
+}
+
 interface Props {
   requestId: string
   description: string
   diffs: FileDiff[]
+  generating?: boolean
   onApprove: (id: string) => void
   onReject: (id: string) => void
 }
 
-export function DiffViewer({ requestId, description, diffs, onApprove, onReject }: Props) {
+export function DiffViewer({ requestId, description, diffs, generating, onApprove, onReject }: Props) {
   const { t } = useLanguage()
   return (
     <div className="mx-4 my-3 rounded-xl border border-gray-700 bg-gray-900 overflow-hidden">
@@ -23,31 +34,44 @@ export function DiffViewer({ requestId, description, diffs, onApprove, onReject
           <h3 className="text-sm font-medium text-gray-200">{t('diff.title')}</h3>
           <p className="text-xs text-gray-400 mt-0.5">{description}</p>
         </div>
-        <div className="flex gap-2">
-          <button
-            className="flex items-center gap-1 rounded-lg bg-green-600 px-3 py-1.5 text-xs font-medium text-white transition-colors hover:bg-green-700"
-            onClick={() => onApprove(requestId)}
-          >
-            <Check className="h-3.5 w-3.5" />
-            {t('diff.approve')}
-          </button>
-          <button
-            className="flex items-center gap-1 rounded-lg bg-red-600 px-3 py-1.5 text-xs font-medium text-white transition-colors hover:bg-red-700"
-            onClick={() => onReject(requestId)}
-          >
-            <X className="h-3.5 w-3.5" />
-            {t('diff.reject')}
-          </button>
-        </div>
+        {generating ? (
+          <div className="flex items-center gap-1 text-xs text-gray-400">
+            <Loader2 className="h-3.5 w-3.5 animate-spin" />
+            {t('diff.generating')}
+          </div>
+        ) : (
+          <div className="flex gap-2">
+            <button
+              className="flex items-center gap-1 rounded-lg bg-green-600 px-3 py-1.5 text-xs font-medium text-white transition-colors hover:bg-green-700"
+              onClick={() => onApprove(requestId)}
+            >
+              <Check className="h-3.5 w-3.5" />
+              {t('diff.approve')}
+            </button>
+            <button
+              className="flex items-center gap-1 rounded-lg bg-red-600 px-3 py-1.5 text-xs font-medium text-white transition-colors hover:bg-red-700"
+              onClick={() => onReject(requestId)}
+            >
+              <X className="h-3.5 w-3.5" />
+              {t('diff.reject')}
+            </button>
+          </div>
+        )}
       </div>
       <div className="max-h-96 overflow-y-auto">
-        {diffs.map((fileDiff, i) => (
+        {diffs.filter(Boolean).map((fileDiff, i) => (
           <div key={i} className="border-b border-gray-800 last:border-b-0">
             <div className="bg-gray-800/50 px-4 py-2 text-xs font-mono text-gray-300">
               {fileDiff.path}
             </div>
             <pre className="px-4 py-3 text-xs font-mono text-gray-400 overflow-x-auto whitespace-pre-wrap">
-              {fileDiff.diff || t('diff.newFile')}
+              {fileDiff.diff
+                ? fileDiff.diff.split('\n').map((line, j) => (
+                    <div key={j} className={lineClass(line)}>
+                      {line || ' '}
+                    </div>
+                  ))
+                : t('diff.newFile')}
             </pre>
           </div>
         ))}
@@ -21,12 +21,14 @@ const translations = {
     'chat.recording.stop': 'Stop recording',
     'chat.generating.stop': 'Stop generating',
     'chat.send': 'Send message',
+    'chat.queued': 'Waiting in queue: #{position}',
     
     // Diff Viewer
     'diff.title': 'Code Change Request',
     'diff.approve': 'Approve',
     'diff.reject': 'Reject',
     'diff.newFile': '(new file)',
+    'diff.generating': 'Generating...',
     
     // Providers
     'provider.llm': 'LLM',
@@ -48,12 +50,14 @@ const translations = {
     'chat.recording.stop': '録音停止',
     'chat.generating.stop': '生成を停止',
     'chat.send': 'メッセージ送信',
+    'chat.queued': '順番待ち: {position}番目',
     
     // Diff Viewer
     'diff.title': 'コード変更要求',
     'diff.approve': '承認',
     'diff.reject': '却下',
     'diff.newFile': '(新規ファイル)',
+    'diff.generating': '生成中...',
     
     // Providers
     'provider.llm': 'LLM',
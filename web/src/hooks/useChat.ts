@@ -24,6 +24,8 @@ export function useChat({ send, subscribe, providerId }: UseChatOptions) {
   const [messages, setMessages] = useState<ChatMessage[]>([])
   const [isStreaming, setIsStreaming] = useState(false)
   const [pendingDiff, setPendingDiff] = useState<DiffData | null>(null)
+  const [draftDiff, setDraftDiff] = useState<DiffData | null>(null)
+  const [queuePosition, setQueuePosition] = useState(0)
   const streamBufferRef = useRef('')
 
   useEffect(() => {
@@ -59,12 +61,33 @@ export function useChat({ send, subscribe, providerId }: UseChatOptions) {
 
           if (done) {
             setIsStreaming(false)
+            setQueuePosition(0)
+            setDraftDiff(null)
             streamBufferRef.current = ''
           }
           break
         }
+        case 'selfmod.progress': {
+          const requestId = (payload?.request_id as string) || ''
+          const kind = payload?.kind as string
+          if (kind === 'description') {
+            const description = (payload?.description as string) || ''
+            setDraftDiff(prev => ({ requestId, diffs: [], ...prev, description }))
+          } else if (kind === 'file') {
+            const index = (payload?.index as number) || 0
+            const diff = payload?.diff as { path: string; diff: string } | undefined
+            if (!diff) break
+            setDraftDiff(prev => {
+              const diffs = [...(prev?.diffs ?? [])]
+              diffs[index] = diff
+              return { requestId, description: '', ...prev, diffs }
+            })
+          }
+          break
+        }
         case 'selfmod.diff': {
           const raw = payload as Record<string, unknown>
+          setDraftDiff(null)
           setPendingDiff({
             requestId: (raw.request_id as string) || '',
             description: (raw.description as string) || '',
@@ -72,10 +95,21 @@ export function useChat({ send, subscribe, providerId }: UseChatOptions) {
           })
           break
         }
+        case 'selfmod.queue': {
+          setQueuePosition((payload?.position as number) || 0)
+          break
+        }
         case 'selfmod.status': {
           const status = (payload?.status as string) || ''
           const message = (payload?.message as string) || ''
           const prUrl = (payload?.pr_url as string) || ''
+          if (status === 'error' || status === 'cancelled') {
+            setDraftDiff(null)
+          }
+          if (status === 'expired') {
+            const requestId = (payload?.request_id as string) || ''
+            setPendingDiff(prev => (prev?.requestId === requestId ? null : prev))
+          }
           let statusText = message
           if (prUrl) {
             statusText += `\n[PR: ${prUrl}](${prUrl})`
@@ -91,6 +125,20 @@ export function useChat({ send, subscribe, providerId }: UseChatOptions) {
           ])
           break
         }
+        case 'server.update': {
+          const stage = (payload?.stage as string) || ''
+          const message = (payload?.message as string) || ''
+          setMessages(prev => [
+            ...prev,
+            {
+              id: crypto.randomUUID(),
+              role: 'assistant',
+              content: `[update: ${stage}]${message ? ' ' + message : ''}`,
+              timestamp: Date.now(),
+            },
+          ])
+          break
+        }
         case 'error': {
           const error = (payload?.error as string) || 'Unknown error'
           setMessages(prev => [
@@ -103,6 +151,7 @@ export function useChat({ send, subscribe, providerId }: UseChatOptions) {
             },
           ])
           setIsStreaming(false)
+          setDraftDiff(null)
           break
         }
       }
@@ -146,6 +195,16 @@ export function useChat({ send, subscribe, providerId }: UseChatOptions) {
     setIsStreaming(false)
   }, [send])
 
+  const cancelSelfMod = useCallback(
+    (requestId?: string) => {
+      send({
+        type: 'selfmod.cancel',
+        payload: requestId ? { request_id: requestId } : {},
+      })
+    },
+    [send],
+  )
+
   const approveDiff = useCallback(
     (requestId: string) => {
       send({
@@ -172,8 +231,11 @@ export function useChat({ send, subscribe, providerId }: UseChatOptions) {
     messages,
     isStreaming,
     pendingDiff,
+    draftDiff,
+    queuePosition,
     sendMessage,
     cancelStream,
+    cancelSelfMod,
     approveDiff,
     rejectDiff,
   }